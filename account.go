@@ -0,0 +1,659 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+// The names of the files in the account archives, which are the ones the Mastodon archives use.
+const (
+	accountActorName     = "actor.json"
+	accountOutboxName    = "outbox.json"
+	accountLikesName     = "likes.json"
+	accountFollowersName = "followers.json"
+	accountFollowingName = "following.json"
+	accountMediaDir      = "media_attachments/files"
+)
+
+// parseDataURL returns the media type and the data of a data URL.
+func parseDataURL(s string) (string, []byte, bool) {
+	rest, ok := strings.CutPrefix(s, "data:")
+	if !ok {
+		return "", nil, false
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, false
+	}
+	typ, isBase64 := strings.CutSuffix(meta, ";base64")
+	if typ == "" {
+		typ = "text/plain;charset=US-ASCII"
+	}
+	if isBase64 {
+		data, err := base64.StdEncoding.DecodeString(payload)
+		return typ, data, err == nil
+	}
+	data, err := url.PathUnescape(payload)
+	return typ, []byte(data), err == nil
+}
+
+// mediaName returns the name of the archive file for the data, which is stable across exports.
+func mediaName(typ string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return mediaFileName(typ, hex.EncodeToString(sum[:]))
+}
+
+// mediaFileName returns the name of the archive file for the content with the hex encoded sha256 sum.
+func mediaFileName(typ, sum string) string {
+	name := sum[:32]
+	if ext, _ := mime.ExtensionsByType(typ); len(ext) > 0 {
+		name += ext[0]
+	}
+	return path.Join(accountMediaDir, name)
+}
+
+func isMediaProperty(k string) bool {
+	return k == "url" || k == "href"
+}
+
+// isAttachmentProperty checks if the k property holds objects which can have media.
+func isAttachmentProperty(k string) bool {
+	return k == "attachment" || k == "icon" || k == "image"
+}
+
+// accountMedia is a media file of an account archive: the data of a data URL, or the blob of a stored object.
+type accountMedia struct {
+	data []byte
+	blob vocab.IRI
+}
+
+// extractMedia replaces the media of the url and href properties in the v JSON document with the paths
+// of the archive files, which get added to media: the data URLs, and the IRIs of the objects with a blob.
+// The objects with a blob which have no url get one, and the attachments referenced by the IRI of an object
+// with a blob get replaced by the object.
+func (r *repo) extractMedia(v any, media map[string]accountMedia) any {
+	switch vv := v.(type) {
+	case map[string]any:
+		for k, val := range vv {
+			if isAttachmentProperty(k) {
+				val = r.derefMedia(val)
+			}
+			s, ok := val.(string)
+			if !ok || !isMediaProperty(k) {
+				vv[k] = r.extractMedia(val, media)
+				continue
+			}
+			if name, typ, ok := r.mediaOf(s, media); ok {
+				vv[k] = "/" + name
+				setMediaType(vv, typ)
+			}
+		}
+		if id, ok := vv["id"].(string); ok && vv["url"] == nil {
+			if name, typ, ok := r.blobMedia(vocab.IRI(id), media); ok {
+				vv["url"] = "/" + name
+				setMediaType(vv, typ)
+			}
+		}
+	case []any:
+		for i := range vv {
+			vv[i] = r.extractMedia(vv[i], media)
+		}
+	}
+	return v
+}
+
+func setMediaType(m map[string]any, typ string) {
+	if _, ok := m["mediaType"]; !ok && typ != "" {
+		m["mediaType"] = typ
+	}
+}
+
+// derefMedia replaces the IRIs in v of the stored objects which have a blob with their JSON documents.
+func (r *repo) derefMedia(v any) any {
+	switch vv := v.(type) {
+	case string:
+		iri := vocab.IRI(vv)
+		if _, err := r.loadBlobInfo(r.pathOf(iri)); err != nil {
+			return v
+		}
+		ob, err := r.loadOneFromIRI(iri)
+		if err != nil || vocab.IsNil(ob) {
+			return v
+		}
+		raw, err := encodeItemFn(ob)
+		if err != nil {
+			return v
+		}
+		if doc, err := decodeJSONValue(raw); err == nil {
+			return doc
+		}
+	case []any:
+		for i := range vv {
+			vv[i] = r.derefMedia(vv[i])
+		}
+	}
+	return v
+}
+
+// mediaOf adds to media the archive file of the s URL: the data of a data URL, or the blob of the object
+// with the s IRI. It returns the name of the file and the media type of its content.
+func (r *repo) mediaOf(s string, media map[string]accountMedia) (string, string, bool) {
+	if typ, data, ok := parseDataURL(s); ok {
+		name := mediaName(typ, data)
+		media[name] = accountMedia{data: data}
+		return name, typ, true
+	}
+	return r.blobMedia(vocab.IRI(s), media)
+}
+
+func (r *repo) blobMedia(iri vocab.IRI, media map[string]accountMedia) (string, string, bool) {
+	p := r.pathOf(iri)
+	if p == "" {
+		return "", "", false
+	}
+	info, err := r.loadBlobInfo(p)
+	if err != nil {
+		return "", "", false
+	}
+	name := mediaFileName(string(info.MediaType), info.SHA256)
+	media[name] = accountMedia{blob: iri}
+	return name, string(info.MediaType), true
+}
+
+// addMedia writes the m media file to the archive, streaming the content of the blobs.
+func (r *repo) addMedia(aw archiveWriter, name string, m accountMedia) error {
+	if m.blob == "" {
+		return aw.add(name, m.data)
+	}
+	b, err := r.OpenBlob(m.blob)
+	if err != nil {
+		return errors.Annotatef(err, "unable to load the media of %s", m.blob)
+	}
+	defer b.Close()
+	return aw.copy(name, b.Size, b)
+}
+
+// accountImport holds the state of an ImportAccount run.
+type accountImport struct {
+	// owner is the IRI of the imported actor.
+	owner vocab.IRI
+	// files are the staged archive entries, by their name.
+	files map[string]string
+	// media are the IRIs of the objects which hold the blobs of the media files that had no object, by the file name.
+	media map[string]vocab.IRI
+}
+
+// mediaFile returns the name of the archive media file the s URL points to.
+func (a *accountImport) mediaFile(s string) (string, bool) {
+	if !strings.HasPrefix(s, "/"+accountMediaDir+"/") {
+		return "", false
+	}
+	name := strings.TrimPrefix(s, "/")
+	_, ok := a.files[name]
+	return name, ok
+}
+
+// mediaIRI returns the IRI of the object holding the blob of the name media file, which has no object of its own.
+func (a *accountImport) mediaIRI(name string) vocab.IRI {
+	base := path.Base(name)
+	return a.owner.AddPath("media", strings.TrimSuffix(base, path.Ext(base)))
+}
+
+// storeMedia stores the content of the name media file as the blob of the object with the iri.
+func (r *repo) storeMedia(a *accountImport, iri vocab.IRI, name, typ string) error {
+	f, err := r.root.Open(a.files[name])
+	if err != nil {
+		return errors.Annotatef(err, "unable to read %s", name)
+	}
+	defer f.Close()
+
+	if typ == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		typ = http.DetectContentType(head[:n])
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if _, err = r.PutBlob(iri, f, vocab.MimeType(typ)); err != nil {
+		return errors.Annotatef(err, "unable to store %s", name)
+	}
+	return nil
+}
+
+// importMedia stores the media files the url and href properties in the v JSON document point to
+// as blobs, the way ExportAccount finds them.
+// The objects with a media url get stored, with the blob and without the url, and they are replaced
+// in the document by their IRI. The links with a media href get an object holding the blob,
+// which the href points to.
+func (r *repo) importMedia(v any, a *accountImport) (any, error) {
+	switch vv := v.(type) {
+	case map[string]any:
+		for k, val := range vv {
+			doc, err := r.importMedia(val, a)
+			if err != nil {
+				return nil, err
+			}
+			vv[k] = doc
+		}
+		typ, _ := vv["mediaType"].(string)
+		if s, ok := vv["href"].(string); ok {
+			if name, ok := a.mediaFile(s); ok {
+				iri, ok := a.media[name]
+				if !ok {
+					iri = a.mediaIRI(name)
+					if _, err := save(r, &vocab.Document{ID: iri, Type: vocab.DocumentType, MediaType: vocab.MimeType(typ)}); err != nil {
+						return nil, err
+					}
+					if err := r.storeMedia(a, iri, name, typ); err != nil {
+						return nil, err
+					}
+					a.media[name] = iri
+				}
+				vv["href"] = iri.String()
+			}
+		}
+		s, ok := vv["url"].(string)
+		if !ok {
+			return vv, nil
+		}
+		name, ok := a.mediaFile(s)
+		if !ok {
+			return vv, nil
+		}
+		delete(vv, "url")
+		id, _ := vv["id"].(string)
+		if id == "" {
+			id = a.mediaIRI(name).String()
+			vv["id"] = id
+		}
+		raw, err := encodeJSONValue(vv)
+		if err != nil {
+			return nil, err
+		}
+		it, err := itemFromRaw(raw)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid object for %s", name)
+		}
+		if vocab.IsNil(it) {
+			return nil, errors.BadRequestf("invalid object for %s", name)
+		}
+		if _, err = save(r, it); err != nil {
+			return nil, err
+		}
+		if err = r.storeMedia(a, vocab.IRI(id), name, typ); err != nil {
+			return nil, err
+		}
+		return id, nil
+	case []any:
+		for i := range vv {
+			doc, err := r.importMedia(vv[i], a)
+			if err != nil {
+				return nil, err
+			}
+			vv[i] = doc
+		}
+	}
+	return v, nil
+}
+
+// rewriteIRIs replaces in the v JSON document the from IRI, and the IRIs under it, with the to IRI.
+func rewriteIRIs(v any, from, to string) any {
+	switch vv := v.(type) {
+	case string:
+		if vv == from {
+			return to
+		}
+		for _, sep := range []string{"/", "#", "?"} {
+			if rest, ok := strings.CutPrefix(vv, from+sep); ok {
+				return to + sep + rest
+			}
+		}
+	case map[string]any:
+		for k, val := range vv {
+			vv[k] = rewriteIRIs(val, from, to)
+		}
+	case []any:
+		for i := range vv {
+			vv[i] = rewriteIRIs(vv[i], from, to)
+		}
+	}
+	return v
+}
+
+// collectionItems returns the items of the col collection. When deref is set, the objects
+// of the activities are loaded, otherwise only the IRIs of the items are returned.
+func (r *repo) collectionItems(col vocab.Item, deref bool) (vocab.ItemCollection, error) {
+	items := make(vocab.ItemCollection, 0)
+	if vocab.IsNil(col) {
+		return items, nil
+	}
+	loaded, err := r.Load(col.GetLink())
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return items, nil
+		}
+		return nil, err
+	}
+	err = vocab.OnCollectionIntf(loaded, func(c vocab.CollectionInterface) error {
+		for _, it := range c.Collection() {
+			if vocab.IsNil(it) {
+				continue
+			}
+			if !deref {
+				items = append(items, it.GetLink())
+				continue
+			}
+			if vocab.ActivityTypes.Match(it.GetType()) {
+				_ = vocab.OnActivity(it, func(a *vocab.Activity) error {
+					if vocab.IsIRI(a.Object) {
+						if ob, err := r.Load(a.Object.GetLink()); err == nil && !vocab.IsNil(ob) {
+							a.Object = ob
+						}
+					}
+					return nil
+				})
+			}
+			items = append(items, it)
+		}
+		return nil
+	})
+	return items, err
+}
+
+// ExportAccount writes to w the archive of the actor with the iri, using the layout of the Mastodon
+// account archives: the actor in actor.json, the activities in its outbox, with their objects,
+// in outbox.json, and the objects it liked in likes.json. The actors it follows and the ones following
+// it are written in following.json and followers.json.
+//
+// The media stored as data URLs, and the blobs of the objects, are written to separate files
+// under media_attachments, which the documents link to.
+func (r *repo) ExportAccount(w io.Writer, iri vocab.IRI, opts ExportOptions) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+	actor, err := r.Load(iri)
+	if err != nil {
+		return err
+	}
+	if vocab.IsNil(actor) || !vocab.ActorTypes.Match(actor.GetType()) {
+		return errors.BadRequestf("%s is not an actor", iri)
+	}
+
+	aw, err := newArchiveWriter(w, opts, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	media := make(map[string]accountMedia)
+	write := func(name string, it vocab.Item) error {
+		raw, err := encodeItemFn(it)
+		if err != nil {
+			return errors.Annotatef(err, "unable to marshal %s", name)
+		}
+		doc, err := decodeJSONValue(raw)
+		if err != nil {
+			return err
+		}
+		doc = r.extractMedia(doc, media)
+		if m, ok := doc.(map[string]any); ok {
+			m["@context"] = vocab.ActivityBaseURI.String()
+		}
+		if raw, err = encodeJSONValue(doc); err != nil {
+			return err
+		}
+		return aw.add(name, raw)
+	}
+
+	if err = write(accountActorName, actor); err != nil {
+		_ = aw.Close()
+		return err
+	}
+
+	var outbox, liked, followers, following vocab.Item
+	_ = vocab.OnActor(actor, func(a *vocab.Actor) error {
+		outbox, liked, followers, following = a.Outbox, a.Liked, a.Followers, a.Following
+		return nil
+	})
+	collections := []struct {
+		name  string
+		col   vocab.Item
+		deref bool
+	}{
+		{name: accountOutboxName, col: outbox, deref: true},
+		{name: accountLikesName, col: liked},
+		{name: accountFollowersName, col: followers},
+		{name: accountFollowingName, col: following},
+	}
+	for _, c := range collections {
+		items, err := r.collectionItems(c.col, c.deref)
+		if err != nil {
+			_ = aw.Close()
+			return errors.Annotatef(err, "unable to load %s", c.name)
+		}
+		col := vocab.OrderedCollection{
+			ID:           vocab.IRI(c.name),
+			Type:         vocab.OrderedCollectionType,
+			TotalItems:   uint(len(items)),
+			OrderedItems: items,
+		}
+		if err = write(c.name, &col); err != nil {
+			_ = aw.Close()
+			return err
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(media)) {
+		if err = r.addMedia(aw, name, media[name]); err != nil {
+			_ = aw.Close()
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// importMembers adds the items to the colIRI collection. The items we don't have a copy of
+// get stored only as links, without an object, to be dereferenced later.
+func (r *repo) importMembers(colIRI vocab.IRI, items vocab.ItemCollection) error {
+	local := make(vocab.ItemCollection, 0, len(items))
+	remote := make(vocab.IRIs, 0)
+	for _, it := range items {
+		if vocab.IsNil(it) {
+			continue
+		}
+		if !vocab.IsIRI(it) {
+			if _, err := save(r, it); err != nil {
+				return err
+			}
+			local = append(local, it)
+			continue
+		}
+		if ob, err := r.loadOneFromIRI(it.GetLink()); err == nil {
+			local = append(local, ob)
+			continue
+		}
+		remote = append(remote, it.GetLink())
+	}
+	if len(local) > 0 {
+		if err := r.AddTo(colIRI, local...); err != nil {
+			return err
+		}
+	}
+	return r.addMembers(r.pathOf(colIRI), remote...)
+}
+
+// ImportAccount loads an archive created by ExportAccount, or by Mastodon, as the actor with the iri.
+// All the IRIs under the IRI of the archived actor get rewritten to be under the new one, and the media
+// files get stored as the blobs of the objects pointing to them. It returns the new actor.
+//
+// The entries are staged in a temporary folder in the storage while the archive is read, and the documents
+// are loaded from it one at a time.
+//
+// The public key of the archived actor is not imported, as its private key is not part of the archive.
+func (r *repo) ImportAccount(in io.Reader, iri vocab.IRI) (vocab.Item, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+
+	stage := ".import.tmp-" + strconv.FormatUint(rand.Uint64(), 36)
+	if err := r.root.Mkdir(stage, defaultDirPerm); err != nil {
+		return nil, errors.Annotatef(err, "unable to create the import staging folder")
+	}
+	defer func() {
+		_ = r.root.RemoveAll(stage)
+	}()
+
+	a := accountImport{owner: iri, files: make(map[string]string), media: make(map[string]vocab.IRI)}
+	err := r.readArchive(in, func(name string, data io.Reader) error {
+		staged := path.Join(stage, ".entry.tmp-"+strconv.Itoa(len(a.files)))
+		if _, err := r.stageEntry(staged, data); err != nil {
+			return errors.Annotatef(err, "unable to read %s", name)
+		}
+		a.files[path.Clean(name)] = staged
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decode := func(name string) (any, error) {
+		staged, ok := a.files[name]
+		if !ok {
+			return nil, nil
+		}
+		raw, err := readRaw(r.root, staged)
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to read %s", name)
+		}
+		doc, err := decodeJSONValue(raw)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid %s", name)
+		}
+		return doc, nil
+	}
+
+	doc, err := decode(accountActorName)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, errors.BadRequestf("the archive has no %s", accountActorName)
+	}
+	m, _ := doc.(map[string]any)
+	from, _ := m["id"].(string)
+	if from == "" {
+		return nil, errors.BadRequestf("the archived actor has no id")
+	}
+
+	load := func(name string) (vocab.Item, error) {
+		doc, err := decode(name)
+		if err != nil || doc == nil {
+			return nil, err
+		}
+		if doc, err = r.importMedia(rewriteIRIs(doc, from, iri.String()), &a); err != nil {
+			return nil, errors.Annotatef(err, "unable to import the media of %s", name)
+		}
+		raw, err := encodeJSONValue(doc)
+		if err != nil {
+			return nil, err
+		}
+		return itemFromRaw(raw)
+	}
+	items := func(name string) (vocab.ItemCollection, error) {
+		col, err := load(name)
+		if err != nil || vocab.IsNil(col) {
+			return nil, err
+		}
+		result := make(vocab.ItemCollection, 0)
+		err = vocab.OnCollectionIntf(col, func(c vocab.CollectionInterface) error {
+			result = append(result, c.Collection()...)
+			return nil
+		})
+		return result, err
+	}
+
+	actor, err := load(accountActorName)
+	if err != nil {
+		return nil, err
+	}
+	if vocab.IsNil(actor) || !vocab.ActorTypes.Match(actor.GetType()) {
+		return nil, errors.BadRequestf("the archived %s is not an actor", from)
+	}
+	collections := make(map[string]vocab.IRI)
+	_ = vocab.OnActor(actor, func(a *vocab.Actor) error {
+		// NOTE(marius): the key of the archived actor can't be used, as we don't have its private part
+		a.PublicKey = vocab.PublicKey{}
+		a.Inbox = iri.AddPath(string(vocab.Inbox))
+		a.Outbox = iri.AddPath(string(vocab.Outbox))
+		a.Liked = iri.AddPath(string(vocab.Liked))
+		a.Followers = iri.AddPath(string(vocab.Followers))
+		a.Following = iri.AddPath(string(vocab.Following))
+		collections[accountOutboxName] = a.Outbox.GetLink()
+		collections[accountLikesName] = a.Liked.GetLink()
+		collections[accountFollowersName] = a.Followers.GetLink()
+		collections[accountFollowingName] = a.Following.GetLink()
+		return nil
+	})
+	if actor, err = save(r, actor); err != nil {
+		return nil, err
+	}
+	for _, colIRI := range append(slices.Collect(maps.Values(collections)), iri.AddPath(string(vocab.Inbox))) {
+		if _, err = r.loadItemFromPath(getObjectKey(r.pathOf(colIRI))); err == nil {
+			continue
+		}
+		if _, err = createCollection(r, colIRI, actor); err != nil {
+			return nil, errors.Annotatef(err, "unable to create collection %s", colIRI)
+		}
+	}
+
+	activities, err := items(accountOutboxName)
+	if err != nil {
+		return nil, err
+	}
+	for _, act := range activities {
+		if vocab.IsNil(act) || vocab.IsIRI(act) || !vocab.ActivityTypes.Match(act.GetType()) {
+			continue
+		}
+		err = vocab.OnActivity(act, func(a *vocab.Activity) error {
+			if vocab.IsNil(a.Object) || vocab.IsIRI(a.Object) {
+				return nil
+			}
+			if _, err := save(r, a.Object); err != nil {
+				return err
+			}
+			a.Object = a.Object.GetLink()
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "unable to import the object of %s", act.GetLink())
+		}
+	}
+	if err = r.importMembers(collections[accountOutboxName], activities); err != nil {
+		return nil, errors.Annotatef(err, "unable to import %s", accountOutboxName)
+	}
+
+	for _, name := range []string{accountLikesName, accountFollowersName, accountFollowingName} {
+		members, err := items(name)
+		if err != nil {
+			return nil, err
+		}
+		if err = r.importMembers(collections[name], members); err != nil {
+			return nil, errors.Annotatef(err, "unable to import %s", name)
+		}
+	}
+	return actor, nil
+}
@@ -0,0 +1,185 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_rewriteIRIs(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want any
+	}{
+		{
+			name: "same",
+			v:    "https://old.example/users/jdoe",
+			want: "https://example.com/~jdoe",
+		},
+		{
+			name: "under",
+			v:    "https://old.example/users/jdoe/statuses/1",
+			want: "https://example.com/~jdoe/statuses/1",
+		},
+		{
+			name: "fragment",
+			v:    "https://old.example/users/jdoe#main-key",
+			want: "https://example.com/~jdoe#main-key",
+		},
+		{
+			name: "prefix of another",
+			v:    "https://old.example/users/jdoe2",
+			want: "https://old.example/users/jdoe2",
+		},
+		{
+			name: "nested",
+			v:    map[string]any{"to": []any{"https://old.example/users/jdoe/followers", "https://www.w3.org/ns/activitystreams#Public"}},
+			want: map[string]any{"to": []any{"https://example.com/~jdoe/followers", "https://www.w3.org/ns/activitystreams#Public"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeJSONValue(rewriteIRIs(tt.v, "https://old.example/users/jdoe", "https://example.com/~jdoe"))
+			if err != nil {
+				t.Fatalf("unable to encode: %s", err)
+			}
+			want, _ := encodeJSONValue(tt.want)
+			if !bytes.Equal(got, want) {
+				t.Errorf("rewriteIRIs() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func Test_repo_ExportAccount_ImportAccount(t *testing.T) {
+	oldIRI := vocab.IRI("https://old.example/users/jdoe")
+	actor := &vocab.Actor{
+		ID:        oldIRI,
+		Type:      vocab.PersonType,
+		Outbox:    oldIRI.AddPath(string(vocab.Outbox)),
+		Liked:     oldIRI.AddPath(string(vocab.Liked)),
+		Following: oldIRI.AddPath(string(vocab.Following)),
+	}
+	image := &vocab.Object{ID: oldIRI.AddPath("media/1"), Type: vocab.ImageType, MediaType: "image/gif"}
+	note := &vocab.Object{
+		ID:           oldIRI.AddPath("statuses/1"),
+		Type:         vocab.NoteType,
+		AttributedTo: oldIRI,
+		Attachment: vocab.ItemCollection{
+			&vocab.Object{
+				Type:      vocab.ImageType,
+				MediaType: "image/png",
+				URL:       vocab.IRI("data:image/png;base64,iVBORw0KGgo="),
+			},
+			image.GetLink(),
+		},
+	}
+	create := &vocab.Activity{ID: oldIRI.AddPath("statuses/1/activity"), Type: vocab.CreateType, Actor: oldIRI, Object: note.GetLink()}
+	liked := &vocab.Object{ID: "https://remote.example/notes/1", Type: vocab.NoteType}
+	alice := vocab.IRI("https://remote.example/~alice")
+
+	src := t.TempDir()
+	from := mockRepo(t, fields{path: src, root: openRoot(t, src)}, withGeneratedItems(vocab.ItemCollection{actor, image, note, create, liked}))
+	if _, err := from.PutBlob(image.GetLink(), strings.NewReader("GIF89a, not really an image"), "image/gif"); err != nil {
+		t.Fatalf("PutBlob() error = %s", err)
+	}
+	for _, colIRI := range []vocab.IRI{actor.Outbox.GetLink(), actor.Liked.GetLink(), actor.Following.GetLink()} {
+		if _, err := createCollection(from, colIRI, actor); err != nil {
+			t.Fatalf("unable to create collection %s: %s", colIRI, err)
+		}
+	}
+	if err := from.AddTo(actor.Outbox.GetLink(), create); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if err := from.AddTo(actor.Liked.GetLink(), liked); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if err := from.importMembers(actor.Following.GetLink(), vocab.ItemCollection{alice}); err != nil {
+		t.Fatalf("importMembers() error = %s", err)
+	}
+	if _, err := from.root.Lstat(getObjectKey(from.pathOf(alice))); !os.IsNotExist(err) {
+		t.Errorf("importMembers() stored an object for the remote member %s: %v", alice, err)
+	}
+
+	archive := bytes.Buffer{}
+	if err := from.ExportAccount(&archive, oldIRI, ExportOptions{Format: ArchiveTar, Compression: CompressionGzip}); err != nil {
+		t.Fatalf("ExportAccount() error = %s", err)
+	}
+	names := make([]string, 0)
+	_ = from.readArchive(bytes.NewReader(archive.Bytes()), func(name string, _ io.Reader) error {
+		names = append(names, name)
+		return nil
+	})
+	media := names[min(5, len(names)):]
+	if len(names) != 7 || !strings.HasPrefix(media[0], accountMediaDir) || !strings.HasPrefix(media[1], accountMediaDir) ||
+		(!strings.HasSuffix(media[0], ".gif") && !strings.HasSuffix(media[1], ".gif")) {
+		t.Errorf("ExportAccount() archive entries = %v", names)
+	}
+
+	newIRI := vocab.IRI("https://example.com/~jdoe")
+	dst := t.TempDir()
+	to := mockRepo(t, fields{path: dst, root: openRoot(t, dst)})
+	imported, err := to.ImportAccount(&archive, newIRI)
+	if err != nil {
+		t.Fatalf("ImportAccount() error = %s", err)
+	}
+	if !imported.GetLink().Equals(newIRI, true) {
+		t.Errorf("ImportAccount() actor = %s, want %s", imported.GetLink(), newIRI)
+	}
+
+	ob, err := to.Load(newIRI.AddPath("statuses/1"))
+	if err != nil {
+		t.Fatalf("Load() imported note error = %s", err)
+	}
+	_ = vocab.OnObject(ob, func(o *vocab.Object) error {
+		if !o.AttributedTo.GetLink().Equals(newIRI, true) {
+			t.Errorf("imported note attributedTo = %s, want %s", o.AttributedTo.GetLink(), newIRI)
+		}
+		contents := make([]string, 0)
+		_ = vocab.OnCollectionIntf(o.Attachment, func(col vocab.CollectionInterface) error {
+			for _, it := range col.Collection() {
+				if !vocab.IsIRI(it) {
+					t.Errorf("imported note attachment %v is not stored separately", it)
+					continue
+				}
+				b, err := to.OpenBlob(it.GetLink())
+				if err != nil {
+					t.Errorf("OpenBlob(%s) error = %s", it.GetLink(), err)
+					continue
+				}
+				raw, _ := io.ReadAll(b)
+				_ = b.Close()
+				contents = append(contents, string(b.MediaType)+" "+string(raw))
+			}
+			return nil
+		})
+		png, _ := base64.StdEncoding.DecodeString("iVBORw0KGgo=")
+		want := []string{"image/png " + string(png), "image/gif GIF89a, not really an image"}
+		if !slices.Equal(contents, want) {
+			t.Errorf("imported note attachment blobs = %q, want %q", contents, want)
+		}
+		return nil
+	})
+
+	for colIRI, want := range map[vocab.IRI]vocab.IRI{
+		newIRI.AddPath(string(vocab.Outbox)):    newIRI.AddPath("statuses/1/activity"),
+		newIRI.AddPath(string(vocab.Liked)):     liked.GetLink(),
+		newIRI.AddPath(string(vocab.Following)): alice,
+	} {
+		items, err := to.collectionItems(colIRI, false)
+		if err != nil {
+			t.Errorf("unable to load %s: %s", colIRI, err)
+			continue
+		}
+		if !items.Contains(want) {
+			t.Errorf("%s items = %v, want %s", colIRI, items, want)
+		}
+	}
+}
@@ -0,0 +1,614 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveFormat is the container format of the storage archives.
+type ArchiveFormat uint8
+
+const (
+	ArchiveTar ArchiveFormat = iota
+	ArchiveZip
+)
+
+// ExportOptions configures the archives created by Export.
+type ExportOptions struct {
+	Format ArchiveFormat
+	// Compression is applied to the whole stream for the tar archives, and to every entry
+	// for the zip ones.
+	Compression Compression
+	// IncludeSecrets adds to the archive the actors' metadata, with their private keys and password
+	// hashes, and the OAuth data, with the client secrets and the tokens. They are written unencrypted,
+	// so the archive needs to be protected like the storage encryption keys.
+	// By default, they are left out.
+	IncludeSecrets bool
+}
+
+const archiveVersion = 1
+
+// The names of the archive entries. The storage paths are the ones of the flat layout, and the
+// file names use the "__" prefix which the escaped path elements can't have.
+const (
+	archiveManifestName = "manifest.json"
+	archiveStoreDir     = "store"
+	archiveObjectName   = objectKey + ".json"
+	archiveMetadataName = metaDataKey + ".json"
+	archiveMembersName  = "__members.json"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// archiveManifest is the last entry of the archive, and it holds the sha256 checksums
+// of all the other entries.
+type archiveManifest struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Files   map[string]string `json:"files"`
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+type archiveWriter interface {
+	add(name string, data []byte) error
+	// copy adds an entry with the size bytes read from r.
+	copy(name string, size int64, r io.Reader) error
+	Close() error
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	// cw compresses the whole archive, if it's compressed.
+	cw       io.WriteCloser
+	modified time.Time
+}
+
+func (w *tarWriter) add(name string, data []byte) error {
+	return w.copy(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (w *tarWriter) copy(name string, size int64, r io.Reader) error {
+	hdr := tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     int64(defaultFilePerm),
+		ModTime:  w.modified,
+	}
+	if err := w.tw.WriteHeader(&hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w.tw, r, size)
+	return err
+}
+
+func (w *tarWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		return err
+	}
+	if w.cw != nil {
+		return w.cw.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw       *zip.Writer
+	method   uint16
+	modified time.Time
+}
+
+func (w *zipWriter) add(name string, data []byte) error {
+	return w.copy(name, int64(len(data)), bytes.NewReader(data))
+}
+
+func (w *zipWriter) copy(name string, size int64, r io.Reader) error {
+	f, err := w.zw.CreateHeader(&zip.FileHeader{Name: name, Method: w.method, Modified: w.modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(f, r, size)
+	return err
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
+
+func newArchiveWriter(w io.Writer, opts ExportOptions, modified time.Time) (archiveWriter, error) {
+	switch opts.Format {
+	case ArchiveTar:
+		aw := tarWriter{modified: modified}
+		switch opts.Compression {
+		case CompressionGzip:
+			aw.cw = gzip.NewWriter(w)
+		case CompressionZstd:
+			enc, err := zstd.NewWriter(w)
+			if err != nil {
+				return nil, err
+			}
+			aw.cw = enc
+		}
+		if aw.cw != nil {
+			w = aw.cw
+		}
+		aw.tw = tar.NewWriter(w)
+		return &aw, nil
+	case ArchiveZip:
+		aw := zipWriter{zw: zip.NewWriter(w), method: zip.Store, modified: modified}
+		switch opts.Compression {
+		case CompressionGzip:
+			aw.method = zip.Deflate
+		case CompressionZstd:
+			aw.method = zstd.ZipMethodWinZip
+			aw.zw.RegisterCompressor(aw.method, zstd.ZipCompressor())
+		}
+		return &aw, nil
+	}
+	return nil, errors.BadRequestf("unknown archive format %d", opts.Format)
+}
+
+// readArchive calls fn for every entry of the tar, compressed tar, or zip archive read from in,
+// with a reader for its contents, which is valid until fn returns.
+//
+// The zip archives need random access, so unless in supports it, they get copied to a temporary
+// file in the storage first.
+func (r *repo) readArchive(in io.Reader, fn func(name string, data io.Reader) error) error {
+	if ra, size, ok := readerAtOf(in); ok {
+		magic := make([]byte, len(zipMagic))
+		if _, err := ra.ReadAt(magic, 0); err == nil && bytes.Equal(magic, zipMagic) {
+			return readZip(ra, size, fn)
+		}
+	}
+
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(len(zipMagic))
+	if bytes.Equal(magic, zipMagic) {
+		tmpPath := ".archive.tmp-" + strconv.FormatUint(rand.Uint64(), 36)
+		f, err := r.root.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, defaultFilePerm)
+		if err != nil {
+			return errors.Annotatef(err, "unable to buffer the zip archive")
+		}
+		defer func() {
+			_ = f.Close()
+			_ = r.root.Remove(tmpPath)
+		}()
+		size, err := io.Copy(f, br)
+		if err != nil {
+			return errors.Annotatef(err, "unable to buffer the zip archive")
+		}
+		return readZip(f, size, fn)
+	}
+
+	var rd io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Annotatef(err, "invalid compressed archive")
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		rd = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return errors.Annotatef(err, "invalid compressed archive")
+		}
+		defer dec.Close()
+		rd = dec
+	}
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Annotatef(err, "invalid tar archive")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err = fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readerAtOf returns in as an io.ReaderAt together with its size, if it supports random access.
+func readerAtOf(in io.Reader) (io.ReaderAt, int64, bool) {
+	switch rr := in.(type) {
+	case *os.File:
+		fi, err := rr.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil, 0, false
+		}
+		return rr, fi.Size(), true
+	case interface {
+		io.ReaderAt
+		Size() int64
+	}:
+		return rr, rr.Size(), true
+	}
+	return nil, 0, false
+}
+
+func readZip(ra io.ReaderAt, size int64, fn func(name string, data io.Reader) error) error {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return errors.Annotatef(err, "invalid zip archive")
+	}
+	zr.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return errors.Annotatef(err, "unable to read %s", f.Name)
+		}
+		err = fn(f.Name, rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Export writes the whole storage to w as an archive: every object as JSON-LD, the list of members
+// of every collection, and, when ExportOptions.IncludeSecrets is set, the actors' metadata and
+// the OAuth data, followed by a manifest with the checksums of all of them.
+//
+// The archive doesn't depend on the storage layout, the way the collection members are stored,
+// the codec, compression or the encryption keys of the storage, and it doesn't contain the indexes.
+func (r *repo) Export(w io.Writer, opts ExportOptions) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+
+	m := archiveManifest{Version: archiveVersion, Created: time.Now().UTC(), Files: make(map[string]string)}
+	aw, err := newArchiveWriter(w, opts, m.Created)
+	if err != nil {
+		return err
+	}
+	add := func(name string, data []byte) error {
+		m.Files[name] = checksum(data)
+		if err := aw.add(name, data); err != nil {
+			return errors.Annotatef(err, "unable to archive %s", name)
+		}
+		return nil
+	}
+
+	err = fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || p == folder {
+				return fs.SkipDir
+			}
+			if !isStorageCollectionKey(p) {
+				return nil
+			}
+			iris, err := r.memberIRIs(p)
+			if err != nil || len(iris) == 0 {
+				return err
+			}
+			raw, err := json.Marshal(iris)
+			if err != nil {
+				return err
+			}
+			return add(path.Join(archiveStoreDir, unshardPath(p), archiveMembersName), raw)
+		}
+
+		var raw []byte
+		var name string
+		switch d.Name() {
+		case objectKey:
+			raw, err = loadRaw(r.root, p)
+			name = archiveObjectName
+		case metaDataKey:
+			if !opts.IncludeSecrets {
+				return nil
+			}
+			raw, err = r.loadSecret(r.root, p)
+			name = archiveMetadataName
+		default:
+			return nil
+		}
+		if err != nil {
+			return errors.Annotatef(err, "unable to load %s", p)
+		}
+		return add(path.Join(archiveStoreDir, unshardPath(path.Dir(p)), name), raw)
+	})
+	if err != nil {
+		_ = aw.Close()
+		return err
+	}
+
+	if opts.IncludeSecrets {
+		if err = r.exportOauth(add); err != nil {
+			_ = aw.Close()
+			return err
+		}
+	}
+
+	raw, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		_ = aw.Close()
+		return err
+	}
+	if err = aw.add(archiveManifestName, raw); err != nil {
+		_ = aw.Close()
+		return err
+	}
+	return aw.Close()
+}
+
+func (r *repo) exportOauth(add func(string, []byte) error) error {
+	if _, err := r.root.Lstat(folder); os.IsNotExist(err) {
+		return nil
+	}
+	root, err := r.root.OpenRoot(folder)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	return fs.WalkDir(root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != objectKey {
+			return err
+		}
+		raw, err := r.loadSecret(root, p)
+		if err != nil {
+			return errors.Annotatef(err, "unable to load %s", path.Join(folder, p))
+		}
+		return add(path.Join(folder, path.Dir(p), archiveObjectName), raw)
+	})
+}
+
+// Import loads into the storage an archive created by Export, and it rebuilds the indexes.
+//
+// The objects get stored with the layout, codec, compression and encryption of the storage.
+// The entries are staged in a temporary folder in the storage, and they are moved in place only
+// after the checksums were verified and all of them were decoded, so an invalid archive doesn't
+// change the storage.
+func (r *repo) Import(in io.Reader) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+
+	stage := ".import.tmp-" + strconv.FormatUint(rand.Uint64(), 36)
+	if err := r.root.Mkdir(stage, defaultDirPerm); err != nil {
+		return errors.Annotatef(err, "unable to create the import staging folder")
+	}
+	defer func() {
+		_ = r.root.RemoveAll(stage)
+	}()
+
+	var m *archiveManifest
+	sums := make(map[string]string)
+	entries := make([]archiveEntry, 0)
+	err := r.readArchive(in, func(name string, data io.Reader) error {
+		if name == archiveManifestName {
+			m = new(archiveManifest)
+			if err := json.NewDecoder(data).Decode(m); err != nil {
+				return errors.Annotatef(err, "invalid archive manifest")
+			}
+			return nil
+		}
+		if _, ok := sums[name]; ok {
+			return errors.BadRequestf("duplicate archive entry %s", name)
+		}
+		e, err := r.archiveEntryOf(name)
+		if err != nil {
+			return err
+		}
+		e.staged = path.Join(stage, ".entry.tmp-"+strconv.Itoa(len(entries)))
+		if sums[name], err = r.stageEntry(e.staged, data); err != nil {
+			return errors.Annotatef(err, "unable to read %s", name)
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = verifyArchive(m, sums); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err = r.prepareEntry(e); err != nil {
+			return err
+		}
+	}
+
+	// NOTE(marius): the members get stored after the objects, to not depend on the entries' order
+	for _, e := range entries {
+		if e.kind == archiveMembersName {
+			continue
+		}
+		if err = r.root.MkdirAll(path.Dir(e.dst), defaultDirPerm); err != nil {
+			return errors.Annotatef(err, "unable to create parent folder for %s", e.dst)
+		}
+		r.record(e.dst)
+		if err = r.root.Rename(e.staged, e.dst); err != nil {
+			return errors.Annotatef(err, "unable to import %s", e.name)
+		}
+		if e.kind == archiveObjectName {
+			r.removeFromCache(e.iri)
+		}
+	}
+	for _, e := range entries {
+		if e.kind != archiveMembersName {
+			continue
+		}
+		iris, err := loadArchiveMembers(r.root, e)
+		if err != nil {
+			return err
+		}
+		if err = r.addMembers(e.dst, iris...); err != nil {
+			return errors.Annotatef(err, "unable to store the members of %s", e.dst)
+		}
+	}
+
+	if r.index != nil {
+		return r.Reindex()
+	}
+	return nil
+}
+
+// archiveEntry is an entry of an archive which is being imported.
+type archiveEntry struct {
+	name string
+	// kind is the file name of the entry: an object, metadata, members, or an OAuth object.
+	kind string
+	iri  vocab.IRI
+	// staged is the path where the entry was staged.
+	staged string
+	// dst is the path where the entry gets stored: its file, or the collection for the members.
+	dst string
+}
+
+func (r *repo) archiveEntryOf(name string) (archiveEntry, error) {
+	e := archiveEntry{name: name}
+	if !fs.ValidPath(name) {
+		return e, errors.BadRequestf("invalid archive entry %s", name)
+	}
+	if p, ok := strings.CutPrefix(name, folder+"/"); ok && path.Base(p) == archiveObjectName {
+		e.kind, e.dst = folder, path.Join(folder, getObjectKey(path.Dir(p)))
+		return e, nil
+	}
+	p, ok := strings.CutPrefix(name, archiveStoreDir+"/")
+	if !ok {
+		return e, errors.BadRequestf("unknown archive entry %s", name)
+	}
+	if e.iri = pathIRI(path.Dir(p)); e.iri == "" {
+		return e, errors.BadRequestf("invalid archive entry %s", name)
+	}
+	switch e.kind = path.Base(p); e.kind {
+	case archiveObjectName:
+		e.dst = getObjectKey(r.pathOf(e.iri))
+	case archiveMetadataName:
+		e.dst = getMetadataKey(r.pathOf(e.iri))
+	case archiveMembersName:
+		e.dst = r.pathOf(e.iri)
+	default:
+		return e, errors.BadRequestf("unknown archive entry %s", name)
+	}
+	return e, nil
+}
+
+// stageEntry copies the contents of an archive entry to p, and it returns their checksum.
+func (r *repo) stageEntry(p string, data io.Reader) (string, error) {
+	f, err := r.root.OpenFile(p, defaultNewFileFlags|os.O_EXCL, defaultFilePerm)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, sum), data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// prepareEntry checks the staged entry, and it encodes it the way the storage stores it.
+func (r *repo) prepareEntry(e archiveEntry) error {
+	if e.kind == archiveMembersName {
+		_, err := loadArchiveMembers(r.root, e)
+		return err
+	}
+	data, err := readRaw(r.root, e.staged)
+	if err != nil {
+		return err
+	}
+	var raw []byte
+	switch e.kind {
+	case folder:
+		raw, err = r.encrypt(data)
+	case archiveObjectName:
+		if _, err = itemFromRaw(data); err != nil {
+			return errors.Annotatef(err, "invalid object %s", e.iri)
+		}
+		if raw, err = r.encodeRaw(data); err == nil {
+			raw, err = r.compressObject(raw)
+		}
+	case archiveMetadataName:
+		if raw, err = r.encodeRaw(data); err == nil {
+			raw, err = r.encrypt(raw)
+		}
+	}
+	if err != nil {
+		return errors.Annotatef(err, "unable to encode %s", e.name)
+	}
+	return putRaw(r.root, e.staged, raw)
+}
+
+func loadArchiveMembers(root *os.Root, e archiveEntry) (vocab.IRIs, error) {
+	data, err := readRaw(root, e.staged)
+	if err != nil {
+		return nil, err
+	}
+	iris := make(vocab.IRIs, 0)
+	if err = json.Unmarshal(data, &iris); err != nil {
+		return nil, errors.Annotatef(err, "invalid members of %s", e.iri)
+	}
+	return iris, nil
+}
+
+// verifyArchive checks the checksums of the imported entries against the ones in the archive's manifest.
+func verifyArchive(m *archiveManifest, sums map[string]string) error {
+	if m == nil {
+		return errors.BadRequestf("the archive has no manifest")
+	}
+	if m.Version > archiveVersion {
+		return errors.NotImplementedf("unsupported archive version %d", m.Version)
+	}
+	invalid := make([]string, 0)
+	for name, sum := range m.Files {
+		if got, ok := sums[name]; !ok || got != sum {
+			invalid = append(invalid, name)
+		}
+	}
+	for name := range sums {
+		if _, ok := m.Files[name]; !ok {
+			invalid = append(invalid, name)
+		}
+	}
+	if len(invalid) > 0 {
+		slices.Sort(invalid)
+		return errors.BadRequestf("the archive entries don't match its manifest: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
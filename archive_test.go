@@ -0,0 +1,171 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_repo_Export_Import(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+	}
+
+	src := t.TempDir()
+	from := mockRepo(t, fields{path: src, root: openRoot(t, src)}, withGeneratedRoot(root), withGeneratedItems(activities), withClient)
+	from.keys = mockKeyring(t)
+	if err := from.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if err := from.SaveMetadata(rootIRI, Metadata{Pw: []byte("dsa")}); err != nil {
+		t.Fatalf("SaveMetadata() error = %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       ExportOptions
+		sharded    bool
+		membership Membership
+		// fromFile imports the archive from a file, which the zip archives are read from directly.
+		fromFile bool
+	}{
+		{
+			name: "tar",
+			opts: ExportOptions{Format: ArchiveTar, IncludeSecrets: true},
+		},
+		{
+			name:    "compressed tar to sharded",
+			opts:    ExportOptions{Format: ArchiveTar, Compression: CompressionGzip, IncludeSecrets: true},
+			sharded: true,
+		},
+		{
+			name:       "zip to manifest",
+			opts:       ExportOptions{Format: ArchiveZip, Compression: CompressionGzip, IncludeSecrets: true},
+			membership: MembershipManifest,
+		},
+		{
+			name: "zstd tar",
+			opts: ExportOptions{Format: ArchiveTar, Compression: CompressionZstd, IncludeSecrets: true},
+		},
+		{
+			name:       "zstd zip from a file",
+			opts:       ExportOptions{Format: ArchiveZip, Compression: CompressionZstd, IncludeSecrets: true},
+			membership: MembershipManifest,
+			fromFile:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := bytes.Buffer{}
+			if err := from.Export(&archive, tt.opts); err != nil {
+				t.Fatalf("Export() error = %s", err)
+			}
+
+			dst := t.TempDir()
+			to := mockRepo(t, fields{path: dst, root: openRoot(t, dst)})
+			to.sharded = tt.sharded
+			to.membership = tt.membership
+			var in io.Reader = &archive
+			if tt.fromFile {
+				name := filepath.Join(t.TempDir(), "archive")
+				if err := os.WriteFile(name, archive.Bytes(), 0o600); err != nil {
+					t.Fatalf("unable to write the archive: %s", err)
+				}
+				f, err := os.Open(name)
+				if err != nil {
+					t.Fatalf("unable to open the archive: %s", err)
+				}
+				defer f.Close()
+				in = f
+			}
+			if err := to.Import(in); err != nil {
+				t.Fatalf("Import() error = %s", err)
+			}
+			if leftovers, _ := filepath.Glob(filepath.Join(dst, ".*.tmp-*")); len(leftovers) > 0 {
+				t.Errorf("Import() left temporary files behind: %v", leftovers)
+			}
+
+			for _, it := range append(vocab.ItemCollection{root}, activities...) {
+				loaded, err := to.Load(it.GetLink())
+				if err != nil {
+					t.Errorf("Load(%s) error = %s", it.GetLink(), err)
+					continue
+				}
+				if !loaded.GetLink().Equals(it.GetLink(), true) {
+					t.Errorf("Load() = %s, want %s", loaded.GetLink(), it.GetLink())
+				}
+			}
+			if got := outboxItems(t, to); len(got) != len(activities) {
+				t.Errorf("imported outbox items = %v, want %d items", got, len(activities))
+			}
+			m := Metadata{}
+			if err := to.LoadMetadata(rootIRI, &m); err != nil || string(m.Pw) != "dsa" {
+				t.Errorf("LoadMetadata() = %v, %v", m, err)
+			}
+			if _, err := to.GetClient(defaultClient.GetId()); err != nil {
+				t.Errorf("GetClient() error = %s", err)
+			}
+		})
+	}
+}
+
+func Test_repo_Export_withoutSecrets(t *testing.T) {
+	src := t.TempDir()
+	from := mockRepo(t, fields{path: src, root: openRoot(t, src)}, withGeneratedRoot(root), withClient)
+	if err := from.SaveMetadata(rootIRI, Metadata{Pw: []byte("dsa")}); err != nil {
+		t.Fatalf("SaveMetadata() error = %s", err)
+	}
+
+	archive := bytes.Buffer{}
+	if err := from.Export(&archive, ExportOptions{Format: ArchiveTar}); err != nil {
+		t.Fatalf("Export() error = %s", err)
+	}
+
+	dst := t.TempDir()
+	to := mockRepo(t, fields{path: dst, root: openRoot(t, dst)})
+	if err := to.Import(&archive); err != nil {
+		t.Fatalf("Import() error = %s", err)
+	}
+	if _, err := to.Load(rootIRI); err != nil {
+		t.Errorf("Load(%s) error = %s", rootIRI, err)
+	}
+	if err := to.LoadMetadata(rootIRI, &Metadata{}); err == nil {
+		t.Errorf("Export() without secrets archived the metadata")
+	}
+	if _, err := to.GetClient(defaultClient.GetId()); err == nil {
+		t.Errorf("Export() without secrets archived the OAuth clients")
+	}
+}
+
+func Test_repo_Import_checksums(t *testing.T) {
+	src := t.TempDir()
+	from := mockRepo(t, fields{path: src, root: openRoot(t, src)}, withGeneratedRoot(root))
+
+	archive := bytes.Buffer{}
+	if err := from.Export(&archive, ExportOptions{Format: ArchiveTar}); err != nil {
+		t.Fatalf("Export() error = %s", err)
+	}
+	raw := bytes.Replace(archive.Bytes(), []byte(`"Service"`), []byte(`"Servixe"`), 1)
+
+	dst := t.TempDir()
+	to := mockRepo(t, fields{path: dst, root: openRoot(t, dst)})
+	if err := to.Import(bytes.NewReader(raw)); err == nil {
+		t.Errorf("Import() of a tampered archive didn't return an error")
+	}
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		t.Fatalf("unable to read the storage folder: %s", err)
+	}
+	if len(entries) > 0 {
+		names := make([]string, 0, len(entries))
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("Import() of a tampered archive changed the storage: %v", names)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time of the file, or its modification time if that's later.
+// With the default relatime mount option, the access time gets updated at most once a day.
+func accessTime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+	if atime := time.Unix(st.Atim.Unix()); atime.After(fi.ModTime()) {
+		return atime
+	}
+	return fi.ModTime()
+}
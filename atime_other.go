@@ -0,0 +1,13 @@
+//go:build !linux
+
+package fs
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time of the file, as the access time is not available on all platforms.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,266 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	// _blobsDirName is the directory, in the root of the storage, which holds the content of the blobs,
+	// under their SHA-256 sum.
+	_blobsDirName = ".blobs"
+	// blobKey is the file, next to the object file, which holds the content of the object's blob.
+	// It's a hard link to the content in the blobs directory, so the objects with the same content share it.
+	blobKey = "__blob"
+	// blobInfoKey is the file, next to the object file, which holds the information about the object's blob.
+	blobInfoKey = "__blob_info"
+)
+
+func getBlobKey(p string) string {
+	return path.Join(p, blobKey)
+}
+
+func getBlobInfoKey(p string) string {
+	return path.Join(p, blobInfoKey)
+}
+
+func blobContentPath(sum string) string {
+	return path.Join(_blobsDirName, sum[:2], sum)
+}
+
+// BlobInfo is the information about the binary content of an object, like the media of an Image or a Document.
+type BlobInfo struct {
+	// SHA256 is the hex encoded SHA-256 sum of the content.
+	SHA256 string `json:"sha256"`
+	// MediaType is the MIME type of the content.
+	MediaType vocab.MimeType `json:"mediaType,omitempty"`
+	// Size is the size of the content in bytes.
+	Size int64 `json:"size"`
+}
+
+// Blob is the content of an object's blob, opened for reading.
+// Besides reading it whole, ranges of it can be read with ReadAt, Seek, or Range.
+type Blob struct {
+	BlobInfo
+	f *os.File
+}
+
+func (b *Blob) Read(p []byte) (int, error) {
+	return b.f.Read(p)
+}
+
+func (b *Blob) ReadAt(p []byte, off int64) (int, error) {
+	return b.f.ReadAt(p, off)
+}
+
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	return b.f.Seek(offset, whence)
+}
+
+func (b *Blob) Close() error {
+	return b.f.Close()
+}
+
+// Range returns a reader for at most length bytes of the content, starting at offset.
+func (b *Blob) Range(offset, length int64) (*io.SectionReader, error) {
+	if offset < 0 || length < 0 || offset > b.Size {
+		return nil, errors.BadRequestf("invalid range of %d bytes at %d, for a blob of %d bytes", length, offset, b.Size)
+	}
+	return io.NewSectionReader(b.f, offset, min(length, b.Size-offset)), nil
+}
+
+// PutBlob saves the content read from in as the blob of the object with the iri, which needs to be already stored.
+// An existing blob of the object gets replaced.
+//
+// The content is stored once for all the objects that have it, and it's removed together with the last of them,
+// either by DeleteBlob, or by Delete. It's stored as is, without being compressed or encrypted.
+func (r *repo) PutBlob(iri vocab.IRI, in io.Reader, mediaType vocab.MimeType) (*BlobInfo, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	itPath := r.pathOf(iri)
+	if _, err := r.root.Stat(getObjectKey(itPath)); err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "unable to save the blob of %s", iri)
+	}
+
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
+	if err := mkDirIfNotExists(r.root, _blobsDirName); err != nil {
+		return nil, errors.Annotatef(err, "unable to create the blobs folder")
+	}
+	tmpPath := path.Join(_blobsDirName, ".tmp-"+strconv.FormatUint(rand.Uint64(), 36))
+	f, err := r.root.OpenFile(tmpPath, defaultNewFileFlags|os.O_EXCL, defaultFilePerm)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to save the blob of %s", iri)
+	}
+	defer func() {
+		_ = r.root.Remove(tmpPath)
+	}()
+
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, sum), in)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to save the blob of %s", iri)
+	}
+
+	info := BlobInfo{SHA256: hex.EncodeToString(sum.Sum(nil)), MediaType: mediaType, Size: size}
+	raw, err := encodeFn(info)
+	if err != nil {
+		return nil, errors.Annotatef(err, "could not marshal the blob information")
+	}
+	if raw, err = r.encodeRaw(raw); err != nil {
+		return nil, errors.Annotatef(err, "could not encode the blob information")
+	}
+
+	prev, _ := r.loadBlobInfo(itPath)
+	r.record(getBlobKey(itPath), getBlobInfoKey(itPath))
+	if err = r.linkBlob(tmpPath, info.SHA256, getBlobKey(itPath)); err != nil {
+		return nil, errors.Annotatef(err, "unable to save the blob of %s", iri)
+	}
+	if err = putRaw(r.root, getBlobInfoKey(itPath), raw); err != nil {
+		return nil, err
+	}
+	if prev != nil && prev.SHA256 != info.SHA256 {
+		r.releaseBlob(prev.SHA256)
+	}
+	return &info, nil
+}
+
+// linkBlob moves the content written at tmpPath to the blobs directory, unless it already has the same content,
+// and it links it at dst.
+func (r *repo) linkBlob(tmpPath, sum, dst string) error {
+	contentPath := blobContentPath(sum)
+	// NOTE(marius): the shared content, and its directory, could be removed by releaseBlob between
+	// finding it and linking to it.
+	defer r.blobs.lock(path.Dir(contentPath))()
+
+	if err := mkDirIfNotExists(r.root, path.Dir(contentPath)); err != nil {
+		return err
+	}
+	if _, err := r.root.Lstat(contentPath); os.IsNotExist(err) {
+		if err = r.root.Rename(tmpPath, contentPath); err != nil {
+			return err
+		}
+	}
+
+	linkPath := path.Join(path.Dir(dst), "."+blobKey+".tmp-"+strconv.FormatUint(rand.Uint64(), 36))
+	if err := r.root.Link(contentPath, linkPath); err != nil {
+		// NOTE(marius): on the filesystems without hard links the object gets its own copy of the content.
+		if err = copyFile(filepath.Join(r.path, contentPath), filepath.Join(r.path, linkPath), defaultFilePerm); err != nil {
+			return err
+		}
+	}
+	if err := r.root.Rename(linkPath, dst); err != nil {
+		_ = r.root.Remove(linkPath)
+		return err
+	}
+	return nil
+}
+
+// releaseBlob removes the content with the sum from the blobs directory, if no object links to it anymore.
+func (r *repo) releaseBlob(sum string) {
+	contentPath := blobContentPath(sum)
+	defer r.blobs.lock(path.Dir(contentPath))()
+
+	fi, err := r.root.Lstat(contentPath)
+	if err != nil {
+		return
+	}
+	// NOTE(marius): on the platforms where the number of links to a file is not known, the content is kept.
+	if links, ok := linkCount(fi); !ok || links > 1 {
+		return
+	}
+	r.record(contentPath)
+	if err = r.root.Remove(contentPath); err != nil && !os.IsNotExist(err) {
+		r.logger.Warnf("unable to remove the blob %s: %s", sum, err)
+		return
+	}
+	// NOTE(marius): this fails, as it should, when other blobs share the directory.
+	_ = r.root.Remove(path.Dir(contentPath))
+}
+
+// OpenBlob opens the blob of the object with the iri for reading. The caller needs to close it.
+func (r *repo) OpenBlob(iri vocab.IRI) (*Blob, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	itPath := r.pathOf(iri)
+	info, err := r.loadBlobInfo(itPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := r.root.Open(getBlobKey(itPath))
+	if err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "could not find the blob of %s", iri)
+	}
+	return &Blob{BlobInfo: *info, f: f}, nil
+}
+
+func (r *repo) loadBlobInfo(itPath string) (*BlobInfo, error) {
+	raw, err := loadRaw(r.root, getBlobInfoKey(itPath))
+	if err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "could not find the blob information")
+	}
+	info := new(BlobInfo)
+	if err = decodeFn(raw, info); err != nil {
+		return nil, errors.Annotatef(err, "could not unmarshal the blob information")
+	}
+	if sum, err := hex.DecodeString(info.SHA256); err != nil || len(sum) != sha256.Size {
+		return nil, errors.Newf("invalid blob sum %q", info.SHA256)
+	}
+	return info, nil
+}
+
+// DeleteBlob removes the blob of the object with the iri, and its content, if no other object has it.
+func (r *repo) DeleteBlob(iri vocab.IRI) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
+	itPath := r.pathOf(iri)
+	info, err := r.loadBlobInfo(itPath)
+	if err != nil {
+		return err
+	}
+	r.record(getBlobInfoKey(itPath), getBlobKey(itPath))
+	for _, p := range []string{getBlobInfoKey(itPath), getBlobKey(itPath)} {
+		if err = r.root.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	r.releaseBlob(info.SHA256)
+	return nil
+}
+
+// blobsUnder returns the sums of the blobs of the objects stored under dir, which need to be released
+// after the directory gets removed.
+func (r *repo) blobsUnder(dir string) []string {
+	sums := make([]string, 0)
+	_ = fs.WalkDir(r.root.FS(), dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != blobInfoKey {
+			return nil
+		}
+		if info, err := r.loadBlobInfo(path.Dir(p)); err == nil {
+			sums = append(sums, info.SHA256)
+		}
+		return nil
+	})
+	return sums
+}
@@ -0,0 +1,158 @@
+package fs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_repo_Blob(t *testing.T) {
+	content := []byte("GIF89a, not really an image")
+	first := &vocab.Object{ID: "https://example.com/objects/first", Type: vocab.ImageType, MediaType: "image/gif"}
+	second := &vocab.Object{ID: "https://example.com/objects/second", Type: vocab.ImageType, MediaType: "image/gif"}
+	missing := vocab.IRI("https://example.com/objects/missing")
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(vocab.ItemCollection{first, second}))
+
+	blobContent := func(info *BlobInfo) string {
+		return filepath.Join(dir, blobContentPath(info.SHA256))
+	}
+
+	info, err := r.PutBlob(first.GetLink(), bytes.NewReader(content), "image/gif")
+	if err != nil {
+		t.Fatalf("PutBlob() error = %s", err)
+	}
+	if info.Size != int64(len(content)) || info.MediaType != "image/gif" || len(info.SHA256) != 64 {
+		t.Errorf("PutBlob() = %+v", info)
+	}
+	if _, err = r.PutBlob(second.GetLink(), bytes.NewReader(content), "image/gif"); err != nil {
+		t.Fatalf("PutBlob() error = %s", err)
+	}
+	if _, err = r.PutBlob(missing, bytes.NewReader(content), "image/gif"); err == nil {
+		t.Errorf("PutBlob() for an object which is not stored didn't return an error")
+	}
+
+	firstFi, err := os.Stat(filepath.Join(dir, getBlobKey(r.pathOf(first.GetLink()))))
+	if err != nil {
+		t.Fatalf("the blob of %s was not stored: %s", first.GetLink(), err)
+	}
+	secondFi, err := os.Stat(filepath.Join(dir, getBlobKey(r.pathOf(second.GetLink()))))
+	if err != nil {
+		t.Fatalf("the blob of %s was not stored: %s", second.GetLink(), err)
+	}
+	if !os.SameFile(firstFi, secondFi) {
+		t.Errorf("the objects with the same blob don't share its content")
+	}
+
+	b, err := r.OpenBlob(first.GetLink())
+	if err != nil {
+		t.Fatalf("OpenBlob() error = %s", err)
+	}
+	got, err := io.ReadAll(b)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("OpenBlob() content = %q, %v, want %q", got, err, content)
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		length int64
+		want   string
+	}{
+		{name: "start", offset: 0, length: 6, want: "GIF89a"},
+		{name: "middle", offset: 8, length: 3, want: "not"},
+		{name: "past the end", offset: 19, length: 100, want: "an image"},
+		{name: "at the end", offset: int64(len(content)), length: 10, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng, err := b.Range(tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("Range() error = %s", err)
+			}
+			got, err := io.ReadAll(rng)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("Range() content = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+	if _, err = b.Range(int64(len(content))+1, 1); err == nil {
+		t.Errorf("Range() past the end of the blob didn't return an error")
+	}
+	if _, err = b.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatalf("Seek() error = %s", err)
+	}
+	if got, _ = io.ReadAll(b); string(got) != "image" {
+		t.Errorf("Read() after Seek() = %q, want %q", got, "image")
+	}
+	_ = b.Close()
+
+	if err = r.Delete(first); err != nil {
+		t.Fatalf("Delete() error = %s", err)
+	}
+	if _, err = r.OpenBlob(first.GetLink()); err == nil {
+		t.Errorf("Delete() didn't remove the blob")
+	}
+	if _, err = os.Stat(blobContent(info)); err != nil {
+		t.Errorf("Delete() removed the blob content which is still used: %s", err)
+	}
+
+	replaced, err := r.PutBlob(second.GetLink(), strings.NewReader("GIF89a, another one"), "image/gif")
+	if err != nil {
+		t.Fatalf("PutBlob() error = %s", err)
+	}
+	if _, err = os.Stat(blobContent(info)); !os.IsNotExist(err) {
+		t.Errorf("PutBlob() didn't remove the replaced blob content: %v", err)
+	}
+
+	if err = r.DeleteBlob(second.GetLink()); err != nil {
+		t.Fatalf("DeleteBlob() error = %s", err)
+	}
+	if _, err = os.Stat(blobContent(replaced)); !os.IsNotExist(err) {
+		t.Errorf("DeleteBlob() didn't remove the blob content: %v", err)
+	}
+	if _, err = r.Load(second.GetLink()); err != nil {
+		t.Errorf("DeleteBlob() removed the object: %s", err)
+	}
+	if err = r.DeleteBlob(second.GetLink()); err == nil {
+		t.Errorf("DeleteBlob() for an object without a blob didn't return an error")
+	}
+}
+
+func Test_repo_Blob_concurrent(t *testing.T) {
+	content := []byte("GIF89a, shared by both objects")
+	objects := vocab.ItemCollection{
+		&vocab.Object{ID: "https://example.com/objects/first", Type: vocab.ImageType},
+		&vocab.Object{ID: "https://example.com/objects/second", Type: vocab.ImageType},
+	}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(objects))
+
+	wg := sync.WaitGroup{}
+	for _, ob := range objects {
+		wg.Go(func() {
+			for range 50 {
+				if _, err := r.PutBlob(ob.GetLink(), bytes.NewReader(content), "image/gif"); err != nil {
+					t.Errorf("PutBlob() error = %s", err)
+					return
+				}
+				if err := r.DeleteBlob(ob.GetLink()); err != nil {
+					t.Errorf("DeleteBlob() error = %s", err)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if entries, _ := os.ReadDir(filepath.Join(dir, _blobsDirName)); len(entries) > 0 {
+		t.Errorf("the blobs folder still has %d entries after all the blobs were removed", len(entries))
+	}
+}
@@ -14,16 +14,16 @@ func Bootstrap(conf Config) error {
 	if _, err := os.Stat(conf.Path); err != nil {
 		if !os.IsNotExist(err) {
 			return err
-		} else {
-			return os.MkdirAll(conf.Path, defaultDirPerm)
+		} else if err = os.MkdirAll(conf.Path, defaultDirPerm); err != nil {
+			return err
 		}
 	}
-	return nil
+	return bootstrapLayout(conf)
 }
 
 func (r *repo) Reset() {
 	r.cache = cache.New(true)
 	if r.index != nil {
-		r.index = newBitmap()
+		r.index = newBitmap(r.index.types...)
 	}
 }
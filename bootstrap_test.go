@@ -8,6 +8,7 @@ import (
 	"git.sr.ht/~mariusor/lw"
 	"github.com/go-ap/cache"
 	"github.com/go-ap/errors"
+	"github.com/go-ap/filters/index"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -110,6 +111,10 @@ func Test_repo_Reset(t *testing.T) {
 			name:   "not empty",
 			fields: fields{index: newBitmap()},
 		},
+		{
+			name:   "custom index types",
+			fields: fields{index: newBitmap(index.ByID, index.ByType, ByURL)},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -129,6 +134,9 @@ func Test_repo_Reset(t *testing.T) {
 				if r.index == nil || r.index == tt.fields.index {
 					t.Errorf("Reset() didn't reinitialize the bitmap index")
 				}
+				if !cmp.Equal(r.index.types, tt.fields.index.types) {
+					t.Errorf("Reset() index types = %v, want %v", r.index.types, tt.fields.index.types)
+				}
 			}
 		})
 	}
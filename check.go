@@ -0,0 +1,573 @@
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+// _quarantineDirName is the directory, in the root of the storage, where Check moves the files it can't repair.
+const _quarantineDirName = ".quarantine"
+
+// Problem is a class of problems found by Check.
+type Problem uint8
+
+const (
+	// ProblemDanglingLink is a collection member link to an object which doesn't exist.
+	// It gets repaired by removing the link.
+	ProblemDanglingLink Problem = iota + 1
+	// ProblemUndecodable is an object file which can't be decoded. It gets quarantined.
+	ProblemUndecodable
+	// ProblemMisplaced is an object stored at a path which doesn't match its id. It gets moved to its path,
+	// or quarantined if there's already an object there, or if it doesn't have an id.
+	ProblemMisplaced
+	// ProblemTotalItems is a collection whose totalItems doesn't match the number of its members.
+	// It gets repaired by updating the collection.
+	ProblemTotalItems
+	// ProblemOrphanedMetadata is a metadata file without an object. It gets quarantined.
+	ProblemOrphanedMetadata
+	// ProblemOrphanedToken is an OAuth authorization or token of a client, or for an access token,
+	// which doesn't exist. It gets removed.
+	ProblemOrphanedToken
+	// ProblemIndexDrift is an object which is missing from the index, or an index entry for an object
+	// which doesn't exist. It gets repaired by updating the index.
+	ProblemIndexDrift
+	// ProblemTempFile is a temporary file left behind by an interrupted write. It gets removed.
+	ProblemTempFile
+)
+
+func (p Problem) String() string {
+	switch p {
+	case ProblemDanglingLink:
+		return "dangling link"
+	case ProblemUndecodable:
+		return "undecodable object"
+	case ProblemMisplaced:
+		return "misplaced object"
+	case ProblemTotalItems:
+		return "wrong totalItems"
+	case ProblemOrphanedMetadata:
+		return "orphaned metadata"
+	case ProblemOrphanedToken:
+		return "orphaned OAuth token"
+	case ProblemIndexDrift:
+		return "index drift"
+	case ProblemTempFile:
+		return "temporary file"
+	}
+	return "unknown"
+}
+
+// CheckOptions control the integrity check of the storage.
+type CheckOptions struct {
+	// Fix repairs the problems that were found, and moves the files which can't be repaired
+	// to the .quarantine directory in the root of the storage.
+	Fix bool
+}
+
+// CheckIssue is a problem found by Check.
+type CheckIssue struct {
+	Problem Problem
+	// Path is the path of the file or directory with the problem, relative to the storage root.
+	Path   string
+	Detail string
+	Fixed  bool
+}
+
+func (i CheckIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Problem, i.Path, i.Detail)
+}
+
+// CheckReport is the result of an integrity check.
+type CheckReport struct {
+	// Checked is the number of objects that were checked.
+	Checked int
+	Issues  []CheckIssue
+}
+
+func (c *CheckReport) add(problem Problem, p string, detail string, args ...any) *CheckIssue {
+	c.Issues = append(c.Issues, CheckIssue{Problem: problem, Path: p, Detail: fmt.Sprintf(detail, args...)})
+	return &c.Issues[len(c.Issues)-1]
+}
+
+// Check verifies the integrity of the storage and, with CheckOptions.Fix, it repairs the problems it finds.
+// The errors returned are only the ones which stopped the check, the problems are returned in the report.
+//
+// Fixing the problems is meant to be done while the storage is not in use by other processes.
+func (r *repo) Check(opts CheckOptions) (*CheckReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	report := CheckReport{Issues: make([]CheckIssue, 0)}
+	scan, err := r.scanStorage(&report)
+	if err != nil {
+		return &report, err
+	}
+	checks := []func(*CheckReport, *checkScan, bool) error{
+		r.checkObjects,
+		r.checkLinks,
+		r.checkCollections,
+		r.checkOauth,
+		r.checkIndex,
+	}
+	for _, check := range checks {
+		if err = check(&report, scan, opts.Fix); err != nil {
+			return &report, err
+		}
+	}
+	return &report, nil
+}
+
+// walkStorage calls fn for the files of the storage, skipping the index, the OAuth and the quarantine directories.
+func (r *repo) walkStorage(fn func(p string, d fs.DirEntry) error) error {
+	return fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || p == folder || p == _quarantineDirName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		return fn(p, d)
+	})
+}
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, ".tmp-")
+}
+
+// quarantine moves the file at p to the quarantine directory. It's kept there under a single escaped name,
+// so the walks over the storage don't mistake it for a storage file.
+func (r *repo) quarantine(p string) error {
+	if err := mkDirIfNotExists(r.root, _quarantineDirName); err != nil {
+		return err
+	}
+	name := url.PathEscape(filepath.ToSlash(p)) + "." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	r.record(p)
+	return r.root.Rename(p, path.Join(_quarantineDirName, name))
+}
+
+type misplacedObject struct {
+	issue int
+	dir   string
+	iri   vocab.IRI
+}
+
+type scannedCollection struct {
+	dir string
+	col vocab.Item
+}
+
+// checkScan holds what the walk over the storage found, for the checks which run after it.
+// The paths get updated when the objects are moved, or quarantined, by the fixes.
+type checkScan struct {
+	// undecodable, orphaned and temporary are the issues of the files to quarantine, or to remove.
+	undecodable []int
+	orphaned    []int
+	temporary   []int
+	misplaced   []misplacedObject
+	// objects are the directories with an object file.
+	objects map[string]struct{}
+	// links are the collection member links.
+	links []string
+	// collections are the collections which have a totalItems.
+	collections []scannedCollection
+}
+
+// moved updates the paths of the scan after the moves were applied.
+func (s *checkScan) moved(applied []pathMove) {
+	if len(applied) == 0 {
+		return
+	}
+	objects := make(map[string]struct{}, len(s.objects))
+	for p := range s.objects {
+		objects[movedPath(p, applied)] = struct{}{}
+	}
+	s.objects = objects
+	for i, p := range s.links {
+		s.links[i] = movedPath(p, applied)
+	}
+	for i, c := range s.collections {
+		s.collections[i].dir = movedPath(c.dir, applied)
+	}
+}
+
+// scanStorage walks the storage once, and it decodes every object once, reporting the object files
+// which can't be decoded, or which are stored at the wrong path, the metadata files without an object,
+// and the temporary files of interrupted writes. It collects what the other checks need.
+func (r *repo) scanStorage(report *CheckReport) (*checkScan, error) {
+	scan := checkScan{objects: make(map[string]struct{})}
+	err := r.walkStorage(func(p string, d fs.DirEntry) error {
+		dir := path.Dir(p)
+		switch name := d.Name(); {
+		case d.Type()&fs.ModeSymlink == fs.ModeSymlink:
+			scan.links = append(scan.links, p)
+		case isTempFile(name):
+			report.add(ProblemTempFile, p, "left by an interrupted write")
+			scan.temporary = append(scan.temporary, len(report.Issues)-1)
+		case name == metaDataKey:
+			if _, err := r.root.Lstat(getObjectKey(dir)); os.IsNotExist(err) {
+				report.add(ProblemOrphanedMetadata, p, "no object at %s", dir)
+				scan.orphaned = append(scan.orphaned, len(report.Issues)-1)
+			}
+		case name == objectKey:
+			report.Checked++
+			scan.objects[dir] = struct{}{}
+			it, err := loadItemRaw(r.root, p)
+			if err != nil || vocab.IsNil(it) {
+				report.add(ProblemUndecodable, p, "%v", err)
+				scan.undecodable = append(scan.undecodable, len(report.Issues)-1)
+				return nil
+			}
+			if expected := r.pathOf(it.GetLink()); expected != dir {
+				report.add(ProblemMisplaced, dir, "the path of %q is %q", it.GetLink(), expected)
+				scan.misplaced = append(scan.misplaced, misplacedObject{issue: len(report.Issues) - 1, dir: dir, iri: it.GetLink()})
+			}
+			if isStorageCollectionKey(dir) {
+				if _, ok := totalItemsOf(it); ok {
+					scan.collections = append(scan.collections, scannedCollection{dir: dir, col: it})
+				}
+			}
+		}
+		return nil
+	})
+	return &scan, err
+}
+
+// checkObjects repairs the problems of the files found by scanStorage: the temporary files get removed,
+// the undecodable objects and the orphaned metadata get quarantined, and the misplaced objects get moved.
+func (r *repo) checkObjects(report *CheckReport, scan *checkScan, fix bool) error {
+	if !fix {
+		return nil
+	}
+
+	var err error
+	for _, i := range scan.temporary {
+		if err = r.root.Remove(report.Issues[i].Path); err == nil || os.IsNotExist(err) {
+			report.Issues[i].Fixed = true
+		}
+	}
+	for _, i := range slices.Concat(scan.undecodable, scan.orphaned) {
+		if err = r.quarantine(report.Issues[i].Path); err != nil {
+			return errors.Annotatef(err, "unable to quarantine %s", report.Issues[i].Path)
+		}
+		delete(scan.objects, path.Dir(report.Issues[i].Path))
+		report.Issues[i].Fixed = true
+	}
+
+	toMove := make([]misplacedObject, 0)
+	for _, m := range scan.misplaced {
+		dst := r.pathOf(m.iri)
+		if _, err = r.root.Lstat(getObjectKey(dst)); dst == "" || err == nil {
+			// NOTE(marius): there's no path to move the object to, or there's already an object there,
+			// and we can't know which of the two copies is the good one.
+			if err = r.quarantine(getObjectKey(m.dir)); err != nil {
+				return errors.Annotatef(err, "unable to quarantine %s", m.dir)
+			}
+			delete(scan.objects, m.dir)
+			report.Issues[m.issue].Fixed = true
+			continue
+		}
+		toMove = append(toMove, m)
+	}
+	if len(toMove) == 0 {
+		return nil
+	}
+
+	// NOTE(marius): the parents get moved before their children, so the children which don't share
+	// their parent's new path get moved back from it.
+	slices.SortStableFunc(toMove, func(a, b misplacedObject) int {
+		return strings.Count(a.dir, "/") - strings.Count(b.dir, "/")
+	})
+	applied := make([]pathMove, 0, len(toMove))
+	for _, m := range toMove {
+		cur := movedPath(m.dir, applied)
+		dst := r.pathOf(m.iri)
+		if cur != dst {
+			r.record(cur, dst)
+			if err = moveDir(r.root, cur, dst); err != nil {
+				return errors.Annotatef(err, "unable to move %s", m.iri)
+			}
+			applied = append(applied, pathMove{from: cur, to: dst})
+		}
+		report.Issues[m.issue].Fixed = true
+	}
+	scan.moved(applied)
+	if err = r.relinkMoved(applied); err != nil {
+		return errors.Annotatef(err, "unable to update the links to the moved objects")
+	}
+	return r.moveIndexRefs(applied)
+}
+
+// checkLinks looks for the collection member links to objects which don't exist. They are checked
+// after the objects were repaired, as those fixes can change what the links point to.
+func (r *repo) checkLinks(report *CheckReport, scan *checkScan, fix bool) error {
+	for _, p := range scan.links {
+		if _, err := r.root.Stat(getObjectKey(p)); !os.IsNotExist(err) {
+			continue
+		}
+		target, _ := r.root.Readlink(p)
+		issue := report.add(ProblemDanglingLink, p, "%s doesn't exist", target)
+		if !fix {
+			continue
+		}
+		r.record(p)
+		if err := r.root.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		issue.Fixed = true
+	}
+	return nil
+}
+
+func totalItemsOf(col vocab.Item) (uint, bool) {
+	var total uint
+	var ok bool
+	if orderedCollectionTypes.Match(col.GetType()) {
+		_ = vocab.OnOrderedCollection(col, func(c *vocab.OrderedCollection) error {
+			total, ok = c.TotalItems, true
+			return nil
+		})
+	} else if collectionTypes.Match(col.GetType()) {
+		_ = vocab.OnCollection(col, func(c *vocab.Collection) error {
+			total, ok = c.TotalItems, true
+			return nil
+		})
+	}
+	return total, ok
+}
+
+func setTotalItems(col vocab.Item, total uint) {
+	if orderedCollectionTypes.Match(col.GetType()) {
+		_ = vocab.OnOrderedCollection(col, func(c *vocab.OrderedCollection) error {
+			c.TotalItems = total
+			return nil
+		})
+	} else if collectionTypes.Match(col.GetType()) {
+		_ = vocab.OnCollection(col, func(c *vocab.Collection) error {
+			c.TotalItems = total
+			return nil
+		})
+	}
+}
+
+// memberCount returns the number of members of the collection stored at colPath, including the objects
+// stored inside it.
+func (r *repo) memberCount(colPath string) (uint, error) {
+	iris, err := r.memberIRIs(colPath)
+	if err != nil {
+		return 0, err
+	}
+	count := uint(len(iris))
+	depth := r.memberDepth(colPath)
+	err = fs.WalkDir(r.root.FS(), colPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || p == colPath {
+			return nil
+		}
+		if d.Name() == _indexDirName {
+			return fs.SkipDir
+		}
+		if strings.Count(strings.TrimPrefix(p, colPath+"/"), "/")+1 < depth {
+			return nil
+		}
+		if _, err := r.root.Lstat(getObjectKey(p)); err == nil {
+			count++
+		}
+		return fs.SkipDir
+	})
+	return count, err
+}
+
+// checkCollections looks for the collections whose totalItems doesn't match the number of their members.
+func (r *repo) checkCollections(report *CheckReport, scan *checkScan, fix bool) error {
+	for _, c := range scan.collections {
+		total, _ := totalItemsOf(c.col)
+		count, err := r.memberCount(c.dir)
+		if err != nil {
+			return err
+		}
+		if count == total {
+			continue
+		}
+		issue := report.add(ProblemTotalItems, c.dir, "totalItems is %d, the collection has %d members", total, count)
+		if !fix {
+			continue
+		}
+		setTotalItems(c.col, count)
+		if _, err = save(r, c.col); err != nil {
+			return err
+		}
+		issue.Fixed = true
+	}
+	return nil
+}
+
+// checkOauth looks for the OAuth authorizations and access tokens of clients which don't exist,
+// and for the refresh tokens of access tokens which don't exist.
+func (r *repo) checkOauth(report *CheckReport, _ *checkScan, fix bool) error {
+	exists := func(p string) bool {
+		_, err := r.root.Stat(path.Join(folder, getObjectKey(p)))
+		return err == nil
+	}
+	clientExists := func(id string) bool {
+		return id != "" && exists(r.oauthClientPath(clientsBucket, id))
+	}
+	buckets := []struct {
+		name  string
+		check func(raw []byte) string
+	}{
+		{
+			name: authorizeBucket,
+			check: func(raw []byte) string {
+				a := auth{}
+				if err := decodeFn(raw, &a); err == nil && !clientExists(a.Client.Id) {
+					return fmt.Sprintf("client %q doesn't exist", a.Client.Id)
+				}
+				return ""
+			},
+		},
+		{
+			name: accessBucket,
+			check: func(raw []byte) string {
+				a := acc{}
+				if err := decodeFn(raw, &a); err == nil && !clientExists(a.Client) {
+					return fmt.Sprintf("client %q doesn't exist", a.Client)
+				}
+				return ""
+			},
+		},
+		{
+			name: refreshBucket,
+			check: func(raw []byte) string {
+				rf := ref{}
+				if err := decodeFn(raw, &rf); err == nil && !exists(path.Join(accessBucket, rf.Access)) {
+					return fmt.Sprintf("access token %q doesn't exist", rf.Access)
+				}
+				return ""
+			},
+		},
+	}
+
+	// NOTE(marius): the buckets are checked in order, so the refresh tokens of the access tokens
+	// which were removed are found orphaned too.
+	for _, b := range buckets {
+		orphaned := make([]int, 0)
+		err := fs.WalkDir(r.root.FS(), path.Join(folder, b.name), func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || d.Name() != oauthObjectKey {
+				return nil
+			}
+			raw, err := r.loadSecret(r.root, p)
+			if err != nil {
+				return nil
+			}
+			if detail := b.check(raw); detail != "" {
+				report.add(ProblemOrphanedToken, path.Dir(p), "%s", detail)
+				orphaned = append(orphaned, len(report.Issues)-1)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !fix {
+			continue
+		}
+		for _, i := range orphaned {
+			p := report.Issues[i].Path
+			r.record(p)
+			if err = r.root.RemoveAll(p); err != nil {
+				return err
+			}
+			report.Issues[i].Fixed = true
+		}
+	}
+	return nil
+}
+
+// checkIndex compares the objects referenced in the index with the ones in the storage.
+func (r *repo) checkIndex(report *CheckReport, scan *checkScan, fix bool) error {
+	if r.index == nil {
+		return nil
+	}
+	_ = r.loadIndex()
+
+	// NOTE(marius): only the objects missing from the index get decoded again, when they are added to it.
+	objects := scan.objects
+	var err error
+
+	r.index.w.RLock()
+	indexed := make(map[string]uint64, len(r.index.ref))
+	for ref, p := range r.index.ref {
+		indexed[filepath.ToSlash(filepath.Clean(p))] = ref
+	}
+	r.index.w.RUnlock()
+
+	stale := make([]string, 0)
+	for p := range indexed {
+		if _, ok := objects[p]; !ok {
+			stale = append(stale, p)
+		}
+	}
+	missing := make([]string, 0)
+	for p := range objects {
+		if _, ok := indexed[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	slices.Sort(stale)
+	slices.Sort(missing)
+
+	for _, p := range stale {
+		issue := report.add(ProblemIndexDrift, p, "the index references an object which doesn't exist")
+		if !fix {
+			continue
+		}
+		r.index.w.Lock()
+		delete(r.index.ref, indexed[p])
+		r.index.w.Unlock()
+		if err = r.removeFromIndex(r.iriFromPath(p), p); err != nil {
+			r.logger.Debugf("unable to remove %s from the index: %s", p, err)
+		}
+		issue.Fixed = true
+	}
+	for _, p := range missing {
+		issue := report.add(ProblemIndexDrift, p, "the object is not in the index")
+		if !fix {
+			continue
+		}
+		it, err := loadItemRaw(r.root, getObjectKey(p))
+		if err != nil || vocab.IsNil(it) {
+			// NOTE(marius): the objects which can't be decoded are reported by checkObjects.
+			continue
+		}
+		if err = r.addToIndex(it, p); err != nil {
+			return err
+		}
+		issue.Fixed = true
+	}
+	if fix && len(stale)+len(missing) > 0 {
+		return r.saveIndex()
+	}
+	return nil
+}
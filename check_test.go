@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters/index"
+	"github.com/openshift/osin"
+)
+
+func countProblems(issues []CheckIssue) map[Problem]int {
+	counts := make(map[Problem]int)
+	for _, issue := range issues {
+		counts[issue.Problem]++
+	}
+	return counts
+}
+
+func Test_repo_Check(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+	}
+	misplaced := &vocab.Object{ID: "https://example.com/objects/1", Type: vocab.NoteType}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(activities))
+	if err := r.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+
+	if err := r.linkMember(r.pathOf(rootOutboxIRI), "https://example.com/missing"); err != nil {
+		t.Fatalf("unable to create a dangling link: %s", err)
+	}
+	if err := putRaw(r.root, "example.com/broken/__raw", []byte("{not json}")); err != nil {
+		t.Fatalf("unable to write an undecodable object: %s", err)
+	}
+	raw, _ := encodeItemFn(misplaced)
+	if err := putRaw(r.root, "example.com/misplaced/__raw", raw); err != nil {
+		t.Fatalf("unable to write a misplaced object: %s", err)
+	}
+	link := r.memberPath(r.pathOf(rootOutboxIRI), misplaced)
+	rel, _ := filepath.Rel(filepath.Dir(link), "example.com/misplaced")
+	if err := os.Symlink(rel, filepath.Join(dir, link)); err != nil {
+		t.Fatalf("unable to link the misplaced object: %s", err)
+	}
+	if err := putRaw(r.root, "example.com/ghost/__meta_data", []byte("{}")); err != nil {
+		t.Fatalf("unable to write orphaned metadata: %s", err)
+	}
+	if err := putRaw(r.root, "example.com/.__raw.tmp-1", []byte("{}")); err != nil {
+		t.Fatalf("unable to write a temporary file: %s", err)
+	}
+	if _, err := save(r, &vocab.OrderedCollection{ID: rootOutboxIRI, Type: vocab.OrderedCollectionType, TotalItems: 5}); err != nil {
+		t.Fatalf("unable to save the outbox: %s", err)
+	}
+	if err := r.SaveAccess(mockAccess("access-666", &osin.DefaultClient{Id: "missing-client"})); err != nil {
+		t.Fatalf("SaveAccess() error = %s", err)
+	}
+
+	report, err := r.Check(CheckOptions{})
+	if err != nil {
+		t.Fatalf("Check() error = %s", err)
+	}
+	want := map[Problem]int{
+		ProblemTempFile:         1,
+		ProblemOrphanedMetadata: 1,
+		ProblemUndecodable:      1,
+		ProblemMisplaced:        1,
+		ProblemDanglingLink:     1,
+		ProblemTotalItems:       1,
+		ProblemOrphanedToken:    1,
+	}
+	if got := countProblems(report.Issues); len(got) != len(want) {
+		t.Errorf("Check() problems = %v, want %v", got, want)
+	} else {
+		for problem, count := range want {
+			if got[problem] != count {
+				t.Errorf("Check() %s problems = %d, want %d", problem, got[problem], count)
+			}
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "example.com", "broken", "__raw")); err != nil {
+		t.Errorf("Check() without Fix changed the storage: %s", err)
+	}
+
+	if report, err = r.Check(CheckOptions{Fix: true}); err != nil {
+		t.Fatalf("Check() with Fix error = %s", err)
+	}
+	for _, issue := range report.Issues {
+		if !issue.Fixed {
+			t.Errorf("Check() didn't fix %s", issue)
+		}
+	}
+	if got := countProblems(report.Issues)[ProblemOrphanedToken]; got != 2 {
+		t.Errorf("Check() with Fix orphaned tokens = %d, want the access and its refresh token", got)
+	}
+
+	if report, err = r.Check(CheckOptions{}); err != nil || len(report.Issues) > 0 {
+		t.Errorf("Check() after Fix = %v, %v, want no issues", report.Issues, err)
+	}
+	if _, err = r.Load(misplaced.GetLink()); err != nil {
+		t.Errorf("Load() of the moved object error = %s", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, _quarantineDirName)); len(entries) != 2 {
+		t.Errorf("quarantined files = %d, want 2", len(entries))
+	}
+	if got := outboxItems(t, r); len(got) != len(activities)+1 || !got.Contains(misplaced.GetLink()) {
+		t.Errorf("outbox items after Fix = %v, want %d items, with the moved object", got, len(activities)+1)
+	}
+}
+
+func Test_repo_Check_index(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+	}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir), index: newBitmap(index.ByID, index.ByType)}, withGeneratedItems(activities))
+
+	unindexed := r.pathOf(activities[0].GetLink())
+	for ref, p := range r.index.ref {
+		if p == unindexed {
+			delete(r.index.ref, ref)
+		}
+	}
+	r.index.ref[42] = "example.com/gone"
+	if err := r.saveIndex(); err != nil {
+		t.Fatalf("saveIndex() error = %s", err)
+	}
+
+	report, err := r.Check(CheckOptions{Fix: true})
+	if err != nil {
+		t.Fatalf("Check() error = %s", err)
+	}
+	if got := countProblems(report.Issues)[ProblemIndexDrift]; got != 2 || len(report.Issues) != 2 {
+		t.Errorf("Check() issues = %v, want a stale and a missing index entry", report.Issues)
+	}
+	if report, err = r.Check(CheckOptions{}); err != nil || len(report.Issues) > 0 {
+		t.Errorf("Check() after Fix = %v, %v, want no issues", report.Issues, err)
+	}
+}
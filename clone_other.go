@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fs
+
+import (
+	"os"
+
+	"github.com/go-ap/errors"
+)
+
+// cloneFile makes dst a reflink copy of src, on the filesystems which support it.
+func cloneFile(dst, src *os.File) error {
+	return errors.NotImplementedf("file cloning is not supported")
+}
@@ -0,0 +1,956 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/valyala/fastjson"
+)
+
+// Codec transforms the JSON documents the repository works with to the format they get stored in.
+//
+// The metadata is always marshaled to JSON first, and the loaded files are transformed back to JSON
+// before being matched by the raw filters. The items are handled the same way, unless the codec is
+// also an ItemCodec.
+type Codec interface {
+	// Format is the marker written at the beginning of the encoded files, it must be unique.
+	Format() byte
+	// Encode transforms the data JSON document to the codec format.
+	Encode(data []byte) ([]byte, error)
+	// Decode transforms data from the codec format back to JSON.
+	Decode(data []byte) ([]byte, error)
+}
+
+// ItemCodec is a Codec which can encode and decode the items directly, without the loaded items
+// going through their JSON document.
+// The built-in binary codecs implement it.
+type ItemCodec interface {
+	Codec
+	// EncodeItem transforms it to the codec format.
+	EncodeItem(it vocab.Item) ([]byte, error)
+	// DecodeItem loads the item stored in data, in the codec format.
+	DecodeItem(data []byte) (vocab.Item, error)
+}
+
+// rawMarker is the first byte of the files that are not stored as JSON.
+// It is followed by the Format of the Codec used for encoding them.
+const rawMarker = 0x00
+
+const (
+	FormatJSON byte = iota
+	FormatCBOR
+	FormatMsgPack
+)
+
+var (
+	JSONCodec    Codec = jsonCodec{}
+	CBORCodec    Codec = cborCodec{}
+	MsgPackCodec Codec = msgpackCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[byte]Codec{
+		FormatJSON:    JSONCodec,
+		FormatCBOR:    CBORCodec,
+		FormatMsgPack: MsgPackCodec,
+	}
+)
+
+// RegisterCodec makes c available for decoding the files it encoded.
+// The built-in codecs are registered by default.
+func RegisterCodec(c Codec) error {
+	if c == nil {
+		return errors.Newf("nil codec")
+	}
+	if c.Format() == FormatEncrypted {
+		return errors.Newf("format %d is reserved for the encrypted files", c.Format())
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecs[c.Format()]; ok {
+		return errors.Conflictf("a codec for format %d is already registered", c.Format())
+	}
+	codecs[c.Format()] = c
+	return nil
+}
+
+func codecFor(format byte) (Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[format]
+	return c, ok
+}
+
+// wrapRaw encodes the data JSON document with c, and prefixes it with the format marker.
+// The JSON documents are stored unchanged.
+func wrapRaw(c Codec, data []byte) ([]byte, error) {
+	if c == nil || c.Format() == FormatJSON {
+		return data, nil
+	}
+	enc, err := c.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat([]byte{rawMarker, c.Format()}, enc), nil
+}
+
+// unwrapRaw returns the JSON document stored in raw, decompressing it if needed, and decoding it
+// with the codec from its format marker.
+func unwrapRaw(raw []byte) ([]byte, error) {
+	raw, err := decompressRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 2 || raw[0] != rawMarker {
+		return raw, nil
+	}
+	if isEncrypted(raw) {
+		return nil, errEncrypted
+	}
+	c, ok := codecFor(raw[1])
+	if !ok {
+		return nil, errors.Newf("unknown storage format %d", raw[1])
+	}
+	return c.Decode(raw[2:])
+}
+
+// rawFormat returns the format of the raw file contents.
+func rawFormat(raw []byte) byte {
+	if len(raw) < 2 || raw[0] != rawMarker {
+		return FormatJSON
+	}
+	return raw[1]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Format() byte {
+	return FormatJSON
+}
+
+func (jsonCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (jsonCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// decodeJSONValue unmarshals data to generic values.
+// The numbers are kept as json.Number, so integers don't lose precision.
+func decodeJSONValue(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// encodeJSONValue marshals a generic value back to JSON.
+func encodeJSONValue(v any) ([]byte, error) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+var (
+	// parsers read the JSON documents encoded by the binary codecs.
+	parsers fastjson.ParserPool
+	// arenas hold the values decoded by the binary codecs, until they get marshaled to JSON.
+	arenas fastjson.ArenaPool
+)
+
+// valueDecoder reads a value of a binary codec, allocating it in a.
+type valueDecoder func(r *binReader, a *fastjson.Arena) (*fastjson.Value, error)
+
+// encodeBinary parses the data JSON document and encodes it with enc.
+func encodeBinary(data []byte, enc func(*bytes.Buffer, *fastjson.Value) error) ([]byte, error) {
+	p := parsers.Get()
+	defer parsers.Put(p)
+
+	v, err := p.ParseBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err = enc(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeBinaryItem marshals it and encodes it with enc.
+func encodeBinaryItem(it vocab.Item, enc func(*bytes.Buffer, *fastjson.Value) error) ([]byte, error) {
+	data, err := encodeItemFn(it)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBinary(data, enc)
+}
+
+// decodeBinary decodes data with dec, and marshals the result to JSON.
+func decodeBinary(data []byte, dec valueDecoder) ([]byte, error) {
+	a := arenas.Get()
+	defer arenas.Put(a)
+
+	v, err := dec(&binReader{data: data}, a)
+	if err != nil {
+		return nil, err
+	}
+	return v.MarshalTo(nil), nil
+}
+
+// decodeBinaryItem decodes data with dec, and loads the item from the decoded values directly,
+// without marshaling them to JSON and parsing them back.
+func decodeBinaryItem(data []byte, dec valueDecoder) (vocab.Item, error) {
+	// NOTE(marius): the arena is not reused, as the loaded item can keep references to the values in it
+	v, err := dec(&binReader{data: data}, new(fastjson.Arena))
+	if err != nil {
+		return nil, err
+	}
+	return vocab.JSONLoadItem(v)
+}
+
+// field is a member of a JSON object.
+type field struct {
+	key string
+	v   *fastjson.Value
+}
+
+// sortedFields returns the members of o, sorted by their keys.
+func sortedFields(o *fastjson.Object) []field {
+	fields := make([]field, 0, o.Len())
+	o.Visit(func(k []byte, v *fastjson.Value) {
+		fields = append(fields, field{key: string(k), v: v})
+	})
+	slices.SortStableFunc(fields, func(a, b field) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return fields
+}
+
+// stringValue allocates s in a.
+// The arena escapes some strings in ways which JSON unescaping doesn't reverse, like the invalid UTF-8
+// and the control characters without a short escape, so those are parsed from their JSON encoding instead.
+func stringValue(a *fastjson.Arena, s []byte) (*fastjson.Value, error) {
+	if !needsQuoting(s) {
+		return a.NewStringBytes(s), nil
+	}
+	q, err := json.Marshal(string(s))
+	if err != nil {
+		return nil, err
+	}
+	return fastjson.ParseBytes(q)
+}
+
+func needsQuoting(s []byte) bool {
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if (c < 0x20 || c == 0x7f) && c != '\b' && c != '\f' && c != '\n' && c != '\r' && c != '\t' {
+				return true
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(s[i:])
+		if (r == utf8.RuneError && size == 1) || (r > 0xffff && !strconv.IsPrint(r)) {
+			return true
+		}
+		i += size
+	}
+	return false
+}
+
+// floatValue allocates f in a. JSON has no representation for the infinities and NaN.
+func floatValue(a *fastjson.Arena, f float64) (*fastjson.Value, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return nil, errors.Newf("unsupported value %v", f)
+	}
+	return a.NewNumberFloat64(f), nil
+}
+
+// intValue allocates n in a.
+func intValue(a *fastjson.Arena, n int64) *fastjson.Value {
+	if n == int64(int(n)) {
+		return a.NewNumberInt(int(n))
+	}
+	return a.NewNumberString(strconv.FormatInt(n, 10))
+}
+
+var errTruncated = errors.Newf("truncated data")
+
+// binReader reads the values of the binary codecs.
+type binReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *binReader) next(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *binReader) readByte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (r *binReader) readUint(size int) (uint64, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (r *binReader) readLength(size int) (int, error) {
+	n, err := r.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		// NOTE(marius): every element takes at least one byte, so this can't be a valid length
+		return 0, errTruncated
+	}
+	return int(n), nil
+}
+
+// cborCodec stores the documents as CBOR (RFC 8949).
+type cborCodec struct{}
+
+func (cborCodec) Format() byte {
+	return FormatCBOR
+}
+
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func cborEncode(buf *bytes.Buffer, v *fastjson.Value) error {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		buf.WriteByte(0xf6)
+	case fastjson.TypeTrue:
+		buf.WriteByte(0xf5)
+	case fastjson.TypeFalse:
+		buf.WriteByte(0xf4)
+	case fastjson.TypeNumber:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 {
+				cborHead(buf, 0, uint64(i))
+			} else {
+				cborHead(buf, 1, uint64(-1-i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xfb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case fastjson.TypeString:
+		s, _ := v.StringBytes()
+		cborHead(buf, 3, uint64(len(s)))
+		buf.Write(s)
+	case fastjson.TypeArray:
+		arr, _ := v.Array()
+		cborHead(buf, 4, uint64(len(arr)))
+		for _, el := range arr {
+			if err := cborEncode(buf, el); err != nil {
+				return err
+			}
+		}
+	case fastjson.TypeObject:
+		o, _ := v.Object()
+		cborHead(buf, 5, uint64(o.Len()))
+		for _, f := range sortedFields(o) {
+			cborHead(buf, 3, uint64(len(f.key)))
+			buf.WriteString(f.key)
+			if err := cborEncode(buf, f.v); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Newf("unsupported value %s", v.Type())
+	}
+	return nil
+}
+
+// cborArgument reads the argument of a data item, from the additional information of its head.
+func cborArgument(r *binReader, info byte) (uint64, error) {
+	switch {
+	case info < 24:
+		return uint64(info), nil
+	case info <= 27:
+		return r.readUint(1 << (info - 24))
+	}
+	return 0, errors.Newf("unsupported CBOR length %d", info)
+}
+
+func cborKey(r *binReader) (string, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	if major := b >> 5; major != 3 {
+		return "", errors.Newf("unsupported CBOR map key type %d", major)
+	}
+	n, err := cborArgument(r, b&0x1f)
+	if err != nil {
+		return "", err
+	}
+	s, err := r.next(int(min(n, math.MaxInt32)))
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func cborDecode(r *binReader, a *fastjson.Arena) (*fastjson.Value, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+	if major == 7 {
+		switch info {
+		case 20:
+			return a.NewFalse(), nil
+		case 21:
+			return a.NewTrue(), nil
+		case 22, 23:
+			return a.NewNull(), nil
+		case 25:
+			h, err := r.readUint(2)
+			if err != nil {
+				return nil, err
+			}
+			return floatValue(a, float16(uint16(h)))
+		case 26:
+			f, err := r.readUint(4)
+			if err != nil {
+				return nil, err
+			}
+			return floatValue(a, float64(math.Float32frombits(uint32(f))))
+		case 27:
+			f, err := r.readUint(8)
+			if err != nil {
+				return nil, err
+			}
+			return floatValue(a, math.Float64frombits(f))
+		}
+		return nil, errors.Newf("unsupported CBOR simple value %d", info)
+	}
+
+	n, err := cborArgument(r, info)
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return a.NewNumberString(strconv.FormatUint(n, 10)), nil
+		}
+		return intValue(a, int64(n)), nil
+	case 1:
+		if n > math.MaxInt64 {
+			return floatValue(a, -1-float64(n))
+		}
+		return intValue(a, -1-int64(n)), nil
+	case 3:
+		s, err := r.next(int(min(n, math.MaxInt32)))
+		if err != nil {
+			return nil, err
+		}
+		return stringValue(a, s)
+	case 4:
+		if n > uint64(len(r.data)) {
+			return nil, errTruncated
+		}
+		arr := a.NewArray()
+		for i := range int(n) {
+			el, err := cborDecode(r, a)
+			if err != nil {
+				return nil, err
+			}
+			arr.SetArrayItem(i, el)
+		}
+		return arr, nil
+	case 5:
+		if n > uint64(len(r.data)) {
+			return nil, errTruncated
+		}
+		obj := a.NewObject()
+		for range n {
+			key, err := cborKey(r)
+			if err != nil {
+				return nil, err
+			}
+			val, err := cborDecode(r, a)
+			if err != nil {
+				return nil, err
+			}
+			obj.Set(key, val)
+		}
+		return obj, nil
+	}
+	return nil, errors.Newf("unsupported CBOR major type %d", major)
+}
+
+// float16 converts an IEEE 754 half precision value.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+func (cborCodec) Encode(data []byte) ([]byte, error) {
+	return encodeBinary(data, cborEncode)
+}
+
+func (cborCodec) Decode(data []byte) ([]byte, error) {
+	raw, err := decodeBinary(data, cborDecode)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid CBOR data")
+	}
+	return raw, nil
+}
+
+func (cborCodec) EncodeItem(it vocab.Item) ([]byte, error) {
+	return encodeBinaryItem(it, cborEncode)
+}
+
+func (cborCodec) DecodeItem(data []byte) (vocab.Item, error) {
+	it, err := decodeBinaryItem(data, cborDecode)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid CBOR data")
+	}
+	return it, nil
+}
+
+// msgpackCodec stores the documents as MessagePack.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Format() byte {
+	return FormatMsgPack
+}
+
+func msgpackHead(buf *bytes.Buffer, fix byte, fixMax int, codes [3]byte, n int) {
+	switch {
+	case n < fixMax:
+		buf.WriteByte(fix | byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		buf.WriteByte(codes[0])
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(codes[1])
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(codes[2])
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func msgpackEncode(buf *bytes.Buffer, v *fastjson.Value) error {
+	switch v.Type() {
+	case fastjson.TypeNull:
+		buf.WriteByte(0xc0)
+	case fastjson.TypeTrue:
+		buf.WriteByte(0xc3)
+	case fastjson.TypeFalse:
+		buf.WriteByte(0xc2)
+	case fastjson.TypeNumber:
+		if i, err := v.Int64(); err == nil {
+			switch {
+			case i >= 0 && i < 128:
+				buf.WriteByte(byte(i))
+			case i < 0 && i >= -32:
+				buf.WriteByte(byte(int8(i)))
+			default:
+				buf.WriteByte(0xd3)
+				buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+	case fastjson.TypeString:
+		s, _ := v.StringBytes()
+		msgpackHead(buf, 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb}, len(s))
+		buf.Write(s)
+	case fastjson.TypeArray:
+		arr, _ := v.Array()
+		msgpackHead(buf, 0x90, 16, [3]byte{0, 0xdc, 0xdd}, len(arr))
+		for _, el := range arr {
+			if err := msgpackEncode(buf, el); err != nil {
+				return err
+			}
+		}
+	case fastjson.TypeObject:
+		o, _ := v.Object()
+		msgpackHead(buf, 0x80, 16, [3]byte{0, 0xde, 0xdf}, o.Len())
+		for _, f := range sortedFields(o) {
+			msgpackHead(buf, 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb}, len(f.key))
+			buf.WriteString(f.key)
+			if err := msgpackEncode(buf, f.v); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Newf("unsupported value %s", v.Type())
+	}
+	return nil
+}
+
+func msgpackArray(r *binReader, a *fastjson.Arena, n int) (*fastjson.Value, error) {
+	arr := a.NewArray()
+	for i := range n {
+		el, err := msgpackDecode(r, a)
+		if err != nil {
+			return nil, err
+		}
+		arr.SetArrayItem(i, el)
+	}
+	return arr, nil
+}
+
+func msgpackMap(r *binReader, a *fastjson.Arena, n int) (*fastjson.Value, error) {
+	obj := a.NewObject()
+	for range n {
+		key, err := msgpackKey(r)
+		if err != nil {
+			return nil, err
+		}
+		val, err := msgpackDecode(r, a)
+		if err != nil {
+			return nil, err
+		}
+		obj.Set(key, val)
+	}
+	return obj, nil
+}
+
+func msgpackKey(r *binReader) (string, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9 || b == 0xda || b == 0xdb:
+		if n, err = r.readLength(1 << (b - 0xd9)); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.Newf("unsupported MessagePack map key type %#x", b)
+	}
+	s, err := r.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func msgpackDecode(r *binReader, a *fastjson.Arena) (*fastjson.Value, error) {
+	b, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b < 0x80:
+		return a.NewNumberInt(int(b)), nil
+	case b >= 0xe0:
+		return a.NewNumberInt(int(int8(b))), nil
+	case b&0xe0 == 0xa0:
+		s, err := r.next(int(b & 0x1f))
+		if err != nil {
+			return nil, err
+		}
+		return stringValue(a, s)
+	case b&0xf0 == 0x90:
+		return msgpackArray(r, a, int(b&0x0f))
+	case b&0xf0 == 0x80:
+		return msgpackMap(r, a, int(b&0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return a.NewNull(), nil
+	case 0xc2:
+		return a.NewFalse(), nil
+	case 0xc3:
+		return a.NewTrue(), nil
+	case 0xca:
+		f, err := r.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return floatValue(a, float64(math.Float32frombits(uint32(f))))
+	case 0xcb:
+		f, err := r.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return floatValue(a, math.Float64frombits(f))
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.readUint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if u > math.MaxInt64 {
+			return a.NewNumberString(strconv.FormatUint(u, 10)), nil
+		}
+		return intValue(a, int64(u)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := r.readUint(size)
+		if err != nil {
+			return nil, err
+		}
+		// NOTE(marius): sign extend the value from its encoded size
+		shift := 64 - 8*size
+		return intValue(a, int64(u<<shift)>>shift), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.readLength(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := r.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return stringValue(a, s)
+	case 0xdc, 0xdd:
+		n, err := r.readLength(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackArray(r, a, n)
+	case 0xde, 0xdf:
+		n, err := r.readLength(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return msgpackMap(r, a, n)
+	}
+	return nil, errors.Newf("unsupported MessagePack type %#x", b)
+}
+
+func (msgpackCodec) Encode(data []byte) ([]byte, error) {
+	return encodeBinary(data, msgpackEncode)
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	raw, err := decodeBinary(data, msgpackDecode)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid MessagePack data")
+	}
+	return raw, nil
+}
+
+func (msgpackCodec) EncodeItem(it vocab.Item) ([]byte, error) {
+	return encodeBinaryItem(it, msgpackEncode)
+}
+
+func (msgpackCodec) DecodeItem(data []byte) (vocab.Item, error) {
+	it, err := decodeBinaryItem(data, msgpackDecode)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid MessagePack data")
+	}
+	return it, nil
+}
+
+// encodeRaw encodes the data JSON document with the codec of the repository.
+func (r *repo) encodeRaw(data []byte) ([]byte, error) {
+	return wrapRaw(r.codec, data)
+}
+
+// encodeItem marshals it in the format of the repository's codec.
+func (r *repo) encodeItem(it vocab.Item) ([]byte, error) {
+	c, ok := r.codec.(ItemCodec)
+	if !ok || c.Format() == FormatJSON {
+		data, err := encodeItemFn(it)
+		if err != nil {
+			return nil, err
+		}
+		return r.encodeRaw(data)
+	}
+	enc, err := c.EncodeItem(it)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat([]byte{rawMarker, c.Format()}, enc), nil
+}
+
+// decodeItem loads the item stored in raw, decompressing it if needed.
+// The items stored by an ItemCodec are decoded by it, the rest are unmarshaled from their JSON document.
+func decodeItem(raw []byte) (vocab.Item, error) {
+	raw, err := decompressRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	if format := rawFormat(raw); format != FormatJSON && !isEncrypted(raw) {
+		if c, ok := codecFor(format); ok {
+			if ic, ok := c.(ItemCodec); ok {
+				return ic.DecodeItem(raw[2:])
+			}
+		}
+	}
+	data, err := unwrapRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	return itemFromRaw(data)
+}
+
+// loadItemRaw loads the item stored at itPath.
+func loadItemRaw(root *os.Root, itPath string) (vocab.Item, error) {
+	raw, err := readRaw(root, itPath)
+	if err != nil {
+		return nil, err
+	}
+	return decodeItem(raw)
+}
+
+// Recode encodes all the objects and metadata files in the storage with c, and uses it for
+// the subsequent writes. The files already stored with c are skipped.
+// It returns the number of files that were re-encoded.
+func (r *repo) Recode(c Codec) (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	if c == nil {
+		c = JSONCodec
+	}
+	if _, ok := codecFor(c.Format()); !ok {
+		return 0, errors.Newf("codec for format %d is not registered", c.Format())
+	}
+
+	count := 0
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || d.Name() == folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != objectKey && d.Name() != metaDataKey {
+			return nil
+		}
+		raw, err := readRaw(r.root, p)
+		if err != nil {
+			return err
+		}
+		if raw, err = decompressRaw(raw); err != nil {
+			return errors.Annotatef(err, "unable to decompress %s", p)
+		}
+		if raw, err = r.decrypt(raw); err != nil {
+			return errors.Annotatef(err, "unable to decrypt %s", p)
+		}
+		if rawFormat(raw) == c.Format() {
+			return nil
+		}
+		data, err := unwrapRaw(raw)
+		if err != nil {
+			return errors.Annotatef(err, "unable to decode %s", p)
+		}
+		if raw, err = wrapRaw(c, data); err != nil {
+			return errors.Annotatef(err, "unable to encode %s", p)
+		}
+		if d.Name() == objectKey {
+			if raw, err = r.compressObject(raw); err != nil {
+				return errors.Annotatef(err, "unable to compress %s", p)
+			}
+		} else if raw, err = r.encrypt(raw); err != nil {
+			return errors.Annotatef(err, "unable to encrypt %s", p)
+		}
+		if err = putRaw(r.root, filepath.Clean(p), raw); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	r.codec = c
+	return count, nil
+}
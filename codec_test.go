@@ -0,0 +1,214 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func TestCodec_Encode(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		doc   string
+		want  string
+	}{
+		{
+			name:  "json",
+			codec: JSONCodec,
+			doc:   `{"a":1,"b":[2,3]}`,
+			want:  hex.EncodeToString([]byte(`{"a":1,"b":[2,3]}`)),
+		},
+		{
+			name:  "cbor",
+			codec: CBORCodec,
+			doc:   `{"a":1,"b":[2,3]}`,
+			want:  "a26161016162820203",
+		},
+		{
+			name:  "msgpack",
+			codec: MsgPackCodec,
+			doc:   `{"compact":true,"schema":0}`,
+			want:  "82a7636f6d70616374c3a6736368656d6100",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.codec.Encode([]byte(tt.doc))
+			if err != nil {
+				t.Fatalf("Encode() error = %s", err)
+			}
+			if hex.EncodeToString(got) != tt.want {
+				t.Errorf("Encode() = %x, want %s", got, tt.want)
+			}
+			back, err := tt.codec.Decode(got)
+			if err != nil {
+				t.Fatalf("Decode() error = %s", err)
+			}
+			if string(back) != tt.doc {
+				t.Errorf("Decode() = %s, want %s", back, tt.doc)
+			}
+		})
+	}
+}
+
+func Test_unwrapRaw(t *testing.T) {
+	// NOTE(marius): the binary codecs sort the keys, so the document needs them sorted to compare equal
+	doc := []byte(`{"c":"a\t\"quoted\" \u0001 string","f":0.25,"id":"https://example.com/1","n":-40000000000,"s":null,"type":"Note"}`)
+	for _, c := range []Codec{JSONCodec, CBORCodec, MsgPackCodec} {
+		raw, err := wrapRaw(c, doc)
+		if err != nil {
+			t.Fatalf("wrapRaw() error = %s", err)
+		}
+		if got := rawFormat(raw); got != c.Format() {
+			t.Errorf("rawFormat() = %d, want %d", got, c.Format())
+		}
+		got, err := unwrapRaw(raw)
+		if err != nil {
+			t.Fatalf("unwrapRaw() error = %s", err)
+		}
+		if !bytes.Equal(got, doc) {
+			t.Errorf("unwrapRaw() = %s, want %s", got, doc)
+		}
+	}
+	if _, err := unwrapRaw([]byte{rawMarker, 0xff, 0x01}); err == nil {
+		t.Errorf("unwrapRaw() with unknown format should return an error")
+	}
+}
+
+func Test_repo_Recode(t *testing.T) {
+	items := vocab.ItemCollection{
+		&vocab.Object{ID: "https://example.com/objects/1", Type: vocab.NoteType, Content: vocab.DefaultNaturalLanguage("one")},
+		&vocab.Object{ID: "https://example.com/objects/2", Type: vocab.NoteType, Content: vocab.DefaultNaturalLanguage("two")},
+	}
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)}, withItems(items...))
+
+	for _, c := range []Codec{CBORCodec, MsgPackCodec, JSONCodec} {
+		count, err := r.Recode(c)
+		if err != nil {
+			t.Fatalf("Recode() error = %s", err)
+		}
+		if count != len(items) {
+			t.Errorf("Recode() re-encoded %d files, want %d", count, len(items))
+		}
+		for _, it := range items {
+			raw, err := readRaw(r.root, getObjectKey(iriPath(it.GetLink())))
+			if err != nil {
+				t.Fatalf("readRaw() error = %s", err)
+			}
+			if got := rawFormat(raw); got != c.Format() {
+				t.Errorf("stored format = %d, want %d", got, c.Format())
+			}
+			loaded, err := r.Load(it.GetLink())
+			if err != nil {
+				t.Fatalf("Load() error = %s", err)
+			}
+			if !loaded.GetLink().Equals(it.GetLink(), true) {
+				t.Errorf("Load() = %s, want %s", loaded.GetLink(), it.GetLink())
+			}
+		}
+	}
+
+	if _, err := save(r, &vocab.Object{ID: "https://example.com/objects/3", Type: vocab.NoteType}); err != nil {
+		t.Fatalf("save() error = %s", err)
+	}
+	if count, _ := r.Recode(JSONCodec); count != 0 {
+		t.Errorf("Recode() with the current codec re-encoded %d files, want 0", count)
+	}
+}
+
+func mockCodecItem() vocab.Item {
+	return &vocab.Object{
+		ID:           "https://example.com/objects/1",
+		Type:         vocab.NoteType,
+		AttributedTo: vocab.IRI("https://example.com/~jdoe"),
+		To:           vocab.ItemCollection{vocab.PublicNS, vocab.IRI("https://example.com/~jdoe/followers")},
+		Name:         vocab.DefaultNaturalLanguage("A \"quoted\" name\twith a \x01 control character"),
+		Content:      vocab.DefaultNaturalLanguage("<p>Some content, with a #hashtag and a @mention.</p>"),
+		Tag: vocab.ItemCollection{
+			&vocab.Object{ID: "https://example.com/tags/hashtag", Type: vocab.ObjectType, Name: vocab.DefaultNaturalLanguage("#hashtag")},
+		},
+	}
+}
+
+func TestItemCodec(t *testing.T) {
+	it := mockCodecItem()
+	want, err := encodeItemFn(it)
+	if err != nil {
+		t.Fatalf("encodeItemFn() error = %s", err)
+	}
+	for _, c := range []ItemCodec{CBORCodec.(ItemCodec), MsgPackCodec.(ItemCodec)} {
+		data, err := c.EncodeItem(it)
+		if err != nil {
+			t.Fatalf("EncodeItem() error = %s", err)
+		}
+		loaded, err := c.DecodeItem(data)
+		if err != nil {
+			t.Fatalf("DecodeItem() error = %s", err)
+		}
+		got, err := encodeItemFn(loaded)
+		if err != nil {
+			t.Fatalf("encodeItemFn() error = %s", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("DecodeItem() = %s, want %s", got, want)
+		}
+
+		r := repo{codec: c}
+		raw, err := r.encodeItem(it)
+		if err != nil {
+			t.Fatalf("encodeItem() error = %s", err)
+		}
+		if got := rawFormat(raw); got != c.Format() {
+			t.Errorf("encodeItem() format = %d, want %d", got, c.Format())
+		}
+		if loaded, err = decodeItem(raw); err != nil || !loaded.GetLink().Equals(it.GetLink(), true) {
+			t.Errorf("decodeItem() = %v, %v, want %s", loaded, err, it.GetLink())
+		}
+		if _, err = c.DecodeItem(data[:len(data)/2]); err == nil {
+			t.Errorf("DecodeItem() of truncated data should return an error")
+		}
+	}
+}
+
+func Benchmark_ItemCodec_Decode(b *testing.B) {
+	it := mockCodecItem()
+	doc, err := encodeItemFn(it)
+	if err != nil {
+		b.Fatalf("encodeItemFn() error = %s", err)
+	}
+	b.Run("json", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := decodeItemFn(doc); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for name, c := range map[string]ItemCodec{"cbor": CBORCodec.(ItemCodec), "msgpack": MsgPackCodec.(ItemCodec)} {
+		data, err := c.Encode(doc)
+		if err != nil {
+			b.Fatalf("Encode() error = %s", err)
+		}
+		b.Run(name+"/through json", func(b *testing.B) {
+			for b.Loop() {
+				raw, err := c.Decode(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = decodeItemFn(raw); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(name+"/direct", func(b *testing.B) {
+			for b.Loop() {
+				if _, err := c.DecodeItem(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
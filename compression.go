@@ -0,0 +1,105 @@
+package fs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/go-ap/errors"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used for compressing the stored objects.
+type Compression uint8
+
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+)
+
+// defaultCompressionMinSize is the size under which compressing an object doesn't save
+// enough space to be worth it.
+const defaultCompressionMinSize = 1024
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isCompressed checks if raw starts with the gzip or the zstd magic bytes.
+// Neither JSON nor the format marker of the other codecs can start with them.
+func isCompressed(raw []byte) bool {
+	return bytes.HasPrefix(raw, gzipMagic) || bytes.HasPrefix(raw, zstdMagic)
+}
+
+// The zstd encoder and decoder are safe for concurrent use, when compressing whole buffers.
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil)
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil)
+	})
+)
+
+func compressRaw(c Compression, raw []byte) ([]byte, error) {
+	if c == CompressionZstd {
+		enc, err := zstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(raw, nil), nil
+	}
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressRaw returns the uncompressed contents of raw, or raw itself if it's not compressed.
+func decompressRaw(raw []byte) ([]byte, error) {
+	if !isCompressed(raw) {
+		return raw, nil
+	}
+	if bytes.HasPrefix(raw, zstdMagic) {
+		dec, err := zstdDecoder()
+		if err != nil {
+			return nil, err
+		}
+		if raw, err = dec.DecodeAll(raw, nil); err != nil {
+			return nil, errors.Annotatef(err, "invalid compressed data")
+		}
+		return raw, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid compressed data")
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	return io.ReadAll(r)
+}
+
+// compressObject compresses the raw contents of an object, if compression is enabled for the
+// repository and the object is large enough.
+func (r *repo) compressObject(raw []byte) ([]byte, error) {
+	if r.compression != CompressionGzip && r.compression != CompressionZstd {
+		return raw, nil
+	}
+	minSize := r.compressionMinSize
+	if minSize <= 0 {
+		minSize = defaultCompressionMinSize
+	}
+	if len(raw) < minSize {
+		return raw, nil
+	}
+	return compressRaw(r.compression, raw)
+}
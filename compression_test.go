@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_repo_compressObject(t *testing.T) {
+	small := []byte(`{"id":"https://example.com/1"}`)
+	large := []byte(`{"content":"` + strings.Repeat("lorem ipsum ", 200) + `"}`)
+
+	tests := []struct {
+		name           string
+		compression    Compression
+		minSize        int
+		raw            []byte
+		wantCompressed bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "disabled",
+			raw:  large,
+		},
+		{
+			name:        "under the default min size",
+			compression: CompressionGzip,
+			raw:         small,
+		},
+		{
+			name:           "over the default min size",
+			compression:    CompressionGzip,
+			raw:            large,
+			wantCompressed: true,
+		},
+		{
+			name:           "custom min size",
+			compression:    CompressionGzip,
+			minSize:        1,
+			raw:            small,
+			wantCompressed: true,
+		},
+		{
+			name:           "zstd",
+			compression:    CompressionZstd,
+			raw:            large,
+			wantCompressed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &repo{compression: tt.compression, compressionMinSize: tt.minSize}
+			got, err := r.compressObject(tt.raw)
+			if err != nil {
+				t.Fatalf("compressObject() error = %s", err)
+			}
+			if isCompressed(got) != tt.wantCompressed {
+				t.Errorf("compressObject() compressed = %t, want %t", isCompressed(got), tt.wantCompressed)
+			}
+			back, err := decompressRaw(got)
+			if err != nil {
+				t.Fatalf("decompressRaw() error = %s", err)
+			}
+			if !bytes.Equal(back, tt.raw) {
+				t.Errorf("decompressRaw() = %s, want %s", back, tt.raw)
+			}
+		})
+	}
+}
+
+func Test_repo_loadCompressed(t *testing.T) {
+	ob := &vocab.Object{ID: "https://example.com/objects/1", Type: vocab.NoteType, Content: vocab.DefaultNaturalLanguage("compressed")}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)})
+	r.codec = CBORCodec
+	r.compression = CompressionGzip
+	r.compressionMinSize = 1
+
+	if _, err := save(r, ob); err != nil {
+		t.Fatalf("save() error = %s", err)
+	}
+	raw, err := readRaw(r.root, getObjectKey(iriPath(ob.ID)))
+	if err != nil {
+		t.Fatalf("readRaw() error = %s", err)
+	}
+	if !isCompressed(raw) {
+		t.Errorf("the object was not stored compressed")
+	}
+	data, err := loadRaw(r.root, getObjectKey(iriPath(ob.ID)))
+	if err != nil {
+		t.Fatalf("loadRaw() error = %s", err)
+	}
+	if !bytes.Contains(data, []byte(`"compressed"`)) {
+		t.Errorf("loadRaw() = %s, want the JSON document", data)
+	}
+	it, err := r.Load(ob.ID)
+	if err != nil {
+		t.Fatalf("Load() error = %s", err)
+	}
+	if !it.GetLink().Equals(ob.ID, true) {
+		t.Errorf("Load() = %s, want %s", it.GetLink(), ob.ID)
+	}
+}
@@ -0,0 +1,139 @@
+package fs
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+// MinCustomIndexType is the lowest index type that can be used by a CustomIndex.
+// The types below it are reserved for the filters/index package and for this package.
+const MinCustomIndexType index.Type = 96
+
+// CustomIndex describes an application defined index, built from the values returned by Extract.
+//
+// By default, the values get stored in a token index maintained by the repository. An application
+// that needs a different structure can provide its own index.Indexable through New, together with
+// a Search function that resolves the filter values against it.
+type CustomIndex struct {
+	// Type identifies the index. It must be unique and not lower than MinCustomIndexType.
+	Type index.Type
+	// Key is the name under which the index gets persisted in the index directory.
+	Key string
+	// Extract returns the values of the item that get indexed.
+	Extract func(vocab.LinkOrIRI) []string
+	// New returns an empty index. It is optional, and the index it returns must be encodable with encoding/gob.
+	New func() index.Indexable
+	// Search returns the references of the items matching any of the values.
+	// It is required when New is set.
+	Search func(idx index.Indexable, values ...string) *roaring64.Bitmap
+}
+
+var customIndexes = struct {
+	sync.RWMutex
+	m map[index.Type]CustomIndex
+}{m: make(map[index.Type]CustomIndex)}
+
+// RegisterIndex makes the ci custom index available to the repositories.
+// The index still needs to be enabled through Config.Indexes.
+// It should be called before opening the repositories that use it.
+func RegisterIndex(ci CustomIndex) error {
+	if ci.Type < MinCustomIndexType {
+		return errors.Newf("custom index type %d is lower than %d", ci.Type, MinCustomIndexType)
+	}
+	if ci.Key == "" || strings.ContainsAny(ci.Key, `/\.`) {
+		return errors.Newf("invalid custom index key %q", ci.Key)
+	}
+	if ci.Extract == nil {
+		return errors.Newf("missing extract function for custom index %q", ci.Key)
+	}
+	if ci.New != nil && ci.Search == nil {
+		return errors.Newf("missing search function for custom index %q", ci.Key)
+	}
+
+	customIndexes.Lock()
+	defer customIndexes.Unlock()
+
+	for typ, other := range customIndexes.m {
+		if typ == ci.Type {
+			return errors.Conflictf("custom index type %d is already registered as %q", typ, other.Key)
+		}
+		if other.Key == ci.Key {
+			return errors.Conflictf("custom index key %q is already registered", ci.Key)
+		}
+	}
+	customIndexes.m[ci.Type] = ci
+	return nil
+}
+
+func customIndex(typ index.Type) (CustomIndex, bool) {
+	customIndexes.RLock()
+	defer customIndexes.RUnlock()
+
+	ci, ok := customIndexes.m[typ]
+	return ci, ok
+}
+
+// customIndexTypes returns the registered custom index types, in order.
+func customIndexTypes() []index.Type {
+	customIndexes.RLock()
+	defer customIndexes.RUnlock()
+
+	types := make([]index.Type, 0, len(customIndexes.m))
+	for typ := range customIndexes.m {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+	return types
+}
+
+func (ci CustomIndex) fileName() string {
+	return fmt.Sprintf(".%s.gob", ci.Key)
+}
+
+// customCheck is the filters.Check for a custom index.
+type customCheck struct {
+	typ    index.Type
+	values []string
+}
+
+// CustomIndexIs matches the items for which the typ custom index extracts any of the values.
+func CustomIndexIs(typ index.Type, values ...string) filters.Check {
+	return customCheck{typ: typ, values: values}
+}
+
+// Match checks if any of the values extracted from the item are part of the check's values.
+func (c customCheck) Match(it vocab.Item) bool {
+	ci, ok := customIndex(c.typ)
+	if !ok || vocab.IsNil(it) {
+		return false
+	}
+	for _, v := range ci.Extract(it) {
+		if slices.Contains(c.values, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c customCheck) indexMatch(b *bitmaps) *roaring64.Bitmap {
+	if ti, ok := b.tokens[c.typ]; ok {
+		return ti.Search(c.values...)
+	}
+	ci, ok := customIndex(c.typ)
+	if !ok || ci.Search == nil {
+		return nil
+	}
+	idx, ok := b.all[c.typ]
+	if !ok {
+		return nil
+	}
+	return ci.Search(idx, c.values...)
+}
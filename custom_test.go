@@ -0,0 +1,103 @@
+package fs
+
+import (
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters/index"
+)
+
+const mockCustomType = MinCustomIndexType + 1
+
+// extractSensitive indexes the objects that have a content warning in their summary.
+func extractSensitive(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		if firstValue(ob.Summary) != "" {
+			result = append(result, "sensitive")
+		}
+	})
+	return result
+}
+
+func withCustomIndex(t *testing.T, ci CustomIndex) {
+	if err := RegisterIndex(ci); err != nil {
+		t.Fatalf("RegisterIndex() error = %s", err)
+	}
+	t.Cleanup(func() {
+		customIndexes.Lock()
+		delete(customIndexes.m, ci.Type)
+		customIndexes.Unlock()
+	})
+}
+
+func TestRegisterIndex(t *testing.T) {
+	withCustomIndex(t, CustomIndex{Type: mockCustomType, Key: "sensitive", Extract: extractSensitive})
+
+	tests := []struct {
+		name    string
+		ci      CustomIndex
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: errors.Newf("custom index type 0 is lower than %d", MinCustomIndexType),
+		},
+		{
+			name:    "invalid key",
+			ci:      CustomIndex{Type: mockCustomType + 1, Key: "../all", Extract: extractSensitive},
+			wantErr: errors.Newf(`invalid custom index key "../all"`),
+		},
+		{
+			name:    "missing search",
+			ci:      CustomIndex{Type: mockCustomType + 1, Key: "test", Extract: extractSensitive, New: func() index.Indexable { return index.All() }},
+			wantErr: errors.Newf(`missing search function for custom index "test"`),
+		},
+		{
+			name:    "duplicate type",
+			ci:      CustomIndex{Type: mockCustomType, Key: "test", Extract: extractSensitive},
+			wantErr: errors.Conflictf(`custom index type %d is already registered as "sensitive"`, mockCustomType),
+		},
+		{
+			name:    "duplicate key",
+			ci:      CustomIndex{Type: mockCustomType + 1, Key: "sensitive", Extract: extractSensitive},
+			wantErr: errors.Conflictf(`custom index key "sensitive" is already registered`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := RegisterIndex(tt.ci)
+			if err == nil || err.Error() != tt.wantErr.Error() {
+				t.Errorf("RegisterIndex() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_bitmaps_customIndex(t *testing.T) {
+	withCustomIndex(t, CustomIndex{Type: mockCustomType, Key: "sensitive", Extract: extractSensitive})
+
+	if got := getIndexKey(mockCustomType); got != ".sensitive.gob" {
+		t.Errorf("getIndexKey() = %s, want %s", got, ".sensitive.gob")
+	}
+
+	cw := &vocab.Object{ID: "https://example.com/objects/cw", Type: vocab.NoteType, Summary: vocab.DefaultNaturalLanguage("spoilers")}
+	plain := &vocab.Object{ID: "https://example.com/objects/plain", Type: vocab.NoteType}
+
+	b := newBitmap(index.ByID, mockCustomType)
+	for _, it := range []vocab.Item{cw, plain} {
+		if err := b.add(it, iriPath(it.GetLink())); err != nil {
+			t.Fatalf("add() error = %s", err)
+		}
+	}
+
+	check := CustomIndexIs(mockCustomType, "sensitive")
+	if !check.Match(cw) || check.Match(plain) {
+		t.Errorf("CustomIndexIs().Match() doesn't match only the item with a summary")
+	}
+	bmp := b.match(check)
+	if bmp.GetCardinality() != 1 || !bmp.Contains(index.HashFn(cw.ID)) {
+		t.Errorf("match() = %v, want only %s", bmp.ToArray(), cw.ID)
+	}
+}
@@ -0,0 +1,344 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-ap/errors"
+)
+
+// FormatEncrypted is the format marker of the encrypted files.
+// It is reserved, and can't be used by a Codec.
+const FormatEncrypted byte = 0xee
+
+const (
+	encryptionVersion = 1
+	encryptionKeySize = 32
+)
+
+var errEncrypted = errors.Forbiddenf("the data is encrypted and no encryption key was configured")
+
+// Keyring holds the key encryption keys used for the encryption at rest of the actors' metadata
+// and of the OAuth data.
+//
+// Every file is encrypted with its own random data key, which in turn is encrypted with the primary
+// key of the keyring. The other keys are used only for decrypting the files written before a key rotation.
+type Keyring struct {
+	mu      sync.RWMutex
+	primary string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns a Keyring with kek as its primary key.
+// The id gets stored with every encrypted file, so it must not change for the same key.
+func NewKeyring(id string, kek []byte) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string][]byte)}
+	if err := k.Add(id, kek); err != nil {
+		return nil, err
+	}
+	k.primary = id
+	return k, nil
+}
+
+// Add makes the kek key available for decryption.
+func (k *Keyring) Add(id string, kek []byte) error {
+	if id == "" || len(id) > 0xff {
+		return errors.Newf("invalid key id %q", id)
+	}
+	if len(kek) != encryptionKeySize {
+		return errors.Newf("invalid key size %d, expected %d bytes", len(kek), encryptionKeySize)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; ok {
+		return errors.Conflictf("a key with id %q already exists", id)
+	}
+	k.keys[id] = bytes.Clone(kek)
+	return nil
+}
+
+// SetPrimary changes the key used for encryption to the one with id.
+// The files encrypted with the previous primary key are still readable, and can be re-encrypted
+// with the new one using repo.Reencrypt.
+func (k *Keyring) SetPrimary(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return errors.NotFoundf("key with id %q not found", id)
+	}
+	k.primary = id
+	return nil
+}
+
+// Primary returns the id of the key used for encryption.
+func (k *Keyring) Primary() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.primary
+}
+
+func (k *Keyring) key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	kek, ok := k.keys[id]
+	return kek, ok
+}
+
+// KeyFromFile loads a key encryption key from the file at path.
+// The file can contain the raw 32 bytes of the key, or their hex or base64 encoding.
+func KeyFromFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read key file %s", path)
+	}
+	return parseKey(data)
+}
+
+// KeyFromEnv loads a key encryption key from the name environment variable.
+// The value must be the hex or base64 encoding of the 32 bytes of the key.
+func KeyFromEnv(name string) ([]byte, error) {
+	val, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, errors.NotFoundf("environment variable %s is not set", name)
+	}
+	return parseKey([]byte(val))
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == encryptionKeySize {
+		return data, nil
+	}
+	s := strings.TrimSpace(string(data))
+	if key, err := hex.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(s); err == nil && len(key) == encryptionKeySize {
+			return key, nil
+		}
+	}
+	return nil, errors.Newf("invalid key, expected %d bytes, raw or hex or base64 encoded", encryptionKeySize)
+}
+
+// isEncrypted checks if raw starts with the encrypted format marker.
+func isEncrypted(raw []byte) bool {
+	return len(raw) > 2 && raw[0] == rawMarker && raw[1] == FormatEncrypted
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with a new data key, using AES-256-GCM.
+//
+// The envelope has the following layout, with everything before the data nonce being authenticated
+// together with the contents:
+//
+//	0x00 0xee | version | key id length | key id | key nonce | encrypted data key | data nonce | encrypted data
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	id := k.Primary()
+	kek, ok := k.key(id)
+	if !ok {
+		return nil, errors.NotFoundf("primary key %q not found", id)
+	}
+	keyAEAD, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	dek := make([]byte, encryptionKeySize)
+	if _, err = rand.Read(dek); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{rawMarker, FormatEncrypted, encryptionVersion, byte(len(id))}
+	header = append(header, id...)
+
+	keyNonce := make([]byte, keyAEAD.NonceSize())
+	if _, err = rand.Read(keyNonce); err != nil {
+		return nil, err
+	}
+	header = append(header, keyNonce...)
+	header = keyAEAD.Seal(header, keyNonce, dek, bytes.Clone(header))
+
+	dataNonce := make([]byte, dataAEAD.NonceSize())
+	if _, err = rand.Read(dataNonce); err != nil {
+		return nil, err
+	}
+	out := append(bytes.Clone(header), dataNonce...)
+	return dataAEAD.Seal(out, dataNonce, data, header), nil
+}
+
+// keyID returns the id of the key raw was encrypted with.
+func keyID(raw []byte) (string, error) {
+	if !isEncrypted(raw) || len(raw) < 4 {
+		return "", errors.Newf("invalid encrypted data")
+	}
+	if raw[2] != encryptionVersion {
+		return "", errors.Newf("unknown encryption version %d", raw[2])
+	}
+	end := 4 + int(raw[3])
+	if len(raw) < end {
+		return "", errors.Newf("invalid encrypted data")
+	}
+	return string(raw[4:end]), nil
+}
+
+// open decrypts raw with the key it was encrypted with.
+func (k *Keyring) open(raw []byte) ([]byte, error) {
+	id, err := keyID(raw)
+	if err != nil {
+		return nil, err
+	}
+	kek, ok := k.key(id)
+	if !ok {
+		return nil, errors.NotFoundf("key %q used for encryption not found", id)
+	}
+	keyAEAD, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	pos := 4 + len(id)
+	wrappedEnd := pos + keyAEAD.NonceSize() + encryptionKeySize + keyAEAD.Overhead()
+	if len(raw) < wrappedEnd {
+		return nil, errors.Newf("invalid encrypted data")
+	}
+	keyNonce := raw[pos : pos+keyAEAD.NonceSize()]
+	dek, err := keyAEAD.Open(nil, keyNonce, raw[pos+keyAEAD.NonceSize():wrappedEnd], raw[:pos+keyAEAD.NonceSize()])
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to decrypt the data key")
+	}
+	dataAEAD, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < wrappedEnd+dataAEAD.NonceSize() {
+		return nil, errors.Newf("invalid encrypted data")
+	}
+	header := raw[:wrappedEnd]
+	dataNonce := raw[wrappedEnd : wrappedEnd+dataAEAD.NonceSize()]
+	data, err := dataAEAD.Open(nil, dataNonce, raw[wrappedEnd+dataAEAD.NonceSize():], header)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to decrypt the data")
+	}
+	return data, nil
+}
+
+// encrypt encrypts raw if the repository has encryption keys configured.
+func (r *repo) encrypt(raw []byte) ([]byte, error) {
+	if r.keys == nil {
+		return raw, nil
+	}
+	return r.keys.seal(raw)
+}
+
+// decrypt returns the decrypted contents of raw, or raw itself if it's not encrypted.
+func (r *repo) decrypt(raw []byte) ([]byte, error) {
+	if !isEncrypted(raw) {
+		return raw, nil
+	}
+	if r.keys == nil {
+		return nil, errEncrypted
+	}
+	return r.keys.open(raw)
+}
+
+// loadSecret loads the contents of a file that can be encrypted.
+func (r *repo) loadSecret(root *os.Root, itPath string) ([]byte, error) {
+	raw, err := readRaw(root, itPath)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = r.decrypt(raw); err != nil {
+		return nil, err
+	}
+	return unwrapRaw(raw)
+}
+
+// putSecret saves raw to filePath, encrypting it if the repository has encryption keys configured.
+func (r *repo) putSecret(root *os.Root, filePath string, raw []byte) error {
+	raw, err := r.encrypt(raw)
+	if err != nil {
+		return errors.Annotatef(err, "unable to encrypt %s", filePath)
+	}
+	return putRaw(root, filePath, raw)
+}
+
+// isSecretFile checks if the file at p, relative to the storage root, is one that gets encrypted:
+// the actors' metadata and all the OAuth data.
+func isSecretFile(p string, d fs.DirEntry) bool {
+	if d.Name() == metaDataKey {
+		return true
+	}
+	return d.Name() == objectKey && strings.HasPrefix(p, folder+"/")
+}
+
+// Reencrypt encrypts with the primary key of the repository's keyring all the metadata and OAuth
+// files which are stored unencrypted or which were encrypted with a different key.
+// It is meant to be used after enabling the encryption for an existing storage, or after a key rotation,
+// and it returns the number of files that were encrypted.
+func (r *repo) Reencrypt() (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	if r.keys == nil {
+		return 0, errors.Newf("no encryption keys configured")
+	}
+	primary := r.keys.Primary()
+
+	count := 0
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !isSecretFile(p, d) {
+			return nil
+		}
+		raw, err := readRaw(r.root, p)
+		if err != nil {
+			return err
+		}
+		if isEncrypted(raw) {
+			if id, _ := keyID(raw); id == primary {
+				return nil
+			}
+			if raw, err = r.keys.open(raw); err != nil {
+				return errors.Annotatef(err, "unable to decrypt %s", p)
+			}
+		}
+		if err = r.putSecret(r.root, filepath.Clean(p), raw); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
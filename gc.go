@@ -0,0 +1,378 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	defaultGCTTL      = 30 * 24 * time.Hour
+	defaultGCInterval = 24 * time.Hour
+)
+
+// GCOptions control the removal of the unreferenced remote objects.
+type GCOptions struct {
+	// Local are the base IRIs of the instance, for example https://example.com.
+	// The objects with IRIs outside them are the remote ones.
+	Local vocab.IRIs
+	// TTL is the time since a remote object was last accessed, or saved, before it can be removed.
+	// It defaults to 30 days.
+	TTL time.Duration
+	// DryRun only reports the objects that would be removed.
+	DryRun bool
+	// Interval is the time between two runs of the garbage collection started with StartGC.
+	// It defaults to a day.
+	Interval time.Duration
+}
+
+func (o GCOptions) ttl() time.Duration {
+	if o.TTL > 0 {
+		return o.TTL
+	}
+	return defaultGCTTL
+}
+
+func (o GCOptions) interval() time.Duration {
+	if o.Interval > 0 {
+		return o.Interval
+	}
+	return defaultGCInterval
+}
+
+func (o GCOptions) isLocal(iri vocab.IRI) bool {
+	p := iriPath(iri)
+	for _, base := range o.Local {
+		if isSubPath(p, iriPath(base)) {
+			return true
+		}
+	}
+	return false
+}
+
+// GCReport is the result of a garbage collection.
+type GCReport struct {
+	// Remote is the number of remote objects found in the storage.
+	Remote int
+	// Referenced is the number of remote objects kept because they are referenced by local ones.
+	Referenced int
+	// Protected is the number of remote actors kept because they have metadata, like keys.
+	Protected int
+	// Recent is the number of remote objects kept because they were accessed within the TTL.
+	Recent int
+	// Removed are the IRIs of the removed objects, or of the ones that would be removed for a dry run.
+	Removed vocab.IRIs
+}
+
+// gcRefs returns the IRIs of the objects it references, which need to be kept as long as it's kept.
+func gcRefs(it vocab.Item) vocab.IRIs {
+	refs := make(vocab.IRIs, 0)
+	var add func(items ...vocab.Item)
+	add = func(items ...vocab.Item) {
+		for _, ref := range items {
+			if vocab.IsNil(ref) {
+				continue
+			}
+			if vocab.IsItemCollection(ref) {
+				_ = vocab.OnItemCollection(ref, func(col *vocab.ItemCollection) error {
+					add(*col...)
+					return nil
+				})
+				continue
+			}
+			if ref.GetLink() != "" {
+				refs = append(refs, ref.GetLink())
+			}
+		}
+	}
+	typ := it.GetType()
+	if vocab.ActivityTypes.Match(typ) {
+		_ = vocab.OnActivity(it, func(a *vocab.Activity) error {
+			add(a.Actor, a.Object, a.Target)
+			return nil
+		})
+	} else if vocab.IntransitiveActivityTypes.Match(typ) {
+		_ = vocab.OnIntransitiveActivity(it, func(a *vocab.IntransitiveActivity) error {
+			add(a.Actor, a.Target)
+			return nil
+		})
+	}
+	if !vocab.IsIRI(it) {
+		_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+			add(ob.InReplyTo, ob.AttributedTo)
+			return nil
+		})
+	}
+	return refs
+}
+
+// GC removes the remote objects which are not referenced by the local ones, and which were not accessed
+// within the GCOptions.TTL. The objects get removed together with their index entries.
+//
+// The remote objects are referenced when they are members of a local collection, or when they are the
+// object, actor, target, inReplyTo, or attributedTo of a local object, and of the remote objects referenced
+// in their turn. The remote actors with metadata, like their keys, are never removed.
+func (r *repo) GC(opts GCOptions) (*GCReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if len(opts.Local) == 0 {
+		return nil, errors.BadRequestf("no local IRIs to tell the remote objects apart")
+	}
+
+	type candidate struct {
+		dir       string
+		iri       vocab.IRI
+		refs      vocab.IRIs
+		accessed  time.Time
+		protected bool
+	}
+	changes, err := r.trackChanges()
+	if err != nil {
+		return nil, err
+	}
+	defer changes.stop()
+
+	candidates := make(map[string]*candidate)
+	queue := make(vocab.IRIs, 0)
+	err = r.walkStorage(func(p string, d fs.DirEntry) error {
+		if d.Name() != objectKey {
+			return nil
+		}
+		it, err := loadItemRaw(r.root, p)
+		if err != nil || vocab.IsNil(it) {
+			return nil
+		}
+
+		dir := path.Dir(p)
+		if opts.isLocal(it.GetLink()) {
+			queue = append(queue, gcRefs(it)...)
+			if isStorageCollectionKey(dir) {
+				members, err := r.memberIRIs(dir)
+				if err != nil {
+					return err
+				}
+				queue = append(queue, members...)
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		_, metaErr := r.root.Lstat(getMetadataKey(dir))
+		candidates[iriPath(it.GetLink())] = &candidate{
+			dir:       dir,
+			iri:       it.GetLink(),
+			refs:      gcRefs(it),
+			accessed:  accessTime(fi),
+			protected: metaErr == nil,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]struct{})
+	reference := func(queue vocab.IRIs) {
+		for len(queue) > 0 {
+			key := iriPath(queue[0])
+			queue = queue[1:]
+			if _, ok := referenced[key]; ok {
+				continue
+			}
+			referenced[key] = struct{}{}
+			if c, ok := candidates[key]; ok {
+				queue = append(queue, c.refs...)
+			}
+		}
+	}
+	reference(queue)
+
+	report := GCReport{Remote: len(candidates), Removed: make(vocab.IRIs, 0)}
+	expired := time.Now().Add(-opts.ttl())
+	removable := make([]*candidate, 0)
+	for key, c := range candidates {
+		if c.protected {
+			report.Protected++
+		} else if _, ok := referenced[key]; ok {
+			report.Referenced++
+		} else if c.accessed.After(expired) {
+			report.Recent++
+		} else {
+			removable = append(removable, c)
+		}
+	}
+	// NOTE(marius): the objects stored deeper get removed first, so their parents can be removed
+	// together with their directories.
+	slices.SortFunc(removable, func(a, b *candidate) int {
+		if d := strings.Count(b.dir, "/") - strings.Count(a.dir, "/"); d != 0 {
+			return d
+		}
+		return strings.Compare(a.dir, b.dir)
+	})
+
+	if opts.DryRun {
+		for _, c := range removable {
+			report.Removed = append(report.Removed, c.iri)
+		}
+		return &report, nil
+	}
+	if len(removable) == 0 {
+		return &report, nil
+	}
+
+	// NOTE(marius): like Snapshot, the walk above runs while the storage is in use. With the writes paused,
+	// the references added since it started are collected, and each candidate is checked again before
+	// being removed.
+	r.quiesce.Lock()
+	defer r.quiesce.Unlock()
+
+	paths, err := changes.changed()
+	if err != nil {
+		return &report, err
+	}
+	changed, err := r.gcChangedRefs(paths)
+	if err != nil {
+		return &report, err
+	}
+	reference(changed)
+
+	_ = r.loadIndex()
+	defer func() {
+		_ = r.saveIndex()
+	}()
+	for _, c := range removable {
+		if _, ok := referenced[iriPath(c.iri)]; ok {
+			report.Referenced++
+			continue
+		}
+		fi, err := r.root.Lstat(getObjectKey(c.dir))
+		if err != nil {
+			continue
+		}
+		if accessTime(fi).After(expired) {
+			report.Recent++
+			continue
+		}
+		if _, err = r.root.Lstat(getMetadataKey(c.dir)); err == nil {
+			report.Protected++
+			continue
+		}
+		if err = r.gcRemove(c.dir, c.iri); err != nil {
+			return &report, errors.Annotatef(err, "unable to remove %s", c.iri)
+		}
+		report.Removed = append(report.Removed, c.iri)
+	}
+	return &report, nil
+}
+
+// gcChangedRefs returns the IRIs referenced by the objects, the collection links and the manifests
+// at the paths written since the walk started. The references of the remote objects are included too,
+// which can only keep more of them.
+func (r *repo) gcChangedRefs(paths []string) (vocab.IRIs, error) {
+	refs := make(vocab.IRIs, 0)
+	for _, p := range paths {
+		fi, err := r.root.Lstat(p)
+		if err != nil {
+			// NOTE(marius): the paths which were removed don't reference anything anymore.
+			continue
+		}
+		switch {
+		case fi.Mode()&fs.ModeSymlink == fs.ModeSymlink:
+			if iri := linkedIRI(r.root, p, pathIRI); iri != "" {
+				refs = append(refs, iri)
+			}
+		case path.Base(p) == _manifestName:
+			m, err := loadManifest(r.root, path.Dir(p))
+			if err != nil {
+				return nil, err
+			}
+			refs = append(refs, m.iris()...)
+		case path.Base(p) == objectKey:
+			if it, err := loadItemRaw(r.root, p); err == nil && !vocab.IsNil(it) {
+				refs = append(refs, gcRefs(it)...)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// gcRemove removes the object stored at dir, together with its directory, unless other objects
+// or collections are stored inside it.
+func (r *repo) gcRemove(dir string, iri vocab.IRI) error {
+	entries, err := fs.ReadDir(r.root.FS(), dir)
+	if err != nil {
+		return err
+	}
+	objectFiles := []string{objectKey, cacheInfoKey, blobKey, blobInfoKey, _indexDirName}
+	targets := []string{dir}
+	for _, e := range entries {
+		if !slices.Contains(objectFiles, e.Name()) {
+			targets = []string{getObjectKey(dir), getCacheInfoKey(dir), getBlobKey(dir), getBlobInfoKey(dir)}
+			break
+		}
+	}
+	blob, _ := r.loadBlobInfo(dir)
+
+	r.record(targets...)
+	for _, target := range targets {
+		if err = r.root.RemoveAll(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if blob != nil {
+		r.releaseBlob(blob.SHA256)
+	}
+	if err = r.removeFromIndex(iri, dir); err != nil && !errors.IsNotImplemented(err) {
+		r.logger.Errorf("unable to remove item %s from index: %s", iri, err)
+	}
+	r.removeFromCache(iri)
+	return nil
+}
+
+// StartGC runs GC in the background every GCOptions.Interval, until the returned function gets called.
+// The function waits for a running garbage collection to finish.
+func (r *repo) StartGC(opts GCOptions) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		t := time.NewTicker(opts.interval())
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				report, err := r.GC(opts)
+				if err != nil {
+					r.logger.Errorf("unable to collect the unreferenced remote objects: %s", err)
+					continue
+				}
+				if len(report.Removed) > 0 {
+					r.logger.WithContext(lw.Ctx{"removed": len(report.Removed), "remote": report.Remote}).Debugf("removed unreferenced remote objects")
+				}
+			}
+		}
+	}()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			close(done)
+		})
+		<-stopped
+	}
+}
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func makeOld(t *testing.T, r *repo, items ...vocab.Item) {
+	t.Helper()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, it := range items {
+		p := filepath.Join(r.path, getObjectKey(r.pathOf(it.GetLink())))
+		if err := os.Chtimes(p, old, old); err != nil {
+			t.Fatalf("unable to change the times of %s: %s", it.GetLink(), err)
+		}
+	}
+}
+
+func Test_repo_GC(t *testing.T) {
+	liked := &vocab.Object{ID: "https://remote.example/notes/liked", Type: vocab.NoteType}
+	unreferenced := &vocab.Object{ID: "https://remote.example/notes/unreferenced", Type: vocab.NoteType}
+	recent := &vocab.Object{ID: "https://remote.example/notes/recent", Type: vocab.NoteType}
+	repliedTo := &vocab.Object{ID: "https://remote.example/notes/replied", Type: vocab.NoteType}
+	member := &vocab.Object{ID: "https://remote.example/notes/member", Type: vocab.NoteType}
+	author := &vocab.Actor{ID: "https://remote.example/~bob", Type: vocab.PersonType}
+	keyed := &vocab.Actor{ID: "https://remote.example/~alice", Type: vocab.PersonType}
+	byAuthor := &vocab.Object{ID: "https://remote.example/notes/by-bob", Type: vocab.NoteType, AttributedTo: author.GetLink()}
+
+	like := &vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.LikeType, Actor: rootIRI, Object: liked.GetLink()}
+	reply := &vocab.Object{ID: "https://example.com/objects/1", Type: vocab.NoteType, InReplyTo: repliedTo.GetLink()}
+	remote := vocab.ItemCollection{liked, unreferenced, recent, repliedTo, member, author, keyed, byAuthor}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(append(vocab.ItemCollection{like, reply}, remote...)))
+	if err := r.AddTo(rootOutboxIRI, like, member, byAuthor); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if err := r.SaveMetadata(keyed.GetLink(), Metadata{Pw: []byte("hash")}); err != nil {
+		t.Fatalf("SaveMetadata() error = %s", err)
+	}
+	makeOld(t, r, liked, unreferenced, repliedTo, member, author, keyed, byAuthor)
+
+	if _, err := r.GC(GCOptions{}); err == nil {
+		t.Errorf("GC() without local IRIs didn't return an error")
+	}
+
+	opts := GCOptions{Local: vocab.IRIs{rootIRI}, TTL: 24 * time.Hour, DryRun: true}
+	report, err := r.GC(opts)
+	if err != nil {
+		t.Fatalf("GC() dry run error = %s", err)
+	}
+	if len(report.Removed) != 1 || !report.Removed.Contains(unreferenced.GetLink()) {
+		t.Errorf("GC() dry run removed = %v, want %s", report.Removed, unreferenced.GetLink())
+	}
+	if report.Remote != len(remote) || report.Protected != 1 || report.Recent != 1 || report.Referenced != 5 {
+		t.Errorf("GC() dry run report = %+v", report)
+	}
+	if _, err = r.Load(unreferenced.GetLink()); err != nil {
+		t.Errorf("GC() dry run removed %s: %s", unreferenced.GetLink(), err)
+	}
+
+	opts.DryRun = false
+	if report, err = r.GC(opts); err != nil {
+		t.Fatalf("GC() error = %s", err)
+	}
+	if len(report.Removed) != 1 {
+		t.Errorf("GC() removed = %v, want %s", report.Removed, unreferenced.GetLink())
+	}
+	if _, err = os.Stat(filepath.Join(dir, r.pathOf(unreferenced.GetLink()))); !os.IsNotExist(err) {
+		t.Errorf("GC() didn't remove %s", unreferenced.GetLink())
+	}
+	for _, it := range remote {
+		if it == unreferenced {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(dir, getObjectKey(r.pathOf(it.GetLink())))); err != nil {
+			t.Errorf("GC() removed %s: %s", it.GetLink(), err)
+		}
+	}
+}
+
+func Test_repo_gcChangedRefs(t *testing.T) {
+	note := &vocab.Object{ID: "https://remote.example/notes/1", Type: vocab.NoteType}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(vocab.ItemCollection{note}))
+
+	changes, err := r.trackChanges()
+	if err != nil {
+		t.Fatalf("trackChanges() error = %s", err)
+	}
+	defer changes.stop()
+
+	paths, _ := changes.changed()
+	if refs, err := r.gcChangedRefs(paths); err != nil || len(refs) > 0 {
+		t.Errorf("gcChangedRefs() with nothing changed = %v, %v, want none", refs, err)
+	}
+	if err = r.AddTo(rootOutboxIRI, note); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	paths, _ = changes.changed()
+	refs, err := r.gcChangedRefs(paths)
+	if err != nil {
+		t.Fatalf("gcChangedRefs() error = %s", err)
+	}
+	if !refs.Contains(note.GetLink()) {
+		t.Errorf("gcChangedRefs() = %v, want the new member %s", refs, note.GetLink())
+	}
+}
+
+func Test_repo_StartGC(t *testing.T) {
+	unreferenced := &vocab.Object{ID: "https://remote.example/notes/unreferenced", Type: vocab.NoteType}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedItems(vocab.ItemCollection{unreferenced}))
+	makeOld(t, r, unreferenced)
+
+	stop := r.StartGC(GCOptions{Local: vocab.IRIs{rootIRI}, TTL: time.Hour, Interval: 10 * time.Millisecond})
+	defer stop()
+
+	p := filepath.Join(dir, r.pathOf(unreferenced.GetLink()))
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return
+		}
+	}
+	t.Errorf("StartGC() didn't remove %s", unreferenced.GetLink())
+}
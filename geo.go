@@ -0,0 +1,361 @@
+package fs
+
+import (
+	"math"
+	"slices"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+)
+
+const (
+	geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	// geoPrecision is the length of the geohashes stored in the location index, which
+	// gives cells of about 38m by 19m.
+	geoPrecision = 8
+	// maxGeoCells is the maximum number of cells a query gets split into.
+	// The cells of the query are as small as possible while staying under this limit.
+	maxGeoCells = 64
+	earthRadius = 6371008.8
+)
+
+type geoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+func (p geoPoint) valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+// distance returns the great circle distance in meters between p and o.
+func (p geoPoint) distance(o geoPoint) float64 {
+	lat1, lat2 := p.Lat*math.Pi/180, o.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (o.Lon - p.Lon) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geohash encodes the point to a geohash of the received length.
+func geohash(p geoPoint, precision int) string {
+	latR := [2]float64{-90, 90}
+	lonR := [2]float64{-180, 180}
+	result := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(result) < precision {
+		if even {
+			if mid := (lonR[0] + lonR[1]) / 2; p.Lon >= mid {
+				ch |= 1 << (4 - bit)
+				lonR[0] = mid
+			} else {
+				lonR[1] = mid
+			}
+		} else {
+			if mid := (latR[0] + latR[1]) / 2; p.Lat >= mid {
+				ch |= 1 << (4 - bit)
+				latR[0] = mid
+			} else {
+				latR[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+			continue
+		}
+		result = append(result, geohashAlphabet[ch])
+		bit, ch = 0, 0
+	}
+	return string(result)
+}
+
+// geohashCellSize returns the height and width in degrees of the cells of a geohash of the received length.
+func geohashCellSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	return 180 / math.Pow(2, float64(bits/2)), 360 / math.Pow(2, float64((bits+1)/2))
+}
+
+// BoundingBox is a geographic area between two latitudes and two longitudes, in degrees.
+// A box with MinLon greater than MaxLon crosses the antimeridian.
+type BoundingBox struct {
+	MinLat, MinLon float64
+	MaxLat, MaxLon float64
+}
+
+func (b BoundingBox) valid() bool {
+	return geoPoint{Lat: b.MinLat, Lon: b.MinLon}.valid() && geoPoint{Lat: b.MaxLat, Lon: b.MaxLon}.valid() &&
+		b.MinLat <= b.MaxLat
+}
+
+// lonRanges returns the longitude ranges of the box, split in two if it crosses the antimeridian.
+func (b BoundingBox) lonRanges() [][2]float64 {
+	if b.MinLon <= b.MaxLon {
+		return [][2]float64{{b.MinLon, b.MaxLon}}
+	}
+	return [][2]float64{{b.MinLon, 180}, {-180, b.MaxLon}}
+}
+
+func (b BoundingBox) contains(p geoPoint) bool {
+	if p.Lat < b.MinLat || p.Lat > b.MaxLat {
+		return false
+	}
+	for _, lr := range b.lonRanges() {
+		if p.Lon >= lr[0] && p.Lon <= lr[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func cellIndex(v, origin, size float64, last int) int {
+	return max(0, min(last, int(math.Floor((v-origin)/size))))
+}
+
+// cellsAt returns the geohashes of the received length covering the box, or nil if there are more than limit.
+func (b BoundingBox) cellsAt(precision, limit int) []string {
+	h, w := geohashCellSize(precision)
+	lastLat, lastLon := int(math.Round(180/h))-1, int(math.Round(360/w))-1
+
+	latFrom, latTo := cellIndex(b.MinLat, -90, h, lastLat), cellIndex(b.MaxLat, -90, h, lastLat)
+	cells := make([]string, 0)
+	for _, lr := range b.lonRanges() {
+		lonFrom, lonTo := cellIndex(lr[0], -180, w, lastLon), cellIndex(lr[1], -180, w, lastLon)
+		if len(cells)+(latTo-latFrom+1)*(lonTo-lonFrom+1) > limit {
+			return nil
+		}
+		for i := latFrom; i <= latTo; i++ {
+			for j := lonFrom; j <= lonTo; j++ {
+				center := geoPoint{Lat: -90 + (float64(i)+0.5)*h, Lon: -180 + (float64(j)+0.5)*w}
+				cells = append(cells, geohash(center, precision))
+			}
+		}
+	}
+	slices.Sort(cells)
+	return slices.Compact(cells)
+}
+
+// cells returns the smallest geohash cells that cover the box, without going over maxGeoCells.
+func (b BoundingBox) cells() []string {
+	for precision := geoPrecision; precision > 1; precision-- {
+		if cells := b.cellsAt(precision, maxGeoCells); cells != nil {
+			return cells
+		}
+	}
+	return b.cellsAt(1, len(geohashAlphabet))
+}
+
+// radiusBox returns the bounding box of the circle with the received center and radius in meters.
+func radiusBox(center geoPoint, radius float64) BoundingBox {
+	dLat := radius / earthRadius * 180 / math.Pi
+	box := BoundingBox{
+		MinLat: max(-90, center.Lat-dLat),
+		MaxLat: min(90, center.Lat+dLat),
+		MinLon: -180,
+		MaxLon: 180,
+	}
+	if box.MinLat == -90 || box.MaxLat == 90 {
+		// NOTE(marius): the circle contains one of the poles, so it covers all the longitudes
+		return box
+	}
+	dLon := dLat / math.Cos(center.Lat*math.Pi/180)
+	if dLon >= 180 {
+		return box
+	}
+	box.MinLon = math.Mod(center.Lon-dLon+540, 360) - 180
+	box.MaxLon = math.Mod(center.Lon+dLon+540, 360) - 180
+	return box
+}
+
+// placePoint returns the coordinates of the it Place.
+func placePoint(it vocab.Item) (geoPoint, bool) {
+	p := geoPoint{}
+	ok := false
+	if vocab.IsNil(it) || vocab.IsIRI(it) || it.GetType() != vocab.PlaceType {
+		return p, ok
+	}
+	_ = vocab.OnPlace(it, func(pl *vocab.Place) error {
+		// NOTE(marius): the zero values can't be told apart from a missing latitude and longitude,
+		// so we ignore them.
+		if pl.Latitude == 0 && pl.Longitude == 0 {
+			return nil
+		}
+		p = geoPoint{Lat: pl.Latitude, Lon: pl.Longitude}
+		ok = p.valid()
+		return nil
+	})
+	return p, ok
+}
+
+// locationsOf returns the coordinates of a Place, or those of the places in an object's location.
+// The locations that are only referenced by IRI are not resolved.
+func locationsOf(li vocab.LinkOrIRI) []geoPoint {
+	points := make([]geoPoint, 0)
+	it, ok := li.(vocab.Item)
+	if !ok || vocab.IsNil(it) || vocab.IsIRI(it) {
+		return points
+	}
+	if it.GetType() == vocab.PlaceType {
+		if p, ok := placePoint(it); ok {
+			points = append(points, p)
+		}
+		return points
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		if vocab.IsNil(ob.Location) {
+			return nil
+		}
+		if !vocab.IsItemCollection(ob.Location) {
+			if p, ok := placePoint(ob.Location); ok {
+				points = append(points, p)
+			}
+			return nil
+		}
+		return vocab.OnItemCollection(ob.Location, func(col *vocab.ItemCollection) error {
+			for _, loc := range *col {
+				if p, ok := placePoint(loc); ok {
+					points = append(points, p)
+				}
+			}
+			return nil
+		})
+	})
+	return points
+}
+
+// extractLocations returns the geohashes of all lengths, up to geoPrecision, for the locations of the item.
+func extractLocations(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	for _, p := range locationsOf(li) {
+		hash := geohash(p, geoPrecision)
+		for i := 1; i <= len(hash); i++ {
+			result = append(result, hash[:i])
+		}
+	}
+	return result
+}
+
+// geoCheck matches the items with a location inside a bounding box, and optionally,
+// inside a circle contained by it.
+type geoCheck struct {
+	box    BoundingBox
+	center *geoPoint
+	radius float64
+}
+
+func (c geoCheck) contains(p geoPoint) bool {
+	if !c.box.contains(p) {
+		return false
+	}
+	return c.center == nil || c.center.distance(p) <= c.radius
+}
+
+// distance returns the distance from the center of the check to the closest location of it.
+func (c geoCheck) distance(it vocab.Item) float64 {
+	closest := math.Inf(1)
+	if c.center == nil {
+		return closest
+	}
+	for _, p := range locationsOf(it) {
+		closest = math.Min(closest, c.center.distance(p))
+	}
+	return closest
+}
+
+// Match checks if any of the locations of the item is inside the area of the check.
+func (c geoCheck) Match(it vocab.Item) bool {
+	for _, p := range locationsOf(it) {
+		if c.contains(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c geoCheck) indexMatch(b *bitmaps) *roaring64.Bitmap {
+	idx, ok := b.tokens[ByLocation]
+	if !ok {
+		return nil
+	}
+	return idx.Search(c.box.cells()...)
+}
+
+// InBoundingBox matches the Place objects, and the objects with a location, inside the box.
+func InBoundingBox(box BoundingBox) filters.Check {
+	return geoCheck{box: box}
+}
+
+// InRadius matches the Place objects, and the objects with a location, that are at most
+// radius meters away from the lat, lon point.
+func InRadius(lat, lon, radius float64) filters.Check {
+	center := geoPoint{Lat: lat, Lon: lon}
+	return geoCheck{box: radiusBox(center, radius), center: &center, radius: radius}
+}
+
+func (r *repo) loadByLocation(colIRI vocab.IRI, check geoCheck, maxItems int, ff ...filters.Check) (vocab.ItemCollection, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if r.index == nil {
+		return nil, indexDisabled
+	}
+	if !check.box.valid() {
+		return nil, errors.BadRequestf("invalid coordinates")
+	}
+	_ = r.loadIndex()
+
+	r.index.w.RLock()
+	bmp := check.indexMatch(r.index)
+	r.index.w.RUnlock()
+	if bmp == nil {
+		return nil, errors.NotImplementedf("location index is disabled")
+	}
+
+	colBmp, err := r.collectionBitmap(colIRI)
+	if err != nil {
+		return nil, err
+	}
+	if colBmp != nil {
+		bmp.And(colBmp)
+	}
+	return r.loadRefs(bmp.ToArray(), maxItems, slices.Concat([]filters.Check{check}, ff)...), nil
+}
+
+// LoadInBoundingBox returns the items of the colIRI collection that are located inside the box.
+// If colIRI is empty, the whole storage gets searched.
+func (r *repo) LoadInBoundingBox(colIRI vocab.IRI, box BoundingBox, ff ...filters.Check) (vocab.ItemCollection, error) {
+	return r.loadByLocation(colIRI, geoCheck{box: box}, filters.MaxCount(ff...), ff...)
+}
+
+// LoadInRadius returns the items of the colIRI collection that are at most radius meters away
+// from the lat, lon point, ordered by their distance to it.
+// If colIRI is empty, the whole storage gets searched.
+func (r *repo) LoadInRadius(colIRI vocab.IRI, lat, lon, radius float64, ff ...filters.Check) (vocab.ItemCollection, error) {
+	center := geoPoint{Lat: lat, Lon: lon}
+	if !center.valid() || radius <= 0 {
+		return nil, errors.BadRequestf("invalid coordinates")
+	}
+	check := geoCheck{box: radiusBox(center, radius), center: &center, radius: radius}
+	// NOTE(marius): the items get ordered by distance after loading, so the max count
+	// can only be applied at the end.
+	result, err := r.loadByLocation(colIRI, check, 0, ff...)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(result, func(a, b vocab.Item) int {
+		da, db := check.distance(a), check.distance(b)
+		switch {
+		case da < db:
+			return -1
+		case da > db:
+			return 1
+		}
+		return 0
+	})
+	if maxItems := filters.MaxCount(ff...); maxItems > 0 && len(result) > maxItems {
+		result = result[:maxItems]
+	}
+	return result, nil
+}
@@ -0,0 +1,202 @@
+package fs
+
+import (
+	"math"
+	"slices"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+var (
+	placeParis  = &vocab.Place{ID: "https://example.com/places/paris", Type: vocab.PlaceType, Latitude: 48.8566, Longitude: 2.3522}
+	placeBerlin = &vocab.Place{ID: "https://example.com/places/berlin", Type: vocab.PlaceType, Latitude: 52.52, Longitude: 13.405}
+	noteLouvre  = &vocab.Object{
+		ID:       "https://example.com/objects/louvre",
+		Type:     vocab.NoteType,
+		Location: &vocab.Place{Type: vocab.PlaceType, Latitude: 48.8606, Longitude: 2.3376},
+	}
+	noteNowhere = &vocab.Object{ID: "https://example.com/objects/nowhere", Type: vocab.NoteType}
+
+	mockGeoItems = vocab.ItemCollection{placeParis, placeBerlin, noteLouvre, noteNowhere}
+)
+
+func Test_geohash(t *testing.T) {
+	tests := []struct {
+		name      string
+		p         geoPoint
+		precision int
+		want      string
+	}{
+		{
+			name: "empty",
+			want: "",
+		},
+		{
+			name:      "origin",
+			precision: 5,
+			want:      "s0000",
+		},
+		{
+			name:      "wikipedia example",
+			p:         geoPoint{Lat: 57.64911, Lon: 10.40744},
+			precision: 11,
+			want:      "u4pruydqqvj",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := geohash(tt.p, tt.precision); got != tt.want {
+				t.Errorf("geohash() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoundingBox_cells(t *testing.T) {
+	tests := []struct {
+		name string
+		box  BoundingBox
+		in   []geoPoint
+	}{
+		{
+			name: "world",
+			box:  BoundingBox{MinLat: -90, MinLon: -180, MaxLat: 90, MaxLon: 180},
+			in:   []geoPoint{{Lat: -90, Lon: -180}, {Lat: 90, Lon: 180}, {}},
+		},
+		{
+			name: "city",
+			box:  BoundingBox{MinLat: 48.80, MinLon: 2.25, MaxLat: 48.90, MaxLon: 2.42},
+			in:   []geoPoint{{Lat: 48.8566, Lon: 2.3522}, {Lat: 48.80, Lon: 2.25}, {Lat: 48.90, Lon: 2.42}},
+		},
+		{
+			name: "antimeridian",
+			box:  BoundingBox{MinLat: -20, MinLon: 175, MaxLat: -15, MaxLon: -175},
+			in:   []geoPoint{{Lat: -17, Lon: 178}, {Lat: -17, Lon: -178}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cells := tt.box.cells()
+			if len(cells) == 0 || len(cells) > maxGeoCells {
+				t.Fatalf("cells() returned %d cells, want between 1 and %d", len(cells), maxGeoCells)
+			}
+			for _, p := range tt.in {
+				hash := geohash(p, geoPrecision)
+				covered := slices.ContainsFunc(cells, func(c string) bool { return hash[:len(c)] == c })
+				if !covered {
+					t.Errorf("cells() %v don't cover %v (%s)", cells, p, hash)
+				}
+			}
+		})
+	}
+}
+
+func Test_radiusBox(t *testing.T) {
+	paris := geoPoint{Lat: placeParis.Latitude, Lon: placeParis.Longitude}
+	berlin := geoPoint{Lat: placeBerlin.Latitude, Lon: placeBerlin.Longitude}
+	if d := paris.distance(berlin); math.Abs(d-878000) > 5000 {
+		t.Errorf("distance() = %f, want about 878km", d)
+	}
+	box := radiusBox(paris, 900000)
+	if !box.contains(berlin) {
+		t.Errorf("radiusBox() %v doesn't contain %v", box, berlin)
+	}
+	box = radiusBox(geoPoint{Lat: 0, Lon: 179.9}, 100000)
+	if box.MinLon <= box.MaxLon {
+		t.Errorf("radiusBox() %v should cross the antimeridian", box)
+	}
+}
+
+func Test_repo_LoadInRadius(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  fields
+		lat     float64
+		lon     float64
+		radius  float64
+		want    vocab.IRIs
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: errNotOpen,
+		},
+		{
+			name: "invalid radius",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			lat:     48.8566,
+			lon:     2.3522,
+			wantErr: errors.BadRequestf("invalid coordinates"),
+		},
+		{
+			name: "around the Louvre",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			lat:    48.8606,
+			lon:    2.3376,
+			radius: 5000,
+			want:   vocab.IRIs{noteLouvre.ID, placeParis.ID},
+		},
+		{
+			name: "around Berlin",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			lat:    52.5,
+			lon:    13.4,
+			radius: 900000,
+			want:   vocab.IRIs{placeBerlin.ID, placeParis.ID, noteLouvre.ID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			if r.root != nil {
+				r = withItems(mockGeoItems...)(t, r)
+			}
+			got, err := r.LoadInRadius("", tt.lat, tt.lon, tt.radius)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("LoadInRadius() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			gotIRIs := make(vocab.IRIs, 0, len(got))
+			for _, it := range got {
+				gotIRIs = append(gotIRIs, it.GetLink())
+			}
+			if !slices.Equal(gotIRIs, tt.want) {
+				t.Errorf("LoadInRadius() = %v, want %v", gotIRIs, tt.want)
+			}
+		})
+	}
+}
+
+func Test_repo_LoadInBoundingBox(t *testing.T) {
+	r := mockRepo(t, fields{path: t.TempDir(), root: openRoot(t, t.TempDir()), index: newBitmap()})
+	r = withItems(mockGeoItems...)(t, r)
+
+	got, err := r.LoadInBoundingBox("", BoundingBox{MinLat: 48, MinLon: 2, MaxLat: 49, MaxLon: 3})
+	if err != nil {
+		t.Fatalf("LoadInBoundingBox() error = %s", err)
+	}
+	gotIRIs := make(vocab.IRIs, 0, len(got))
+	for _, it := range got {
+		gotIRIs = append(gotIRIs, it.GetLink())
+	}
+	if len(gotIRIs) != 2 || !gotIRIs.Contains(placeParis.ID) || !gotIRIs.Contains(noteLouvre.ID) {
+		t.Errorf("LoadInBoundingBox() = %v, want %s and %s", gotIRIs, placeParis.ID, noteLouvre.ID)
+	}
+	if _, err = r.LoadInBoundingBox("", BoundingBox{MinLat: 10, MaxLat: -10}); !errors.Is(err, errors.BadRequestf("")) {
+		t.Errorf("LoadInBoundingBox() with invalid box error = %v, want bad request", err)
+	}
+}
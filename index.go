@@ -1,10 +1,10 @@
 package fs
 
 import (
-	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 
@@ -19,8 +19,50 @@ type bitmaps struct {
 	w   sync.RWMutex
 	ref map[uint64]string
 	all map[index.Type]index.Indexable
+	// types are the index types the bitmaps were created with.
+	types []index.Type
+	// tokens holds the indexes for the types defined by this package.
+	tokens map[index.Type]*tokenIndex
+	// text is the full text index, enabled by the ByFullText type.
+	text *fullText
+	// threads holds the reply relationships between objects.
+	threads *threads
 }
 
+// The index types added by this package start from 64, so they don't overlap
+// with the ones from the filters/index package.
+const (
+	// ByHashtag indexes the names of the Hashtag entries in an object's tags.
+	ByHashtag index.Type = iota + 64
+	// ByMention indexes the IRIs and names of the Mention entries in an object's tags.
+	ByMention
+	// ByThread indexes the reply relationships between objects.
+	ByThread
+	// ByURL indexes the url property of objects.
+	ByURL
+	// ByMediaType indexes the mediaType property of objects and links.
+	ByMediaType
+	// ByAttachmentMediaType indexes the media types of an object's attachments.
+	ByAttachmentMediaType
+	// ByGenerator indexes the application that generated an object.
+	ByGenerator
+	// ByLanguage indexes the languages of the natural language values of objects.
+	ByLanguage
+	// ByNameLanguage indexes the terms of the name values, partitioned by their language.
+	ByNameLanguage
+	// BySummaryLanguage indexes the terms of the summary values, partitioned by their language.
+	BySummaryLanguage
+	// ByContentLanguage indexes the terms of the content values, partitioned by their language.
+	ByContentLanguage
+	// ByLocation indexes the geohashes of the coordinates of Place objects, and of the places in an object's location.
+	ByLocation
+	// ByTag indexes the entries of an object's tags, for answering the filters.Tag checks.
+	ByTag
+	// ByFullText is the positional index over the name, summary and content of objects used by Search.
+	// It's not enabled by default.
+	ByFullText
+)
+
 var genericIndexTypes = []index.Type{
 	index.ByID, index.ByType,
 	index.ByRecipients, index.ByAttributedTo,
@@ -30,13 +72,20 @@ var genericIndexTypes = []index.Type{
 var allIndexTypes = append(genericIndexTypes,
 	index.ByPreferredUsername, index.ByActor, index.ByObject /*, index.ByCollection*/)
 
+var defaultIndexTypes = slices.Concat(allIndexTypes, tagIndexTypes, []index.Type{ByThread, ByLanguage, ByLocation})
+
+// knownIndexTypes are all the index types that can be enabled for a repository.
+var knownIndexTypes = slices.Concat(defaultIndexTypes, propertyIndexTypes, languagePartitionTypes, []index.Type{ByFullText})
+
 func newBitmap(typ ...index.Type) *bitmaps {
 	if len(typ) == 0 {
-		typ = allIndexTypes
+		typ = defaultIndexTypes
 	}
 	b := bitmaps{
-		ref: make(map[uint64]string),
-		all: make(map[index.Type]index.Indexable),
+		ref:    make(map[uint64]string),
+		all:    make(map[index.Type]index.Indexable),
+		tokens: make(map[index.Type]*tokenIndex),
+		types:  slices.Clone(typ),
 	}
 	for _, tt := range typ {
 		switch tt {
@@ -52,6 +101,8 @@ func newBitmap(typ ...index.Type) *bitmaps {
 			b.all[tt] = index.NewTokenIndex(index.ExtractSummary)
 		case index.ByContent:
 			b.all[tt] = index.NewTokenIndex(index.ExtractContent)
+		case ByFullText:
+			b.text = newFullText()
 		case index.ByActor:
 			b.all[tt] = index.NewTokenIndex(index.ExtractActor)
 		case index.ByObject:
@@ -60,6 +111,42 @@ func newBitmap(typ ...index.Type) *bitmaps {
 			b.all[tt] = index.NewTokenIndex(index.ExtractRecipients)
 		case index.ByAttributedTo:
 			b.all[tt] = index.NewTokenIndex(index.ExtractAttributedTo)
+		case ByHashtag:
+			b.tokens[tt] = newTokenIndex(extractHashtags)
+		case ByMention:
+			b.tokens[tt] = newTokenIndex(extractMentions)
+		case ByTag:
+			b.tokens[tt] = newTokenIndex(extractTags)
+		case ByThread:
+			b.threads = newThreads()
+		case ByURL:
+			b.tokens[tt] = newTokenIndex(extractURL)
+		case ByMediaType:
+			b.tokens[tt] = newTokenIndex(extractMediaType)
+		case ByAttachmentMediaType:
+			b.tokens[tt] = newTokenIndex(extractAttachmentMediaType)
+		case ByGenerator:
+			b.tokens[tt] = newTokenIndex(extractGenerator)
+		case ByLanguage:
+			b.tokens[tt] = newTokenIndex(extractLanguages)
+		case ByNameLanguage:
+			b.tokens[tt] = newTokenIndex(extractNameByLanguage)
+		case BySummaryLanguage:
+			b.tokens[tt] = newTokenIndex(extractSummaryByLanguage)
+		case ByContentLanguage:
+			b.tokens[tt] = newTokenIndex(extractContentByLanguage)
+		case ByLocation:
+			b.tokens[tt] = newTokenIndex(extractLocations)
+		default:
+			ci, ok := customIndex(tt)
+			if !ok {
+				continue
+			}
+			if ci.New != nil {
+				b.all[tt] = ci.New()
+			} else {
+				b.tokens[tt] = newTokenIndex(ci.Extract)
+			}
 		}
 	}
 	return &b
@@ -82,7 +169,7 @@ func (r *repo) searchIndex(col vocab.Item, ff ...filters.Check) (vocab.ItemColle
 
 	idxPath := r.collectionIndexStoragePath(col.GetLink())
 
-	bmp := filters.Checks(ff).IndexMatch(i.all)
+	bmp := i.match(ff...)
 	colBmp := roaring64.New()
 	_ = loadBinFromFile(r.root, idxPath, colBmp)
 	bmp.And(colBmp)
@@ -113,7 +200,7 @@ func (r *repo) searchIndex(col vocab.Item, ff ...filters.Check) (vocab.ItemColle
 const _indexDirName = ".index"
 
 func (r *repo) collectionIndexStoragePath(col vocab.IRI) string {
-	return filepath.Join(iriPath(col), _indexDirName)
+	return filepath.Join(r.pathOf(col), _indexDirName)
 }
 
 func getIndexKey(typ index.Type) string {
@@ -138,10 +225,37 @@ func getIndexKey(typ index.Type) string {
 		return ".recipients.gob"
 	case index.ByAttributedTo:
 		return ".attributedTo.gob"
+	case ByHashtag:
+		return ".hashtag.gob"
+	case ByMention:
+		return ".mention.gob"
+	case ByTag:
+		return ".tag.gob"
+	case ByURL:
+		return ".url.gob"
+	case ByMediaType:
+		return ".mediaType.gob"
+	case ByAttachmentMediaType:
+		return ".attachmentMediaType.gob"
+	case ByGenerator:
+		return ".generator.gob"
+	case ByLanguage:
+		return ".language.gob"
+	case ByNameLanguage:
+		return ".nameLanguage.gob"
+	case BySummaryLanguage:
+		return ".summaryLanguage.gob"
+	case ByContentLanguage:
+		return ".contentLanguage.gob"
+	case ByLocation:
+		return ".location.gob"
 	case index.ByInReplyTo:
 	case index.ByPublished:
 	case index.ByUpdated:
 	default:
+		if ci, ok := customIndex(typ); ok {
+			return ci.fileName()
+		}
 	}
 	return ""
 }
@@ -175,9 +289,31 @@ func saveIndex(root *os.Root, idx *bitmaps, idxPath string) error {
 			errs = append(errs, err)
 		}
 	}
+	for typ, ti := range idx.tokens {
+		ip := filepath.Join(idxPath, getIndexKey(typ))
+		ti.w.RLock()
+		err := writeBinFile(root, ip, ti)
+		ti.w.RUnlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
 	if err := writeBinFile(root, filepath.Join(idxPath, _refName), idx.ref); err != nil {
 		errs = append(errs, err)
 	}
+	if idx.threads != nil {
+		idx.threads.w.RLock()
+		err := writeBinFile(root, filepath.Join(idxPath, _threadsName), idx.threads)
+		idx.threads.w.RUnlock()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if idx.text != nil {
+		if err := idx.text.persist(root, idxPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	return errors.Join(errs...)
 }
@@ -201,9 +337,30 @@ func (r *repo) loadIndex() error {
 			errs = append(errs, err)
 		}
 	}
+	for typ, ti := range r.index.tokens {
+		ti.w.Lock()
+		err := loadBinFromFile(r.root, filepath.Join(idxPath, getIndexKey(typ)), ti)
+		ti.w.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
 	if err := loadBinFromFile(r.root, filepath.Join(idxPath, _refName), &r.index.ref); err != nil {
 		errs = append(errs, err)
 	}
+	if r.index.threads != nil {
+		r.index.threads.w.Lock()
+		err := loadBinFromFile(r.root, filepath.Join(idxPath, _threadsName), r.index.threads)
+		r.index.threads.w.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	if r.index.text != nil {
+		if err := r.index.text.load(r.root, idxPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
 	return errors.Join(errs...)
 }
 
@@ -231,6 +388,10 @@ func (r *repo) removeFromIndex(it vocab.Item, path string) error {
 		return errors.NotFoundf("nil item")
 	}
 	in := r.index
+
+	in.w.Lock()
+	defer in.w.Unlock()
+
 	errs := make([]error, 0)
 	typ := it.GetType()
 	switch {
@@ -269,6 +430,30 @@ func (r *repo) removeFromIndex(it vocab.Item, path string) error {
 			continue
 		}
 	}
+	for _, ct := range customIndexTypes() {
+		i, ok := in.all[ct]
+		if !ok {
+			continue
+		}
+		if rem, ok := i.(remover); ok {
+			if err := rem.Remove(it); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, ti := range in.tokens {
+		if err := ti.Remove(it); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if in.threads != nil {
+		in.threads.Remove(it.GetLink())
+	}
+	if in.text != nil {
+		if err := in.text.Remove(it); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	return errors.Join(errs...)
 }
@@ -277,10 +462,13 @@ func (r *repo) addToIndex(it vocab.Item, path string) error {
 	if r == nil || r.index == nil {
 		return indexDisabled
 	}
+	return r.index.add(r.withLoadedTags(it), path)
+}
+
+func (in *bitmaps) add(it vocab.Item, path string) error {
 	if vocab.IsNil(it) {
 		return errors.NotFoundf("nil item")
 	}
-	in := r.index
 
 	in.w.Lock()
 	defer in.w.Unlock()
@@ -311,14 +499,56 @@ func (r *repo) addToIndex(it vocab.Item, path string) error {
 			itemRef = ig.Add(it)
 		}
 	}
+	for _, ct := range customIndexTypes() {
+		if ic, ok := in.all[ct]; ok {
+			_ = ic.Add(it)
+		}
+	}
+	for _, ti := range in.tokens {
+		_ = ti.Add(it)
+	}
+	if in.threads != nil {
+		in.threads.Add(it)
+	}
+	if in.text != nil {
+		_ = in.text.Add(it)
+	}
+	if itemRef == 0 && index.HashFn != nil {
+		itemRef = index.HashFn(it.GetLink())
+	}
 	in.ref[itemRef] = path
 
 	return nil
 }
 
+// merge replaces the indexes of in with the ones from fresh, for the types fresh was created with.
+func (in *bitmaps) merge(fresh *bitmaps) {
+	in.w.Lock()
+	defer in.w.Unlock()
+
+	for typ, idx := range fresh.all {
+		in.all[typ] = idx
+	}
+	for typ, ti := range fresh.tokens {
+		in.tokens[typ] = ti
+	}
+	if fresh.threads != nil {
+		in.threads = fresh.threads
+	}
+	if fresh.text != nil {
+		fresh.text.w.Lock()
+		fresh.text.rewrite = true
+		fresh.text.w.Unlock()
+		in.text = fresh.text
+	}
+	for ref, p := range fresh.ref {
+		in.ref[ref] = p
+	}
+}
+
 func (r *repo) iriFromPath(p string) vocab.IRI {
-	p = strings.Trim(strings.TrimSuffix(strings.Replace(p, r.root.Name(), "", 1), objectKey), "/")
-	return vocab.IRI(fmt.Sprintf("https://%s", p))
+	p = unshardPath(strings.Trim(strings.TrimSuffix(strings.Replace(p, r.root.Name(), "", 1), objectKey), "/"))
+	return pathIRI(p)
 }
 
 func (r *repo) collectionBitmapOp(fn func(*roaring64.Bitmap, uint64), items ...vocab.Item) func(col vocab.CollectionInterface) error {
@@ -363,53 +593,17 @@ func (r *repo) collectionBitmapOp(fn func(*roaring64.Bitmap, uint64), items ...v
 	}
 }
 
-func (r *repo) Reindex() (err error) {
-	if r == nil || r.root == nil {
-		return errNotOpen
-	}
-	if err = r.loadIndex(); err != nil {
-		return indexDisabled
-	}
-	defer func() {
-		err = r.saveIndex()
-	}()
-
-	root := r.root.FS()
-	err = fs.WalkDir(root, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.Type().IsDir() {
-			return nil
-		}
-		if d.Name() != objectKey {
-			return nil
-		}
-
-		var it vocab.Item
-		dir := filepath.Dir(path)
-		maybeCol := filepath.Base(dir)
-		iri := r.iriFromPath(dir)
-		if storageCollectionPaths.Contains(vocab.CollectionPath(maybeCol)) {
-			it, err = r.loadCollectionFromPath(filepath.Join(path), iri)
-			if err == nil {
-				err = vocab.OnCollectionIntf(it, r.collectionBitmapOp((*roaring64.Bitmap).Add))
-			}
-		} else {
-			it, err = r.loadItemFromPath(filepath.Join(path))
-		}
-		if err != nil || vocab.IsNil(it) {
-			return nil
-		}
-		if err = r.addToIndex(it, dir); err != nil {
-			if errors.IsNotImplemented(err) {
-				return fs.SkipAll
-			}
-		}
-		return nil
-	})
+// Reindex rebuilds the indexes for the whole storage, using the default ReindexOptions.
+// If a previous reindex was interrupted, it continues from its last checkpoint.
+func (r *repo) Reindex() error {
+	report, err := r.ReindexWithOptions(ReindexOptions{})
 	if err != nil {
 		return err
 	}
+	for _, failed := range report.Failed {
+		if r.logger != nil {
+			r.logger.Debugf("unable to reindex %s", failed)
+		}
+	}
 	return nil
 }
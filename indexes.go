@@ -0,0 +1,187 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters/index"
+)
+
+// DefaultIndexTypes returns the index types enabled when Config.Indexes is empty.
+func DefaultIndexTypes() []index.Type {
+	return slices.Clone(defaultIndexTypes)
+}
+
+// indexTypes returns the index types enabled by the configuration.
+// When Indexes is empty, the default types are used.
+func (c Config) indexTypes() []index.Type {
+	types := slices.Clone(c.Indexes)
+	if len(types) == 0 {
+		types = DefaultIndexTypes()
+	}
+	slices.Sort(types)
+	return slices.Compact(types)
+}
+
+// indexFiles returns the names of the files, from the index directory, that hold the typ index.
+func indexFiles(typ index.Type) []string {
+	switch typ {
+	case ByThread:
+		return []string{_threadsName}
+	case ByFullText:
+		return []string{_fullTextName, _fullTextLogName}
+	}
+	if key := getIndexKey(typ); key != "" {
+		return []string{key}
+	}
+	return nil
+}
+
+func (r *repo) indexFileExists(name string) bool {
+	_, err := r.root.Stat(filepath.Join(_indexDirName, name))
+	return err == nil
+}
+
+// missingIndexTypes returns the enabled index types that don't have any data on disk.
+// A storage that was never indexed has no missing types, it needs a full Reindex instead.
+func (r *repo) missingIndexTypes() []index.Type {
+	if r.index == nil || !r.indexFileExists(_refName) {
+		return nil
+	}
+	missing := make([]index.Type, 0)
+	for _, typ := range r.index.types {
+		for _, name := range indexFiles(typ) {
+			if !r.indexFileExists(name) {
+				missing = append(missing, typ)
+				break
+			}
+		}
+	}
+	return missing
+}
+
+// MissingIndexTypes returns the enabled index types that were not built yet for the storage,
+// which BackfillIndex builds.
+func (r *repo) MissingIndexTypes() []index.Type {
+	if r == nil || r.root == nil {
+		return nil
+	}
+	return r.missingIndexTypes()
+}
+
+// DropIndex deletes the files of the types indexes. The types must not be enabled.
+// When no types are passed, the files of all the types that are not enabled get deleted, as they
+// would go stale otherwise, and be loaded as such when the types get enabled again.
+func (r *repo) DropIndex(types ...index.Type) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+	if r.index == nil {
+		return indexDisabled
+	}
+	if len(types) == 0 {
+		for _, typ := range slices.Concat(knownIndexTypes, customIndexTypes()) {
+			if !slices.Contains(r.index.types, typ) {
+				types = append(types, typ)
+			}
+		}
+	}
+	for _, typ := range types {
+		if slices.Contains(r.index.types, typ) {
+			return errors.Conflictf("unable to drop the enabled index type %d", typ)
+		}
+	}
+	errs := make([]error, 0)
+	for _, typ := range types {
+		for _, name := range indexFiles(typ) {
+			err := r.root.Remove(filepath.Join(_indexDirName, name))
+			if err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BackfillIndex builds the indexes of the enabled types that are missing, from the objects found
+// in the storage. The indexes for the other types are left untouched.
+// It walks the whole storage, so callers usually run it in the background after Open, reporting
+// the progress through ReindexOptions.Progress every ReindexOptions.CheckpointEvery objects.
+// The objects that failed to load are returned in the report, they don't stop the backfill.
+func (r *repo) BackfillIndex(opts ReindexOptions) (*ReindexReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	return r.backfillIndex(opts, r.missingIndexTypes()...)
+}
+
+// backfillIndex builds the indexes for types from the objects found in the storage.
+func (r *repo) backfillIndex(opts ReindexOptions, types ...index.Type) (*ReindexReport, error) {
+	report := new(ReindexReport)
+	if r.index == nil || len(types) == 0 {
+		return report, nil
+	}
+	if err := r.loadIndex(); err != nil && errors.Is(err, errNotOpen) {
+		return report, err
+	}
+
+	started := time.Now().UTC()
+	last := ""
+	progress := func() {
+		if opts.Progress != nil {
+			opts.Progress(ReindexProgress{
+				Processed: report.Processed,
+				Failed:    len(report.Failed),
+				Last:      last,
+				Elapsed:   time.Since(started),
+			})
+		}
+	}
+
+	fresh := newBitmap(types...)
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || d.Name() == folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != objectKey {
+			return nil
+		}
+		it, err := r.loadItemFromPath(p)
+		if err == nil && vocab.IsNil(it) {
+			err = errors.NotFoundf("empty object")
+		}
+		if err != nil {
+			// NOTE(marius): objects that can't be loaded are skipped, the same as Reindex does
+			report.Failed = append(report.Failed, ReindexError{Path: p, Err: err})
+			return nil
+		}
+		if err = fresh.add(r.withLoadedTags(it), filepath.Dir(p)); err != nil {
+			return err
+		}
+		last = p
+		if report.Processed++; report.Processed%opts.checkpointEvery() == 0 {
+			progress()
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	r.index.merge(fresh)
+	if err = r.saveIndex(); err != nil {
+		return report, err
+	}
+	progress()
+	return report, nil
+}
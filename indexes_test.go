@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters/index"
+)
+
+func TestConfig_indexTypes(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   []index.Type
+	}{
+		{
+			name:   "empty",
+			config: Config{},
+			want:   Config{Indexes: defaultIndexTypes}.indexTypes(),
+		},
+		{
+			name:   "selected",
+			config: Config{Indexes: []index.Type{ByGenerator, ByURL}},
+			want:   []index.Type{ByURL, ByGenerator},
+		},
+		{
+			name:   "selected with duplicates",
+			config: Config{Indexes: []index.Type{ByGenerator, ByURL, ByGenerator}},
+			want:   []index.Type{ByURL, ByGenerator},
+		},
+		{
+			name:   "default with optional",
+			config: Config{Indexes: append(DefaultIndexTypes(), ByURL)},
+			want: func() []index.Type {
+				types := slices.Concat(defaultIndexTypes, []index.Type{ByURL})
+				slices.Sort(types)
+				return types
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.indexTypes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("indexTypes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_repo_missingIndexTypes(t *testing.T) {
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path), index: newBitmap(index.ByID, index.ByType)})
+	if got := r.missingIndexTypes(); len(got) > 0 {
+		t.Errorf("missingIndexTypes() for a storage never indexed = %v, want none", got)
+	}
+
+	r = withItems(mockPropertyItems...)(t, r)
+	if got := r.missingIndexTypes(); len(got) > 0 {
+		t.Errorf("missingIndexTypes() = %v, want none", got)
+	}
+
+	r.index = newBitmap(index.ByID, index.ByType, index.ByContent, ByThread, ByFullText)
+	want := []index.Type{index.ByContent, ByThread, ByFullText}
+	if got := r.missingIndexTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("missingIndexTypes() = %v, want %v", got, want)
+	}
+}
+
+func Test_repo_BackfillIndex(t *testing.T) {
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path), index: newBitmap(index.ByID, index.ByType, ByMention)})
+	r = withItems(mockPropertyItems...)(t, r)
+
+	r.index = newBitmap(index.ByID, index.ByType, ByURL)
+	progress := make([]ReindexProgress, 0)
+	report, err := r.BackfillIndex(ReindexOptions{CheckpointEvery: 1, Progress: func(p ReindexProgress) {
+		progress = append(progress, p)
+	}})
+	if err != nil {
+		t.Fatalf("BackfillIndex() error = %s", err)
+	}
+	if report.Processed == 0 || len(progress) <= report.Processed {
+		t.Errorf("BackfillIndex() processed %d objects, reporting progress %d times", report.Processed, len(progress))
+	}
+	if got := r.MissingIndexTypes(); len(got) > 0 {
+		t.Errorf("MissingIndexTypes() after backfill = %v, want none", got)
+	}
+	if !r.indexFileExists(getIndexKey(ByMention)) {
+		t.Errorf("BackfillIndex() removed the disabled %s index", getIndexKey(ByMention))
+	}
+
+	got, err := r.LoadByURL("https://example.com/@alice")
+	if err != nil {
+		t.Fatalf("LoadByURL() after backfill error = %s", err)
+	}
+	if want := vocab.IRI("https://example.com/~alice"); !got.GetLink().Equals(want, true) {
+		t.Errorf("LoadByURL() after backfill = %s, want %s", got.GetLink(), want)
+	}
+}
+
+func Test_repo_DropIndex(t *testing.T) {
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path), index: newBitmap(index.ByID, index.ByType, ByMention, ByURL)})
+	r = withItems(mockPropertyItems...)(t, r)
+
+	r.index = newBitmap(index.ByID, index.ByType)
+	if err := r.DropIndex(index.ByType); !errors.IsConflict(err) {
+		t.Errorf("DropIndex() for an enabled type error = %v, want a conflict", err)
+	}
+	if err := r.DropIndex(ByMention); err != nil {
+		t.Fatalf("DropIndex() error = %s", err)
+	}
+	if r.indexFileExists(getIndexKey(ByMention)) {
+		t.Errorf("DropIndex() didn't remove the %s index", getIndexKey(ByMention))
+	}
+	if !r.indexFileExists(getIndexKey(ByURL)) {
+		t.Errorf("DropIndex() removed the %s index", getIndexKey(ByURL))
+	}
+	if err := r.DropIndex(); err != nil {
+		t.Fatalf("DropIndex() error = %s", err)
+	}
+	if r.indexFileExists(getIndexKey(ByURL)) {
+		t.Errorf("DropIndex() didn't remove the disabled %s index", getIndexKey(ByURL))
+	}
+	if !r.indexFileExists(getIndexKey(index.ByType)) {
+		t.Errorf("DropIndex() removed the enabled %s index", getIndexKey(index.ByType))
+	}
+}
@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+// languagePartitionTypes are the optional indexes that partition the name, summary and
+// content terms by the language of the value they were extracted from.
+var languagePartitionTypes = []index.Type{ByNameLanguage, BySummaryLanguage, ByContentLanguage}
+
+// undeterminedLanguage is the partition used for the values without a language tag.
+const undeterminedLanguage = "und"
+
+// languageTags returns the lower cased language tag, and its primary subtag if it has a region or script.
+// The values without a language tag don't return anything.
+func languageTags(lang string) []string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang == "" || lang == "-" {
+		return nil
+	}
+	lang = strings.ReplaceAll(lang, "_", "-")
+	if primary, _, ok := strings.Cut(lang, "-"); ok && primary != "" {
+		return []string{lang, primary}
+	}
+	return []string{lang}
+}
+
+// partitionOf returns the partition the values in the lang language are indexed under.
+func partitionOf(lang string) string {
+	tags := languageTags(lang)
+	if len(tags) == 0 {
+		return undeterminedLanguage
+	}
+	return tags[len(tags)-1]
+}
+
+// extractLanguages returns the languages of the name, summary and content values of the item.
+func extractLanguages(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		for _, nlv := range []vocab.NaturalLanguageValues{ob.Name, ob.Summary, ob.Content} {
+			for _, lv := range langValues(nlv) {
+				result = append(result, languageTags(lv.Lang)...)
+			}
+		}
+	})
+	return result
+}
+
+// partitionedTerms returns the terms of the nlv values, prefixed by the partition of their language.
+func partitionedTerms(nlv vocab.NaturalLanguageValues) []string {
+	result := make([]string, 0)
+	for _, lv := range langValues(nlv) {
+		part := partitionOf(lv.Lang)
+		for _, tok := range tokenize(stripHTML(lv.Value)) {
+			result = append(result, part+":"+tok)
+		}
+	}
+	return result
+}
+
+func extractPartitionedFn(prop func(*vocab.Object) vocab.NaturalLanguageValues) func(vocab.LinkOrIRI) []string {
+	return func(li vocab.LinkOrIRI) []string {
+		result := make([]string, 0)
+		onObjectProps(li, func(ob *vocab.Object) {
+			result = partitionedTerms(prop(ob))
+		})
+		return result
+	}
+}
+
+var (
+	extractNameByLanguage    = extractPartitionedFn(func(ob *vocab.Object) vocab.NaturalLanguageValues { return ob.Name })
+	extractSummaryByLanguage = extractPartitionedFn(func(ob *vocab.Object) vocab.NaturalLanguageValues { return ob.Summary })
+	extractContentByLanguage = extractPartitionedFn(func(ob *vocab.Object) vocab.NaturalLanguageValues { return ob.Content })
+)
+
+// InLanguage matches the objects having a name, summary or content in any of the received languages.
+// A primary language, like "de", matches the regional variants too, like "de-AT".
+func InLanguage(langs ...string) filters.Check {
+	c := tokenCheck{typ: ByLanguage, extractFn: extractLanguages}
+	for _, lang := range langs {
+		if tags := languageTags(lang); len(tags) > 0 {
+			c.tokens = append(c.tokens, tags[0])
+		}
+	}
+	return c
+}
+
+func partitionedCheck(typ index.Type, extractFn func(vocab.LinkOrIRI) []string, lang string, terms []string) filters.Check {
+	c := tokenCheck{typ: typ, extractFn: extractFn}
+	part := partitionOf(lang)
+	for _, term := range terms {
+		for _, tok := range tokenize(term) {
+			c.tokens = append(c.tokens, part+":"+tok)
+		}
+	}
+	return c
+}
+
+// NameIn matches the objects with a name in the lang language containing any of the terms.
+func NameIn(lang string, terms ...string) filters.Check {
+	return partitionedCheck(ByNameLanguage, extractNameByLanguage, lang, terms)
+}
+
+// SummaryIn matches the objects with a summary in the lang language containing any of the terms.
+func SummaryIn(lang string, terms ...string) filters.Check {
+	return partitionedCheck(BySummaryLanguage, extractSummaryByLanguage, lang, terms)
+}
+
+// ContentIn matches the objects with a content in the lang language containing any of the terms.
+func ContentIn(lang string, terms ...string) filters.Check {
+	return partitionedCheck(ByContentLanguage, extractContentByLanguage, lang, terms)
+}
@@ -0,0 +1,137 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+var mockMultilingual = &vocab.Object{
+	ID:   "https://example.com/objects/multilingual",
+	Type: vocab.NoteType,
+	Name: vocab.NaturalLanguageValues{
+		"en": vocab.Content("Good morning"),
+	},
+	Content: vocab.NaturalLanguageValues{
+		"de-AT": vocab.Content("<p>Guten Morgen</p>"),
+		"en":    vocab.Content("<p>Good morning</p>"),
+	},
+}
+
+func Test_languageTags(t *testing.T) {
+	tests := []struct {
+		name string
+		lang string
+		want []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "undetermined",
+			lang: "-",
+		},
+		{
+			name: "primary",
+			lang: "EN",
+			want: []string{"en"},
+		},
+		{
+			name: "with region",
+			lang: "de_AT",
+			want: []string{"de-at", "de"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := languageTags(tt.lang); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("languageTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extractLanguages(t *testing.T) {
+	want := []string{"en", "de-at", "de", "en"}
+	if got := extractLanguages(mockMultilingual); !reflect.DeepEqual(got, want) {
+		t.Errorf("extractLanguages() = %v, want %v", got, want)
+	}
+}
+
+func Test_extractContentByLanguage(t *testing.T) {
+	want := []string{"de:guten", "de:morgen", "en:good", "en:morning"}
+	if got := extractContentByLanguage(mockMultilingual); !reflect.DeepEqual(got, want) {
+		t.Errorf("extractContentByLanguage() = %v, want %v", got, want)
+	}
+}
+
+func TestInLanguage(t *testing.T) {
+	tests := []struct {
+		name  string
+		langs []string
+		it    vocab.Item
+		want  bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "primary matches region",
+			langs: []string{"de"},
+			it:    mockMultilingual,
+			want:  true,
+		},
+		{
+			name:  "region",
+			langs: []string{"de-AT"},
+			it:    mockMultilingual,
+			want:  true,
+		},
+		{
+			name:  "other language",
+			langs: []string{"fr"},
+			it:    mockMultilingual,
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := InLanguage(tt.langs...).Match(tt.it); got != tt.want {
+				t.Errorf("InLanguage().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentIn(t *testing.T) {
+	tests := []struct {
+		name  string
+		lang  string
+		terms []string
+		want  bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "term in language",
+			lang:  "de",
+			terms: []string{"morgen"},
+			want:  true,
+		},
+		{
+			name:  "term in other language",
+			lang:  "en",
+			terms: []string{"Morgen"},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContentIn(tt.lang, tt.terms...).Match(mockMultilingual); got != tt.want {
+				t.Errorf("ContentIn().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/go-ap/errors"
+)
+
+// _layoutName is the file, in the root of the storage, which records how the storage is organized on disk.
+const _layoutName = ".storage.json"
+
+// layout is the content of the layout file.
+type layout struct {
+	Version    int        `json:"version"`
+	Sharded    bool       `json:"sharded,omitempty"`
+	Membership Membership `json:"membership,omitempty"`
+	Updated    time.Time  `json:"updated"`
+}
+
+// migration upgrades a storage from the previous layout version to its version, and it returns
+// the number of files it changed.
+type migration struct {
+	version int
+	name    string
+	run     func(r *repo) (int, error)
+}
+
+// migrations are the steps for upgrading a storage to the current layout version, in order.
+//
+// A change to the paths, the index formats, or the shape of the stored records, needs a new step at the end.
+// The steps must be safe to run on a storage which doesn't need them, as the storages created before
+// the layout file was introduced get all of them applied.
+var migrations = []migration{
+	{version: 1, name: "paths", run: (*repo).MigratePaths},
+	{version: 2, name: "index", run: reindexLayout},
+}
+
+func currentLayoutVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+func reindexLayout(r *repo) (int, error) {
+	if r.index == nil {
+		return 0, nil
+	}
+	report, err := r.ReindexWithOptions(ReindexOptions{Fresh: true})
+	if err != nil {
+		return 0, err
+	}
+	return report.Processed, nil
+}
+
+func loadLayout(root *os.Root) (*layout, error) {
+	raw, err := fs.ReadFile(root.FS(), _layoutName)
+	if err != nil {
+		return nil, err
+	}
+	l := new(layout)
+	if err = decodeFn(raw, l); err != nil {
+		return nil, errors.Annotatef(err, "invalid layout file %s", _layoutName)
+	}
+	return l, nil
+}
+
+func saveLayout(root *os.Root, l layout) error {
+	l.Updated = time.Now().UTC()
+	raw, err := encodeFn(l)
+	if err != nil {
+		return err
+	}
+	return putRaw(root, _layoutName, raw)
+}
+
+// bootstrapLayout writes the layout file of a new storage at conf.Path.
+// The existing storages which don't have one are left for Upgrade, as we can't know their layout version.
+func bootstrapLayout(conf Config) error {
+	if entries, err := os.ReadDir(conf.Path); err != nil || len(entries) > 0 {
+		return nil
+	}
+	root, err := os.OpenRoot(conf.Path)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	return saveLayout(root, layout{Version: currentLayoutVersion(), Sharded: conf.ShardedLayout, Membership: conf.Membership})
+}
+
+// checkLayout compares the layout file of the storage with the layout the repository was configured with.
+// The storages with a newer layout version are refused, and for the older ones, a warning is logged.
+func (r *repo) checkLayout() error {
+	l, err := loadLayout(r.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		if entries, _ := fs.ReadDir(r.root.FS(), "."); len(entries) > 0 {
+			r.logger.Warnf("The storage at %s has no layout file, run Upgrade to bring it to the current layout", r.path)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if l.Version > currentLayoutVersion() {
+		return errors.NotImplementedf("the storage layout version %d is newer than the supported %d", l.Version, currentLayoutVersion())
+	}
+	if l.Version < currentLayoutVersion() {
+		r.logger.Warnf("The storage layout version %d is older than the current %d, run Upgrade to bring it up to date", l.Version, currentLayoutVersion())
+	}
+	// NOTE(marius): the layout file is authoritative, so a mismatched configuration doesn't get to
+	// write members in a layout the rest of the storage doesn't use.
+	if l.Sharded != r.sharded {
+		r.logger.Warnf("The storage uses the sharded layout: %t, which doesn't match the configuration", l.Sharded)
+		r.sharded = l.Sharded
+	}
+	if l.Membership != r.membership {
+		r.logger.Warnf("The storage uses the %d membership storage, which doesn't match the configuration", l.Membership)
+		r.membership = l.Membership
+	}
+	return nil
+}
+
+// updateLayout applies fn to the layout file of the storage, if it has one.
+func (r *repo) updateLayout(fn func(*layout)) error {
+	l, err := loadLayout(r.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fn(l)
+	return saveLayout(r.root, *l)
+}
+
+// UpgradeOptions control the upgrade of a storage to the current layout version.
+type UpgradeOptions struct {
+	// DryRun only reports the steps that would be applied.
+	DryRun bool
+}
+
+// UpgradeStep is a step applied by Upgrade.
+type UpgradeStep struct {
+	Version int
+	Name    string
+	// Count is the number of files the step changed, it's always 0 for a dry run.
+	Count int
+}
+
+// UpgradeReport is the result of an upgrade.
+type UpgradeReport struct {
+	From  int
+	To    int
+	Steps []UpgradeStep
+}
+
+// Upgrade applies, in order, the steps needed to bring the storage from its layout version to the current one.
+// The version in the layout file is updated after every step, so an interrupted upgrade continues
+// with the step that failed. The storages without a layout file are considered to be at version 0.
+//
+// It is meant to be run while the storage is not in use by other processes.
+func (r *repo) Upgrade(opts UpgradeOptions) (*UpgradeReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	l, err := loadLayout(r.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		l, err = &layout{Sharded: r.sharded, Membership: r.membership}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.Version > currentLayoutVersion() {
+		return nil, errors.NotImplementedf("the storage layout version %d is newer than the supported %d", l.Version, currentLayoutVersion())
+	}
+
+	report := UpgradeReport{From: l.Version, To: l.Version, Steps: make([]UpgradeStep, 0)}
+	for _, m := range migrations {
+		if m.version <= l.Version {
+			continue
+		}
+		step := UpgradeStep{Version: m.version, Name: m.name}
+		if !opts.DryRun {
+			if step.Count, err = m.run(r); err != nil {
+				return &report, errors.Annotatef(err, "unable to upgrade the storage to version %d (%s)", m.version, m.name)
+			}
+			l.Version = m.version
+			if err = saveLayout(r.root, *l); err != nil {
+				return &report, err
+			}
+		}
+		report.To = m.version
+		report.Steps = append(report.Steps, step)
+	}
+	return &report, nil
+}
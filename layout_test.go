@@ -0,0 +1,82 @@
+package fs
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func Test_Bootstrap_layout(t *testing.T) {
+	conf := Config{Path: filepath.Join(t.TempDir(), "test"), ShardedLayout: true, Membership: MembershipManifest}
+	if err := Bootstrap(conf); err != nil {
+		t.Fatalf("Bootstrap() error = %s", err)
+	}
+
+	r, err := New(Config{Path: conf.Path})
+	if err != nil {
+		t.Fatalf("New() error = %s", err)
+	}
+	if err = r.Open(); err != nil {
+		t.Fatalf("Open() error = %s", err)
+	}
+	defer r.Close()
+
+	l, err := loadLayout(r.root)
+	if err != nil {
+		t.Fatalf("loadLayout() error = %s", err)
+	}
+	if l.Version != currentLayoutVersion() {
+		t.Errorf("layout version = %d, want %d", l.Version, currentLayoutVersion())
+	}
+	if !r.sharded || r.membership != MembershipManifest {
+		t.Errorf("Open() sharded, membership = %t, %d, want the ones from the layout file", r.sharded, r.membership)
+	}
+
+	if _, err = r.Reshard(false); err != nil {
+		t.Fatalf("Reshard() error = %s", err)
+	}
+	if l, _ = loadLayout(r.root); l == nil || l.Sharded {
+		t.Errorf("Reshard() didn't update the layout file: %+v", l)
+	}
+
+	l.Version = currentLayoutVersion() + 1
+	if err = saveLayout(r.root, *l); err != nil {
+		t.Fatalf("saveLayout() error = %s", err)
+	}
+	newer, _ := New(Config{Path: conf.Path})
+	if err = newer.Open(); err == nil {
+		newer.Close()
+		t.Errorf("Open() of a storage with a newer layout didn't return an error")
+	}
+}
+
+func Test_repo_Upgrade(t *testing.T) {
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)}, withGeneratedRoot(root))
+
+	report, err := r.Upgrade(UpgradeOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Upgrade() dry run error = %s", err)
+	}
+	if report.From != 0 || report.To != currentLayoutVersion() || len(report.Steps) != len(migrations) {
+		t.Errorf("Upgrade() dry run report = %+v", report)
+	}
+	if _, err = loadLayout(r.root); err == nil {
+		t.Errorf("Upgrade() dry run wrote the layout file")
+	}
+
+	if _, err = r.Upgrade(UpgradeOptions{}); err != nil {
+		t.Fatalf("Upgrade() error = %s", err)
+	}
+	l, err := loadLayout(r.root)
+	if err != nil || l.Version != currentLayoutVersion() {
+		t.Errorf("Upgrade() layout = %+v, %v, want version %d", l, err, currentLayoutVersion())
+	}
+	if _, err = r.Load(rootIRI); err != nil {
+		t.Errorf("Load() after Upgrade() error = %s", err)
+	}
+
+	report, err = r.Upgrade(UpgradeOptions{})
+	if err != nil || len(report.Steps) != 0 {
+		t.Errorf("Upgrade() of an up to date storage = %+v, %v", report, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package fs
+
+import "os"
+
+// linkCount reports that the number of hard links to the file is not known, as it's not available on all platforms.
+func linkCount(_ os.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,586 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+)
+
+// Membership is the way the members of the collections are stored.
+type Membership uint8
+
+const (
+	// MembershipSymlinks stores every member of a collection as a relative symlink to the member object,
+	// inside the collection's directory.
+	MembershipSymlinks Membership = iota
+	// MembershipManifest stores the members of a collection in an append-only manifest file,
+	// inside the collection's directory.
+	MembershipManifest
+)
+
+const _manifestName = ".members"
+
+// manifestCompactMinLines is the size of a manifest under which it doesn't get compacted.
+const manifestCompactMinLines = 64
+
+const (
+	manifestAdd    = '+'
+	manifestRemove = '-'
+)
+
+// manifest holds the members of a collection.
+//
+// The manifest file contains one line for every operation on the collection, in the order they happened:
+// "+<seq> <iri>" for adding a member, and "-<seq> <iri>" for removing one.
+// The sequence numbers keep growing, so the members are ordered by the time they were added.
+type manifest struct {
+	next    uint64
+	lines   int
+	members map[vocab.IRI]uint64
+
+	// size is the length of the manifest file that was read, which ends in the last complete line,
+	// and file is the state of the file at that time.
+	size int64
+	file os.FileInfo
+}
+
+func newManifest() *manifest {
+	return &manifest{members: make(map[vocab.IRI]uint64)}
+}
+
+func manifestPath(colPath string) string {
+	return path.Join(colPath, _manifestName)
+}
+
+func (m *manifest) contains(iri vocab.IRI) bool {
+	_, ok := m.members[iri]
+	return ok
+}
+
+func (m *manifest) apply(op byte, seq uint64, iri vocab.IRI) {
+	m.lines++
+	if seq >= m.next {
+		m.next = seq + 1
+	}
+	switch op {
+	case manifestAdd:
+		if !m.contains(iri) {
+			m.members[iri] = seq
+		}
+	case manifestRemove:
+		delete(m.members, iri)
+	}
+}
+
+// iris returns the members in the order they were added.
+func (m *manifest) iris() vocab.IRIs {
+	iris := make(vocab.IRIs, 0, len(m.members))
+	for iri := range m.members {
+		iris = append(iris, iri)
+	}
+	slices.SortFunc(iris, func(a, b vocab.IRI) int {
+		return cmp.Compare(m.members[a], m.members[b])
+	})
+	return iris
+}
+
+// needsCompaction checks if most of the lines of the manifest are for members that were removed.
+func (m *manifest) needsCompaction() bool {
+	return m.lines > manifestCompactMinLines && m.lines > 2*len(m.members)
+}
+
+func manifestLine(op byte, seq uint64, iri vocab.IRI) []byte {
+	line := make([]byte, 0, len(iri)+24)
+	line = append(line, op)
+	line = strconv.AppendUint(line, seq, 10)
+	line = append(line, ' ')
+	line = append(line, iri...)
+	return append(line, '\n')
+}
+
+// loadManifest reads the manifest of the collection stored at colPath.
+// A missing manifest is returned as an empty one.
+func loadManifest(root *os.Root, colPath string) (*manifest, error) {
+	m := newManifest()
+	if err := m.refresh(root, colPath); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// refresh reads the lines appended to the manifest file since it was last read.
+// When the file was replaced, or removed, the manifest gets read again from its start.
+func (m *manifest) refresh(root *os.Root, colPath string) error {
+	f, err := root.Open(manifestPath(colPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			*m = *newManifest()
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if m.file == nil || !os.SameFile(m.file, fi) || fi.Size() < m.size {
+		*m = *newManifest()
+	}
+	m.file = fi
+	if fi.Size() == m.size {
+		return nil
+	}
+	if _, err = f.Seek(m.size, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for {
+		raw, err := br.ReadBytes('\n')
+		if err != nil {
+			// NOTE(marius): a last line without a new line is cut short by an interrupted append,
+			// it doesn't get read, and the next append replaces it.
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		m.size += int64(len(raw))
+		line := string(raw[:len(raw)-1])
+		if len(line) < 2 || (line[0] != manifestAdd && line[0] != manifestRemove) {
+			// NOTE(marius): garbage
+			continue
+		}
+		seqStr, iri, ok := strings.Cut(line[1:], " ")
+		if !ok {
+			continue
+		}
+		seq, err := strconv.ParseUint(seqStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		m.apply(line[0], seq, vocab.IRI(iri))
+	}
+}
+
+// manifest returns the members of the collection stored at colPath, which it keeps in memory between
+// the calls, reading only the lines that were appended to the manifest file since the previous one.
+// It must be called with the colPath key of r.manifests held.
+func (r *repo) manifest(colPath string) (*manifest, error) {
+	v, _ := r.manifestState.LoadOrStore(colPath, newManifest())
+	m := v.(*manifest)
+	if err := m.refresh(r.root, colPath); err != nil {
+		r.manifestState.Delete(colPath)
+		return nil, err
+	}
+	return m, nil
+}
+
+// appendToManifest appends the lines to the manifest file of the collection stored at colPath.
+// A last line cut short by an interrupted append gets removed first, so the new lines don't get glued to it.
+func appendToManifest(root *os.Root, colPath string, m *manifest, lines []byte) error {
+	f, err := root.OpenFile(manifestPath(colPath), os.O_RDWR|os.O_CREATE|os.O_APPEND, defaultFilePerm)
+	if err != nil {
+		return errors.Annotatef(err, "unable to open manifest for %s", colPath)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Annotatef(err, "unable to open manifest for %s", colPath)
+	}
+	size := fi.Size()
+	if m.file != nil && os.SameFile(m.file, fi) && size > m.size {
+		tail := make([]byte, size-m.size)
+		if _, err = f.ReadAt(tail, m.size); err != nil {
+			return errors.Annotatef(err, "unable to read manifest for %s", colPath)
+		}
+		if tail[len(tail)-1] != '\n' {
+			size = m.size + int64(bytes.LastIndexByte(tail, '\n')+1)
+			if err = f.Truncate(size); err != nil {
+				return errors.Annotatef(err, "unable to truncate manifest for %s", colPath)
+			}
+		}
+	}
+	if _, err = f.Write(lines); err != nil {
+		return errors.Annotatef(err, "unable to append to manifest for %s", colPath)
+	}
+	if size == m.size {
+		// NOTE(marius): when other processes appended complete lines since the manifest was read,
+		// they get read, together with ours, on the next refresh.
+		m.size += int64(len(lines))
+	}
+	if fi, err = f.Stat(); err == nil {
+		m.file = fi
+	}
+	return nil
+}
+
+// addToManifest appends the iris which are not already members to the manifest of the collection stored at colPath.
+func (r *repo) addToManifest(colPath string, iris ...vocab.IRI) error {
+	defer r.manifests.lock(colPath)()
+
+	m, err := r.manifest(colPath)
+	if err != nil {
+		return err
+	}
+	lines := make([]byte, 0)
+	for _, iri := range iris {
+		if m.contains(iri) {
+			continue
+		}
+		lines = append(lines, manifestLine(manifestAdd, m.next, iri)...)
+		m.apply(manifestAdd, m.next, iri)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return r.appendToManifest(colPath, m, lines)
+}
+
+// removeFromManifest appends the removal of the iris to the manifest of the collection stored at colPath,
+// and it compacts it if most of its lines are for removed members.
+func (r *repo) removeFromManifest(colPath string, iris ...vocab.IRI) error {
+	defer r.manifests.lock(colPath)()
+
+	m, err := r.manifest(colPath)
+	if err != nil {
+		return err
+	}
+	lines := make([]byte, 0)
+	for _, iri := range iris {
+		if !m.contains(iri) {
+			continue
+		}
+		lines = append(lines, manifestLine(manifestRemove, m.next, iri)...)
+		m.apply(manifestRemove, m.next, iri)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if m.needsCompaction() {
+		return r.saveManifest(colPath, m)
+	}
+	return r.appendToManifest(colPath, m, lines)
+}
+
+// appendToManifest appends the lines to the manifest, and it drops the members kept in memory if that fails,
+// as they were already changed.
+func (r *repo) appendToManifest(colPath string, m *manifest, lines []byte) error {
+	if err := appendToManifest(r.root, colPath, m, lines); err != nil {
+		r.manifestState.Delete(colPath)
+		return err
+	}
+	return nil
+}
+
+// saveManifest replaces the manifest of the collection, and it drops the members kept in memory if that fails.
+func (r *repo) saveManifest(colPath string, m *manifest) error {
+	if err := saveManifest(r.root, colPath, m); err != nil {
+		r.manifestState.Delete(colPath)
+		return err
+	}
+	return nil
+}
+
+// saveManifest replaces the manifest of the collection stored at colPath with one containing only
+// the current members of m.
+func saveManifest(root *os.Root, colPath string, m *manifest) error {
+	buf := bytes.Buffer{}
+	for _, iri := range m.iris() {
+		buf.Write(manifestLine(manifestAdd, m.members[iri], iri))
+	}
+	if err := putRaw(root, manifestPath(colPath), buf.Bytes()); err != nil {
+		return errors.Annotatef(err, "unable to replace manifest for %s", colPath)
+	}
+	m.lines = len(m.members)
+	m.size = int64(buf.Len())
+	fi, err := root.Stat(manifestPath(colPath))
+	if err != nil {
+		return err
+	}
+	m.file = fi
+	return nil
+}
+
+// loadManifestMembers appends to items the members from the manifest of the collection stored at colPath
+// which are matching the ff filters, skipping the ones already present.
+func loadManifestMembers(r *repo, colPath string, items *vocab.ItemCollection, ff ...filters.Check) error {
+	unlock := r.manifests.lock(colPath)
+	m, err := r.manifest(colPath)
+	if err != nil {
+		unlock()
+		return err
+	}
+	iris := m.iris()
+	unlock()
+
+	present := make(map[vocab.IRI]struct{}, len(*items))
+	for _, it := range *items {
+		present[it.GetLink()] = struct{}{}
+	}
+	matcherFn := filters.RawMatcher(ff)
+	for _, iri := range iris {
+		if _, ok := present[iri]; ok {
+			continue
+		}
+		raw, err := loadRaw(r.root, getObjectKey(r.pathOf(iri)))
+		if err != nil {
+			continue
+		}
+		if !matcherFn(raw) {
+			continue
+		}
+		if it, _ := itemFromRaw(raw); !vocab.IsNil(it) {
+			*items = append(*items, it)
+		}
+	}
+	return nil
+}
+
+// loadCollectionMembers appends to items the members of the collection stored at colPath which are
+// matching the ff filters: the objects stored inside it, and the ones it links to.
+func (r *repo) loadCollectionMembers(colPath string, items *vocab.ItemCollection, ff ...filters.Check) error {
+	if err := fs.WalkDir(r.root.FS(), colPath, loadWithRawFiltering(r, colPath, items, ff...)); err != nil {
+		return err
+	}
+	if r.membership != MembershipManifest {
+		return nil
+	}
+	return loadManifestMembers(r, colPath, items, ff...)
+}
+
+// linkMember creates the symlink to the iri object in the collection stored at colPath.
+func (r *repo) linkMember(colPath string, iri vocab.IRI) error {
+	itPath := r.pathOf(iri)
+	if isSubPath(itPath, colPath) {
+		// NOTE(marius): the objects stored inside the collection don't need a link
+		return nil
+	}
+	link := r.memberPath(colPath, iri)
+	rel, err := filepath.Rel(path.Dir(link), itPath)
+	if err != nil {
+		return err
+	}
+	if err = r.root.MkdirAll(path.Dir(link), defaultDirPerm); err != nil {
+		return err
+	}
+	if err = r.root.Symlink(rel, link); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// addMembers stores the iris as members of the collection stored at colPath, without loading them.
+func (r *repo) addMembers(colPath string, iris ...vocab.IRI) error {
+	if r.membership == MembershipManifest {
+		return r.addToManifest(colPath, iris...)
+	}
+	for _, iri := range iris {
+		if err := r.linkMember(colPath, iri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memberIRIs returns the IRIs of the members the collection stored at colPath links to.
+// The objects stored inside the collection are not included.
+func (r *repo) memberIRIs(colPath string) (vocab.IRIs, error) {
+	if r.membership == MembershipManifest {
+		unlock := r.manifests.lock(colPath)
+		m, err := r.manifest(colPath)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		members := m.iris()
+		unlock()
+
+		iris := make(vocab.IRIs, 0, len(members))
+		for _, iri := range members {
+			if !isSubPath(r.pathOf(iri), colPath) {
+				iris = append(iris, iri)
+			}
+		}
+		return iris, nil
+	}
+	iris := make(vocab.IRIs, 0)
+	depth := r.memberDepth(colPath)
+	err := fs.WalkDir(r.root.FS(), colPath, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && p != colPath && strings.Count(strings.TrimPrefix(p, colPath+"/"), "/")+1 >= depth {
+			// NOTE(marius): the directories at the depth of the members are the objects stored in the collection
+			return fs.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			if iri := linkedIRI(r.root, p, pathIRI); iri != "" {
+				iris = append(iris, iri)
+			}
+		}
+		return nil
+	})
+	return iris, err
+}
+
+// CompactManifests rewrites the membership manifests which contain removed members, and it returns
+// the number of manifests that were compacted.
+func (r *repo) CompactManifests() (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	count := 0
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || p == folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != _manifestName {
+			return nil
+		}
+		compacted, err := r.compactManifest(path.Dir(p))
+		if compacted {
+			count++
+		}
+		return err
+	})
+	return count, err
+}
+
+func (r *repo) compactManifest(colPath string) (bool, error) {
+	defer r.manifests.lock(colPath)()
+
+	m, err := r.manifest(colPath)
+	if err != nil {
+		return false, err
+	}
+	if m.lines == len(m.members) {
+		return false, nil
+	}
+	if err = r.saveManifest(colPath, m); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ConvertMembership converts the collection members to the to membership storage, and it returns
+// the number of converted members.
+// It is meant to be run while the storage is not in use by other processes.
+func (r *repo) ConvertMembership(to Membership) (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	if r.membership == to {
+		return 0, nil
+	}
+
+	var count int
+	var err error
+	switch to {
+	case MembershipManifest:
+		count, err = r.linksToManifests()
+	case MembershipSymlinks:
+		count, err = r.manifestsToLinks()
+	default:
+		return 0, errors.Newf("unknown membership storage %d", to)
+	}
+	if err != nil {
+		return count, err
+	}
+	r.membership = to
+	return count, r.updateLayout(func(l *layout) { l.Membership = to })
+}
+
+func (r *repo) linksToManifests() (int, error) {
+	links := make([]string, 0)
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == _indexDirName || p == folder) {
+			return fs.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			links = append(links, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, p := range links {
+		iri := linkedIRI(r.root, p, pathIRI)
+		if iri == "" {
+			continue
+		}
+		if err = r.addToManifest(r.collectionOfMember(p), iri); err != nil {
+			return count, err
+		}
+		if err = r.root.Remove(p); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func (r *repo) manifestsToLinks() (int, error) {
+	manifests := make([]string, 0)
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && (d.Name() == _indexDirName || p == folder) {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && d.Name() == _manifestName {
+			manifests = append(manifests, path.Dir(p))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, colPath := range manifests {
+		m, err := loadManifest(r.root, colPath)
+		if err != nil {
+			return count, err
+		}
+		for _, iri := range m.iris() {
+			if err = r.linkMember(colPath, iri); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if err = r.root.Remove(manifestPath(colPath)); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,276 @@
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_loadManifest(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		want      vocab.IRIs
+		wantLines int
+		wantNext  uint64
+	}{
+		{
+			name: "missing",
+			want: vocab.IRIs{},
+		},
+		{
+			name:      "adds",
+			raw:       "+0 https://example.com/1\n+1 https://example.com/2\n",
+			want:      vocab.IRIs{"https://example.com/1", "https://example.com/2"},
+			wantLines: 2,
+			wantNext:  2,
+		},
+		{
+			name:      "add and remove",
+			raw:       "+0 https://example.com/1\n+1 https://example.com/2\n-2 https://example.com/1\n+3 https://example.com/1\n",
+			want:      vocab.IRIs{"https://example.com/2", "https://example.com/1"},
+			wantLines: 4,
+			wantNext:  4,
+		},
+		{
+			name:      "interrupted append",
+			raw:       "+0 https://example.com/1\n+1 https://exa",
+			want:      vocab.IRIs{"https://example.com/1"},
+			wantLines: 1,
+			wantNext:  1,
+		},
+		{
+			name:      "garbage",
+			raw:       "+0 https://example.com/1\nlorem ipsum\n+x https://example.com/2\n",
+			want:      vocab.IRIs{"https://example.com/1"},
+			wantLines: 1,
+			wantNext:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := openRoot(t, t.TempDir())
+			if tt.raw != "" {
+				if err := putRaw(root, manifestPath("inbox"), []byte(tt.raw)); err != nil {
+					t.Fatalf("unable to write manifest: %s", err)
+				}
+			}
+			m, err := loadManifest(root, "inbox")
+			if err != nil {
+				t.Fatalf("loadManifest() error = %s", err)
+			}
+			if got := m.iris(); !slices.Equal(got, tt.want) {
+				t.Errorf("loadManifest() members = %v, want %v", got, tt.want)
+			}
+			if m.lines != tt.wantLines {
+				t.Errorf("loadManifest() lines = %d, want %d", m.lines, tt.wantLines)
+			}
+			if m.next != tt.wantNext {
+				t.Errorf("loadManifest() next = %d, want %d", m.next, tt.wantNext)
+			}
+		})
+	}
+}
+
+func Test_addToManifest_interruptedAppend(t *testing.T) {
+	root := openRoot(t, t.TempDir())
+	r := &repo{root: root}
+
+	if err := r.addToManifest("inbox", "https://example.com/1"); err != nil {
+		t.Fatalf("addToManifest() error = %s", err)
+	}
+	f, err := root.OpenFile(manifestPath("inbox"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unable to open manifest: %s", err)
+	}
+	_, _ = f.WriteString("+1 https://exa")
+	_ = f.Close()
+
+	if err = r.addToManifest("inbox", "https://example.com/2"); err != nil {
+		t.Fatalf("addToManifest() error = %s", err)
+	}
+	raw, err := readRaw(root, manifestPath("inbox"))
+	if err != nil {
+		t.Fatalf("unable to read manifest: %s", err)
+	}
+	if want := "+0 https://example.com/1\n+1 https://example.com/2\n"; string(raw) != want {
+		t.Errorf("manifest = %q, want %q", raw, want)
+	}
+}
+
+func Test_repo_manifest_appended(t *testing.T) {
+	root := openRoot(t, t.TempDir())
+	r := &repo{root: root}
+
+	if err := r.addToManifest("inbox", "https://example.com/1"); err != nil {
+		t.Fatalf("addToManifest() error = %s", err)
+	}
+	// NOTE(marius): another process appends to the manifest, and then it compacts it.
+	other := &repo{root: root}
+	if err := other.addToManifest("inbox", "https://example.com/2"); err != nil {
+		t.Fatalf("addToManifest() error = %s", err)
+	}
+	m, err := r.manifest("inbox")
+	if err != nil {
+		t.Fatalf("manifest() error = %s", err)
+	}
+	if want := (vocab.IRIs{"https://example.com/1", "https://example.com/2"}); !slices.Equal(m.iris(), want) {
+		t.Errorf("manifest() members = %v, want %v", m.iris(), want)
+	}
+
+	if err = other.removeFromManifest("inbox", "https://example.com/1"); err != nil {
+		t.Fatalf("removeFromManifest() error = %s", err)
+	}
+	if _, err = other.compactManifest("inbox"); err != nil {
+		t.Fatalf("compactManifest() error = %s", err)
+	}
+	if m, err = r.manifest("inbox"); err != nil {
+		t.Fatalf("manifest() error = %s", err)
+	}
+	if want := (vocab.IRIs{"https://example.com/2"}); !slices.Equal(m.iris(), want) {
+		t.Errorf("manifest() members after compaction = %v, want %v", m.iris(), want)
+	}
+}
+
+func Test_removeFromManifest_compacts(t *testing.T) {
+	root := openRoot(t, t.TempDir())
+	r := &repo{root: root}
+
+	iris := make(vocab.IRIs, 0, 100)
+	for i := range cap(iris) {
+		iris = append(iris, vocab.IRI(fmt.Sprintf("https://example.com/%d", i)))
+	}
+	if err := r.addToManifest("inbox", iris...); err != nil {
+		t.Fatalf("addToManifest() error = %s", err)
+	}
+	for _, iri := range iris[:90] {
+		if err := r.removeFromManifest("inbox", iri); err != nil {
+			t.Fatalf("removeFromManifest() error = %s", err)
+		}
+	}
+	m, err := loadManifest(root, "inbox")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %s", err)
+	}
+	if !slices.Equal(m.iris(), iris[90:]) {
+		t.Errorf("manifest members = %v, want %v", m.iris(), iris[90:])
+	}
+	if m.needsCompaction() {
+		t.Errorf("manifest has %d lines for %d members, it should have been compacted", m.lines, len(m.members))
+	}
+}
+
+func Test_addToManifest_concurrent(t *testing.T) {
+	root := openRoot(t, t.TempDir())
+	r := &repo{root: root}
+
+	iris := make(vocab.IRIs, 0, 50)
+	for i := range cap(iris) {
+		iris = append(iris, vocab.IRI(fmt.Sprintf("https://example.com/%d", i)))
+	}
+	wg := sync.WaitGroup{}
+	for _, iri := range iris {
+		wg.Go(func() {
+			if err := r.addToManifest("inbox", iri); err != nil {
+				t.Errorf("addToManifest() error = %s", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	m, err := loadManifest(root, "inbox")
+	if err != nil {
+		t.Fatalf("loadManifest() error = %s", err)
+	}
+	if len(m.members) != len(iris) || m.lines != len(iris) {
+		t.Errorf("manifest has %d members in %d lines, want %d", len(m.members), m.lines, len(iris))
+	}
+	seqs := make(map[uint64]struct{}, len(m.members))
+	for _, seq := range m.members {
+		seqs[seq] = struct{}{}
+	}
+	if len(seqs) != len(iris) {
+		t.Errorf("manifest has %d distinct sequence numbers for %d members", len(seqs), len(iris))
+	}
+}
+
+func countSymlinks(t *testing.T, r *repo) int {
+	count := 0
+	_ = fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func outboxItems(t *testing.T, r *repo) vocab.IRIs {
+	t.Helper()
+	outbox, err := r.Load(rootOutboxIRI)
+	if err != nil {
+		t.Fatalf("Load() outbox error = %s", err)
+	}
+	iris := make(vocab.IRIs, 0)
+	_ = vocab.OnOrderedCollection(outbox, func(col *vocab.OrderedCollection) error {
+		for _, it := range col.OrderedItems {
+			iris = append(iris, it.GetLink())
+		}
+		return nil
+	})
+	return iris
+}
+
+func Test_repo_ConvertMembership(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/3", Type: vocab.CreateType},
+	}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)}, withGeneratedRoot(root), withGeneratedItems(activities))
+	r.membership = MembershipManifest
+
+	if err := r.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if count := countSymlinks(t, r); count != 0 {
+		t.Errorf("AddTo() created %d symlinks with the manifest membership", count)
+	}
+	if got := outboxItems(t, r); len(got) != len(activities) {
+		t.Errorf("outbox items = %v, want %d items", got, len(activities))
+	}
+	if err := r.RemoveFrom(rootOutboxIRI, activities[0]); err != nil {
+		t.Fatalf("RemoveFrom() error = %s", err)
+	}
+	if got := outboxItems(t, r); len(got) != 2 || got.Contains(activities[0].GetLink()) {
+		t.Errorf("outbox items after RemoveFrom() = %v", got)
+	}
+
+	count, err := r.ConvertMembership(MembershipSymlinks)
+	if err != nil {
+		t.Fatalf("ConvertMembership() error = %s", err)
+	}
+	if count != 2 || countSymlinks(t, r) != 2 {
+		t.Errorf("ConvertMembership() converted %d members to %d symlinks, want 2", count, countSymlinks(t, r))
+	}
+	if got := outboxItems(t, r); len(got) != 2 {
+		t.Errorf("outbox items with symlinks = %v, want 2 items", got)
+	}
+
+	if count, err = r.ConvertMembership(MembershipManifest); err != nil || count != 2 {
+		t.Errorf("ConvertMembership() = %d, %v, want 2", count, err)
+	}
+	if countSymlinks(t, r) != 0 {
+		t.Errorf("ConvertMembership() left %d symlinks", countSymlinks(t, r))
+	}
+	if got := outboxItems(t, r); len(got) != 2 {
+		t.Errorf("outbox items with the manifest = %v, want 2 items", got)
+	}
+}
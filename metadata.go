@@ -55,8 +55,8 @@ func (r *repo) LoadMetadata(iri vocab.IRI, m any) error {
 	if r == nil || r.root == nil {
 		return errNotOpen
 	}
-	p := iriPath(iri)
-	raw, err := loadRaw(r.root, getMetadataKey(p))
+	p := r.pathOf(iri)
+	raw, err := r.loadSecret(r.root, getMetadataKey(p))
 	if err != nil {
 		err = errors.NewNotFound(err, "could not find metadata in path")
 		return err
@@ -79,11 +79,18 @@ func (r *repo) SaveMetadata(iri vocab.IRI, m any) error {
 	if err != nil {
 		return errors.Annotatef(err, "Could not marshal metadata")
 	}
+	if entryBytes, err = r.encodeRaw(entryBytes); err != nil {
+		return errors.Annotatef(err, "Could not encode metadata")
+	}
+
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
 
-	basePath := iriPath(iri)
-	if err := putRaw(r.root, getMetadataKey(basePath), entryBytes); err != nil {
+	basePath := r.pathOf(iri)
+	if err := r.putSecret(r.root, getMetadataKey(basePath), entryBytes); err != nil {
 		return err
 	}
+	r.record(getMetadataKey(basePath))
 	return nil
 }
 
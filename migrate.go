@@ -0,0 +1,494 @@
+package fs
+
+import (
+	"crypto"
+	"fmt"
+	"io/fs"
+	"slices"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+	"github.com/openshift/osin"
+)
+
+const defaultMigrateProgressEvery = 100
+
+// MigrationSource is the storage the objects get migrated from, usually one of the other go-ap storage
+// backends. Of the conformance suite's ActivityPubStorage interface we only need the loading.
+//
+// When the source also implements WalkIRIs, every object and collection it lists gets migrated. Otherwise,
+// only the ones reachable from the MigrateOptions.Roots are.
+// The metadata, the private keys, the OAuth clients, authorizations and access tokens get migrated when
+// the source also implements LoadMetadata, LoadKey, ListClients, ListAuthorize or ListAccess.
+type MigrationSource interface {
+	Load(vocab.IRI, ...filters.Check) (vocab.Item, error)
+}
+
+type iriSource interface {
+	WalkIRIs(func(vocab.IRI) error) error
+}
+
+type metadataSource interface {
+	LoadMetadata(vocab.IRI, any) error
+}
+
+type keySource interface {
+	LoadKey(vocab.IRI) (crypto.PrivateKey, error)
+}
+
+type clientSource interface {
+	ListClients() ([]osin.Client, error)
+}
+
+type authorizeSource interface {
+	ListAuthorize() ([]*osin.AuthorizeData, error)
+}
+
+type accessSource interface {
+	ListAccess() ([]*osin.AccessData, error)
+}
+
+// MigrateOptions control the migration from another storage.
+type MigrateOptions struct {
+	// Roots are the IRIs the migration starts from, usually the IRI of the instance's service actor.
+	// They are needed only when the source can't list its objects.
+	// Everything that can be reached from them, through the collections of the actors and objects,
+	// the collection members, the actors and objects of the activities, and the objects' authors,
+	// replies, tags and attachments, gets migrated.
+	Roots vocab.IRIs
+	// ProgressEvery is the number of objects migrated between two calls of Progress.
+	ProgressEvery int
+	// Progress gets called periodically while the objects are migrated.
+	Progress func(MigrateProgress)
+	// SkipVerify skips comparing the migrated objects and collections with the ones in the source.
+	SkipVerify bool
+}
+
+func (o MigrateOptions) progressEvery() int {
+	if o.ProgressEvery > 0 {
+		return o.ProgressEvery
+	}
+	return defaultMigrateProgressEvery
+}
+
+// MigrateProgress is the state of a running migration, passed to MigrateOptions.Progress.
+type MigrateProgress struct {
+	Objects     int
+	Collections int
+	Failed      int
+	Skipped     int
+	Last        vocab.IRI
+	Elapsed     time.Duration
+}
+
+// MigrateError records an object that could not be migrated.
+type MigrateError struct {
+	IRI vocab.IRI
+	Err error
+}
+
+func (e MigrateError) Error() string {
+	return fmt.Sprintf("%s: %s", e.IRI, e.Err)
+}
+
+func (e MigrateError) Unwrap() error {
+	return e.Err
+}
+
+// MigrateSkip records something that was not migrated, because the source doesn't have it, or can't list it.
+// The IRI is empty for what isn't an object, like the OAuth records.
+type MigrateSkip struct {
+	IRI    vocab.IRI
+	Reason string
+}
+
+// MigrateDiff records an object or a collection which is different in the storage than in the source
+// after the migration.
+type MigrateDiff struct {
+	IRI    vocab.IRI
+	Reason string
+}
+
+// MigrateReport is the result of a migration.
+type MigrateReport struct {
+	Objects        int
+	Collections    int
+	Members        int
+	Metadata       int
+	Clients        int
+	Authorizations int
+	Accesses       int
+	Failed         []MigrateError
+	Skipped        []MigrateSkip
+	Diff           []MigrateDiff
+}
+
+func isNotFound(err error) bool {
+	return errors.IsNotFound(err) || errors.Is(err, fs.ErrNotExist)
+}
+
+// migrateRefs returns the IRIs of the collections of it, of the objects it references, and for activities,
+// of their actor and object, which get migrated together with it.
+func migrateRefs(it vocab.Item) vocab.IRIs {
+	refs := make(vocab.IRIs, 0)
+	var add func(items ...vocab.Item)
+	add = func(items ...vocab.Item) {
+		for _, ref := range items {
+			if vocab.IsNil(ref) {
+				continue
+			}
+			if vocab.IsItemCollection(ref) {
+				_ = vocab.OnItemCollection(ref, func(col *vocab.ItemCollection) error {
+					add(*col...)
+					return nil
+				})
+				continue
+			}
+			if ref.GetLink() != "" {
+				refs = append(refs, ref.GetLink())
+			}
+		}
+	}
+	typ := it.GetType()
+	if vocab.ActorTypes.Match(typ) {
+		_ = vocab.OnActor(it, func(a *vocab.Actor) error {
+			add(a.Inbox, a.Outbox, a.Followers, a.Following, a.Liked, a.Streams)
+			return nil
+		})
+	}
+	if vocab.ActivityTypes.Match(typ) {
+		_ = vocab.OnActivity(it, func(a *vocab.Activity) error {
+			add(a.Actor, a.Object, a.Target, a.Origin, a.Result, a.Instrument)
+			return nil
+		})
+	} else if vocab.IntransitiveActivityTypes.Match(typ) {
+		_ = vocab.OnIntransitiveActivity(it, func(a *vocab.IntransitiveActivity) error {
+			add(a.Actor, a.Target, a.Origin, a.Result, a.Instrument)
+			return nil
+		})
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		add(ob.Likes, ob.Shares, ob.Replies)
+		add(ob.AttributedTo, ob.InReplyTo, ob.Context, ob.Generator, ob.Audience)
+		add(ob.Tag, ob.Attachment, ob.Icon, ob.Image, ob.Location, ob.Preview)
+		return nil
+	})
+	return refs
+}
+
+// collectionMembers returns the IRIs of the members of the col collection.
+func collectionMembers(col vocab.Item) vocab.IRIs {
+	iris := make(vocab.IRIs, 0)
+	_ = vocab.OnCollectionIntf(col, func(c vocab.CollectionInterface) error {
+		for _, it := range c.Collection() {
+			if !vocab.IsNil(it) {
+				iris = append(iris, it.GetLink())
+			}
+		}
+		return nil
+	})
+	return iris
+}
+
+// withoutMembers returns the col collection without its items, which the storage keeps separately.
+func withoutMembers(col vocab.Item) vocab.Item {
+	if orderedCollectionTypes.Match(col.GetType()) {
+		_ = vocab.OnOrderedCollection(col, func(c *vocab.OrderedCollection) error {
+			c.OrderedItems = nil
+			return nil
+		})
+	} else if collectionTypes.Match(col.GetType()) {
+		_ = vocab.OnCollection(col, func(c *vocab.Collection) error {
+			c.Items = nil
+			return nil
+		})
+	}
+	return col
+}
+
+// MigrateFrom copies into the storage the objects, the collections with their members, the actors' metadata,
+// which includes their password hashes and private keys, and the OAuth records from the src storage.
+// Each migrated object and collection is compared with the one in the source, and the differences are
+// returned in the report, together with what couldn't be migrated.
+//
+// The objects are migrated one at a time, and only the IRIs still to be visited are kept in memory.
+// Without the source listing its objects, the ones already in the storage are not visited again,
+// so a source which can't list its objects needs to be migrated into an empty storage.
+func (r *repo) MigrateFrom(src MigrationSource, opts MigrateOptions) (*MigrateReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	walker, canWalk := src.(iriSource)
+	if !canWalk && len(opts.Roots) == 0 {
+		return nil, errors.BadRequestf("no IRIs to start the migration from")
+	}
+
+	m := migrationRun{r: r, src: src, opts: opts, start: time.Now(), skipped: make(map[vocab.IRI]struct{})}
+	if _, ok := src.(metadataSource); !ok {
+		if _, ok = src.(keySource); !ok {
+			m.skip("", "the source doesn't store metadata or keys")
+		}
+	}
+
+	if canWalk {
+		err := walker.WalkIRIs(func(iri vocab.IRI) error {
+			m.migrate(iri)
+			return nil
+		})
+		if err != nil {
+			return &m.report, errors.Annotatef(err, "unable to list the objects of the source")
+		}
+	} else {
+		queue := slices.Clone(opts.Roots)
+		for len(queue) > 0 {
+			iri := queue[0]
+			queue = queue[1:]
+			if m.visited(iri) {
+				continue
+			}
+			queue = append(queue, m.migrate(iri)...)
+		}
+	}
+
+	if err := m.migrateOAuth(); err != nil {
+		return &m.report, err
+	}
+
+	if r.index != nil {
+		if err := r.Reindex(); err != nil {
+			return &m.report, err
+		}
+	}
+	m.progress("")
+	return &m.report, nil
+}
+
+// migrationRun is the state of a running MigrateFrom.
+type migrationRun struct {
+	r         *repo
+	src       MigrationSource
+	opts      MigrateOptions
+	start     time.Time
+	processed int
+	report    MigrateReport
+	// skipped are the IRIs which were not stored, so they are not loaded again from the source.
+	skipped map[vocab.IRI]struct{}
+}
+
+func (m *migrationRun) progress(last vocab.IRI) {
+	if m.opts.Progress == nil {
+		return
+	}
+	m.opts.Progress(MigrateProgress{
+		Objects:     m.report.Objects,
+		Collections: m.report.Collections,
+		Failed:      len(m.report.Failed),
+		Skipped:     len(m.report.Skipped),
+		Last:        last,
+		Elapsed:     time.Since(m.start),
+	})
+}
+
+func (m *migrationRun) fail(iri vocab.IRI, err error) {
+	m.report.Failed = append(m.report.Failed, MigrateError{IRI: iri, Err: err})
+	if iri != "" {
+		m.skipped[iri] = struct{}{}
+	}
+}
+
+func (m *migrationRun) skip(iri vocab.IRI, reason string) {
+	m.report.Skipped = append(m.report.Skipped, MigrateSkip{IRI: iri, Reason: reason})
+	if iri != "" {
+		m.skipped[iri] = struct{}{}
+	}
+}
+
+// visited reports if iri was already migrated, or skipped.
+func (m *migrationRun) visited(iri vocab.IRI) bool {
+	if iri == "" {
+		return true
+	}
+	if _, ok := m.skipped[iri]; ok {
+		return true
+	}
+	_, err := m.r.root.Lstat(getObjectKey(m.r.pathOf(iri)))
+	return err == nil
+}
+
+// migrate copies the object or the collection with the iri from the source, and returns the IRIs
+// it references, which need to be migrated too.
+func (m *migrationRun) migrate(iri vocab.IRI) vocab.IRIs {
+	it, err := m.src.Load(iri)
+	if err != nil && !isNotFound(err) {
+		m.fail(iri, err)
+		return nil
+	}
+	if vocab.IsNil(it) || isNotFound(err) {
+		// NOTE(marius): the remote objects the source doesn't have a copy of are stored as links
+		// in the collections they are members of.
+		m.skip(iri, "not stored in the source")
+		return nil
+	}
+
+	var refs, members vocab.IRIs
+	isCollection := vocab.IsCollection(it) && !vocab.IsItemCollection(it)
+	if isCollection {
+		members = collectionMembers(it)
+		refs = members
+		it = withoutMembers(it)
+		m.report.Collections++
+	} else {
+		refs = migrateRefs(it)
+		m.report.Objects++
+	}
+	if _, err = save(m.r, it); err != nil {
+		m.fail(iri, err)
+		return nil
+	}
+	if len(members) > 0 {
+		if err = m.r.addMembers(m.r.pathOf(iri), members...); err != nil {
+			m.fail(iri, err)
+		} else {
+			m.report.Members += len(members)
+		}
+	}
+
+	if vocab.ActorTypes.Match(it.GetType()) {
+		if err = m.r.migrateMetadata(m.src, iri); err == nil {
+			m.report.Metadata++
+		} else if !isNotFound(err) {
+			m.report.Failed = append(m.report.Failed, MigrateError{IRI: iri, Err: err})
+		}
+	}
+
+	if !m.opts.SkipVerify {
+		m.report.Diff = append(m.report.Diff, m.r.migrateDiff(m.src, iri, isCollection, members)...)
+	}
+
+	if m.processed++; m.processed%m.opts.progressEvery() == 0 {
+		m.progress(iri)
+	}
+	return refs
+}
+
+// migrateOAuth copies the OAuth clients, authorizations and access tokens, with their refresh tokens,
+// from the source.
+func (m *migrationRun) migrateOAuth() error {
+	if cs, ok := m.src.(clientSource); ok {
+		clients, err := cs.ListClients()
+		if err != nil {
+			return errors.Annotatef(err, "unable to list the OAuth clients")
+		}
+		for _, c := range clients {
+			if err = m.r.SaveClient(c); err != nil {
+				m.fail(vocab.IRI(c.GetId()), err)
+				continue
+			}
+			m.report.Clients++
+		}
+	} else {
+		m.skip("", "the source can't list its OAuth clients")
+	}
+
+	if as, ok := m.src.(authorizeSource); ok {
+		authorizations, err := as.ListAuthorize()
+		if err != nil {
+			return errors.Annotatef(err, "unable to list the OAuth authorizations")
+		}
+		for _, a := range authorizations {
+			if err = m.r.SaveAuthorize(a); err != nil {
+				m.fail("", errors.Annotatef(err, "unable to save the OAuth authorization %s", a.Code))
+				continue
+			}
+			m.report.Authorizations++
+		}
+	} else {
+		m.skip("", "the source can't list its OAuth authorizations")
+	}
+
+	if as, ok := m.src.(accessSource); ok {
+		accesses, err := as.ListAccess()
+		if err != nil {
+			return errors.Annotatef(err, "unable to list the OAuth access tokens")
+		}
+		for _, a := range accesses {
+			if err = m.r.SaveAccess(a); err != nil {
+				m.fail("", errors.Annotatef(err, "unable to save an OAuth access token"))
+				continue
+			}
+			m.report.Accesses++
+		}
+	} else {
+		m.skip("", "the source can't list its OAuth access tokens")
+	}
+	return nil
+}
+
+// migrateMetadata copies the metadata of the actor with the iri from src, or only its private key
+// if src doesn't store metadata.
+func (r *repo) migrateMetadata(src MigrationSource, iri vocab.IRI) error {
+	if ms, ok := src.(metadataSource); ok {
+		m := Metadata{}
+		if err := ms.LoadMetadata(iri, &m); err != nil {
+			return err
+		}
+		if len(m.Pw) == 0 && len(m.PrivateKey) == 0 {
+			return errors.NotFoundf("empty metadata")
+		}
+		return r.SaveMetadata(iri, m)
+	}
+	if ks, ok := src.(keySource); ok {
+		key, err := ks.LoadKey(iri)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			return errors.NotFoundf("no key")
+		}
+		_, err = r.SaveKey(iri, key)
+		return err
+	}
+	return errors.NotFoundf("no metadata")
+}
+
+// migrateDiff compares the migrated object or collection with the iri with the one in src.
+// For the collections, only the members are compared.
+func (r *repo) migrateDiff(src MigrationSource, iri vocab.IRI, isCollection bool, want vocab.IRIs) []MigrateDiff {
+	it, err := r.Load(iri)
+	if err != nil || vocab.IsNil(it) {
+		return []MigrateDiff{{IRI: iri, Reason: "missing"}}
+	}
+	diff := make([]MigrateDiff, 0)
+	if isCollection {
+		got := collectionMembers(it)
+		gotSet := make(map[vocab.IRI]struct{}, len(got))
+		for _, m := range got {
+			gotSet[m] = struct{}{}
+		}
+		wantSet := make(map[vocab.IRI]struct{}, len(want))
+		for _, m := range want {
+			wantSet[m] = struct{}{}
+		}
+		for _, m := range want {
+			if _, ok := gotSet[m]; !ok {
+				diff = append(diff, MigrateDiff{IRI: iri, Reason: fmt.Sprintf("missing member %s", m)})
+			}
+		}
+		for _, m := range got {
+			if _, ok := wantSet[m]; !ok {
+				diff = append(diff, MigrateDiff{IRI: iri, Reason: fmt.Sprintf("extra member %s", m)})
+			}
+		}
+		return diff
+	}
+	orig, err := src.Load(iri)
+	if err != nil {
+		return diff
+	}
+	if !vocab.ItemsEqual(orig, it) {
+		diff = append(diff, MigrateDiff{IRI: iri, Reason: "different"})
+	}
+	return diff
+}
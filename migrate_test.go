@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_repo_MigrateFrom(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType, Actor: rootIRI},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType, Actor: rootIRI},
+	}
+	remote := vocab.IRI("https://remote.example/activities/1")
+
+	srcPath := t.TempDir()
+	src := mockRepo(t, fields{path: srcPath, root: openRoot(t, srcPath)}, withGeneratedRoot(root), withGeneratedItems(activities), withClient, withAuthorization, withAccess)
+	if err := src.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+	if err := src.importMembers(rootInboxIRI, vocab.ItemCollection{remote}); err != nil {
+		t.Fatalf("importMembers() error = %s", err)
+	}
+	if err := src.PasswordSet(rootIRI, []byte("secret")); err != nil {
+		t.Fatalf("PasswordSet() error = %s", err)
+	}
+
+	dstPath := t.TempDir()
+	dst := mockRepo(t, fields{path: dstPath, root: openRoot(t, dstPath)})
+	if _, err := dst.MigrateFrom(src, MigrateOptions{}); err == nil {
+		t.Errorf("MigrateFrom() without roots didn't return an error")
+	}
+
+	calls := 0
+	report, err := dst.MigrateFrom(src, MigrateOptions{
+		ProgressEvery: 1,
+		Progress:      func(MigrateProgress) { calls++ },
+	})
+	if err != nil {
+		t.Fatalf("MigrateFrom() error = %s", err)
+	}
+	if report.Objects != 3 || report.Collections != 2 || report.Members != 3 {
+		t.Errorf("MigrateFrom() objects, collections, members = %d, %d, %d, want 3, 2, 3", report.Objects, report.Collections, report.Members)
+	}
+	if report.Metadata != 1 || report.Clients != 1 || report.Authorizations != 1 || report.Accesses != 2 {
+		t.Errorf("MigrateFrom() metadata, clients, authorizations, accesses = %d, %d, %d, %d, want 1, 1, 1, 2",
+			report.Metadata, report.Clients, report.Authorizations, report.Accesses)
+	}
+	if len(report.Failed) > 0 || len(report.Skipped) > 0 || len(report.Diff) > 0 {
+		t.Errorf("MigrateFrom() failed = %v, skipped = %v, diff = %v", report.Failed, report.Skipped, report.Diff)
+	}
+	if calls == 0 {
+		t.Errorf("MigrateFrom() didn't report its progress")
+	}
+
+	if got := outboxItems(t, dst); len(got) != len(activities) {
+		t.Errorf("migrated outbox items = %v, want %d items", got, len(activities))
+	}
+	inbox, err := dst.collectionItems(rootInboxIRI, false)
+	if err != nil || !inbox.Contains(remote) {
+		t.Errorf("migrated inbox items = %v, %v, want %s", inbox, err, remote)
+	}
+	if _, err = os.Lstat(filepath.Join(dstPath, getObjectKey(dst.pathOf(remote)))); !os.IsNotExist(err) {
+		t.Errorf("MigrateFrom() stored an object for the remote member %s: %v", remote, err)
+	}
+	if err = dst.PasswordCheck(rootIRI, []byte("secret")); err != nil {
+		t.Errorf("PasswordCheck() on the migrated actor error = %s", err)
+	}
+	if _, err = dst.GetClient(defaultClient.GetId()); err != nil {
+		t.Errorf("GetClient() on the migrated client error = %s", err)
+	}
+	if _, err = dst.LoadAuthorize("test-code"); err != nil {
+		t.Errorf("LoadAuthorize() on the migrated authorization error = %s", err)
+	}
+	if _, err = dst.LoadRefresh("refresh-666"); err != nil {
+		t.Errorf("LoadRefresh() on the migrated refresh token error = %s", err)
+	}
+
+	// NOTE(marius): a source which only loads objects gets migrated by following their references from the roots.
+	loader := struct{ MigrationSource }{src}
+	bfsPath := t.TempDir()
+	bfs := mockRepo(t, fields{path: bfsPath, root: openRoot(t, bfsPath)})
+	if _, err = bfs.MigrateFrom(loader, MigrateOptions{}); err == nil {
+		t.Errorf("MigrateFrom() without roots, from a source which can't list its objects, didn't return an error")
+	}
+	report, err = bfs.MigrateFrom(loader, MigrateOptions{Roots: vocab.IRIs{rootIRI}})
+	if err != nil {
+		t.Fatalf("MigrateFrom() error = %s", err)
+	}
+	if report.Objects != 3 || report.Collections != 2 || report.Members != 3 {
+		t.Errorf("MigrateFrom() objects, collections, members = %d, %d, %d, want 3, 2, 3", report.Objects, report.Collections, report.Members)
+	}
+	if len(report.Failed) > 0 || len(report.Diff) > 0 {
+		t.Errorf("MigrateFrom() failed = %v, diff = %v", report.Failed, report.Diff)
+	}
+	skipped := make(vocab.IRIs, 0)
+	for _, s := range report.Skipped {
+		skipped = append(skipped, s.IRI)
+	}
+	// NOTE(marius): the remote member, the metadata, and the OAuth clients, authorizations and access tokens.
+	if len(report.Skipped) != 5 || !skipped.Contains(remote) {
+		t.Errorf("MigrateFrom() skipped = %v, want %s, and the metadata and OAuth records", report.Skipped, remote)
+	}
+	if got := outboxItems(t, bfs); len(got) != len(activities) {
+		t.Errorf("migrated outbox items = %v, want %d items", got, len(activities))
+	}
+}
@@ -1,11 +1,14 @@
 package fs
 
 import (
+	"io"
 	"io/fs"
+	"math/rand/v2"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -122,7 +125,7 @@ func (r *repo) loadFromOauthPath(itPath string, loaderFn func([]byte) error) err
 				return errors.NotFoundf("%s not found", p)
 			}
 
-			it, _ := loadRaw(root, getObjectKey(p))
+			it, _ := r.loadSecret(root, getObjectKey(p))
 			if it != nil {
 				if err := loaderFn(it); err != nil {
 					return err
@@ -132,7 +135,7 @@ func (r *repo) loadFromOauthPath(itPath string, loaderFn func([]byte) error) err
 		})
 	} else {
 		var raw []byte
-		raw, err = loadRaw(root, getObjectKey(itPath))
+		raw, err = r.loadSecret(root, getObjectKey(itPath))
 		if err != nil {
 			return errors.NewNotFound(err, "not found")
 		}
@@ -207,34 +210,55 @@ func (r *repo) GetClient(id string) (osin.Client, error) {
 	return r.loadClientFromPath(r.oauthClientPath(clientsBucket, id))
 }
 
-func putItem(root *os.Root, basePath string, it any) error {
+func (r *repo) putItem(root *os.Root, basePath string, it any) error {
 	raw, err := encodeFn(it)
 	if err != nil {
 		return errors.Annotatef(err, "Unable to marshal %T", it)
 	}
-	return putRaw(root, getObjectKey(basePath), raw)
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
+	if err = r.putSecret(root, getObjectKey(basePath), raw); err != nil {
+		return err
+	}
+	r.record(path.Join(folder, getObjectKey(basePath)))
+	return nil
+}
+
+func (r *repo) removeItem(root *os.Root, basePath string) error {
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
+	r.record(path.Join(folder, basePath))
+	return root.RemoveAll(basePath)
 }
 
+// putRaw saves raw to filePath. The data is written to a temporary file which then replaces
+// the existing one, so readers never see a partially written file, and the hard links to the
+// previous version, like the ones in the snapshots, keep it unchanged.
 func putRaw(root *os.Root, filePath string, raw []byte) error {
 	if err := mkDirIfNotExists(root, filepath.Dir(filePath)); err != nil {
 		return errors.Annotatef(err, "unable to create parent folder for %s", filePath)
 	}
 
-	f, err := root.OpenFile(filePath, defaultNewFileFlags, defaultFilePerm)
+	tmpPath := filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-"+strconv.FormatUint(rand.Uint64(), 36))
+	f, err := root.OpenFile(tmpPath, defaultNewFileFlags|os.O_EXCL, defaultFilePerm)
 	if err != nil {
 		return errors.Annotatef(err, "unable to save data to path %s", filePath)
 	}
 
-	defer func() {
-		_ = f.Close()
-	}()
-
 	wrote, err := f.Write(raw)
+	_ = f.Close()
+	if err == nil && wrote != len(raw) {
+		err = io.ErrShortWrite
+	}
 	if err != nil {
+		_ = root.Remove(tmpPath)
 		return errors.Annotatef(err, "could not store encoded object")
 	}
-	if wrote != len(raw) {
-		return errors.Annotatef(err, "failed writing object")
+	if err = root.Rename(tmpPath, filePath); err != nil {
+		_ = root.Remove(tmpPath)
+		return errors.Annotatef(err, "unable to save data to path %s", filePath)
 	}
 	return nil
 }
@@ -257,7 +281,7 @@ func (r *repo) SaveClient(c osin.Client) error {
 	}
 
 	clientPath := r.oauthClientPath(clientsBucket, cl.Id)
-	return putItem(root, clientPath, cl)
+	return r.putItem(root, clientPath, cl)
 }
 
 // RemoveClient
@@ -267,7 +291,7 @@ func (r *repo) RemoveClient(id string) error {
 		return errors.Annotatef(err, "Invalid path %s", folder)
 	}
 	clientPath := r.oauthClientPath(clientsBucket, id)
-	return root.RemoveAll(clientPath)
+	return r.removeItem(root, clientPath)
 }
 
 // SaveAuthorize saves authorize data.
@@ -284,7 +308,7 @@ func (r *repo) SaveAuthorize(data *osin.AuthorizeData) error {
 	}
 
 	authorizePath := filepath.Join(authorizeBucket, data.Code)
-	return putItem(root, authorizePath, data)
+	return r.putItem(root, authorizePath, data)
 }
 
 func (r *repo) loadAuthorizeFromPath(authPath string) (*osin.AuthorizeData, error) {
@@ -331,13 +355,62 @@ func (r *repo) LoadAuthorize(code string) (*osin.AuthorizeData, error) {
 	return r.loadAuthorizeFromPath(filepath.Join(authorizeBucket, code))
 }
 
-func saveRefresh(root *os.Root, refreshTok, accessTok string) error {
-	r := ref{
+// ListAuthorize returns the authorizations which didn't expire.
+// The ones that can't be loaded are skipped, and logged.
+func (r *repo) ListAuthorize() ([]*osin.AuthorizeData, error) {
+	return listOauth(r, authorizeBucket, r.loadAuthorizeFromPath)
+}
+
+// listOauth loads all the records stored in the bucket of the OAuth folder, skipping and logging
+// the ones that can't be loaded.
+func listOauth[T any](r *repo, bucket string, loadFn func(string) (T, error)) ([]T, error) {
+	keys, err := r.oauthKeys(bucket)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]T, 0, len(keys))
+	for _, key := range keys {
+		data, err := loadFn(filepath.Join(bucket, key))
+		if err != nil {
+			r.logger.Warnf("skipping the OAuth %s record %s: %s", bucket, key, err)
+			continue
+		}
+		result = append(result, data)
+	}
+	return result, nil
+}
+
+// oauthKeys returns the names of the records stored in the bucket of the OAuth folder.
+func (r *repo) oauthKeys(bucket string) ([]string, error) {
+	root, err := r.openOauthRoot()
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+
+	entries, err := fs.ReadDir(root.FS(), bucket)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			keys = append(keys, e.Name())
+		}
+	}
+	return keys, nil
+}
+
+func (r *repo) saveRefresh(root *os.Root, refreshTok, accessTok string) error {
+	rf := ref{
 		Access: accessTok,
 	}
 
 	refreshPath := filepath.Join(refreshBucket, refreshTok)
-	if err := putItem(root, refreshPath, r); err != nil {
+	if err := r.putItem(root, refreshPath, rf); err != nil {
 		return err
 	}
 	return nil
@@ -350,7 +423,7 @@ func (r *repo) RemoveAuthorize(code string) error {
 		return errors.Annotatef(err, "Invalid path %s", folder)
 	}
 	authPath := filepath.Join(authorizeBucket, code)
-	return root.RemoveAll(authPath)
+	return r.removeItem(root, authPath)
 }
 
 // SaveAccess writes AccessData.
@@ -367,7 +440,7 @@ func (r *repo) SaveAccess(data *osin.AccessData) error {
 	}
 
 	if data.RefreshToken != "" {
-		if err := saveRefresh(root, data.RefreshToken, data.AccessToken); err != nil {
+		if err := r.saveRefresh(root, data.RefreshToken, data.AccessToken); err != nil {
 			return err
 		}
 	}
@@ -391,7 +464,7 @@ func (r *repo) SaveAccess(data *osin.AccessData) error {
 	if err = mkDirIfNotExists(root, authorizePath); err != nil {
 		return errors.Annotatef(err, "Invalid path %s", authorizePath)
 	}
-	return putItem(root, authorizePath, acc)
+	return r.putItem(root, authorizePath, acc)
 }
 
 func (r *repo) loadAccessFromPath(accessPath string) (*osin.AccessData, error) {
@@ -443,6 +516,12 @@ func (r *repo) LoadAccess(code string) (*osin.AccessData, error) {
 	return r.loadAccessFromPath(filepath.Join(accessBucket, code))
 }
 
+// ListAccess returns the access data of all the access tokens, including the ones of the refresh tokens.
+// The ones that can't be loaded are skipped, and logged.
+func (r *repo) ListAccess() ([]*osin.AccessData, error) {
+	return listOauth(r, accessBucket, r.loadAccessFromPath)
+}
+
 // RemoveAccess revokes or deletes an AccessData.
 func (r *repo) RemoveAccess(code string) error {
 	root, err := r.openOauthRoot()
@@ -450,7 +529,7 @@ func (r *repo) RemoveAccess(code string) error {
 		return errors.Annotatef(err, "Invalid path %s", folder)
 	}
 	accessPath := filepath.Join(accessBucket, code)
-	return root.RemoveAll(accessPath)
+	return r.removeItem(root, accessPath)
 }
 
 // LoadRefresh retrieves refresh AccessData. Client information MUST be loaded together.
@@ -479,5 +558,5 @@ func (r *repo) RemoveRefresh(code string) error {
 		return errors.Annotatef(err, "Invalid path %s", folder)
 	}
 	refreshPath := filepath.Join(refreshBucket, code)
-	return root.RemoveAll(refreshPath)
+	return r.removeItem(root, refreshPath)
 }
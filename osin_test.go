@@ -401,6 +401,27 @@ func Test_repo_LoadAccess(t *testing.T) {
 	}
 }
 
+func Test_repo_ListAccess(t *testing.T) {
+	r := mockRepo(t, fields{path: t.TempDir()}, withOpenRoot, withClient, withAuthorization, withAccess)
+	defer r.Close()
+
+	broken := filepath.Join(r.path, folder, accessBucket, "broken")
+	if err := os.MkdirAll(broken, defaultDirPerm); err != nil {
+		t.Fatalf("unable to create the broken access token: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(broken, objectKey), []byte("{not json"), defaultFilePerm); err != nil {
+		t.Fatalf("unable to write the broken access token: %s", err)
+	}
+
+	got, err := r.ListAccess()
+	if err != nil {
+		t.Fatalf("ListAccess() error = %s", err)
+	}
+	if len(got) != 1 || got[0].AccessToken != "access-666" {
+		t.Errorf("ListAccess() = %v, want only access-666", got)
+	}
+}
+
 func Test_repo_LoadRefresh(t *testing.T) {
 	tests := []struct {
 		name     string
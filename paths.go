@@ -0,0 +1,402 @@
+package fs
+
+import (
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+// defaultScheme is the scheme of the IRIs which don't get a scheme directory in their storage path.
+const defaultScheme = "https"
+
+// escapeMarker is prepended to the path elements which would otherwise be confused with
+// the storage files, with the scheme, query or fragment elements, or with the relative path elements.
+const escapeMarker = "!"
+
+func escapeSegment(s string) string {
+	if s == "" || s == "." || strings.HasPrefix(s, ".") || strings.HasPrefix(s, "__") ||
+		strings.HasPrefix(s, escapeMarker) || strings.HasPrefix(s, "?") || strings.HasPrefix(s, "#") ||
+		strings.HasSuffix(s, ":") {
+		return escapeMarker + s
+	}
+	return s
+}
+
+func unescapeSegment(s string) string {
+	return strings.TrimPrefix(s, escapeMarker)
+}
+
+var componentEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// escapeComponent escapes the query and the fragment, so they can be stored as a single path element.
+func escapeComponent(s string) string {
+	return componentEscaper.Replace(s)
+}
+
+func unescapeComponent(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
+
+func isSchemeSegment(s string) bool {
+	if len(s) < 2 || !strings.HasSuffix(s, ":") {
+		return false
+	}
+	for i, c := range s[:len(s)-1] {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		case i > 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// iriPath returns the storage path of iri in the flat layout.
+//
+// The mapping is reversible, see pathIRI:
+//   - the scheme gets its own "<scheme>:" directory, unless it's https,
+//   - the host, including the port and the user info, is the first directory,
+//   - every element of the escaped path is a directory,
+//   - the query string and the fragment are the last directories, prefixed with "?" and "#".
+//
+// The trailing slashes of the path are not considered significant.
+func iriPath(iri vocab.IRI) string {
+	u, err := iri.URL()
+	if err != nil {
+		return ""
+	}
+
+	pieces := make([]string, 0)
+	pieces = append(pieces, "./")
+	if u.Scheme != "" && u.Scheme != defaultScheme {
+		pieces = append(pieces, u.Scheme+":")
+	}
+	// NOTE(marius): the URL type doesn't expose the escaped host, so we let it build the authority
+	host := strings.TrimPrefix((&url.URL{User: u.User, Host: u.Host}).String(), "//")
+	if host != "" || len(pieces) > 1 {
+		pieces = append(pieces, escapeSegment(host))
+	}
+	if p := strings.TrimRight(strings.TrimPrefix(u.EscapedPath(), "/"), "/"); p != "" {
+		for _, seg := range strings.Split(p, "/") {
+			pieces = append(pieces, escapeSegment(seg))
+		}
+	}
+	if u.ForceQuery || u.RawQuery != "" {
+		pieces = append(pieces, "?"+escapeComponent(u.RawQuery))
+	}
+	if u.Fragment != "" {
+		pieces = append(pieces, "#"+escapeComponent(u.EscapedFragment()))
+	}
+	return filepath.Join(pieces...)
+}
+
+// pathIRI returns the IRI stored at the p flat layout path.
+func pathIRI(p string) vocab.IRI {
+	pieces := strings.Split(path.Clean(filepath.ToSlash(p)), "/")
+	if len(pieces) == 0 || pieces[0] == "." || pieces[0] == "" {
+		return ""
+	}
+	scheme := defaultScheme
+	if isSchemeSegment(pieces[0]) {
+		scheme = strings.TrimSuffix(pieces[0], ":")
+		pieces = pieces[1:]
+	}
+
+	b := strings.Builder{}
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if len(pieces) > 0 {
+		b.WriteString(unescapeSegment(pieces[0]))
+		pieces = pieces[1:]
+	}
+	query, fragment := "", ""
+	hasQuery := false
+	for _, seg := range pieces {
+		switch {
+		case strings.HasPrefix(seg, "?"):
+			query, hasQuery = unescapeComponent(seg[1:]), true
+		case strings.HasPrefix(seg, "#"):
+			fragment = unescapeComponent(seg[1:])
+		default:
+			b.WriteString("/")
+			b.WriteString(unescapeSegment(seg))
+		}
+	}
+	if hasQuery {
+		b.WriteString("?")
+		b.WriteString(query)
+	}
+	if fragment != "" {
+		b.WriteString("#")
+		b.WriteString(fragment)
+	}
+	return vocab.IRI(b.String())
+}
+
+// withoutQuery returns iri without its query string.
+// For the collections, the query string holds filters, and it's not part of their identity.
+func withoutQuery(iri vocab.IRI) vocab.IRI {
+	u, err := iri.URL()
+	if err != nil || (u.RawQuery == "" && !u.ForceQuery) {
+		return iri
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	return vocab.IRI(u.String())
+}
+
+type pathMove struct {
+	from, to string
+}
+
+// movedPath returns the current location of the p path, after the moves were applied in order.
+func movedPath(p string, moves []pathMove) string {
+	for _, m := range moves {
+		if p == m.from {
+			p = m.to
+		} else if strings.HasPrefix(p, m.from+"/") {
+			p = m.to + strings.TrimPrefix(p, m.from)
+		}
+	}
+	return p
+}
+
+// unmovedPath returns the location the p path had before the moves were applied.
+func unmovedPath(p string, moves []pathMove) string {
+	for i := len(moves) - 1; i >= 0; i-- {
+		m := moves[i]
+		if p == m.to {
+			p = m.from
+		} else if strings.HasPrefix(p, m.to+"/") {
+			p = m.from + strings.TrimPrefix(p, m.to)
+		}
+	}
+	return p
+}
+
+// moveDir moves the from directory to the to path, merging their contents if to already exists.
+func moveDir(root *os.Root, from, to string) error {
+	if strings.HasPrefix(to, from+"/") {
+		// NOTE(marius): an object moving inside its own directory, like one with a query string, needs
+		// to be moved out of the way first.
+		tmp := path.Join(path.Dir(from), "."+path.Base(from)+".tmp")
+		if err := root.Rename(from, tmp); err != nil {
+			return err
+		}
+		from = tmp
+	}
+	fi, err := root.Lstat(to)
+	if os.IsNotExist(err) {
+		if err = root.MkdirAll(path.Dir(to), defaultDirPerm); err != nil {
+			return err
+		}
+		return root.Rename(from, to)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.Conflictf("%s already exists", to)
+	}
+	entries, err := fs.ReadDir(root.FS(), from)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		src, dst := path.Join(from, e.Name()), path.Join(to, e.Name())
+		if e.IsDir() {
+			err = moveDir(root, src, dst)
+		} else if _, err = root.Lstat(dst); os.IsNotExist(err) {
+			err = root.Rename(src, dst)
+		} else if err == nil {
+			err = errors.Conflictf("%s already exists", dst)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return root.Remove(from)
+}
+
+// linkedIRI returns the IRI of the object the symlink at p points to.
+// For the links to objects we don't have locally, the IRI is obtained from the target path with iriFn.
+func linkedIRI(root *os.Root, p string, iriFn func(string) vocab.IRI) vocab.IRI {
+	if it, err := loadItemRaw(root, getObjectKey(p)); err == nil && !vocab.IsNil(it) {
+		return it.GetLink()
+	}
+	target, err := root.Readlink(p)
+	if err != nil {
+		return ""
+	}
+	return iriFn(unshardPath(path.Join(path.Dir(p), target)))
+}
+
+// collectionOfMember returns the path of the collection the link at p belongs to.
+func (r *repo) collectionOfMember(p string) string {
+	dir := path.Dir(p)
+	if !r.sharded {
+		return dir
+	}
+	if col := path.Dir(path.Dir(dir)); isStorageCollectionKey(col) {
+		return col
+	}
+	return dir
+}
+
+// MigratePaths moves the objects, and the collection links to them, which are not stored at the path
+// their IRI maps to, and it returns the number of moved objects and links.
+//
+// It converts the storages created with the older path mapping, which ignored the scheme and the query
+// string of the IRIs, and which stored the fragment as a regular path element.
+// It is meant to be run while the storage is not in use by other processes.
+func (r *repo) MigratePaths() (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+
+	type entry struct {
+		path string
+		iri  vocab.IRI
+	}
+	objects := make([]entry, 0)
+	links := make([]entry, 0)
+	err := fs.WalkDir(r.root.FS(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || p == folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			legacyIRI := func(p string) vocab.IRI {
+				return vocab.IRI(defaultScheme + "://" + p)
+			}
+			if iri := linkedIRI(r.root, p, legacyIRI); iri != "" {
+				links = append(links, entry{path: p, iri: iri})
+			}
+			return nil
+		}
+		if d.Name() != objectKey {
+			return nil
+		}
+		if it, err := loadItemRaw(r.root, p); err == nil && !vocab.IsNil(it) && it.GetLink() != "" {
+			objects = append(objects, entry{path: path.Dir(p), iri: it.GetLink()})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// NOTE(marius): the parents get moved before their children, so the children which don't share
+	// their parent's new path get moved back from it.
+	slices.SortStableFunc(objects, func(a, b entry) int {
+		return strings.Count(a.path, "/") - strings.Count(b.path, "/")
+	})
+
+	count := 0
+	moves := make([]pathMove, 0)
+	for _, ob := range objects {
+		cur := movedPath(ob.path, moves)
+		dst := r.pathOf(ob.iri)
+		if dst == "" || cur == dst {
+			continue
+		}
+		if err = moveDir(r.root, cur, dst); err != nil {
+			return count, errors.Annotatef(err, "unable to move %s", ob.iri)
+		}
+		moves = append(moves, pathMove{from: cur, to: dst})
+		count++
+	}
+
+	for _, l := range links {
+		cur := movedPath(l.path, moves)
+		dst := r.memberPath(r.collectionOfMember(cur), l.iri)
+		rel, err := filepath.Rel(path.Dir(dst), r.pathOf(l.iri))
+		if err != nil {
+			return count, err
+		}
+		if target, _ := r.root.Readlink(cur); cur == dst && target == rel {
+			continue
+		}
+		if err = r.root.Remove(cur); err != nil {
+			return count, err
+		}
+		if err = r.root.MkdirAll(path.Dir(dst), defaultDirPerm); err != nil {
+			return count, err
+		}
+		if err = r.root.Symlink(rel, dst); err != nil && !os.IsExist(err) {
+			return count, errors.Annotatef(err, "unable to link %s", l.iri)
+		}
+		count++
+	}
+
+	return count, r.moveIndexRefs(moves)
+}
+
+// moveIndexRefs updates the paths of the objects in the index after the moves.
+func (r *repo) moveIndexRefs(moves []pathMove) error {
+	if r.index == nil || len(moves) == 0 {
+		return nil
+	}
+	_ = r.loadIndex()
+	r.index.w.Lock()
+	for ref, p := range r.index.ref {
+		r.index.ref[ref] = movedPath(filepath.Clean(p), moves)
+	}
+	r.index.w.Unlock()
+	return r.saveIndex()
+}
+
+// relinkMoved points the collection links which were broken by the moves to the new location of their
+// objects. Both the link and the object it points to could have been moved.
+func (r *repo) relinkMoved(moves []pathMove) error {
+	if len(moves) == 0 {
+		return nil
+	}
+	return r.walkStorage(func(p string, d fs.DirEntry) error {
+		if d.Type()&fs.ModeSymlink != fs.ModeSymlink {
+			return nil
+		}
+		target, err := r.root.Readlink(p)
+		if err != nil {
+			return nil
+		}
+		if _, err = r.root.Lstat(path.Join(path.Dir(p), target)); err == nil {
+			return nil
+		}
+		candidates := []string{
+			movedPath(path.Join(path.Dir(p), target), moves),
+			movedPath(path.Join(path.Dir(unmovedPath(p, moves)), target), moves),
+		}
+		for _, dst := range candidates {
+			if _, err = r.root.Lstat(dst); err != nil {
+				continue
+			}
+			rel, err := filepath.Rel(path.Dir(p), dst)
+			if err != nil {
+				return err
+			}
+			r.record(p)
+			if err = r.root.Remove(p); err != nil {
+				return err
+			}
+			return r.root.Symlink(rel, p)
+		}
+		return nil
+	})
+}
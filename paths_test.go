@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_iriPath(t *testing.T) {
+	tests := []struct {
+		name string
+		iri  vocab.IRI
+		want string
+	}{
+		{
+			name: "empty",
+			iri:  "",
+			want: ".",
+		},
+		{
+			name: "host",
+			iri:  "https://example.com",
+			want: "example.com",
+		},
+		{
+			name: "object",
+			iri:  "https://example.com/objects/1",
+			want: "example.com/objects/1",
+		},
+		{
+			name: "trailing slash",
+			iri:  "https://example.com/objects/1/",
+			want: "example.com/objects/1",
+		},
+		{
+			name: "http with port",
+			iri:  "http://example.com:8080/objects/1",
+			want: "http:/example.com:8080/objects/1",
+		},
+		{
+			name: "query",
+			iri:  "https://example.com/users/jdoe/statuses/1/replies?only_other_accounts=true&page=true",
+			want: "example.com/users/jdoe/statuses/1/replies/?only_other_accounts=true&page=true",
+		},
+		{
+			name: "fragment",
+			iri:  "https://example.com/~jdoe#main",
+			want: "example.com/~jdoe/#main",
+		},
+		{
+			name: "percent escapes",
+			iri:  "https://example.com/tags/a%2Fb?q=%2F",
+			want: "example.com/tags/a%2Fb/?q=%252F",
+		},
+		{
+			name: "storage file names",
+			iri:  "https://example.com/__raw/.index/!x",
+			want: "example.com/!__raw/!.index/!!x",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := iriPath(tt.iri)
+			if got != tt.want {
+				t.Errorf("iriPath() = %s, want %s", got, tt.want)
+			}
+			if tt.iri == "" {
+				return
+			}
+			if back := pathIRI(got); back != vocab.IRI(strings.TrimSuffix(tt.iri.String(), "/")) {
+				t.Errorf("pathIRI() = %s, want %s", back, tt.iri)
+			}
+		})
+	}
+}
+
+// canonicalIRI returns the form of s the path mapping round-trips to: the one the URL type produces,
+// without the trailing slashes.
+func canonicalIRI(s string) (vocab.IRI, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Opaque != "" || u.Scheme == "" || u.Host == "" {
+		return "", false
+	}
+	if u.Path != "" && !strings.HasPrefix(u.Path, "/") {
+		return "", false
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	c := u.String()
+	if u2, err := url.Parse(c); err != nil || u2.String() != c {
+		return "", false
+	}
+	return vocab.IRI(c), true
+}
+
+func Fuzz_iriPath(f *testing.F) {
+	seeds := []string{
+		"https://example.com/objects/1",
+		"http://example.com:8080/a%2Fb?x=1&y=%2F#frag",
+		"https://user:pw@example.com/~jdoe#main",
+		"https://example.com/__raw/.index/!x",
+		"https://example.com?",
+		"gopher://[::1]:70/a//b/",
+	}
+	for _, s := range seeds {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		iri, ok := canonicalIRI(s)
+		if !ok {
+			t.Skip()
+		}
+		p := iriPath(iri)
+		if got := pathIRI(p); got != iri {
+			t.Errorf("pathIRI(iriPath(%q)) = %q, stored at %q", iri, got, p)
+		}
+		if got := pathIRI(unshardPath(shardPath(p))); got != iri {
+			t.Errorf("pathIRI(iriPath(%q)) in the sharded layout = %q", iri, got)
+		}
+	})
+}
+
+func Test_repo_MigratePaths(t *testing.T) {
+	items := vocab.ItemCollection{
+		&vocab.Object{ID: "http://example.com/objects/1", Type: vocab.NoteType},
+		&vocab.Object{ID: "https://example.com/objects/2?page=1", Type: vocab.NoteType},
+		&vocab.Actor{ID: "https://example.com/~jdoe", Type: vocab.PersonType},
+		&vocab.Object{ID: "https://example.com/~jdoe#main", Type: vocab.NoteType},
+	}
+	legacyPaths := []string{
+		"example.com/objects/1",
+		"example.com/objects/2",
+		"example.com/~jdoe",
+		"example.com/~jdoe/main",
+	}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)})
+	for i, it := range items {
+		raw, err := encodeItemFn(it)
+		if err != nil {
+			t.Fatalf("unable to encode %s: %s", it.GetLink(), err)
+		}
+		if err = putRaw(r.root, getObjectKey(legacyPaths[i]), raw); err != nil {
+			t.Fatalf("unable to store %s: %s", it.GetLink(), err)
+		}
+	}
+
+	count, err := r.MigratePaths()
+	if err != nil {
+		t.Fatalf("MigratePaths() error = %s", err)
+	}
+	if count != 3 {
+		t.Errorf("MigratePaths() moved %d objects, want 3", count)
+	}
+	for _, it := range items {
+		if _, err = r.root.Stat(getObjectKey(iriPath(it.GetLink()))); err != nil {
+			t.Errorf("%s was not moved to %s: %s", it.GetLink(), iriPath(it.GetLink()), err)
+		}
+	}
+	if count, _ = r.MigratePaths(); count != 0 {
+		t.Errorf("MigratePaths() on a migrated storage moved %d objects, want 0", count)
+	}
+}
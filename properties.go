@@ -0,0 +1,202 @@
+package fs
+
+import (
+	"net/url"
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+// propertyIndexTypes are the optional indexes for secondary object properties.
+// They are not enabled by default, and need to be requested through Config.Indexes.
+var propertyIndexTypes = []index.Type{ByURL, ByMediaType, ByAttachmentMediaType, ByGenerator}
+
+// normalizeURL lower cases the scheme and host of the URL, and removes its trailing slash.
+func normalizeURL(s string) string {
+	s = strings.TrimSpace(s)
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(s, "/")
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return strings.TrimSuffix(u.String(), "/")
+}
+
+// normalizeMediaType returns the lower cased media type without its parameters, together with
+// the "type/*" wildcard for its top level type.
+func normalizeMediaType(s string) []string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	if s == "" {
+		return nil
+	}
+	top, _, ok := strings.Cut(s, "/")
+	if !ok || strings.HasSuffix(s, "/*") {
+		return []string{s}
+	}
+	return []string{s, top + "/*"}
+}
+
+// urlsOf returns the IRIs of the it property, using the href for Link values.
+func urlsOf(it vocab.Item) []string {
+	result := make([]string, 0)
+	if vocab.IsNil(it) {
+		return result
+	}
+	if vocab.IsItemCollection(it) {
+		_ = vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, u := range *col {
+				result = append(result, urlsOf(u)...)
+			}
+			return nil
+		})
+		return result
+	}
+	if l, ok := it.(*vocab.Link); ok {
+		return append(result, normalizeURL(l.Href.String()))
+	}
+	return append(result, normalizeURL(it.GetLink().String()))
+}
+
+func onObjectProps(li vocab.LinkOrIRI, fn func(*vocab.Object)) {
+	it, ok := li.(vocab.Item)
+	if !ok || vocab.IsNil(it) || vocab.IsIRI(it) {
+		return
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		fn(ob)
+		return nil
+	})
+}
+
+// extractURL returns the normalized values of the url property.
+func extractURL(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		result = append(result, urlsOf(ob.URL)...)
+	})
+	return result
+}
+
+// extractMediaType returns the mediaType of the object.
+func extractMediaType(li vocab.LinkOrIRI) []string {
+	if l, ok := li.(*vocab.Link); ok {
+		return normalizeMediaType(string(l.MediaType))
+	}
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		result = append(result, normalizeMediaType(string(ob.MediaType))...)
+	})
+	return result
+}
+
+// extractAttachmentMediaType returns the media types of the object's attachments.
+func extractAttachmentMediaType(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		if vocab.IsNil(ob.Attachment) {
+			return
+		}
+		if vocab.IsItemCollection(ob.Attachment) {
+			_ = vocab.OnItemCollection(ob.Attachment, func(col *vocab.ItemCollection) error {
+				for _, att := range *col {
+					result = append(result, extractMediaType(att)...)
+				}
+				return nil
+			})
+			return
+		}
+		result = append(result, extractMediaType(ob.Attachment)...)
+	})
+	return result
+}
+
+// extractGenerator returns the IRI of the application that generated the object.
+func extractGenerator(li vocab.LinkOrIRI) []string {
+	result := make([]string, 0)
+	onObjectProps(li, func(ob *vocab.Object) {
+		if !vocab.IsNil(ob.Generator) {
+			result = append(result, ob.Generator.GetLink().String())
+		}
+	})
+	return result
+}
+
+// URLIs matches the objects having any of the received values as url.
+func URLIs(urls ...string) filters.Check {
+	c := tokenCheck{typ: ByURL, extractFn: extractURL}
+	for _, u := range urls {
+		c.tokens = append(c.tokens, normalizeURL(u))
+	}
+	return c
+}
+
+// MediaTypeIs matches the objects with any of the received media types.
+// A top level wildcard, like "image/*", is supported.
+func MediaTypeIs(types ...string) filters.Check {
+	c := tokenCheck{typ: ByMediaType, extractFn: extractMediaType}
+	for _, typ := range types {
+		if mt := normalizeMediaType(typ); len(mt) > 0 {
+			c.tokens = append(c.tokens, mt[0])
+		}
+	}
+	return c
+}
+
+// AttachmentMediaTypeIs matches the objects having an attachment with any of the received media types.
+// A top level wildcard, like "video/*", is supported.
+func AttachmentMediaTypeIs(types ...string) filters.Check {
+	c := tokenCheck{typ: ByAttachmentMediaType, extractFn: extractAttachmentMediaType}
+	for _, typ := range types {
+		if mt := normalizeMediaType(typ); len(mt) > 0 {
+			c.tokens = append(c.tokens, mt[0])
+		}
+	}
+	return c
+}
+
+// GeneratorIs matches the objects generated by any of the received applications.
+func GeneratorIs(generators ...vocab.IRI) filters.Check {
+	c := tokenCheck{typ: ByGenerator, extractFn: extractGenerator}
+	for _, g := range generators {
+		c.tokens = append(c.tokens, g.String())
+	}
+	return c
+}
+
+// LoadByURL returns the object that has u as its url property.
+// It's useful for resolving the profile URL of an actor to its IRI.
+func (r *repo) LoadByURL(u string) (vocab.Item, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if r.index == nil {
+		return nil, indexDisabled
+	}
+	_ = r.loadIndex()
+
+	r.index.w.RLock()
+	defer r.index.w.RUnlock()
+
+	idx, ok := r.index.tokens[ByURL]
+	if !ok {
+		return nil, errors.NotImplementedf("url index is disabled")
+	}
+	it := idx.Search(normalizeURL(u)).Iterator()
+	for it.HasNext() {
+		p, ok := r.index.ref[it.Next()]
+		if !ok {
+			continue
+		}
+		if ob, err := r.loadItemFromPath(getObjectKey(p)); err == nil && !vocab.IsNil(ob) {
+			return ob, nil
+		}
+	}
+	return nil, errors.NotFoundf("no object found with url %s", u)
+}
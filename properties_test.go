@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+var mockPropertyItems = vocab.ItemCollection{
+	&vocab.Person{
+		ID:   "https://example.com/~alice",
+		Type: vocab.PersonType,
+		URL:  vocab.IRI("https://Example.com/@alice/"),
+	},
+	&vocab.Object{
+		ID:        "https://example.com/objects/1",
+		Type:      vocab.ImageType,
+		MediaType: "image/png",
+		URL: vocab.ItemCollection{
+			&vocab.Link{Type: vocab.LinkType, Href: "https://example.com/media/1.png", MediaType: "image/png"},
+			vocab.IRI("https://example.com/media/1"),
+		},
+		Generator: vocab.IRI("https://example.com/apps/1"),
+	},
+	&vocab.Object{
+		ID:   "https://example.com/objects/2",
+		Type: vocab.NoteType,
+		Attachment: vocab.ItemCollection{
+			&vocab.Document{Type: vocab.VideoType, MediaType: "video/mp4; codecs=avc1"},
+			&vocab.Link{Type: vocab.LinkType, MediaType: "text/html"},
+		},
+	},
+}
+
+func Test_normalizeMediaType(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want []string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "full",
+			arg:  "Image/PNG",
+			want: []string{"image/png", "image/*"},
+		},
+		{
+			name: "with parameters",
+			arg:  "text/html; charset=utf-8",
+			want: []string{"text/html", "text/*"},
+		},
+		{
+			name: "wildcard",
+			arg:  "video/*",
+			want: []string{"video/*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeMediaType(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeMediaType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extractURL(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  vocab.Item
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "IRI",
+			arg:  mockPropertyItems[0],
+			want: []string{"https://example.com/@alice"},
+		},
+		{
+			name: "link and IRI",
+			arg:  mockPropertyItems[1],
+			want: []string{"https://example.com/media/1.png", "https://example.com/media/1"},
+		},
+		{
+			name: "no url",
+			arg:  mockPropertyItems[2],
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractURL(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extractAttachmentMediaType(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  vocab.Item
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "no attachments",
+			arg:  mockPropertyItems[1],
+			want: []string{},
+		},
+		{
+			name: "attachments",
+			arg:  mockPropertyItems[2],
+			want: []string{"video/mp4", "video/*", "text/html", "text/*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractAttachmentMediaType(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractAttachmentMediaType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaTypeIs(t *testing.T) {
+	tests := []struct {
+		name  string
+		types []string
+		it    vocab.Item
+		want  bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "exact",
+			types: []string{"image/png"},
+			it:    mockPropertyItems[1],
+			want:  true,
+		},
+		{
+			name:  "wildcard",
+			types: []string{"image/*"},
+			it:    mockPropertyItems[1],
+			want:  true,
+		},
+		{
+			name:  "doesn't match",
+			types: []string{"video/*"},
+			it:    mockPropertyItems[1],
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MediaTypeIs(tt.types...).Match(tt.it); got != tt.want {
+				t.Errorf("MediaTypeIs().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeneratorIs(t *testing.T) {
+	tests := []struct {
+		name string
+		apps vocab.IRIs
+		it   vocab.Item
+		want bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "generated by",
+			apps: vocab.IRIs{"https://example.com/apps/1"},
+			it:   mockPropertyItems[1],
+			want: true,
+		},
+		{
+			name: "no generator",
+			apps: vocab.IRIs{"https://example.com/apps/1"},
+			it:   mockPropertyItems[2],
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := GeneratorIs(tt.apps...).Match(tt.it); got != tt.want {
+				t.Errorf("GeneratorIs().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_repo_LoadByURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  fields
+		url     string
+		want    vocab.IRI
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: errNotOpen,
+		},
+		{
+			name: "index disabled",
+			fields: fields{
+				path: t.TempDir(),
+				root: openRoot(t, t.TempDir()),
+			},
+			url:     "https://example.com/@alice",
+			wantErr: indexDisabled,
+		},
+		{
+			name: "url index disabled",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			url:     "https://example.com/@alice",
+			wantErr: errors.NotImplementedf("url index is disabled"),
+		},
+		{
+			name: "profile url",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(slices.Concat(defaultIndexTypes, propertyIndexTypes)...),
+			},
+			url:  "https://example.com/@alice/",
+			want: "https://example.com/~alice",
+		},
+		{
+			name: "not found",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(slices.Concat(defaultIndexTypes, propertyIndexTypes)...),
+			},
+			url:     "https://example.com/@bob",
+			wantErr: errors.NotFoundf("no object found with url https://example.com/@bob"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			if r.root != nil {
+				r = withItems(mockPropertyItems...)(t, r)
+			}
+			got, err := r.LoadByURL(tt.url)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("LoadByURL() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if !got.GetLink().Equals(tt.want, true) {
+				t.Errorf("LoadByURL() = %v, want %v", got.GetLink(), tt.want)
+			}
+		})
+	}
+}
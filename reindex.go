@@ -0,0 +1,352 @@
+package fs
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+const (
+	defaultCheckpointEvery = 1000
+	_checkpointName        = ".reindex.gob"
+)
+
+// ReindexOptions control how the storage gets walked when rebuilding the indexes.
+type ReindexOptions struct {
+	// Workers is the number of objects decoded and indexed concurrently.
+	// It defaults to the number of available CPUs.
+	Workers int
+	// CheckpointEvery is the number of objects processed between two saves of the index to disk.
+	// A checkpoint records the last processed path, so an interrupted reindex can resume from it.
+	CheckpointEvery int
+	// Fresh ignores any existing checkpoint and walks the whole storage again.
+	Fresh bool
+	// Progress gets called after every checkpoint.
+	Progress func(ReindexProgress)
+}
+
+// ReindexProgress is the state of a running reindex, passed to ReindexOptions.Progress.
+type ReindexProgress struct {
+	Processed int
+	Failed    int
+	Skipped   int
+	Last      string
+	Elapsed   time.Duration
+}
+
+// ReindexError records an object that could not be loaded or indexed.
+type ReindexError struct {
+	Path string
+	Err  error
+}
+
+func (e ReindexError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e ReindexError) Unwrap() error {
+	return e.Err
+}
+
+// ReindexReport is the result of a reindex run.
+type ReindexReport struct {
+	Processed int
+	// Skipped is the number of objects that were already indexed by a previous, interrupted, run.
+	Skipped int
+	Failed  []ReindexError
+}
+
+type reindexCheckpoint struct {
+	Root      string
+	Last      string
+	Processed int
+	Started   time.Time
+}
+
+func (o ReindexOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (o ReindexOptions) checkpointEvery() int {
+	if o.CheckpointEvery > 0 {
+		return o.CheckpointEvery
+	}
+	return defaultCheckpointEvery
+}
+
+// walkOrderLess compares two slash separated paths in the order fs.WalkDir visits them:
+// lexically, one path element at a time.
+func walkOrderLess(a, b string) bool {
+	pa := strings.Split(filepath.ToSlash(a), "/")
+	pb := strings.Split(filepath.ToSlash(b), "/")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] != pb[i] {
+			return pa[i] < pb[i]
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+func checkpointPath() string {
+	return filepath.Join(_indexDirName, _checkpointName)
+}
+
+func (r *repo) loadCheckpoint(start string) *reindexCheckpoint {
+	cp := new(reindexCheckpoint)
+	if err := loadBinFromFile(r.root, checkpointPath(), cp); err != nil {
+		return nil
+	}
+	if cp.Root != start {
+		return nil
+	}
+	return cp
+}
+
+func (r *repo) saveCheckpoint(cp reindexCheckpoint) error {
+	_ = mkDirIfNotExists(r.root, _indexDirName)
+	return writeBinFile(r.root, checkpointPath(), cp)
+}
+
+func (r *repo) removeCheckpoint() error {
+	if err := r.root.Remove(checkpointPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReindexWithOptions rebuilds the global index and the collection bitmaps, using a pool of workers.
+// The index gets persisted every ReindexOptions.CheckpointEvery objects, together with a checkpoint
+// that allows a subsequent call to continue where an interrupted one stopped.
+// The objects that failed to load are returned in the report, they don't stop the reindex.
+func (r *repo) ReindexWithOptions(opts ReindexOptions) (*ReindexReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	return r.reindex(".", opts)
+}
+
+// ReindexPath rebuilds the global index entries and the collection bitmaps only for the objects
+// stored under the iri's storage path, using the default ReindexOptions.
+func (r *repo) ReindexPath(iri vocab.IRI) error {
+	_, err := r.ReindexPathWithOptions(iri, ReindexOptions{})
+	return err
+}
+
+// ReindexPathWithOptions is the scoped version of ReindexWithOptions.
+// Before walking, the index entries and collection bitmaps belonging to the subtree are removed,
+// unless we're resuming an interrupted run for the same subtree.
+func (r *repo) ReindexPathWithOptions(iri vocab.IRI, opts ReindexOptions) (*ReindexReport, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	start := r.pathOf(iri)
+	if start == "" || start == "." {
+		return r.reindex(".", opts)
+	}
+	if _, err := r.root.Stat(start); err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "unable to reindex %s", iri)
+	}
+	if r.index == nil {
+		return new(ReindexReport), nil
+	}
+	if opts.Fresh || r.loadCheckpoint(start) == nil {
+		if err := r.loadIndex(); err != nil {
+			return nil, indexDisabled
+		}
+		if err := r.removeSubtreeFromIndex(start); err != nil {
+			return nil, err
+		}
+		// NOTE(marius): the pruned index needs to be persisted, as reindex loads it again from disk,
+		// and loading merges the stored entries into the ones in memory.
+		if err := r.saveIndex(); err != nil {
+			return nil, err
+		}
+	}
+	return r.reindex(start, opts)
+}
+
+func isSubPath(p, parent string) bool {
+	return p == parent || strings.HasPrefix(p, parent+"/")
+}
+
+// removeSubtreeFromIndex drops the index references and the collection bitmaps for all the objects
+// stored under the start path.
+func (r *repo) removeSubtreeFromIndex(start string) error {
+	in := r.index
+
+	in.w.Lock()
+	stale := make([]vocab.Item, 0)
+	for ref, p := range in.ref {
+		if !isSubPath(filepath.Clean(p), start) {
+			continue
+		}
+		stale = append(stale, r.iriFromPath(p))
+		delete(in.ref, ref)
+	}
+	in.w.Unlock()
+
+	errs := make([]error, 0)
+	for _, it := range stale {
+		if err := r.removeFromIndex(it, ""); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	err := fs.WalkDir(r.root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() != _indexDirName || d.IsDir() {
+			return nil
+		}
+		if err := r.root.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (r *repo) reindex(start string, opts ReindexOptions) (*ReindexReport, error) {
+	report := new(ReindexReport)
+	if r.index == nil {
+		return report, nil
+	}
+	if err := r.loadIndex(); err != nil {
+		return report, indexDisabled
+	}
+
+	cp := reindexCheckpoint{Root: start, Started: time.Now().UTC()}
+	if !opts.Fresh {
+		if prev := r.loadCheckpoint(start); prev != nil {
+			cp = *prev
+		}
+	}
+
+	paths := make(chan string)
+	failedMu := sync.Mutex{}
+
+	batch := make([]string, 0, opts.checkpointEvery())
+	runBatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		wg := sync.WaitGroup{}
+		for range min(opts.workers(), len(batch)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for p := range paths {
+					if err := r.reindexPath(p); err != nil {
+						failedMu.Lock()
+						report.Failed = append(report.Failed, ReindexError{Path: p, Err: err})
+						failedMu.Unlock()
+					}
+				}
+			}()
+		}
+		for _, p := range batch {
+			paths <- p
+		}
+		close(paths)
+		wg.Wait()
+		paths = make(chan string)
+
+		cp.Last = batch[len(batch)-1]
+		cp.Processed += len(batch)
+		report.Processed += len(batch)
+		batch = batch[:0]
+
+		if err := r.saveIndex(); err != nil {
+			return err
+		}
+		if err := r.saveCheckpoint(cp); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(ReindexProgress{
+				Processed: cp.Processed,
+				Failed:    len(report.Failed),
+				Skipped:   report.Skipped,
+				Last:      cp.Last,
+				Elapsed:   time.Since(cp.Started),
+			})
+		}
+		return nil
+	}
+
+	err := fs.WalkDir(r.root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == _indexDirName || d.Name() == folder {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.Name() != objectKey {
+			return nil
+		}
+		if cp.Last != "" && !walkOrderLess(cp.Last, p) {
+			report.Skipped++
+			return nil
+		}
+		if batch = append(batch, p); len(batch) >= opts.checkpointEvery() {
+			return runBatch()
+		}
+		return nil
+	})
+	if err == nil {
+		err = runBatch()
+	}
+
+	if err != nil {
+		return report, err
+	}
+	return report, r.removeCheckpoint()
+}
+
+// reindexPath adds the object found at path p to the index.
+// If the object is a collection, its members are added to its collection bitmap.
+func (r *repo) reindexPath(p string) error {
+	dir := filepath.Dir(p)
+	it, err := r.loadItemFromPath(p)
+	if err != nil {
+		return err
+	}
+	if vocab.IsNil(it) {
+		return errors.NotFoundf("empty item")
+	}
+	if isStorageCollectionKey(dir) && vocab.IsCollection(it) {
+		items := make(vocab.ItemCollection, 0)
+		if err = r.loadCollectionMembers(dir, &items); err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			err = vocab.OnCollectionIntf(it, r.collectionBitmapOp((*roaring64.Bitmap).Add, items...))
+			if err != nil && !errors.Is(err, fs.SkipAll) {
+				return err
+			}
+		}
+	}
+	if err = r.addToIndex(it, dir); err != nil && !errors.IsNotImplemented(err) {
+		return err
+	}
+	return nil
+}
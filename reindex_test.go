@@ -0,0 +1,305 @@
+package fs
+
+import (
+	"slices"
+	"testing"
+
+	"git.sr.ht/~mariusor/lw"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+func Test_walkOrderLess(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{
+			name: "empty",
+			want: false,
+		},
+		{
+			name: "same",
+			a:    "example.com/objects/1/__raw",
+			b:    "example.com/objects/1/__raw",
+			want: false,
+		},
+		{
+			name: "parent before child",
+			a:    "example.com/__raw",
+			b:    "example.com/objects/1/__raw",
+			want: true,
+		},
+		{
+			name: "folder contents before sibling with longer name",
+			a:    "example.com/a/__raw",
+			b:    "example.com/a-b/__raw",
+			want: true,
+		},
+		{
+			name: "sibling with longer name after folder contents",
+			a:    "example.com/a-b/__raw",
+			b:    "example.com/a/__raw",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walkOrderLess(tt.a, tt.b); got != tt.want {
+				t.Errorf("walkOrderLess() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mockIndexedFields returns the fields of a repository with the mockItems stored, and an empty index,
+// in a root of its own.
+func mockIndexedFields(t *testing.T) fields {
+	mockRoot := openRoot(t, t.TempDir())
+	return fields{
+		path:  t.TempDir(),
+		index: mockIndex(t, mockRoot),
+		root:  mockFilesToIndex(t, mockRoot),
+	}
+}
+
+// withCorruptObject stores an object which can't be decoded at example.com/broken.
+func withCorruptObject(t *testing.T, f fields) fields {
+	if err := putRaw(f.root, "example.com/broken/__raw", []byte("not an object")); err != nil {
+		t.Fatalf("Unable to save the corrupt object: %s", err)
+	}
+	return f
+}
+
+func Test_repo_ReindexWithOptions(t *testing.T) {
+	// NOTE(marius): the mockItems have 8 distinct paths, as the Link shares its ID with an Object.
+	const mockPaths = 8
+	tests := []struct {
+		name           string
+		fields         fields
+		opts           ReindexOptions
+		checkpoint     *reindexCheckpoint
+		wantProcessed  int
+		wantSkipped    int
+		wantFailed     []string
+		wantIndexed    []string
+		wantNotIndexed []string
+		wantErr        error
+	}{
+		{
+			name:    "empty",
+			wantErr: errNotOpen,
+		},
+		{
+			name: "index disabled",
+			fields: fields{
+				path: t.TempDir(),
+				root: mockFilesToIndex(t, openRoot(t, t.TempDir())),
+			},
+		},
+		{
+			name:          "single worker",
+			fields:        mockIndexedFields(t),
+			opts:          ReindexOptions{Workers: 1, CheckpointEvery: 2},
+			wantProcessed: mockPaths,
+			wantIndexed:   []string{"example.com/1", "example.com/~jdoe", "example.com/~jdoe/3"},
+		},
+		{
+			name:           "resume from checkpoint",
+			fields:         mockIndexedFields(t),
+			opts:           ReindexOptions{Workers: 4, CheckpointEvery: 1},
+			checkpoint:     &reindexCheckpoint{Root: ".", Last: "example.com/arctic/__raw"},
+			wantProcessed:  mockPaths - 2,
+			wantSkipped:    2,
+			wantIndexed:    []string{"example.com/plain-iri", "example.com/~jdoe", "example.com/~jdoe/1"},
+			wantNotIndexed: []string{"example.com/1", "example.com/arctic"},
+		},
+		{
+			name:          "fresh ignores the checkpoint",
+			fields:        mockIndexedFields(t),
+			opts:          ReindexOptions{Workers: 2, Fresh: true},
+			checkpoint:    &reindexCheckpoint{Root: ".", Last: "example.com/arctic/__raw"},
+			wantProcessed: mockPaths,
+			wantIndexed:   []string{"example.com/1", "example.com/arctic"},
+		},
+		{
+			name:           "corrupt object",
+			fields:         withCorruptObject(t, mockIndexedFields(t)),
+			opts:           ReindexOptions{Workers: 2},
+			wantProcessed:  mockPaths + 1,
+			wantFailed:     []string{"example.com/broken/__raw"},
+			wantIndexed:    []string{"example.com/1", "example.com/~jdoe"},
+			wantNotIndexed: []string{"example.com/broken"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			if tt.checkpoint != nil {
+				if err := r.saveCheckpoint(*tt.checkpoint); err != nil {
+					t.Fatalf("unable to save checkpoint: %s", err)
+				}
+			}
+			progressCalls := 0
+			tt.opts.Progress = func(p ReindexProgress) {
+				progressCalls++
+				r.logger.WithContext(lw.Ctx{"processed": p.Processed, "last": p.Last}).Debugf("progress")
+			}
+
+			report, err := r.ReindexWithOptions(tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ReindexWithOptions() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			if cp := r.loadCheckpoint("."); cp != nil {
+				t.Errorf("ReindexWithOptions() didn't remove the checkpoint after finishing: %v", cp)
+			}
+			if tt.fields.index == nil {
+				return
+			}
+			if report.Processed != tt.wantProcessed {
+				t.Errorf("ReindexWithOptions() processed %d objects, want %d", report.Processed, tt.wantProcessed)
+			}
+			if report.Skipped != tt.wantSkipped {
+				t.Errorf("ReindexWithOptions() skipped %d objects, want %d", report.Skipped, tt.wantSkipped)
+			}
+			failed := make([]string, 0, len(report.Failed))
+			for _, f := range report.Failed {
+				failed = append(failed, f.Path)
+			}
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("ReindexWithOptions() failed for %v, want %v", failed, tt.wantFailed)
+			}
+			if progressCalls == 0 {
+				t.Errorf("ReindexWithOptions() didn't report any progress")
+			}
+
+			indexed := make(map[string]struct{})
+			for _, p := range r.index.ref {
+				indexed[p] = struct{}{}
+			}
+			for _, p := range tt.wantIndexed {
+				if _, ok := indexed[p]; !ok {
+					t.Errorf("ReindexWithOptions() didn't index %s", p)
+				}
+			}
+			for _, p := range tt.wantNotIndexed {
+				if _, ok := indexed[p]; ok {
+					t.Errorf("ReindexWithOptions() indexed %s, which it should have skipped", p)
+				}
+			}
+		})
+	}
+}
+
+func Test_repo_ReindexPathWithOptions(t *testing.T) {
+	mockRoot := openRoot(t, t.TempDir())
+	tests := []struct {
+		name          string
+		fields        fields
+		iri           vocab.IRI
+		wantProcessed int
+		wantErr       func(error) bool
+	}{
+		{
+			name: "empty",
+			wantErr: func(err error) bool {
+				return errors.Is(err, errNotOpen)
+			},
+		},
+		{
+			name: "missing path",
+			fields: fields{
+				path:  t.TempDir(),
+				index: mockIndex(t, mockRoot),
+				root:  mockFilesToIndex(t, mockRoot),
+			},
+			iri:     "https://example.com/missing",
+			wantErr: errors.IsNotFound,
+		},
+		{
+			name: "actor subtree",
+			fields: fields{
+				path:  t.TempDir(),
+				index: mockIndex(t, mockRoot),
+				root:  mockFilesToIndex(t, mockRoot),
+			},
+			iri:           "https://example.com/~jdoe",
+			wantProcessed: 5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			report, err := r.ReindexPathWithOptions(tt.iri, ReindexOptions{Workers: 2})
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Errorf("ReindexPathWithOptions() returned unexpected error = %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ReindexPathWithOptions() unexpected error = %v", err)
+				return
+			}
+			if report.Processed != tt.wantProcessed {
+				t.Errorf("ReindexPathWithOptions() processed %d objects, want %d", report.Processed, tt.wantProcessed)
+			}
+			for _, p := range r.index.ref {
+				if isSubPath(p, iriPath(tt.iri)) {
+					return
+				}
+			}
+			t.Errorf("ReindexPathWithOptions() didn't add any references for %s", tt.iri)
+		})
+	}
+}
+
+func Test_repo_ReindexPath_removed(t *testing.T) {
+	f := mockIndexedFields(t)
+	r := mockRepo(t, f)
+	if _, err := r.ReindexWithOptions(ReindexOptions{Fresh: true}); err != nil {
+		t.Fatalf("ReindexWithOptions() error = %s", err)
+	}
+
+	removed := vocab.IRI("https://example.com/~jdoe/2")
+	ref := index.HashFn(removed)
+	if _, ok := r.index.ref[ref]; !ok {
+		t.Fatalf("ReindexWithOptions() didn't index %s", removed)
+	}
+	if err := r.root.RemoveAll(iriPath(removed)); err != nil {
+		t.Fatalf("unable to remove %s: %s", removed, err)
+	}
+
+	if err := r.ReindexPath("https://example.com/~jdoe"); err != nil {
+		t.Fatalf("ReindexPath() error = %s", err)
+	}
+
+	isIndexed := func(r *repo) bool {
+		if _, ok := r.index.ref[ref]; ok {
+			return true
+		}
+		return r.index.match(filters.SameID(removed)).Contains(ref)
+	}
+	if isIndexed(r) {
+		t.Errorf("ReindexPath() kept the index entries of the removed %s", removed)
+	}
+	if _, ok := r.index.ref[index.HashFn(vocab.IRI("https://example.com/~jdoe/1"))]; !ok {
+		t.Errorf("ReindexPath() removed the index entries of an existing object")
+	}
+
+	// NOTE(marius): the index stored on disk must not have the entries either.
+	stored := mockRepo(t, fields{path: f.path, root: f.root, index: newBitmap()})
+	if err := stored.loadIndex(); err != nil {
+		t.Fatalf("loadIndex() error = %s", err)
+	}
+	if isIndexed(stored) {
+		t.Errorf("ReindexPath() saved the index entries of the removed %s", removed)
+	}
+}
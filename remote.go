@@ -0,0 +1,351 @@
+package fs
+
+import (
+	"bufio"
+	"cmp"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+)
+
+const (
+	// cacheInfoKey is the file, next to the object file, which holds the cache information of a remote object.
+	cacheInfoKey = "__cache"
+	// _expiryIndexName is the file, in the index directory, which holds the expiration times of the remote
+	// objects with cache information. It has a "<expires> <path>" line for each of them, where the time is
+	// the hex encoded Unix time in nanoseconds, or 0 for the objects without one. The lines are appended
+	// when the cache information changes, so the outdated ones get dropped only when the index is compacted.
+	_expiryIndexName = ".expiry"
+)
+
+func getCacheInfoKey(p string) string {
+	return path.Join(p, cacheInfoKey)
+}
+
+func expiryIndexPath() string {
+	return path.Join(_indexDirName, _expiryIndexName)
+}
+
+// CacheInfo is the information about the fetching of a remote object, which allows refreshing it
+// when it expires, with conditional requests.
+type CacheInfo struct {
+	// Fetched is the time the object was last fetched, or revalidated, from its server.
+	Fetched time.Time `json:"fetched"`
+	// ETag is the value of the ETag header of the response the object was fetched with.
+	ETag string `json:"etag,omitempty"`
+	// LastModified is the value of the Last-Modified header of the response the object was fetched with.
+	LastModified time.Time `json:"lastModified,omitzero"`
+	// Expires is the time after which the object needs to be fetched again, usually computed from
+	// the Cache-Control or the Expires headers of the response.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// StaleAt checks if the object needs to be fetched again at the t time.
+// The objects without an expiration time always need to be revalidated.
+func (c CacheInfo) StaleAt(t time.Time) bool {
+	return c.Expires.IsZero() || !t.Before(c.Expires)
+}
+
+// Stale checks if the object needs to be fetched again.
+func (c CacheInfo) Stale() bool {
+	return c.StaleAt(time.Now())
+}
+
+// SaveCacheInfo saves the cache information of the remote object with the iri, which needs to be already stored.
+// It's meant to be called after saving a fetched object, and after revalidating an unchanged one.
+func (r *repo) SaveCacheInfo(iri vocab.IRI, info CacheInfo) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+	itPath := r.pathOf(iri)
+	if _, err := r.root.Stat(getObjectKey(itPath)); err != nil {
+		return errors.NewNotFound(asPathErr(err), "unable to save the cache information of %s", iri)
+	}
+
+	raw, err := encodeFn(info)
+	if err != nil {
+		return errors.Annotatef(err, "could not marshal the cache information")
+	}
+	if raw, err = r.encodeRaw(raw); err != nil {
+		return errors.Annotatef(err, "could not encode the cache information")
+	}
+
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
+	prev, _ := r.loadCacheInfo(itPath)
+	if err = putRaw(r.root, getCacheInfoKey(itPath), raw); err != nil {
+		return err
+	}
+	r.record(getCacheInfoKey(itPath))
+	if err = r.updateExpiryIndex(itPath, prev, info); err != nil {
+		return errors.Annotatef(err, "unable to update the expiry index")
+	}
+	return nil
+}
+
+// LoadCacheInfo loads the cache information of the remote object with the iri.
+func (r *repo) LoadCacheInfo(iri vocab.IRI) (*CacheInfo, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	return r.loadCacheInfo(r.pathOf(iri))
+}
+
+func (r *repo) loadCacheInfo(itPath string) (*CacheInfo, error) {
+	raw, err := loadRaw(r.root, getCacheInfoKey(itPath))
+	if err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "could not find the cache information")
+	}
+	info := new(CacheInfo)
+	if err = decodeFn(raw, info); err != nil {
+		return nil, errors.Annotatef(err, "could not unmarshal the cache information")
+	}
+	return info, nil
+}
+
+// LoadWithCacheInfo loads the object with the iri, like Load, together with its cache information.
+// The cache information is nil for the objects which don't have it, like the local ones.
+func (r *repo) LoadWithCacheInfo(iri vocab.IRI, f ...filters.Check) (vocab.Item, *CacheInfo, error) {
+	it, err := r.Load(iri, f...)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := r.loadCacheInfo(r.pathOf(iri))
+	if err != nil && !errors.IsNotFound(err) {
+		return it, nil, err
+	}
+	return it, info, nil
+}
+
+// StaleObjects returns the IRIs of the remote objects which need to be fetched again at the t time,
+// the ones that expired first coming first. At most limit IRIs are returned, if it's larger than 0.
+//
+// Only the objects which have cache information are considered, see SaveCacheInfo. They are read from
+// the expiry index, which gets built from the stored cache information the first time it's needed.
+func (r *repo) StaleObjects(t time.Time, limit int) (vocab.IRIs, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if err := r.ensureExpiryIndex(); err != nil {
+		return nil, err
+	}
+
+	until := expiryKey(t)
+	total := 0
+	due := make([]expiryEntry, 0)
+	err := r.scanExpiryIndex(func(e expiryEntry) bool {
+		total++
+		if e.expires <= until {
+			due = append(due, e)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(due, compareExpiry)
+	due = slices.Compact(due)
+
+	iris := make(vocab.IRIs, 0)
+	dead := make([]expiryEntry, 0)
+	for _, e := range due {
+		if limit > 0 && len(iris) >= limit {
+			break
+		}
+		// NOTE(marius): the entries of the objects which were removed, or whose cache information
+		// was changed since, are skipped.
+		if !r.validExpiryEntry(e) {
+			dead = append(dead, e)
+			continue
+		}
+		iris = append(iris, r.iriFromPath(e.path))
+	}
+	if len(dead) > 0 && len(dead)*expiryCompactRatio >= total {
+		if err = r.compactExpiryIndex(dead...); err != nil {
+			r.logger.Warnf("unable to compact the expiry index: %s", err)
+		}
+	}
+	return iris, nil
+}
+
+// expiryCompactRatio is the inverse of the share of the expiry index lines which need to be found
+// outdated, before the index gets compacted.
+const expiryCompactRatio = 4
+
+type expiryEntry struct {
+	expires uint64
+	path    string
+}
+
+// validExpiryEntry checks if the object of the e entry is still stored, with the same expiration time.
+func (r *repo) validExpiryEntry(e expiryEntry) bool {
+	info, err := r.loadCacheInfo(e.path)
+	if err != nil || expiryKey(info.Expires) != e.expires {
+		return false
+	}
+	_, err = r.root.Lstat(getObjectKey(e.path))
+	return err == nil
+}
+
+func expiryKey(t time.Time) uint64 {
+	if t.IsZero() || t.UnixNano() < 0 {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func compareExpiry(a, b expiryEntry) int {
+	if c := cmp.Compare(a.expires, b.expires); c != 0 {
+		return c
+	}
+	return strings.Compare(a.path, b.path)
+}
+
+// scanExpiryIndex calls fn with the entries of the expiry index, in the order they were added,
+// until it returns false.
+func (r *repo) scanExpiryIndex(fn func(expiryEntry) bool) error {
+	f, err := r.root.Open(expiryIndexPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		key, p, ok := strings.Cut(sc.Text(), " ")
+		if !ok {
+			continue
+		}
+		expires, err := strconv.ParseUint(key, 16, 64)
+		if err != nil {
+			continue
+		}
+		if !fn(expiryEntry{expires: expires, path: p}) {
+			break
+		}
+	}
+	return sc.Err()
+}
+
+func (r *repo) loadExpiryIndex() ([]expiryEntry, error) {
+	entries := make([]expiryEntry, 0)
+	err := r.scanExpiryIndex(func(e expiryEntry) bool {
+		entries = append(entries, e)
+		return true
+	})
+	return entries, err
+}
+
+func (r *repo) saveExpiryIndex(entries []expiryEntry) error {
+	raw := make([]byte, 0, 64*len(entries))
+	for _, e := range entries {
+		raw = appendExpiryLine(raw, e)
+	}
+	return putRaw(r.root, expiryIndexPath(), raw)
+}
+
+func appendExpiryLine(raw []byte, e expiryEntry) []byte {
+	raw = strconv.AppendUint(raw, e.expires, 16)
+	raw = append(raw, ' ')
+	raw = append(raw, e.path...)
+	return append(raw, '\n')
+}
+
+// ensureExpiryIndex builds the expiry index from the cache information of the stored objects, if it
+// doesn't exist, like for the storages created before it.
+func (r *repo) ensureExpiryIndex() error {
+	if _, err := r.root.Lstat(expiryIndexPath()); err == nil {
+		return nil
+	}
+	r.expiry.Lock()
+	defer r.expiry.Unlock()
+	return r.buildExpiryIndex()
+}
+
+func (r *repo) buildExpiryIndex() error {
+	if _, err := r.root.Lstat(expiryIndexPath()); err == nil {
+		return nil
+	}
+	entries := make([]expiryEntry, 0)
+	err := r.walkStorage(func(p string, d fs.DirEntry) error {
+		if d.Name() != cacheInfoKey {
+			return nil
+		}
+		dir := path.Dir(p)
+		if info, err := r.loadCacheInfo(dir); err == nil {
+			entries = append(entries, expiryEntry{expires: expiryKey(info.Expires), path: dir})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(entries, compareExpiry)
+	return r.saveExpiryIndex(entries)
+}
+
+// updateExpiryIndex appends the entry of the object stored at itPath for its info cache information.
+// The entry for its prev cache information is left in place, as it stops being valid.
+func (r *repo) updateExpiryIndex(itPath string, prev *CacheInfo, info CacheInfo) error {
+	expires := expiryKey(info.Expires)
+	if prev != nil && expiryKey(prev.Expires) == expires {
+		return nil
+	}
+
+	r.expiry.Lock()
+	defer r.expiry.Unlock()
+
+	f, err := r.root.OpenFile(expiryIndexPath(), os.O_RDWR|os.O_APPEND, defaultFilePerm)
+	if errors.Is(err, fs.ErrNotExist) {
+		// NOTE(marius): the new cache information is already stored, so it gets into the built index.
+		return r.buildExpiryIndex()
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	line := make([]byte, 0, 64)
+	if size := fi.Size(); size > 0 {
+		// NOTE(marius): a torn last line gets terminated, so it doesn't get glued to the new one.
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, size-1); err == nil && last[0] != '\n' {
+			line = append(line, '\n')
+		}
+	}
+	line = appendExpiryLine(line, expiryEntry{expires: expires, path: itPath})
+	_, err = f.Write(line)
+	return err
+}
+
+// compactExpiryIndex rewrites the expiry index without the dead entries, if they are still not valid,
+// and without the duplicated ones.
+func (r *repo) compactExpiryIndex(dead ...expiryEntry) error {
+	r.expiry.Lock()
+	defer r.expiry.Unlock()
+
+	entries, err := r.loadExpiryIndex()
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(entries, compareExpiry)
+	entries = slices.Compact(entries)
+	entries = slices.DeleteFunc(entries, func(e expiryEntry) bool {
+		_, found := slices.BinarySearchFunc(dead, e, compareExpiry)
+		return found && !r.validExpiryEntry(e)
+	})
+	return r.saveExpiryIndex(entries)
+}
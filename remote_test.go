@@ -0,0 +1,135 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func TestCacheInfo_StaleAt(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		info CacheInfo
+		want bool
+	}{
+		{
+			name: "no expiration",
+			info: CacheInfo{Fetched: now.Add(-time.Minute)},
+			want: true,
+		},
+		{
+			name: "expired",
+			info: CacheInfo{Fetched: now.Add(-time.Hour), Expires: now.Add(-time.Minute)},
+			want: true,
+		},
+		{
+			name: "expires now",
+			info: CacheInfo{Fetched: now.Add(-time.Hour), Expires: now},
+			want: true,
+		},
+		{
+			name: "fresh",
+			info: CacheInfo{Fetched: now.Add(-time.Hour), Expires: now.Add(time.Minute)},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.StaleAt(now); got != tt.want {
+				t.Errorf("StaleAt() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_repo_CacheInfo(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	expired := &vocab.Object{ID: "https://remote.example/notes/expired", Type: vocab.NoteType}
+	older := &vocab.Object{ID: "https://remote.example/notes/older", Type: vocab.NoteType}
+	fresh := &vocab.Object{ID: "https://remote.example/notes/fresh", Type: vocab.NoteType}
+	missing := vocab.IRI("https://remote.example/notes/missing")
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir)}, withGeneratedRoot(root), withGeneratedItems(vocab.ItemCollection{expired, older, fresh}))
+
+	infos := map[vocab.IRI]CacheInfo{
+		expired.GetLink(): {Fetched: now.Add(-2 * time.Hour), ETag: `"1"`, Expires: now.Add(-time.Hour)},
+		older.GetLink():   {Fetched: now.Add(-3 * time.Hour), LastModified: now.Add(-24 * time.Hour), Expires: now.Add(-2 * time.Hour)},
+		fresh.GetLink():   {Fetched: now, Expires: now.Add(time.Hour)},
+	}
+	for iri, info := range infos {
+		if err := r.SaveCacheInfo(iri, info); err != nil {
+			t.Fatalf("SaveCacheInfo() error = %s", err)
+		}
+	}
+	if err := r.SaveCacheInfo(missing, CacheInfo{Fetched: now}); err == nil {
+		t.Errorf("SaveCacheInfo() for an object which is not stored didn't return an error")
+	}
+
+	it, info, err := r.LoadWithCacheInfo(expired.GetLink())
+	if err != nil {
+		t.Fatalf("LoadWithCacheInfo() error = %s", err)
+	}
+	if !it.GetLink().Equals(expired.GetLink(), true) {
+		t.Errorf("LoadWithCacheInfo() item = %s, want %s", it.GetLink(), expired.GetLink())
+	}
+	if info == nil || info.ETag != `"1"` || !info.Fetched.Equal(infos[expired.GetLink()].Fetched) || !info.Stale() {
+		t.Errorf("LoadWithCacheInfo() cache info = %+v, want %+v", info, infos[expired.GetLink()])
+	}
+	if _, info, err = r.LoadWithCacheInfo(rootIRI); err != nil || info != nil {
+		t.Errorf("LoadWithCacheInfo() of a local object = %+v, %v, want no cache information", info, err)
+	}
+
+	stale, err := r.StaleObjects(now, 0)
+	if err != nil {
+		t.Fatalf("StaleObjects() error = %s", err)
+	}
+	if len(stale) != 2 || !stale[0].Equals(older.GetLink(), true) || !stale[1].Equals(expired.GetLink(), true) {
+		t.Errorf("StaleObjects() = %v, want %s, %s", stale, older.GetLink(), expired.GetLink())
+	}
+	if stale, _ = r.StaleObjects(now, 1); len(stale) != 1 {
+		t.Errorf("StaleObjects() with limit 1 = %v", stale)
+	}
+	if stale, _ = r.StaleObjects(now.Add(2*time.Hour), 0); len(stale) != 3 {
+		t.Errorf("StaleObjects() in two hours = %v, want all the objects", stale)
+	}
+
+	if err = r.Delete(expired); err != nil {
+		t.Fatalf("Delete() error = %s", err)
+	}
+	if _, err = r.LoadCacheInfo(expired.GetLink()); err == nil {
+		t.Errorf("Delete() didn't remove the cache information")
+	}
+	if stale, _ = r.StaleObjects(now.Add(2*time.Hour), 0); len(stale) != 2 || stale.Contains(expired.GetLink()) {
+		t.Errorf("StaleObjects() after Delete() = %v, want %s, %s", stale, older.GetLink(), fresh.GetLink())
+	}
+	entries, err := r.loadExpiryIndex()
+	if err != nil || len(entries) != 2 {
+		t.Errorf("expiry index after StaleObjects() = %v, %v, want the entries of the deleted object removed", entries, err)
+	}
+
+	if err = r.SaveCacheInfo(fresh.GetLink(), CacheInfo{Fetched: now, Expires: now.Add(-3 * time.Hour)}); err != nil {
+		t.Fatalf("SaveCacheInfo() error = %s", err)
+	}
+	if stale, _ = r.StaleObjects(now, 0); len(stale) != 2 || !stale[0].Equals(fresh.GetLink(), true) {
+		t.Errorf("StaleObjects() after updating the cache information = %v, want %s first", stale, fresh.GetLink())
+	}
+	if entries, err = r.loadExpiryIndex(); err != nil || len(entries) != 3 {
+		t.Errorf("expiry index after updating the cache information = %v, %v, want the new entry appended", entries, err)
+	}
+
+	// NOTE(marius): the storages without an expiry index get one built from their cache information.
+	if err = os.Remove(filepath.Join(dir, expiryIndexPath())); err != nil {
+		t.Fatalf("unable to remove the expiry index: %s", err)
+	}
+	if stale, _ = r.StaleObjects(now, 0); len(stale) != 2 || !stale[0].Equals(fresh.GetLink(), true) {
+		t.Errorf("StaleObjects() without an expiry index = %v, want %s, %s", stale, fresh.GetLink(), older.GetLink())
+	}
+	if _, err = os.Stat(filepath.Join(dir, expiryIndexPath())); err != nil {
+		t.Errorf("StaleObjects() didn't build the expiry index: %s", err)
+	}
+}
@@ -6,11 +6,11 @@ import (
 	xerrors "errors"
 	"io"
 	"io/fs"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"git.sr.ht/~mariusor/lw"
@@ -19,6 +19,7 @@ import (
 	"github.com/go-ap/cache"
 	"github.com/go-ap/errors"
 	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
 )
 
 var encodeItemFn = vocab.MarshalJSON
@@ -33,7 +34,41 @@ type Config struct {
 	Path        string
 	EnableCache bool
 	EnableIndex bool
-	Logger      lw.Logger
+	// Indexes is the set of index types to maintain when the index is enabled.
+	// It defaults to DefaultIndexTypes, which are all the types from the filters/index package,
+	// together with the hashtag, mention, tag, thread, language and location indexes.
+	// The optional indexes, like ByURL or ByContentLanguage, get enabled by adding them
+	// to the default ones, for example: append(DefaultIndexTypes(), ByURL).
+	// The types that get enabled for an existing storage are built by BackfillIndex, and the files
+	// of the ones that get disabled are deleted by DropIndex. Open doesn't change the index files.
+	Indexes []index.Type
+	// Codec is the format the objects and their metadata get stored in. It defaults to JSON.
+	// The files are read according to the format they were written in, so changing it
+	// doesn't require converting the existing ones. See repo.Recode for that.
+	Codec Codec
+	// Compression enables the compression of the stored objects.
+	// The compressed objects are detected when loading, regardless of this setting.
+	Compression Compression
+	// CompressionMinSize is the size in bytes under which the objects are stored uncompressed.
+	// It defaults to 1KiB.
+	CompressionMinSize int
+	// EncryptionKeys enables the encryption at rest of the actors' metadata, which holds their
+	// passwords and private keys, and of the OAuth clients and tokens.
+	// The files are encrypted with the primary key of the keyring, see repo.Reencrypt for
+	// encrypting the existing ones, or for switching them to a new key after a rotation.
+	EncryptionKeys *Keyring
+	// ShardedLayout stores the members of the collections, including the objects themselves, two
+	// directory levels deeper, for example objects/ab/cd/<uuid>, to keep the size of the directories small.
+	// It must match the layout of an existing storage, see repo.Reshard for converting between the two.
+	// For the storages created with Bootstrap, the layout recorded in their layout file takes precedence.
+	ShardedLayout bool
+	// Membership selects how the members of the collections are stored: as symlinks, which is the default,
+	// or in a manifest file. See repo.ConvertMembership for converting an existing storage.
+	Membership Membership
+	// Journal records the paths of the files modified by every write, which allows creating
+	// incremental snapshots of the storage with repo.IncrementalSnapshot.
+	Journal bool
+	Logger  lw.Logger
 }
 
 var errMissingPath = errors.Newf("missing path in config")
@@ -54,13 +89,21 @@ func New(c Config) (*repo, error) {
 
 	b := repo{
 		path:   p,
+		codec:  c.Codec,
 		logger: emptyLogger,
+
+		compression:        c.Compression,
+		compressionMinSize: c.CompressionMinSize,
+		keys:               c.EncryptionKeys,
+		sharded:            c.ShardedLayout,
+		membership:         c.Membership,
+		journal:            c.Journal,
 	}
 	if c.Logger != nil {
 		b.logger = c.Logger
 	}
 	if c.EnableIndex {
-		b.index = newBitmap()
+		b.index = newBitmap(c.indexTypes()...)
 	}
 	if c.EnableCache {
 		b.cache = cache.New(true)
@@ -73,7 +116,30 @@ type repo struct {
 	root   *os.Root
 	index  *bitmaps
 	cache  cache.CanStore
+	codec  Codec
 	logger lw.Logger
+
+	compression        Compression
+	compressionMinSize int
+	keys               *Keyring
+	sharded            bool
+	membership         Membership
+	journal            bool
+
+	// quiesce is held for reading by the writes, so Snapshot can pause them.
+	quiesce   sync.RWMutex
+	journalMu sync.Mutex
+	// watches are the active change watches, which get the paths recorded by the writes.
+	watchMu sync.Mutex
+	watches map[*changeWatch]struct{}
+	// manifests serializes the writes to the membership manifest of each collection.
+	manifests keyedMutex
+	// manifestState holds the members read from the manifest of each collection, by its path.
+	manifestState sync.Map
+	// expiry serializes the writes to the expiry index of the remote objects.
+	expiry sync.Mutex
+	// blobs serializes the linking and the removal of the blob contents in each directory of the blobs folder.
+	blobs keyedMutex
 }
 
 // Open
@@ -86,6 +152,14 @@ func (r *repo) Open() error {
 		return err
 	}
 	r.root = root
+	if err = r.checkLayout(); err != nil {
+		_ = r.close()
+		r.root = nil
+		return err
+	}
+	if missing := r.missingIndexTypes(); len(missing) > 0 {
+		r.logger.Warnf("The index types %v were not built yet, BackfillIndex builds them", missing)
+	}
 	return nil
 }
 
@@ -113,6 +187,23 @@ func (r *repo) Load(i vocab.IRI, f ...filters.Check) (vocab.Item, error) {
 	return filters.Checks(f).Run(it), nil
 }
 
+// WalkIRIs calls fn with the IRI of each object and collection in the storage, stopping at the first error.
+// It makes the storage usable as a source of MigrateFrom.
+func (r *repo) WalkIRIs(fn func(vocab.IRI) error) error {
+	if r == nil || r.root == nil {
+		return errNotOpen
+	}
+	return r.walkStorage(func(p string, d fs.DirEntry) error {
+		if d.Name() != objectKey {
+			return nil
+		}
+		if iri := pathIRI(unshardPath(path.Dir(p))); iri != "" {
+			return fn(iri)
+		}
+		return nil
+	})
+}
+
 // Save
 func (r *repo) Save(it vocab.Item) (vocab.Item, error) {
 	if r == nil || r.root == nil {
@@ -121,23 +212,33 @@ func (r *repo) Save(it vocab.Item) (vocab.Item, error) {
 	if vocab.IsNil(it) {
 		return nil, errors.Newf("Unable to save nil element")
 	}
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
 
 	return save(r, it)
 }
 
 // RemoveFrom removes the items from the colIRI collection.
 func (r *repo) RemoveFrom(colIRI vocab.IRI, items ...vocab.Item) error {
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
 	// NOTE(marius): We make sure the collection exists (unless it's a hidden collection)
-	itPath := iriPath(colIRI)
+	itPath := r.pathOf(colIRI)
 	col, err := r.loadItemFromPath(getObjectKey(itPath))
 	if err != nil && !isHiddenCollectionKey(itPath) {
 		return err
 	}
 
-	linkPath := iriPath(colIRI)
+	linkPath := r.pathOf(colIRI)
 	for _, it := range items {
-		fullLink := path.Join(linkPath, url.PathEscape(iriPath(it.GetLink())))
+		fullLink := r.memberPath(linkPath, it)
 		err = onCollection(r, col, it, func(p string) error {
+			if r.membership == MembershipManifest {
+				r.record(manifestPath(p))
+				return r.removeFromManifest(p, it.GetLink())
+			}
+			r.record(fullLink)
 			return r.root.RemoveAll(fullLink)
 		})
 		if err != nil {
@@ -190,29 +291,6 @@ func isSymLink(fi os.FileInfo) bool {
 	return fi.Mode()&os.ModeSymlink == os.ModeSymlink
 }
 
-func iriPath(iri vocab.IRI) string {
-	u, err := iri.URL()
-	if err != nil {
-		return ""
-	}
-
-	pieces := make([]string, 0)
-	pieces = append(pieces, "./")
-	if h := u.Host; h != "" {
-		pieces = append(pieces, h)
-	}
-	if p := u.Path; p != "" && p != "/" {
-		pieces = append(pieces, p)
-	}
-	//if u.ForceQuery || u.RawQuery != "" {
-	//	pieces = append(pieces, url.PathEscape(u.RawQuery))
-	//}
-	if u.Fragment != "" {
-		pieces = append(pieces, strings.ReplaceAll(u.Fragment, "#", ""))
-	}
-	return filepath.Join(pieces...)
-}
-
 func createCollection(r *repo, colIRI vocab.IRI, owner vocab.Item) (vocab.CollectionInterface, error) {
 	col := vocab.OrderedCollection{
 		ID:        colIRI,
@@ -241,8 +319,11 @@ var collectionTypes = vocab.ActivityVocabularyTypes{vocab.CollectionPageType, vo
 
 // AddTo adds the items to the colIRI collection.
 func (r *repo) AddTo(colIRI vocab.IRI, items ...vocab.Item) error {
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
+
 	// NOTE(marius): We make sure the collection exists (unless it's a hidden collection)
-	itPath := iriPath(colIRI)
+	itPath := r.pathOf(colIRI)
 	col, err := r.loadItemFromPath(getObjectKey(itPath))
 	if err != nil && !isHiddenCollectionKey(itPath) {
 		return err
@@ -258,7 +339,7 @@ func (r *repo) AddTo(colIRI vocab.IRI, items ...vocab.Item) error {
 		}
 	}
 
-	linkPath := iriPath(colIRI)
+	linkPath := r.pathOf(colIRI)
 	for _, it := range items {
 		if vocab.IsIRI(it) {
 			it, err = r.loadOneFromIRI(it.GetLink())
@@ -272,25 +353,33 @@ func (r *repo) AddTo(colIRI vocab.IRI, items ...vocab.Item) error {
 			if err := mkDirIfNotExists(r.root, p); err != nil {
 				return errors.Annotatef(err, "unable to create collection folder %s", p)
 			}
+			if r.membership == MembershipManifest {
+				r.record(manifestPath(p))
+				return r.addToManifest(p, it.GetLink())
+			}
 			// NOTE(marius): if 'it' IRI belongs to the 'col' collection we can skip symlinking it
 			if it.GetLink().Contains(col.GetLink(), true) {
 				return nil
 			}
 
-			fullLink := path.Join(linkPath, url.PathEscape(iriPath(it.GetLink())))
+			fullLink := r.memberPath(linkPath, it)
 			if fi, _ := r.root.Stat(fullLink); fi != nil {
 				if isSymLink(fi) {
 					return nil
 				}
 			}
+			if err := mkDirIfNotExists(r.root, path.Dir(fullLink)); err != nil {
+				return errors.Annotatef(err, "unable to create collection folder %s", path.Dir(fullLink))
+			}
 
-			itOriginalPath := iriPath(it.GetLink())
-			relativePath, err := filepath.Rel(linkPath, itOriginalPath)
+			itOriginalPath := r.pathOf(it.GetLink())
+			relativePath, err := filepath.Rel(path.Dir(fullLink), itOriginalPath)
 			if err != nil {
 				return err
 			}
 			// NOTE(marius): we can't use hard links as we're linking to folders :(
 			// This would have been tremendously easier (as in, not having to compute paths) with hard-links.
+			r.record(fullLink)
 			if err = r.root.Symlink(relativePath, fullLink); err != nil {
 				if os.IsExist(err) {
 					return nil
@@ -340,10 +429,18 @@ func (r *repo) Delete(it vocab.Item) error {
 	if vocab.IsNil(it) {
 		return nil
 	}
+	r.quiesce.RLock()
+	defer r.quiesce.RUnlock()
 	return r.delete(it)
 }
 
 func (r *repo) delete(it vocab.Item) error {
+	_ = r.loadIndex()
+
+	defer func() {
+		_ = r.saveIndex()
+	}()
+
 	if vocab.IsItemCollection(it) {
 		if col, ok := it.(vocab.ItemCollection); ok {
 			for _, it := range col {
@@ -408,11 +505,19 @@ func deleteItem(r *repo, it vocab.Item) error {
 	if it.GetLink() == "" {
 		return nil
 	}
-	itemPath := iriPath(it.GetLink())
+	itemPath := r.pathOf(it.GetLink())
 
+	blobs := r.blobsUnder(itemPath)
+	r.record(itemPath)
 	if err := r.root.RemoveAll(itemPath); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	for _, sum := range blobs {
+		r.releaseBlob(sum)
+	}
+	if err := r.removeFromIndex(it, itemPath); err != nil && !errors.IsNotImplemented(err) {
+		r.logger.Errorf("unable to remove item %s from index: %s", it.GetLink(), err)
+	}
 	r.removeFromCache(it.GetLink())
 	return nil
 }
@@ -429,17 +534,21 @@ func save(r *repo, it vocab.Item) (vocab.Item, error) {
 	}()
 
 	writeSingleObjFn := func(it vocab.Item) (vocab.Item, error) {
-		itPath := iriPath(it.GetLink())
+		itPath := r.pathOf(it.GetLink())
 		_ = mkDirIfNotExists(r.root, itPath)
 
-		entryBytes, err := encodeItemFn(it)
+		entryBytes, err := r.encodeItem(it)
 		if err != nil {
 			return it, errors.Annotatef(err, "could not marshal object")
 		}
+		if entryBytes, err = r.compressObject(entryBytes); err != nil {
+			return it, errors.Annotatef(err, "could not compress object")
+		}
 
 		if err = putRaw(r.root, getObjectKey(itPath), entryBytes); err != nil {
 			return it, err
 		}
+		r.record(getObjectKey(itPath))
 
 		if err = r.addToIndex(it, itPath); err != nil && !errors.IsNotImplemented(err) {
 			r.logger.Errorf("unable to add item %s to index: %s", it.GetLink(), err)
@@ -481,7 +590,7 @@ func onCollection(r *repo, col vocab.Item, it vocab.Item, fn func(p string) erro
 		return errors.Newf("invalid item, it does not have a valid IRI")
 	}
 
-	itPath := iriPath(col.GetLink())
+	itPath := r.pathOf(col.GetLink())
 	if err := fn(itPath); err != nil {
 		if os.IsExist(err) {
 			return errors.NewConflict(err, "%s already exists in collection %s", it.GetID(), itPath)
@@ -493,7 +602,17 @@ func onCollection(r *repo, col vocab.Item, it vocab.Item, fn func(p string) erro
 	return nil
 }
 
+// loadRaw returns the JSON document stored at itPath, decompressing and decoding it if it was
+// stored compressed or in another format.
 func loadRaw(root *os.Root, itPath string) ([]byte, error) {
+	raw, err := readRaw(root, itPath)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapRaw(raw)
+}
+
+func readRaw(root *os.Root, itPath string) ([]byte, error) {
 	fi, err := root.Open(itPath)
 	if err != nil {
 		return nil, err
@@ -514,7 +633,7 @@ func itemFromRaw(raw []byte) (vocab.Item, error) {
 }
 
 func (r *repo) loadOneFromIRI(i vocab.IRI) (vocab.Item, error) {
-	col, err := r.loadItemFromPath(getObjectKey(iriPath(i)))
+	col, err := r.loadItemFromPath(getObjectKey(r.pathOf(i)))
 	if err != nil {
 		return nil, err
 	}
@@ -555,7 +674,7 @@ func loadFilteredPropsForObject(r *repo, fil ...filters.Check) func(o *vocab.Obj
 				if vocab.IsNil(t) || !vocab.IsIRI(t) {
 					return nil
 				}
-				ob, err := r.loadItemFromPath(getObjectKey(iriPath(t.GetLink())))
+				ob, err := r.loadItemFromPath(getObjectKey(r.pathOf(t.GetLink())))
 				if err != nil {
 					continue
 				}
@@ -577,7 +696,7 @@ func dereferenceItemAndFilter(r *repo, ob vocab.Item, fil ...filters.Check) (voc
 	if !vocab.IsIRI(ob) {
 		return ob, nil
 	}
-	itPath := iriPath(ob.GetLink())
+	itPath := r.pathOf(ob.GetLink())
 	o, err := r.loadItemFromPath(getObjectKey(itPath), fil...)
 	if err != nil {
 		return ob, nil
@@ -652,13 +771,15 @@ func getOriginalIRI(root *os.Root, p string) (vocab.Item, error) {
 	if err != nil {
 		return nil, nil
 	}
-	original = strings.TrimLeft(path.Clean(original), "../")
+	original = unshardPath(strings.TrimLeft(path.Clean(original), "../"))
 	pieces := strings.Split(original, "/")
 	if len(pieces) == 0 {
 		return nil, nil
 	}
-	upath := ""
 	host := pieces[0]
+	if isSchemeSegment(host) && len(pieces) > 1 {
+		host = pieces[1]
+	}
 	// NOTE(marius): this heuristic of trying to see if the path we received is of type activities/UUID
 	// is not very good, and it might lead to problems down the line.
 	// Currently, it prevents returning invalid IRIs when an item in an inbox points to a valid folder in /activities,
@@ -667,11 +788,7 @@ func getOriginalIRI(root *os.Root, p string) (vocab.Item, error) {
 		// directory is local, but has no __raw file
 		return nil, errors.NotFoundf("invalid path %s", p)
 	}
-	if len(pieces) > 1 {
-		upath = path.Join(pieces[1:]...)
-	}
-	u := url.URL{Scheme: "https", Host: host, Path: upath}
-	return vocab.IRI(u.String()), nil
+	return pathIRI(original), nil
 }
 
 func (r *repo) loadFromCache(iri vocab.IRI) vocab.Item {
@@ -682,20 +799,13 @@ func (r *repo) loadFromCache(iri vocab.IRI) vocab.Item {
 }
 
 func loadRawFromPath(root *os.Root, p string) (vocab.Item, error) {
-	raw, err := loadRaw(root, p)
+	it, err := loadItemRaw(root, p)
 	if err != nil {
 		if os.IsNotExist(err) && !isStorageCollectionKey(filepath.Dir(p)) {
 			return getOriginalIRI(root, p)
 		}
 		return nil, err
 	}
-	if raw == nil {
-		return nil, nil
-	}
-	it, err := itemFromRaw(raw)
-	if err != nil {
-		return nil, err
-	}
 	if vocab.IsNil(it) {
 		return nil, errors.NotFoundf("not found")
 	}
@@ -786,10 +896,7 @@ func (r *repo) loadCollectionFromPath(itPath string, iri vocab.IRI, fil ...filte
 		}
 
 		colDirPath := filepath.Dir(itPath)
-
-		var fn fs.WalkDirFunc
-		fn = loadWithRawFiltering(r, colDirPath, &items, fil...)
-		if err = fs.WalkDir(r.root.FS(), colDirPath, fn); err != nil {
+		if err = r.loadCollectionMembers(colDirPath, &items, fil...); err != nil {
 			return it, err
 		}
 	}
@@ -815,11 +922,11 @@ func loadWithRawFiltering(r *repo, colDirPath string, items *vocab.ItemCollectio
 
 		dir := p
 		diff := strings.TrimPrefix(dir, colDirPath)
-		if strings.Count(diff, "/") != 1 {
+		if strings.Count(diff, "/") != r.memberDepth(colDirPath) {
 			// NOTE(marius): when encountering the raw file that is deeper than the first level under the collection path, we skip
 			return nil
 		}
-		if fn := filepath.Base(p); fn == objectKey || fn == metaDataKey || fn == _indexDirName {
+		if fn := filepath.Base(p); fn == objectKey || fn == metaDataKey || fn == _indexDirName || fn == _manifestName {
 			return nil
 		}
 
@@ -943,7 +1050,10 @@ func (r *repo) loadFromIRI(iri vocab.IRI, fil ...filters.Check) (vocab.Item, err
 	var err error
 	var it vocab.Item
 
-	itPath := iriPath(iri)
+	itPath := r.pathOf(iri)
+	if colPath := r.pathOf(withoutQuery(iri)); isStorageCollectionKey(colPath) {
+		itPath = colPath
+	}
 	if isStorageCollectionKey(itPath) {
 		return r.loadCollectionFromPath(getObjectKey(itPath), iri, fil...)
 	}
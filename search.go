@@ -0,0 +1,677 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/gob"
+	"encoding/json"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+const (
+	_fullTextName = ".fulltext.gob"
+	// _fullTextLogName is the file, next to the full text index, which holds the documents added to the index,
+	// or removed from it, since it was last written whole. It has a JSON line for each of them.
+	_fullTextLogName = ".fulltext.log"
+	// fullTextCompactSize is the size the log can grow to before being folded into the index file,
+	// unless the index file is larger.
+	fullTextCompactSize = 4 << 20
+)
+
+// fieldGap is the distance in token positions between two indexed properties of the same document,
+// so phrase queries can't match across the end of the name and the beginning of the content.
+const fieldGap = 64
+
+// fullText is a positional inverted index over the normalized and stemmed tokens found in
+// the name, summary and content of the indexed objects.
+type fullText struct {
+	w sync.RWMutex
+	// Terms maps a stemmed token to the documents containing it, and the positions it appears at.
+	Terms map[string]map[uint64][]uint32
+	// Docs holds the document length and the distinct terms of each indexed document,
+	// the latter being needed for removing it.
+	Docs map[uint64]textDoc
+
+	// pending are the changes which were not appended to the log yet.
+	pending []textChange
+	// rewrite is set when the index needs to be written whole, like after it was rebuilt.
+	rewrite bool
+	// base is the index file the index was loaded from, and logSize is the size of the log applied on it,
+	// so only the changes appended after it, by other processes, need to be loaded again.
+	base    os.FileInfo
+	logSize int64
+}
+
+// textChange is a line of the full text log. It replaces the terms of the Ref document with the ones
+// in Positions, the document getting removed when there are none.
+type textChange struct {
+	Ref       uint64              `json:"ref"`
+	Length    int                 `json:"len,omitempty"`
+	Positions map[string][]uint32 `json:"pos,omitempty"`
+}
+
+type textDoc struct {
+	Length int
+	Terms  []string
+}
+
+func newFullText() *fullText {
+	return &fullText{
+		Terms: make(map[string]map[uint64][]uint32),
+		Docs:  make(map[uint64]textDoc),
+	}
+}
+
+type langValue struct {
+	Lang  string
+	Value string
+}
+
+// langValues returns the values of a natural language property together with their language tags.
+func langValues(nlv vocab.NaturalLanguageValues) []langValue {
+	result := make([]langValue, 0, len(nlv))
+	for lang, val := range nlv {
+		if len(val) == 0 {
+			continue
+		}
+		result = append(result, langValue{Lang: string(lang), Value: string(val)})
+	}
+	slices.SortFunc(result, func(a, b langValue) int {
+		return strings.Compare(a.Lang, b.Lang)
+	})
+	return result
+}
+
+func textFieldsOf(it vocab.Item) [][]langValue {
+	fields := make([][]langValue, 0, 3)
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		fields = append(fields, langValues(ob.Name), langValues(ob.Summary), langValues(ob.Content))
+		return nil
+	})
+	return fields
+}
+
+// stripHTML returns the text content of an HTML fragment, with the entities decoded.
+// The contents of script and style elements are dropped, and tags get replaced with spaces,
+// so words in adjacent block elements don't get glued together.
+func stripHTML(s string) string {
+	if !strings.ContainsAny(s, "<&") {
+		return s
+	}
+	b := strings.Builder{}
+	b.Grow(len(s))
+	skipUntil := ""
+	for len(s) > 0 {
+		start := strings.IndexByte(s, '<')
+		if start < 0 {
+			if skipUntil == "" {
+				b.WriteString(s)
+			}
+			break
+		}
+		if skipUntil == "" {
+			b.WriteString(s[:start])
+		}
+		end := strings.IndexByte(s[start:], '>')
+		if end < 0 {
+			break
+		}
+		tag := strings.ToLower(strings.TrimSpace(s[start+1 : start+end]))
+		name := strings.FieldsFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == '/' })
+		switch {
+		case skipUntil != "":
+			if strings.HasPrefix(tag, "/"+skipUntil) {
+				skipUntil = ""
+			}
+		case len(name) > 0 && (name[0] == "script" || name[0] == "style") && !strings.HasSuffix(tag, "/"):
+			skipUntil = name[0]
+		}
+		b.WriteByte(' ')
+		s = s[start+end+1:]
+	}
+	return html.UnescapeString(b.String())
+}
+
+var foldedRunes = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th", 'ł': "l", 'ı': "i",
+}
+
+const (
+	accentedRunes = "àáâãäåāăąçćĉċčďèéêëēĕėęěĝğġģĥìíîïĩīĭįĵķĺļľñńņňòóôõöōŏőŕŗřśŝşšţťùúûüũūŭůűųŵýÿŷźżž"
+	foldedLetters = "aaaaaaaaacccccdeeeeeeeeegggghiiiiiiiijklllnnnnoooooooorrrssssttuuuuuuuuuuwyyyzzz"
+)
+
+// foldRune lower cases r and removes its diacritics, if it's a Latin letter.
+func foldRune(r rune) string {
+	r = unicode.ToLower(r)
+	if f, ok := foldedRunes[r]; ok {
+		return f
+	}
+	if r < 0xC0 {
+		return string(r)
+	}
+	if i := strings.IndexRune(accentedRunes, r); i >= 0 {
+		return string(foldedLetters[len([]rune(accentedRunes[:i]))])
+	}
+	return string(r)
+}
+
+// tokenize splits s into case and diacritic folded tokens, made of letters and digits.
+func tokenize(s string) []string {
+	tokens := make([]string, 0)
+	cur := strings.Builder{}
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur.WriteString(foldRune(r))
+			continue
+		}
+		if unicode.Is(unicode.Mn, r) {
+			// NOTE(marius): combining marks from decomposed text get dropped
+			continue
+		}
+		flush()
+	}
+	flush()
+	return tokens
+}
+
+// analyze returns the stemmed tokens of the natural language value s, in the lang language.
+func analyze(s, lang string) []string {
+	stem := stemmerFor(lang)
+	tokens := tokenize(stripHTML(s))
+	for i, tok := range tokens {
+		tokens[i] = stem(tok)
+	}
+	return tokens
+}
+
+func (t *fullText) remove(ref uint64) {
+	doc, ok := t.Docs[ref]
+	if !ok {
+		return
+	}
+	for _, term := range doc.Terms {
+		if postings, ok := t.Terms[term]; ok {
+			delete(postings, ref)
+			if len(postings) == 0 {
+				delete(t.Terms, term)
+			}
+		}
+	}
+	delete(t.Docs, ref)
+}
+
+// apply replaces the terms of the document with the ones of the change.
+func (t *fullText) apply(c textChange) {
+	t.remove(c.Ref)
+	if len(c.Positions) == 0 {
+		return
+	}
+	doc := textDoc{Length: c.Length, Terms: make([]string, 0, len(c.Positions))}
+	for term, positions := range c.Positions {
+		postings, ok := t.Terms[term]
+		if !ok {
+			postings = make(map[uint64][]uint32)
+			t.Terms[term] = postings
+		}
+		postings[c.Ref] = positions
+		doc.Terms = append(doc.Terms, term)
+	}
+	t.Docs[c.Ref] = doc
+}
+
+// Add indexes the natural language properties of the item, replacing any previous version of it.
+func (t *fullText) Add(li vocab.LinkOrIRI) uint64 {
+	it, ok := li.(vocab.Item)
+	if !ok || vocab.IsNil(it) || index.HashFn == nil {
+		return 0
+	}
+	c := textChange{Ref: index.HashFn(it.GetLink()), Positions: make(map[string][]uint32)}
+	pos := uint32(0)
+	for _, field := range textFieldsOf(it) {
+		for _, lv := range field {
+			for _, tok := range analyze(lv.Value, lv.Lang) {
+				c.Positions[tok] = append(c.Positions[tok], pos)
+				pos++
+			}
+			pos += fieldGap
+		}
+	}
+	if len(c.Positions) > 0 {
+		c.Length = int(pos)
+	}
+
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	t.apply(c)
+	t.pending = append(t.pending, c)
+	return c.Ref
+}
+
+// Remove drops the item from the full text index.
+func (t *fullText) Remove(li vocab.LinkOrIRI) error {
+	if li == nil || index.HashFn == nil {
+		return nil
+	}
+
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	c := textChange{Ref: index.HashFn(li.GetLink())}
+	t.apply(c)
+	t.pending = append(t.pending, c)
+	return nil
+}
+
+func sameFileState(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
+
+// load reads the index from the dir directory. When the index file is the one it was loaded from,
+// only the changes appended to the log since then get applied.
+func (t *fullText) load(root *os.Root, dir string) error {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	if t.rewrite {
+		return nil
+	}
+	fi, err := root.Stat(filepath.Join(dir, _fullTextName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !sameFileState(t.base, fi) {
+		t.Terms = make(map[string]map[uint64][]uint32)
+		t.Docs = make(map[uint64]textDoc)
+		if fi != nil {
+			if err = loadBinFromFile(root, filepath.Join(dir, _fullTextName), t); err != nil {
+				return err
+			}
+		}
+		t.base = fi
+		t.logSize = 0
+		defer func() {
+			// NOTE(marius): the changes which were not persisted yet are applied again on the loaded index.
+			for _, c := range t.pending {
+				t.apply(c)
+			}
+		}()
+	}
+
+	f, err := root.Open(filepath.Join(dir, _fullTextLogName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(t.logSize, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			// NOTE(marius): a last line without a new line is being written, or was torn by a crash.
+			break
+		}
+		t.logSize += int64(len(line))
+		c := textChange{}
+		if err = json.Unmarshal(line, &c); err == nil {
+			t.apply(c)
+		}
+	}
+	return nil
+}
+
+// persist appends the pending changes to the log in the dir directory. The index gets written whole
+// when it was rebuilt, or when the log grew larger than both fullTextCompactSize and the index file.
+func (t *fullText) persist(root *os.Root, dir string) error {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	if !t.rewrite {
+		if len(t.pending) == 0 {
+			return nil
+		}
+		size, err := t.appendLog(root, dir)
+		if err != nil {
+			return err
+		}
+		limit := int64(fullTextCompactSize)
+		if t.base != nil {
+			limit = max(limit, t.base.Size())
+		}
+		if size <= limit {
+			return nil
+		}
+	}
+	return t.compact(root, dir)
+}
+
+// appendLog appends the pending changes to the log, and returns its new size.
+func (t *fullText) appendLog(root *os.Root, dir string) (int64, error) {
+	f, err := root.OpenFile(filepath.Join(dir, _fullTextLogName), os.O_RDWR|os.O_CREATE|os.O_APPEND, defaultFilePerm)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	buf := bytes.Buffer{}
+	if size := fi.Size(); size > 0 {
+		// NOTE(marius): a torn last line gets terminated, so it doesn't get glued to the first new one.
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, size-1); err == nil && last[0] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	enc := json.NewEncoder(&buf)
+	for _, c := range t.pending {
+		if err = enc.Encode(c); err != nil {
+			return 0, err
+		}
+	}
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	size := fi.Size() + int64(buf.Len())
+	if fi.Size() == t.logSize {
+		// NOTE(marius): when other processes appended to the log since it was loaded, their changes,
+		// and ours with them, get applied on the next load.
+		t.logSize = size
+	}
+	t.pending = nil
+	return size, nil
+}
+
+// compact writes the index whole, and it removes the log.
+func (t *fullText) compact(root *os.Root, dir string) error {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(t); err != nil {
+		return err
+	}
+	if err := putRaw(root, filepath.Join(dir, _fullTextName), buf.Bytes()); err != nil {
+		return err
+	}
+	if err := root.Remove(filepath.Join(dir, _fullTextLogName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fi, err := root.Stat(filepath.Join(dir, _fullTextName))
+	if err != nil {
+		return err
+	}
+	t.base = fi
+	t.logSize = 0
+	t.pending = nil
+	t.rewrite = false
+	return nil
+}
+
+// textQuery is a parsed search query.
+//
+// The syntax supports plain terms, which must all be present in a document, "quoted phrases",
+// which must be present in the same order, terms prefixed with "-" which must be absent,
+// and a "lang:xx" modifier which sets the language used for stemming the query.
+type textQuery struct {
+	Lang     string
+	Terms    []string
+	Phrases  [][]string
+	Excluded []string
+}
+
+func (q textQuery) empty() bool {
+	return len(q.Terms) == 0 && len(q.Phrases) == 0
+}
+
+func parseTextQuery(s string) textQuery {
+	q := textQuery{}
+
+	type rawPart struct {
+		text    string
+		phrase  bool
+		exclude bool
+	}
+	parts := make([]rawPart, 0)
+	for len(s) > 0 {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if len(s) == 0 {
+			break
+		}
+		exclude := false
+		if s[0] == '-' {
+			exclude = true
+			s = s[1:]
+		}
+		if len(s) > 0 && s[0] == '"' {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			parts = append(parts, rawPart{text: s[1 : end+1], phrase: true, exclude: exclude})
+			s = s[min(end+2, len(s)):]
+			continue
+		}
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			end = len(s)
+		}
+		word := s[:end]
+		s = s[end:]
+		if lang, ok := strings.CutPrefix(word, "lang:"); ok && !exclude {
+			q.Lang = lang
+			continue
+		}
+		parts = append(parts, rawPart{text: word, exclude: exclude})
+	}
+
+	for _, p := range parts {
+		tokens := analyze(p.text, q.Lang)
+		switch {
+		case len(tokens) == 0:
+		case p.exclude:
+			q.Excluded = append(q.Excluded, tokens...)
+		case p.phrase && len(tokens) > 1:
+			q.Phrases = append(q.Phrases, tokens)
+		default:
+			q.Terms = append(q.Terms, tokens...)
+		}
+	}
+	return q
+}
+
+func (t *fullText) idf(term string) float64 {
+	return math.Log(1 + float64(len(t.Docs))/float64(1+len(t.Terms[term])))
+}
+
+// hasPhrase checks if the terms of the phrase appear at consecutive positions in the ref document.
+func (t *fullText) hasPhrase(ref uint64, phrase []string) bool {
+	starts := t.Terms[phrase[0]][ref]
+	for _, start := range starts {
+		found := true
+		for i, term := range phrase[1:] {
+			if !slices.Contains(t.Terms[term][ref], start+uint32(i+1)) {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// search returns the documents matching the query, with their relevance score.
+func (t *fullText) search(q textQuery) map[uint64]float64 {
+	t.w.RLock()
+	defer t.w.RUnlock()
+
+	required := slices.Clone(q.Terms)
+	for _, phrase := range q.Phrases {
+		required = append(required, phrase...)
+	}
+	if len(required) == 0 {
+		return nil
+	}
+
+	scores := make(map[uint64]float64)
+	for ref := range t.Terms[required[0]] {
+		scores[ref] = 0
+	}
+	for _, term := range required[1:] {
+		postings := t.Terms[term]
+		for ref := range scores {
+			if _, ok := postings[ref]; !ok {
+				delete(scores, ref)
+			}
+		}
+	}
+	for _, term := range q.Excluded {
+		for ref := range t.Terms[term] {
+			delete(scores, ref)
+		}
+	}
+
+	for ref := range scores {
+		length := 1.0
+		if doc, ok := t.Docs[ref]; ok && doc.Length > 0 {
+			length = float64(doc.Length)
+		}
+		score := 0.0
+		for _, term := range required {
+			tf := float64(len(t.Terms[term][ref]))
+			score += tf * t.idf(term)
+		}
+		for _, phrase := range q.Phrases {
+			if !t.hasPhrase(ref, phrase) {
+				score = -1
+				break
+			}
+			for _, term := range phrase {
+				score += t.idf(term)
+			}
+		}
+		if score < 0 {
+			delete(scores, ref)
+			continue
+		}
+		scores[ref] = score / (1 + math.Log(length))
+	}
+	return scores
+}
+
+// Search does a full text search in the name, summary and content of the items belonging
+// to the colIRI collection, and returns them ordered by relevance.
+// If colIRI is empty, the search covers the whole storage.
+// The filters get applied on the matched items, after they are loaded from disk.
+func (r *repo) Search(colIRI vocab.IRI, query string, ff ...filters.Check) (vocab.ItemCollection, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if r.index == nil || r.index.text == nil {
+		return nil, indexDisabled
+	}
+	q := parseTextQuery(query)
+	if q.empty() {
+		return nil, errors.BadRequestf("empty search query")
+	}
+	_ = r.loadIndex()
+
+	scores := r.index.text.search(q)
+
+	colBmp, err := r.collectionBitmap(colIRI)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]uint64, 0, len(scores))
+	for ref := range scores {
+		if colBmp != nil && !colBmp.Contains(ref) {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	// NOTE(marius): the items with equal scores are ordered by their reference, so the results
+	// come in the same order on every search.
+	slices.SortFunc(refs, func(a, b uint64) int {
+		if c := cmp.Compare(scores[b], scores[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+
+	return r.loadRefs(refs, filters.MaxCount(ff...), ff...), nil
+}
+
+// collectionBitmap loads the bitmap of the colIRI collection.
+// It returns a nil bitmap if colIRI is empty.
+func (r *repo) collectionBitmap(colIRI vocab.IRI) (*roaring64.Bitmap, error) {
+	if colIRI == "" {
+		return nil, nil
+	}
+	colBmp := roaring64.New()
+	if err := loadBinFromFile(r.root, r.collectionIndexStoragePath(colIRI), colBmp); err != nil {
+		return nil, errors.NewNotFound(asPathErr(err), "unable to load collection index for %s", colIRI)
+	}
+	return colBmp, nil
+}
+
+// loadRefs loads the indexed items for refs, keeping their order, and applies the filters on them.
+// It stops after maxItems matching items, if maxItems is greater than zero.
+func (r *repo) loadRefs(refs []uint64, maxItems int, ff ...filters.Check) vocab.ItemCollection {
+	r.index.w.RLock()
+	paths := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if p, ok := r.index.ref[ref]; ok {
+			paths = append(paths, p)
+		}
+	}
+	r.index.w.RUnlock()
+
+	result := make(vocab.ItemCollection, 0, len(paths))
+	for _, p := range paths {
+		it, err := r.loadItemFromPath(getObjectKey(filepath.Clean(p)))
+		if err != nil || vocab.IsNil(it) {
+			continue
+		}
+		if len(ff) > 0 && !applyAllFiltersOnItem(it, ff...) {
+			continue
+		}
+		result = append(result, it)
+		if maxItems > 0 && len(result) == maxItems {
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,395 @@
+package fs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters/index"
+)
+
+func Test_stripHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "plain text",
+			arg:  "plain text",
+			want: "plain text",
+		},
+		{
+			name: "paragraphs",
+			arg:  "<p>first</p><p>second &amp; third</p>",
+			want: " first  second & third ",
+		},
+		{
+			name: "script",
+			arg:  `<p>text<script type="text/javascript">alert("boo")</script></p>`,
+			want: " text   ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripHTML(tt.arg); got != tt.want {
+				t.Errorf("stripHTML() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tokenize(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "case folding",
+			arg:  "Hello, WORLD!",
+			want: []string{"hello", "world"},
+		},
+		{
+			name: "diacritics",
+			arg:  "Café Straße naïve",
+			want: []string{"cafe", "strasse", "naive"},
+		},
+		{
+			name: "decomposed diacritics",
+			arg:  "Cafe\u0301",
+			want: []string{"cafe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenize(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_parseTextQuery(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  string
+		want textQuery
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "terms",
+			arg:  "running cats",
+			want: textQuery{Terms: []string{"run", "cat"}},
+		},
+		{
+			name: "phrase and exclusion",
+			arg:  `"free software" -proprietary`,
+			want: textQuery{Phrases: [][]string{{"free", "software"}}, Excluded: []string{"proprietary"}},
+		},
+		{
+			name: "language",
+			arg:  "lang:de Katzen",
+			want: textQuery{Lang: "de", Terms: []string{"katz"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTextQuery(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTextQuery() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+var mockTextItems = vocab.ItemCollection{
+	&vocab.Object{
+		ID:      "https://example.com/objects/1",
+		Type:    vocab.NoteType,
+		Name:    vocab.DefaultNaturalLanguage("Running cats"),
+		Content: vocab.DefaultNaturalLanguage("<p>The cats were running through the <b>free software</b> conference.</p>"),
+	},
+	&vocab.Object{
+		ID:      "https://example.com/objects/2",
+		Type:    vocab.NoteType,
+		Content: vocab.DefaultNaturalLanguage("<p>Software that is free, and a cat.</p>"),
+	},
+	&vocab.Object{
+		ID:      "https://example.com/objects/3",
+		Type:    vocab.ArticleType,
+		Content: vocab.DefaultNaturalLanguage("Nothing to see here"),
+	},
+}
+
+func Test_fullText_search(t *testing.T) {
+	idx := newFullText()
+	for _, it := range mockTextItems {
+		_ = idx.Add(it)
+	}
+	_ = idx.Remove(mockTextItems[2])
+
+	tests := []struct {
+		name  string
+		query string
+		want  vocab.IRIs
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "stemmed term",
+			query: "cat",
+			want:  vocab.IRIs{"https://example.com/objects/1", "https://example.com/objects/2"},
+		},
+		{
+			name:  "phrase",
+			query: `"free software"`,
+			want:  vocab.IRIs{"https://example.com/objects/1"},
+		},
+		{
+			name:  "excluded",
+			query: "cat -running",
+			want:  vocab.IRIs{"https://example.com/objects/2"},
+		},
+		{
+			name:  "removed",
+			query: "nothing",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idx.search(parseTextQuery(tt.query))
+			if len(got) != len(tt.want) {
+				t.Errorf("search() returned %d results, want %d", len(got), len(tt.want))
+			}
+			for _, iri := range tt.want {
+				if _, ok := got[index.HashFn(iri)]; !ok {
+					t.Errorf("search() didn't find %s", iri)
+				}
+			}
+		})
+	}
+}
+
+func Test_fullText_persist(t *testing.T) {
+	root := openRoot(t, t.TempDir())
+	found := func(idx *fullText, query string) int {
+		return len(idx.search(parseTextQuery(query)))
+	}
+
+	idx := newFullText()
+	for _, it := range mockTextItems {
+		_ = idx.Add(it)
+	}
+	if err := idx.persist(root, "."); err != nil {
+		t.Fatalf("persist() error = %s", err)
+	}
+	if _, err := root.Stat(_fullTextName); !os.IsNotExist(err) {
+		t.Errorf("persist() wrote the whole index, err = %v", err)
+	}
+
+	// NOTE(marius): a line torn by a crash is skipped, and it doesn't break the lines appended after it.
+	f, err := root.OpenFile(_fullTextLogName, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unable to open the log: %s", err)
+	}
+	_, _ = f.WriteString(`{"ref":1,"pos":`)
+	_ = f.Close()
+
+	_ = idx.Remove(mockTextItems[0])
+	if err = idx.persist(root, "."); err != nil {
+		t.Fatalf("persist() error = %s", err)
+	}
+
+	loaded := newFullText()
+	if err = loaded.load(root, "."); err != nil {
+		t.Fatalf("load() error = %s", err)
+	}
+	if got := found(loaded, "cat"); got != 1 {
+		t.Errorf("search() after load returned %d results, want 1", got)
+	}
+
+	_ = idx.Add(mockTextItems[0])
+	idx.rewrite = true
+	if err = idx.persist(root, "."); err != nil {
+		t.Fatalf("persist() error = %s", err)
+	}
+	if _, err = root.Stat(_fullTextLogName); !os.IsNotExist(err) {
+		t.Errorf("persist() didn't remove the compacted log, err = %v", err)
+	}
+
+	// NOTE(marius): the index was rewritten by another process, so it gets loaded again.
+	if err = loaded.load(root, "."); err != nil {
+		t.Fatalf("load() error = %s", err)
+	}
+	if got := found(loaded, "cat"); got != 2 {
+		t.Errorf("search() after compaction returned %d results, want 2", got)
+	}
+}
+
+func Test_repo_Search(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  fields
+		query   string
+		want    int
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: errNotOpen,
+		},
+		{
+			name: "index disabled",
+			fields: fields{
+				path: t.TempDir(),
+				root: openRoot(t, t.TempDir()),
+			},
+			query:   "cat",
+			wantErr: indexDisabled,
+		},
+		{
+			name: "not enabled by default",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			query:   "cat",
+			wantErr: indexDisabled,
+		},
+		{
+			name: "found",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(append(DefaultIndexTypes(), ByFullText)...),
+			},
+			query: "cats",
+			want:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			if r.root != nil {
+				r = withItems(mockTextItems...)(t, r)
+			}
+			got, err := r.Search("", tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Search() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("Search() returned %d items, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func Test_repo_Search_order(t *testing.T) {
+	often := &vocab.Object{
+		ID:      "https://example.com/objects/often",
+		Type:    vocab.NoteType,
+		Name:    vocab.DefaultNaturalLanguage("Cat"),
+		Content: vocab.DefaultNaturalLanguage("Cat, cat, cat"),
+	}
+	long := &vocab.Object{
+		ID:      "https://example.com/objects/long",
+		Type:    vocab.NoteType,
+		Content: vocab.DefaultNaturalLanguage("A cat sat on the mat for a very long afternoon, watching birds fly past the window"),
+	}
+	tied1 := &vocab.Object{
+		ID:      "https://example.com/objects/tied-1",
+		Type:    vocab.NoteType,
+		Content: vocab.DefaultNaturalLanguage("Cat nap"),
+	}
+	tied2 := &vocab.Object{
+		ID:      "https://example.com/objects/tied-2",
+		Type:    vocab.NoteType,
+		Content: vocab.DefaultNaturalLanguage("Cat nap"),
+	}
+	other := &vocab.Object{
+		ID:      "https://example.com/objects/other",
+		Type:    vocab.NoteType,
+		Content: vocab.DefaultNaturalLanguage("Dog nap"),
+	}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir), index: newBitmap(append(DefaultIndexTypes(), ByFullText)...)}, withGeneratedRoot(root), withItems(often, long, tied1, tied2, other))
+	if err := r.AddTo(rootOutboxIRI, long, tied2, other); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+
+	// NOTE(marius): the items with the same score are ordered by their index reference.
+	tied := vocab.IRIs{tied1.GetLink(), tied2.GetLink()}
+	if index.HashFn(tied[1]) < index.HashFn(tied[0]) {
+		tied[0], tied[1] = tied[1], tied[0]
+	}
+
+	tests := []struct {
+		name    string
+		colIRI  vocab.IRI
+		query   string
+		want    vocab.IRIs
+		wantErr func(error) bool
+	}{
+		{
+			name:  "ranked",
+			query: "cat",
+			want:  vocab.IRIs{often.GetLink(), tied[0], tied[1], long.GetLink()},
+		},
+		{
+			name:   "collection",
+			colIRI: rootOutboxIRI,
+			query:  "cat",
+			want:   vocab.IRIs{tied2.GetLink(), long.GetLink()},
+		},
+		{
+			name:   "collection without matches",
+			colIRI: rootOutboxIRI,
+			query:  "birds -cat",
+		},
+		{
+			name:    "collection without index",
+			colIRI:  "https://example.com/missing",
+			query:   "cat",
+			wantErr: errors.IsNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// NOTE(marius): the order needs to be the same on every search
+			for range 5 {
+				got, err := r.Search(tt.colIRI, tt.query)
+				if tt.wantErr != nil {
+					if !tt.wantErr(err) {
+						t.Errorf("Search() error = %v", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Search() error = %s", err)
+				}
+				iris := make(vocab.IRIs, 0, len(got))
+				for _, it := range got {
+					iris = append(iris, it.GetLink())
+				}
+				if !reflect.DeepEqual(iris, tt.want) && (len(iris) > 0 || len(tt.want) > 0) {
+					t.Fatalf("Search() = %v, want %v", iris, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package fs
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+// shardLevels is the number of directories inserted between a collection and its members
+// when the sharded layout is enabled.
+const shardLevels = 2
+
+// shardDirs returns the shard directories for a collection member named name.
+// They are the hex encoding of the first bytes of its FNV-1a hash, so the members are spread
+// evenly regardless of how their names look.
+func shardDirs(name string) []string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum(nil)
+
+	dirs := make([]string, shardLevels)
+	for i := range dirs {
+		dirs[i] = hex.EncodeToString(sum[i : i+1])
+	}
+	return dirs
+}
+
+// isShardedAt checks if pieces starts with the shard directories of the member following them.
+func isShardedAt(pieces []string) bool {
+	if len(pieces) <= shardLevels {
+		return false
+	}
+	dirs := shardDirs(pieces[shardLevels])
+	for i, dir := range dirs {
+		if pieces[i] != dir {
+			return false
+		}
+	}
+	return true
+}
+
+func isCollectionName(name string) bool {
+	return storageCollectionPaths.Contains(vocab.CollectionPath(name))
+}
+
+// shardPath inserts the shard directories before every path element that follows a storage collection:
+// example.com/objects/<uuid> becomes example.com/objects/ab/cd/<uuid>.
+func shardPath(p string) string {
+	pieces := strings.Split(filepath.ToSlash(filepath.Clean(p)), "/")
+	result := make([]string, 0, len(pieces)+shardLevels*2)
+	for i, piece := range pieces {
+		if i > 0 && isCollectionName(pieces[i-1]) {
+			result = append(result, shardDirs(piece)...)
+		}
+		result = append(result, piece)
+	}
+	return path.Join(result...)
+}
+
+// unshardPath removes the shard directories from p.
+// A pair of directories is considered to be a shard only if it matches the name of the element
+// following it, so paths from the flat layout are returned unchanged.
+func unshardPath(p string) string {
+	pieces := strings.Split(filepath.ToSlash(filepath.Clean(p)), "/")
+	result := make([]string, 0, len(pieces))
+	for i := 0; i < len(pieces); i++ {
+		if len(result) > 0 && isCollectionName(result[len(result)-1]) && isShardedAt(pieces[i:]) {
+			i += shardLevels
+		}
+		result = append(result, pieces[i])
+	}
+	return path.Join(result...)
+}
+
+// pathOf returns the storage path of iri, according to the layout of the repository.
+func (r *repo) pathOf(iri vocab.IRI) string {
+	p := iriPath(iri)
+	if !r.sharded || p == "" {
+		return p
+	}
+	return shardPath(p)
+}
+
+// memberPath returns the path of the link to it, inside the collection stored at colPath.
+func (r *repo) memberPath(colPath string, it vocab.Item) string {
+	name := url.PathEscape(iriPath(it.GetLink()))
+	if r.sharded && isStorageCollectionKey(colPath) {
+		return path.Join(append(append([]string{colPath}, shardDirs(name)...), name)...)
+	}
+	return path.Join(colPath, name)
+}
+
+// memberDepth returns how deep below the collection stored at colPath its members are.
+func (r *repo) memberDepth(colPath string) int {
+	if r.sharded && isStorageCollectionKey(colPath) {
+		return shardLevels + 1
+	}
+	return 1
+}
+
+// Reshard converts the storage to the sharded layout, or back to the flat one, and it returns the
+// number of collection members that were moved.
+//
+// The objects and the links to them get moved to their new paths, and the paths kept in the index
+// get updated. It is meant to be run while the storage is not in use by other processes.
+func (r *repo) Reshard(sharded bool) (int, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	if r.sharded == sharded {
+		return 0, nil
+	}
+
+	convert := unshardPath
+	if sharded {
+		convert = func(p string) string {
+			return shardPath(unshardPath(p))
+		}
+	}
+	rs := resharder{root: r.root, from: r.sharded, to: sharded, convert: convert}
+	if err := rs.dir("."); err != nil {
+		return rs.count, err
+	}
+	r.sharded = sharded
+	if err := r.updateLayout(func(l *layout) { l.Sharded = sharded }); err != nil {
+		return rs.count, err
+	}
+
+	if r.index == nil {
+		return rs.count, nil
+	}
+	_ = r.loadIndex()
+	r.index.w.Lock()
+	for ref, p := range r.index.ref {
+		r.index.ref[ref] = convert(p)
+	}
+	r.index.w.Unlock()
+	return rs.count, r.saveIndex()
+}
+
+type resharder struct {
+	root    *os.Root
+	from    bool
+	to      bool
+	convert func(string) string
+	count   int
+}
+
+// dir looks for collections under the dir path, and moves their members.
+func (rs *resharder) dir(dir string) error {
+	entries, err := fs.ReadDir(rs.root.FS(), dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == _indexDirName || (dir == "." && e.Name() == folder) {
+			continue
+		}
+		p := path.Join(dir, e.Name())
+		if isCollectionName(e.Name()) {
+			err = rs.collection(p)
+		} else {
+			err = rs.dir(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// members returns the paths of the members of the collection stored at col, in the current layout.
+func (rs *resharder) members(col string) ([]string, error) {
+	depth := 1
+	if rs.from {
+		depth += shardLevels
+	}
+	members := make([]string, 0)
+	err := fs.WalkDir(rs.root.FS(), col, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == col {
+			return nil
+		}
+		if d.Name() == _indexDirName || d.Name() == objectKey || d.Name() == metaDataKey {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.Count(strings.TrimPrefix(p, col), "/") < depth {
+			return nil
+		}
+		if !d.IsDir() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		members = append(members, p)
+		if d.IsDir() {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	return members, err
+}
+
+func (rs *resharder) collection(col string) error {
+	members, err := rs.members(col)
+	if err != nil {
+		return err
+	}
+	for _, old := range members {
+		name := path.Base(old)
+		dst := path.Join(col, name)
+		if rs.to {
+			dst = path.Join(append(append([]string{col}, shardDirs(name)...), name)...)
+		}
+		if err = rs.root.MkdirAll(path.Dir(dst), defaultDirPerm); err != nil {
+			return err
+		}
+
+		fi, err := rs.root.Lstat(old)
+		if err != nil {
+			return err
+		}
+		if isSymLink(fi) {
+			err = rs.relink(old, dst)
+		} else {
+			err = rs.root.Rename(old, dst)
+		}
+		if err != nil {
+			return errors.Annotatef(err, "unable to move %s", old)
+		}
+		rs.count++
+
+		if fi.IsDir() {
+			if err = rs.dir(dst); err != nil {
+				return err
+			}
+		}
+	}
+	if rs.from {
+		rs.removeEmptyShards(col)
+	}
+	return nil
+}
+
+// relink replaces the old symlink with one at dst, pointing to the new path of its target.
+func (rs *resharder) relink(old, dst string) error {
+	target, err := rs.root.Readlink(old)
+	if err != nil {
+		return err
+	}
+	newTarget := rs.convert(path.Join(path.Dir(old), target))
+	rel, err := filepath.Rel(path.Dir(dst), newTarget)
+	if err != nil {
+		return err
+	}
+	if err = rs.root.Remove(old); err != nil {
+		return err
+	}
+	return rs.root.Symlink(rel, dst)
+}
+
+func (rs *resharder) removeEmptyShards(col string) {
+	entries, _ := fs.ReadDir(rs.root.FS(), col)
+	for _, e := range entries {
+		if !e.IsDir() || len(e.Name()) != 2 {
+			continue
+		}
+		p := path.Join(col, e.Name())
+		inner, _ := fs.ReadDir(rs.root.FS(), p)
+		for _, ie := range inner {
+			// NOTE(marius): Remove fails for the directories which are not empty, which is what we want
+			_ = rs.root.Remove(path.Join(p, ie.Name()))
+		}
+		_ = rs.root.Remove(p)
+	}
+}
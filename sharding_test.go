@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_shardPath(t *testing.T) {
+	tests := []struct {
+		name string
+		p    string
+		want string
+	}{
+		{
+			name: "host",
+			p:    "example.com",
+			want: "example.com",
+		},
+		{
+			name: "collection",
+			p:    "example.com/objects",
+			want: "example.com/objects",
+		},
+		{
+			name: "object",
+			p:    "example.com/objects/1",
+			want: "example.com/objects/" + shardDirs("1")[0] + "/" + shardDirs("1")[1] + "/1",
+		},
+		{
+			name: "actor collection",
+			p:    "example.com/actors/jdoe/inbox",
+			want: "example.com/actors/" + shardDirs("jdoe")[0] + "/" + shardDirs("jdoe")[1] + "/jdoe/inbox",
+		},
+		{
+			name: "not under a collection",
+			p:    "example.com/~jdoe/1",
+			want: "example.com/~jdoe/1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shardPath(tt.p)
+			if got != tt.want {
+				t.Errorf("shardPath() = %s, want %s", got, tt.want)
+			}
+			if back := unshardPath(got); back != tt.p {
+				t.Errorf("unshardPath() = %s, want %s", back, tt.p)
+			}
+			if unchanged := unshardPath(tt.p); unchanged != tt.p {
+				t.Errorf("unshardPath() of flat path = %s, want %s", unchanged, tt.p)
+			}
+		})
+	}
+}
+
+func Test_repo_Reshard(t *testing.T) {
+	objects := vocab.ItemCollection{
+		&vocab.Object{ID: "https://example.com/objects/1", Type: vocab.NoteType},
+		&vocab.Object{ID: "https://example.com/objects/2", Type: vocab.NoteType},
+	}
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType, Object: objects[0].GetLink()},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType, Object: objects[1].GetLink()},
+	}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)}, withGeneratedRoot(root), withGeneratedItems(objects), withGeneratedItems(activities))
+	if err := r.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+
+	assertLayout := func(sharded bool) {
+		t.Helper()
+		for _, it := range append(objects, activities...) {
+			p := iriPath(it.GetLink())
+			if sharded {
+				p = shardPath(p)
+			}
+			if _, err := r.root.Stat(getObjectKey(p)); err != nil {
+				t.Errorf("%s not found at %s: %s", it.GetLink(), p, err)
+			}
+			loaded, err := r.Load(it.GetLink())
+			if err != nil {
+				t.Errorf("Load() error = %s", err)
+				continue
+			}
+			if !loaded.GetLink().Equals(it.GetLink(), true) {
+				t.Errorf("Load() = %s, want %s", loaded.GetLink(), it.GetLink())
+			}
+		}
+		outbox, err := r.Load(rootOutboxIRI)
+		if err != nil {
+			t.Fatalf("Load() outbox error = %s", err)
+		}
+		_ = vocab.OnOrderedCollection(outbox, func(col *vocab.OrderedCollection) error {
+			if len(col.OrderedItems) != len(activities) {
+				t.Errorf("outbox has %d items, want %d", len(col.OrderedItems), len(activities))
+			}
+			return nil
+		})
+	}
+
+	assertLayout(false)
+	count, err := r.Reshard(true)
+	if err != nil {
+		t.Fatalf("Reshard() error = %s", err)
+	}
+	if want := len(objects) + len(activities) + len(activities); count != want {
+		t.Errorf("Reshard() moved %d members, want %d", count, want)
+	}
+	assertLayout(true)
+
+	if _, err = r.Reshard(false); err != nil {
+		t.Fatalf("Reshard() error = %s", err)
+	}
+	assertLayout(false)
+}
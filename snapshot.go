@@ -0,0 +1,428 @@
+package fs
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-ap/errors"
+)
+
+// _journalName is the file, in the root of the storage, which holds the paths of the modified files.
+// The positions in the journal are the offsets in this file.
+const _journalName = ".journal"
+
+// _removedName is the file of an incremental snapshot listing the paths removed since the previous one.
+const _removedName = ".removed"
+
+// record appends to the journal the paths, relative to the storage root, of the files modified by a write.
+// The paths are passed on to the active change watches too.
+func (r *repo) record(paths ...string) {
+	if len(paths) == 0 {
+		return
+	}
+	cleaned := make([]string, 0, len(paths))
+	for _, p := range paths {
+		cleaned = append(cleaned, filepath.ToSlash(filepath.Clean(p)))
+	}
+	r.watchMu.Lock()
+	for w := range r.watches {
+		w.add(cleaned...)
+	}
+	r.watchMu.Unlock()
+
+	if !r.journal {
+		return
+	}
+	buf := bytes.Buffer{}
+	for _, p := range cleaned {
+		buf.WriteString(p)
+		buf.WriteByte('\n')
+	}
+
+	r.journalMu.Lock()
+	defer r.journalMu.Unlock()
+
+	f, err := r.root.OpenFile(_journalName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, defaultFilePerm)
+	if err != nil {
+		r.logger.Warnf("unable to open the journal: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err = f.Write(buf.Bytes()); err != nil {
+		r.logger.Warnf("unable to write to the journal: %s", err)
+	}
+}
+
+func (r *repo) journalPosition() (int64, error) {
+	fi, err := r.root.Stat(_journalName)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// journalSince returns the unique paths recorded in the journal after the since position,
+// and the current position.
+func (r *repo) journalSince(since int64) ([]string, int64, error) {
+	pos, err := r.journalPosition()
+	if err != nil {
+		return nil, 0, err
+	}
+	if since < 0 || since > pos {
+		return nil, 0, errors.BadRequestf("invalid journal position %d, the journal ends at %d", since, pos)
+	}
+	paths := make([]string, 0)
+	if since == pos {
+		return paths, pos, nil
+	}
+
+	f, err := r.root.Open(_journalName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(io.NewSectionReader(f, since, pos-since))
+	for s.Scan() {
+		if p := s.Text(); p != "" && !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths, pos, s.Err()
+}
+
+// changeWatch collects in memory the paths recorded by the writes while it's active.
+type changeWatch struct {
+	mu    sync.Mutex
+	paths map[string]struct{}
+}
+
+func (w *changeWatch) add(paths ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, p := range paths {
+		w.paths[p] = struct{}{}
+	}
+}
+
+// changeTracker returns the paths written since it was created, which the operations that walk the storage
+// while it's in use need for catching up with the writes once they are paused.
+// It reads them from the journal, when it's enabled, and collects them in memory otherwise.
+type changeTracker struct {
+	r     *repo
+	since int64
+	watch *changeWatch
+}
+
+// trackChanges starts tracking the paths written to the storage. The tracker needs to be stopped.
+func (r *repo) trackChanges() (*changeTracker, error) {
+	t := changeTracker{r: r}
+	if r.journal {
+		pos, err := r.journalPosition()
+		if err != nil {
+			return nil, err
+		}
+		t.since = pos
+		return &t, nil
+	}
+	t.watch = &changeWatch{paths: make(map[string]struct{})}
+
+	r.watchMu.Lock()
+	defer r.watchMu.Unlock()
+
+	if r.watches == nil {
+		r.watches = make(map[*changeWatch]struct{})
+	}
+	r.watches[t.watch] = struct{}{}
+	return &t, nil
+}
+
+// changed returns the sorted paths written since the tracker was created.
+func (t *changeTracker) changed() ([]string, error) {
+	if t.watch == nil {
+		paths, _, err := t.r.journalSince(t.since)
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(paths)
+		return paths, nil
+	}
+
+	t.watch.mu.Lock()
+	defer t.watch.mu.Unlock()
+
+	return slices.Sorted(maps.Keys(t.watch.paths)), nil
+}
+
+func (t *changeTracker) stop() {
+	if t.watch == nil {
+		return
+	}
+	t.r.watchMu.Lock()
+	defer t.r.watchMu.Unlock()
+
+	delete(t.r.watches, t.watch)
+}
+
+// isLinkable checks if the file at p can be shared between the storage and its snapshots.
+// Only the files which are always replaced, and never modified in place, can.
+//
+// NOTE(marius): the blobs are not, even if they are never modified, as the number of links to their
+// content tells when it's no longer used.
+func isLinkable(p string) bool {
+	base := path.Base(p)
+	return base == objectKey || base == metaDataKey || base == cacheInfoKey
+}
+
+// copyFile copies the src file to dst, cloning it if the filesystem supports it.
+func copyFile(src, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, defaultNewFileFlags, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if err = cloneFile(out, in); err != nil {
+		_, err = io.Copy(out, in)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// snapshotter synchronizes a snapshot directory with the storage root.
+type snapshotter struct {
+	src, dst string
+	root     *os.Root
+}
+
+func (s snapshotter) srcPath(p string) string {
+	return filepath.Join(s.src, filepath.FromSlash(p))
+}
+
+func (s snapshotter) dstPath(p string) string {
+	return filepath.Join(s.dst, filepath.FromSlash(p))
+}
+
+// sync updates the snapshot with the storage files under p that are missing or changed.
+func (s snapshotter) sync(p string) error {
+	return fs.WalkDir(s.root.FS(), p, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if p == _journalName || isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		dst := s.dstPath(p)
+		if d.IsDir() {
+			return os.MkdirAll(dst, fi.Mode().Perm())
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), defaultDirPerm); err != nil {
+			return err
+		}
+
+		existing, _ := os.Lstat(dst)
+		if d.Type()&fs.ModeSymlink == fs.ModeSymlink {
+			target, err := s.root.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				if cur, _ := os.Readlink(dst); cur == target {
+					return nil
+				}
+				_ = os.RemoveAll(dst)
+			}
+			return os.Symlink(target, dst)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if existing != nil {
+			if os.SameFile(fi, existing) || (existing.Size() == fi.Size() && existing.ModTime().Equal(fi.ModTime())) {
+				return nil
+			}
+			_ = os.RemoveAll(dst)
+		}
+		if isLinkable(p) {
+			if err = os.Link(s.srcPath(p), dst); err == nil {
+				return nil
+			}
+		}
+		if err = copyFile(s.srcPath(p), dst, fi.Mode()); err != nil {
+			return errors.Annotatef(err, "unable to copy %s", p)
+		}
+		return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+	})
+}
+
+// prune removes from the snapshot the files which are not in the storage anymore.
+func (s snapshotter) prune() error {
+	return filepath.WalkDir(s.dst, func(dst string, d fs.DirEntry, err error) error {
+		if err != nil || dst == s.dst {
+			return err
+		}
+		rel, err := filepath.Rel(s.dst, dst)
+		if err != nil {
+			return err
+		}
+		if _, err = s.root.Lstat(rel); os.IsNotExist(err) {
+			if err = os.RemoveAll(dst); err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+		}
+		return nil
+	})
+}
+
+// snapshotDir creates the dir directory for a snapshot. It must be outside the storage, and empty.
+func (r *repo) snapshotDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(r.path, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.BadRequestf("the snapshot directory %s is inside the storage", dir)
+	}
+	if err = os.MkdirAll(dir, defaultDirPerm); err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) > 0 {
+		return "", errors.Conflictf("the snapshot directory %s is not empty", dir)
+	}
+	return dir, nil
+}
+
+// Snapshot writes to dir a point in time copy of the storage, while it's in use, and it returns
+// the position in the journal the copy corresponds to, to be used for the next IncrementalSnapshot.
+//
+// The objects and the metadata files are hard linked, so the snapshot doesn't take additional space
+// for them until they get modified. The other files, like the indexes, are copied, using reflinks
+// when the filesystem supports them.
+// The storage gets copied while it's being written to, and then the writes are paused only for
+// updating the files written in the meantime, and the indexes.
+func (r *repo) Snapshot(dir string) (int64, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	dir, err := r.snapshotDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	changes, err := r.trackChanges()
+	if err != nil {
+		return 0, err
+	}
+	defer changes.stop()
+
+	s := snapshotter{src: r.path, dst: dir, root: r.root}
+	if err = s.sync("."); err != nil {
+		return 0, err
+	}
+	if err = s.prune(); err != nil {
+		return 0, err
+	}
+
+	r.quiesce.Lock()
+	defer r.quiesce.Unlock()
+
+	if err = r.saveIndex(); err != nil {
+		return 0, errors.Annotatef(err, "unable to save the index")
+	}
+	paths, err := changes.changed()
+	if err != nil {
+		return 0, err
+	}
+	for _, p := range append(paths, _indexDirName) {
+		if _, err = r.root.Lstat(p); os.IsNotExist(err) {
+			if err = os.RemoveAll(s.dstPath(p)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err = s.sync(p); err != nil {
+			return 0, err
+		}
+	}
+	return r.journalPosition()
+}
+
+// IncrementalSnapshot writes to dir the files which were modified after the since position in the
+// journal, and it returns the current position. The paths which were removed are listed in its
+// .removed file.
+// Restoring a storage means applying the incremental snapshots, in order, on top of a full one.
+//
+// It requires the journal to be enabled, and the indexes are not part of the incremental snapshots,
+// they need to be rebuilt after restoring one.
+func (r *repo) IncrementalSnapshot(dir string, since int64) (int64, error) {
+	if r == nil || r.root == nil {
+		return 0, errNotOpen
+	}
+	if !r.journal {
+		return 0, errors.NotImplementedf("the journal is not enabled")
+	}
+	dir, err := r.snapshotDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	r.quiesce.Lock()
+	defer r.quiesce.Unlock()
+
+	paths, pos, err := r.journalSince(since)
+	if err != nil {
+		return 0, err
+	}
+
+	s := snapshotter{src: r.path, dst: dir, root: r.root}
+	removed := bytes.Buffer{}
+	for _, p := range paths {
+		if _, err = r.root.Lstat(p); os.IsNotExist(err) {
+			removed.WriteString(p)
+			removed.WriteByte('\n')
+			continue
+		}
+		if err = s.sync(p); err != nil {
+			return 0, err
+		}
+	}
+	if removed.Len() > 0 {
+		if err = os.WriteFile(filepath.Join(dir, _removedName), removed.Bytes(), defaultFilePerm); err != nil {
+			return 0, err
+		}
+	}
+	return pos, nil
+}
@@ -0,0 +1,143 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+)
+
+func Test_repo_Snapshot(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+	}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)}, withGeneratedRoot(root), withGeneratedItems(activities))
+	if err := r.AddTo(rootOutboxIRI, activities...); err != nil {
+		t.Fatalf("AddTo() error = %s", err)
+	}
+
+	dir := t.TempDir()
+	if _, err := r.Snapshot(dir); err != nil {
+		t.Fatalf("Snapshot() error = %s", err)
+	}
+	if _, err := r.Snapshot(dir); err == nil {
+		t.Errorf("Snapshot() in a non empty directory didn't return an error")
+	}
+	if _, err := r.Snapshot(filepath.Join(path, "snapshot")); err == nil {
+		t.Errorf("Snapshot() inside the storage didn't return an error")
+	}
+
+	// NOTE(marius): the snapshot shares the object files with the storage, so we check it's not
+	// affected by the later writes.
+	updated := *root
+	updated.Name = vocab.DefaultNaturalLanguage("updated")
+	if _, err := r.Save(&updated); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	if err := r.Delete(activities[1]); err != nil {
+		t.Fatalf("Delete() error = %s", err)
+	}
+
+	snap := mockRepo(t, fields{path: dir, root: openRoot(t, dir)})
+	it, err := snap.Load(rootIRI)
+	if err != nil {
+		t.Fatalf("Load() from snapshot error = %s", err)
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		if got := firstValue(ob.Name); got != "example.com" {
+			t.Errorf("snapshot root name = %s, want example.com", got)
+		}
+		return nil
+	})
+	if got := outboxItems(t, snap); len(got) != len(activities) {
+		t.Errorf("snapshot outbox items = %v, want %d items", got, len(activities))
+	}
+}
+
+func Test_repo_IncrementalSnapshot(t *testing.T) {
+	activities := vocab.ItemCollection{
+		&vocab.Activity{ID: "https://example.com/activities/1", Type: vocab.CreateType},
+		&vocab.Activity{ID: "https://example.com/activities/2", Type: vocab.CreateType},
+	}
+
+	path := t.TempDir()
+	r := mockRepo(t, fields{path: path, root: openRoot(t, path)})
+	r.journal = true
+	r = withGeneratedItems(activities[1:])(t, withGeneratedRoot(root)(t, r))
+
+	if _, err := r.IncrementalSnapshot(t.TempDir(), 1<<20); err == nil {
+		t.Errorf("IncrementalSnapshot() past the end of the journal didn't return an error")
+	}
+	pos, err := r.Snapshot(t.TempDir())
+	if err != nil {
+		t.Fatalf("Snapshot() error = %s", err)
+	}
+	if pos == 0 {
+		t.Errorf("Snapshot() journal position = 0, after writes")
+	}
+
+	if _, err = r.Save(activities[0]); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	if err = r.Delete(activities[1]); err != nil {
+		t.Fatalf("Delete() error = %s", err)
+	}
+
+	dir := t.TempDir()
+	next, err := r.IncrementalSnapshot(dir, pos)
+	if err != nil {
+		t.Fatalf("IncrementalSnapshot() error = %s", err)
+	}
+	if next <= pos {
+		t.Errorf("IncrementalSnapshot() position = %d, want more than %d", next, pos)
+	}
+	if _, err = os.Stat(filepath.Join(dir, getObjectKey(iriPath(activities[0].GetLink())))); err != nil {
+		t.Errorf("IncrementalSnapshot() didn't copy the new object: %s", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, getObjectKey(iriPath(rootOutboxIRI)))); err == nil {
+		t.Errorf("IncrementalSnapshot() copied an unmodified object")
+	}
+	removed, err := os.ReadFile(filepath.Join(dir, _removedName))
+	if want := iriPath(activities[1].GetLink()) + "\n"; err != nil || string(removed) != want {
+		t.Errorf("IncrementalSnapshot() removed = %q, %v, want %q", removed, err, want)
+	}
+
+	if _, err = r.IncrementalSnapshot(t.TempDir(), next); err != nil {
+		t.Errorf("IncrementalSnapshot() without changes error = %s", err)
+	}
+}
+
+func Test_repo_trackChanges(t *testing.T) {
+	for _, journal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("journal %t", journal), func(t *testing.T) {
+			path := t.TempDir()
+			r := mockRepo(t, fields{path: path, root: openRoot(t, path)})
+			r.journal = journal
+			r.record("before")
+
+			changes, err := r.trackChanges()
+			if err != nil {
+				t.Fatalf("trackChanges() error = %s", err)
+			}
+			r.record("b/", "a", "b")
+			got, err := changes.changed()
+			if err != nil {
+				t.Fatalf("changed() error = %s", err)
+			}
+			if want := []string{"a", "b"}; !slices.Equal(got, want) {
+				t.Errorf("changed() = %v, want %v", got, want)
+			}
+
+			changes.stop()
+			if len(r.watches) > 0 {
+				t.Errorf("stop() left %d active watches", len(r.watches))
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+)
+
+// Stemmer reduces a normalized token to its stem.
+type Stemmer func(string) string
+
+// defaultTextLanguage is used for stemming values that don't have a language tag.
+const defaultTextLanguage = "en"
+
+var (
+	stemmersMu sync.RWMutex
+	stemmers   = map[string]Stemmer{
+		"en": stemEnglish,
+		"de": stemGerman,
+		"fr": stemFrench,
+		"es": stemSpanish,
+		"it": stemItalian,
+		"pt": stemPortuguese,
+	}
+)
+
+// RegisterStemmer sets the stemmer used by the full text index for the lang language.
+// The language is matched on its primary subtag, so a stemmer for "de" will be used for "de-AT" too.
+func RegisterStemmer(lang string, fn Stemmer) {
+	stemmersMu.Lock()
+	defer stemmersMu.Unlock()
+
+	lang = primaryLanguage(lang)
+	if fn == nil {
+		delete(stemmers, lang)
+		return
+	}
+	stemmers[lang] = fn
+}
+
+// primaryLanguage returns the lower cased primary subtag of a BCP47 language tag.
+func primaryLanguage(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		lang = lang[:i]
+	}
+	if lang == "" || lang == "-" {
+		return defaultTextLanguage
+	}
+	return lang
+}
+
+func stemmerFor(lang string) Stemmer {
+	stemmersMu.RLock()
+	defer stemmersMu.RUnlock()
+
+	if fn, ok := stemmers[primaryLanguage(lang)]; ok {
+		return fn
+	}
+	return func(s string) string { return s }
+}
+
+// trimSuffixes removes the first matching suffix from s,
+// as long as the remaining stem is at least minStem characters long.
+func trimSuffixes(s string, minStem int, suffixes ...string) string {
+	for _, suf := range suffixes {
+		if strings.HasSuffix(s, suf) && len([]rune(s))-len([]rune(suf)) >= minStem {
+			return strings.TrimSuffix(s, suf)
+		}
+	}
+	return s
+}
+
+// stemEnglish is a light stemmer loosely following the first steps of the Porter algorithm.
+func stemEnglish(s string) string {
+	if len(s) <= 3 {
+		return s
+	}
+	switch {
+	case strings.HasSuffix(s, "sses"):
+		s = strings.TrimSuffix(s, "es")
+	case strings.HasSuffix(s, "ies") && len(s) > 4:
+		s = strings.TrimSuffix(s, "ies") + "y"
+	case strings.HasSuffix(s, "ss"), strings.HasSuffix(s, "us"), strings.HasSuffix(s, "is"):
+	case strings.HasSuffix(s, "s"):
+		s = strings.TrimSuffix(s, "s")
+	}
+	stem := trimSuffixes(s, 3, "ational", "fulness", "iveness", "ization", "ously", "ement", "ments", "ment",
+		"ness", "ingly", "edly", "ing", "ed", "ly")
+	switch s[len(stem):] {
+	case "ingly", "edly", "ing", "ed":
+		if n := len(stem); n > 3 && stem[n-1] == stem[n-2] && strings.ContainsRune("bdfgmnprt", rune(stem[n-1])) {
+			// NOTE(marius): undouble the consonant left by removing -ing/-ed: "running" -> "run"
+			stem = stem[:n-1]
+		}
+	}
+	return stem
+}
+
+func stemGerman(s string) string {
+	return trimSuffixes(s, 3, "ungen", "heiten", "keiten", "ung", "heit", "keit", "ern", "em", "en", "er", "es", "e", "s")
+}
+
+func stemFrench(s string) string {
+	s = trimSuffixes(s, 3, "issements", "issement", "ements", "ement", "ations", "ation", "euses", "euse", "eux")
+	return trimSuffixes(s, 3, "es", "s", "x", "e")
+}
+
+func stemSpanish(s string) string {
+	s = trimSuffixes(s, 3, "amientos", "imientos", "amiento", "imiento", "aciones", "acion", "mente")
+	return trimSuffixes(s, 3, "es", "s", "a", "o", "e")
+}
+
+func stemItalian(s string) string {
+	s = trimSuffixes(s, 3, "amento", "imento", "azioni", "azione", "mente")
+	return trimSuffixes(s, 3, "i", "e", "a", "o")
+}
+
+func stemPortuguese(s string) string {
+	s = trimSuffixes(s, 3, "amentos", "imentos", "amento", "imento", "acoes", "acao", "mente")
+	return trimSuffixes(s, 3, "es", "s", "a", "o", "e")
+}
@@ -0,0 +1,24 @@
+package fs
+
+import "testing"
+
+func Test_stemEnglish(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{word: "running", want: "run"},
+		{word: "stopped", want: "stop"},
+		{word: "butt", want: "butt"},
+		{word: "staff", want: "staff"},
+		{word: "ponies", want: "pony"},
+		{word: "jumped", want: "jump"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			if got := stemEnglish(tt.word); got != tt.want {
+				t.Errorf("stemEnglish(%q) = %q, want %q", tt.word, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package fs
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+var tagIndexTypes = []index.Type{ByHashtag, ByMention, ByTag}
+
+// hashtagType is the type of the hashtag entries in an object's tags, as used by Mastodon.
+const hashtagType vocab.ActivityVocabularyType = "Hashtag"
+
+var (
+	hashtagTypes = vocab.ActivityVocabularyTypes{hashtagType}
+	mentionTypes = vocab.ActivityVocabularyTypes{vocab.MentionType}
+)
+
+// firstValue returns the first non-empty natural language value.
+func firstValue(nlv vocab.NaturalLanguageValues) string {
+	for _, lv := range langValues(nlv) {
+		return lv.Value
+	}
+	return ""
+}
+
+// normalizeTag case folds a hashtag, and removes its leading "#".
+func normalizeTag(s string) string {
+	s = strings.TrimLeft(strings.TrimSpace(s), "#")
+	b := strings.Builder{}
+	for _, r := range s {
+		b.WriteString(foldRune(r))
+	}
+	return b.String()
+}
+
+// normalizeMention case folds a mention name, and removes its leading "@".
+// The IRI mentions are kept as they are.
+func normalizeMention(s string) string {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "://") {
+		return s
+	}
+	return strings.ToLower(strings.TrimLeft(s, "@"))
+}
+
+// onTags calls fn for every tag of the item, with its name and the IRI it points to.
+func onTags(li vocab.LinkOrIRI, fn func(typ vocab.Typer, name string, href vocab.IRI)) {
+	it, ok := li.(vocab.Item)
+	if !ok || vocab.IsNil(it) || vocab.IsIRI(it) {
+		return
+	}
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		for _, t := range ob.Tag {
+			if vocab.IsNil(t) || vocab.IsIRI(t) {
+				continue
+			}
+			switch tt := t.(type) {
+			case *vocab.Link:
+				fn(tt.GetType(), firstValue(tt.Name), tt.Href)
+			default:
+				_ = vocab.OnObject(t, func(tob *vocab.Object) error {
+					href := tob.ID
+					if !vocab.IsNil(tob.URL) {
+						href = tob.URL.GetLink()
+					}
+					fn(tob.GetType(), firstValue(tob.Name), href)
+					return nil
+				})
+			}
+		}
+		return nil
+	})
+}
+
+// extractHashtags returns the normalized names of the Hashtag tags of the item.
+func extractHashtags(li vocab.LinkOrIRI) []string {
+	tags := make([]string, 0)
+	onTags(li, func(typ vocab.Typer, name string, _ vocab.IRI) {
+		if !hashtagTypes.Match(typ) {
+			return
+		}
+		if name = normalizeTag(name); name != "" {
+			tags = append(tags, name)
+		}
+	})
+	return tags
+}
+
+// extractMentions returns the IRIs and the normalized names of the Mention tags of the item.
+func extractMentions(li vocab.LinkOrIRI) []string {
+	mentions := make([]string, 0)
+	onTags(li, func(typ vocab.Typer, name string, href vocab.IRI) {
+		if !mentionTypes.Match(typ) {
+			return
+		}
+		if href != "" {
+			mentions = append(mentions, href.String())
+		}
+		if name = normalizeMention(name); name != "" {
+			mentions = append(mentions, name)
+		}
+	})
+	return mentions
+}
+
+// extractTags returns the JSON encoding of every tag of the item. The ByTag index keeps them as tokens,
+// so the distinct tags in the storage can be decoded back and matched against the filters.Tag checks.
+func extractTags(li vocab.LinkOrIRI) []string {
+	it, ok := li.(vocab.Item)
+	if !ok || vocab.IsNil(it) || vocab.IsIRI(it) {
+		return nil
+	}
+	tags := make([]string, 0)
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		for _, t := range ob.Tag {
+			if vocab.IsNil(t) {
+				continue
+			}
+			if raw, err := vocab.MarshalJSON(t); err == nil {
+				tags = append(tags, string(raw))
+			}
+		}
+		return nil
+	})
+	return tags
+}
+
+// tagCheck holds the checks of a filters.Tag check, which get answered from the ByTag index.
+// The checks are run on the distinct tags in the storage, instead of on every object, and each tag
+// gets decoded only once.
+type tagCheck filters.Checks
+
+func (c tagCheck) indexMatch(b *bitmaps) *roaring64.Bitmap {
+	idx, ok := b.tokens[ByTag]
+	if !ok {
+		return nil
+	}
+	check := filters.All(c...)
+	// NOTE(marius): checks like filters.NilItem select the objects without tags, which are not in the index.
+	if check.Match(nil) {
+		return nil
+	}
+
+	idx.w.RLock()
+	defer idx.w.RUnlock()
+
+	result := roaring64.New()
+	for tok, bmp := range idx.Tokens {
+		tag := idx.decode(tok, decodeTag)
+		if vocab.IsNil(tag) || !check.Match(tag) {
+			continue
+		}
+		result.Or(bmp)
+	}
+	return result
+}
+
+func decodeTag(tok string) (vocab.Item, error) {
+	return vocab.UnmarshalJSON([]byte(tok))
+}
+
+// withLoadedTags returns the item with its tags that are stored as IRIs replaced by the tag objects
+// loaded from the storage, so they can be indexed. The item is copied before being changed.
+func (r *repo) withLoadedTags(it vocab.Item) vocab.Item {
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return it
+	}
+	hasIRIs := false
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		hasIRIs = slices.ContainsFunc(ob.Tag, func(t vocab.Item) bool {
+			return !vocab.IsNil(t) && vocab.IsIRI(t)
+		})
+		return nil
+	})
+	if !hasIRIs {
+		return it
+	}
+
+	raw, err := vocab.MarshalJSON(it)
+	if err != nil {
+		return it
+	}
+	cp, err := vocab.UnmarshalJSON(raw)
+	if err != nil || vocab.IsNil(cp) {
+		return it
+	}
+	_ = vocab.OnObject(cp, func(ob *vocab.Object) error {
+		for i, t := range ob.Tag {
+			if vocab.IsNil(t) || !vocab.IsIRI(t) {
+				continue
+			}
+			tag, err := r.loadItemFromPath(getObjectKey(r.pathOf(t.GetLink())))
+			if err != nil || vocab.IsNil(tag) || vocab.IsIRI(tag) {
+				continue
+			}
+			ob.Tag[i] = tag
+		}
+		return nil
+	})
+	return cp
+}
+
+// HashtagIs matches the objects tagged with any of the received hashtags.
+// The hashtags are compared case insensitive, and the leading "#" is optional, which the filters.Tag
+// checks on the tag names can't do.
+func HashtagIs(tags ...string) filters.Check {
+	c := tokenCheck{typ: ByHashtag, extractFn: extractHashtags}
+	for _, tag := range tags {
+		c.tokens = append(c.tokens, normalizeTag(tag))
+	}
+	return c
+}
+
+// MentionOf matches the objects that mention any of the received actors.
+// The actors can be passed either as IRIs, or as "@name@host" handles.
+func MentionOf(actors ...string) filters.Check {
+	c := tokenCheck{typ: ByMention, extractFn: extractMentions}
+	for _, actor := range actors {
+		c.tokens = append(c.tokens, normalizeMention(actor))
+	}
+	return c
+}
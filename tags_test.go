@@ -0,0 +1,274 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+var mockTaggedItems = vocab.ItemCollection{
+	&vocab.Object{
+		ID:   "https://example.com/objects/1",
+		Type: vocab.NoteType,
+		Tag: vocab.ItemCollection{
+			&vocab.Link{Type: hashtagType, Name: vocab.DefaultNaturalLanguage("#GoLang"), Href: "https://example.com/tags/golang"},
+			&vocab.Link{Type: hashtagType, Name: vocab.DefaultNaturalLanguage("#Fediverse"), Href: "https://example.com/tags/fediverse"},
+			&vocab.Link{Type: vocab.MentionType, Name: vocab.DefaultNaturalLanguage("@Alice@example.com"), Href: "https://example.com/~alice"},
+		},
+	},
+	&vocab.Object{
+		ID:   "https://example.com/objects/2",
+		Type: vocab.NoteType,
+		Tag: vocab.ItemCollection{
+			&vocab.Object{Type: hashtagType, Name: vocab.DefaultNaturalLanguage("golang")},
+		},
+	},
+	&vocab.Object{
+		ID:   "https://example.com/objects/3",
+		Type: vocab.NoteType,
+	},
+}
+
+func Test_extractHashtags(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  vocab.Item
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "links",
+			arg:  mockTaggedItems[0],
+			want: []string{"golang", "fediverse"},
+		},
+		{
+			name: "object",
+			arg:  mockTaggedItems[1],
+			want: []string{"golang"},
+		},
+		{
+			name: "no tags",
+			arg:  mockTaggedItems[2],
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractHashtags(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractHashtags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_extractMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		arg  vocab.Item
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "mention",
+			arg:  mockTaggedItems[0],
+			want: []string{"https://example.com/~alice", "alice@example.com"},
+		},
+		{
+			name: "no mentions",
+			arg:  mockTaggedItems[1],
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := extractMentions(tt.arg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractMentions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashtagIs(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []string
+		it   vocab.Item
+		want bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "matches case insensitive",
+			tags: []string{"#GOLANG"},
+			it:   mockTaggedItems[1],
+			want: true,
+		},
+		{
+			name: "doesn't match",
+			tags: []string{"rust"},
+			it:   mockTaggedItems[0],
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HashtagIs(tt.tags...).Match(tt.it); got != tt.want {
+				t.Errorf("HashtagIs().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMentionOf(t *testing.T) {
+	tests := []struct {
+		name   string
+		actors []string
+		it     vocab.Item
+		want   bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "by IRI",
+			actors: []string{"https://example.com/~alice"},
+			it:     mockTaggedItems[0],
+			want:   true,
+		},
+		{
+			name:   "by handle",
+			actors: []string{"@alice@Example.com"},
+			it:     mockTaggedItems[0],
+			want:   true,
+		},
+		{
+			name:   "not mentioned",
+			actors: []string{"@bob@example.com"},
+			it:     mockTaggedItems[0],
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MentionOf(tt.actors...).Match(tt.it); got != tt.want {
+				t.Errorf("MentionOf().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tagCheck_indexMatch(t *testing.T) {
+	b := newBitmap(index.ByID, ByTag)
+	for _, it := range mockTaggedItems {
+		_ = b.tokens[ByTag].Add(it)
+	}
+
+	tests := []struct {
+		name string
+		ff   filters.Checks
+		want vocab.IRIs
+	}{
+		{
+			name: "tag name",
+			ff:   filters.Checks{filters.Tag(filters.NameIs("#GoLang"))},
+			want: vocab.IRIs{"https://example.com/objects/1"},
+		},
+		{
+			name: "tag type",
+			ff:   filters.Checks{filters.Tag(filters.HasType(hashtagType))},
+			want: vocab.IRIs{"https://example.com/objects/1", "https://example.com/objects/2"},
+		},
+		{
+			name: "mention",
+			ff:   filters.Checks{filters.Tag(filters.HasType(vocab.MentionType), filters.NameIs("@Alice@example.com"))},
+			want: vocab.IRIs{"https://example.com/objects/1"},
+		},
+		{
+			name: "unknown tag",
+			ff:   filters.Checks{filters.Tag(filters.NameIs("#rust"))},
+		},
+		{
+			name: "without tags",
+			ff:   filters.Checks{filters.Tag(filters.NilItem)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded := len(b.tokens[ByTag].decoded)
+			got := b.match(tt.ff...)
+			if decoded > 0 && len(b.tokens[ByTag].decoded) != decoded {
+				t.Errorf("match() decoded the tags again")
+			}
+			if got.GetCardinality() != uint64(len(tt.want)) {
+				t.Errorf("match() returned %d results, want %d", got.GetCardinality(), len(tt.want))
+			}
+			for _, iri := range tt.want {
+				if !got.Contains(index.HashFn(iri)) {
+					t.Errorf("match() didn't return %s", iri)
+				}
+			}
+		})
+	}
+}
+
+func Test_tokenIndex_decode(t *testing.T) {
+	idx := newTokenIndex(extractTags)
+	_ = idx.Add(mockTaggedItems[1])
+
+	calls := 0
+	decodeFn := func(tok string) (vocab.Item, error) {
+		calls++
+		return decodeTag(tok)
+	}
+	for tok := range idx.Tokens {
+		for range 2 {
+			if vocab.IsNil(idx.decode(tok, decodeFn)) {
+				t.Errorf("decode() returned no tag for %s", tok)
+			}
+		}
+	}
+	if calls != len(idx.Tokens) {
+		t.Errorf("decode() decoded %d times, want %d", calls, len(idx.Tokens))
+	}
+
+	_ = idx.Remove(mockTaggedItems[1])
+	if len(idx.decoded) > 0 {
+		t.Errorf("Remove() kept %d decoded tags", len(idx.decoded))
+	}
+}
+
+func Test_repo_addToIndex_tagIRIs(t *testing.T) {
+	tag := &vocab.Object{ID: "https://example.com/tags/golang", Type: hashtagType, Name: vocab.DefaultNaturalLanguage("#GoLang")}
+	note := &vocab.Object{
+		ID:   "https://example.com/objects/tagged",
+		Type: vocab.NoteType,
+		Tag:  vocab.ItemCollection{tag.GetLink(), vocab.IRI("https://example.com/tags/missing")},
+	}
+
+	dir := t.TempDir()
+	r := mockRepo(t, fields{path: dir, root: openRoot(t, dir), index: newBitmap()}, withItems(tag, note))
+
+	ref := index.HashFn(note.GetLink())
+	if !r.index.tokens[ByHashtag].Search("golang").Contains(ref) {
+		t.Errorf("the hashtag stored as an IRI was not indexed")
+	}
+	if !r.index.match(filters.Tag(filters.NameIs("#GoLang"))).Contains(ref) {
+		t.Errorf("the tag stored as an IRI doesn't match the filters.Tag check")
+	}
+	if !r.index.match(filters.Tag(filters.SameID("https://example.com/tags/missing"))).Contains(ref) {
+		t.Errorf("the tag which is not stored doesn't match the filters.Tag check")
+	}
+	if !vocab.IsIRI(note.Tag[0]) {
+		t.Errorf("indexing changed the tags of the item to %T", note.Tag[0])
+	}
+}
@@ -0,0 +1,227 @@
+package fs
+
+import (
+	"slices"
+	"sync"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/filters"
+)
+
+const _threadsName = ".threads.gob"
+
+// threads holds the reply relationships between the stored objects, built from their inReplyTo
+// and context properties.
+type threads struct {
+	w sync.RWMutex
+	// Parents maps an object to the objects it replies to.
+	Parents map[vocab.IRI]vocab.IRIs
+	// Replies maps an object to its direct replies.
+	Replies map[vocab.IRI]vocab.IRIs
+	// Contexts maps an object to its context (or conversation).
+	Contexts map[vocab.IRI]vocab.IRI
+	// Members maps a context to the objects belonging to it.
+	Members map[vocab.IRI]vocab.IRIs
+}
+
+func newThreads() *threads {
+	return &threads{
+		Parents:  make(map[vocab.IRI]vocab.IRIs),
+		Replies:  make(map[vocab.IRI]vocab.IRIs),
+		Contexts: make(map[vocab.IRI]vocab.IRI),
+		Members:  make(map[vocab.IRI]vocab.IRIs),
+	}
+}
+
+func removeIRI(m map[vocab.IRI]vocab.IRIs, key, iri vocab.IRI) {
+	rest := slices.DeleteFunc(m[key], func(i vocab.IRI) bool {
+		return i.Equals(iri, true)
+	})
+	if len(rest) == 0 {
+		delete(m, key)
+		return
+	}
+	m[key] = rest
+}
+
+func appendIRI(m map[vocab.IRI]vocab.IRIs, key, iri vocab.IRI) {
+	if m[key].Contains(iri) {
+		return
+	}
+	m[key] = append(m[key], iri)
+}
+
+func (t *threads) remove(iri vocab.IRI) {
+	for _, parent := range t.Parents[iri] {
+		removeIRI(t.Replies, parent, iri)
+	}
+	delete(t.Parents, iri)
+	if ctx, ok := t.Contexts[iri]; ok {
+		removeIRI(t.Members, ctx, iri)
+		delete(t.Contexts, iri)
+	}
+}
+
+func linksOf(it vocab.Item) vocab.IRIs {
+	if vocab.IsNil(it) {
+		return nil
+	}
+	iris := make(vocab.IRIs, 0)
+	if vocab.IsItemCollection(it) {
+		_ = vocab.OnItemCollection(it, func(col *vocab.ItemCollection) error {
+			for _, ob := range *col {
+				if !vocab.IsNil(ob) {
+					iris = append(iris, ob.GetLink())
+				}
+			}
+			return nil
+		})
+		return iris
+	}
+	return append(iris, it.GetLink())
+}
+
+// Add records the inReplyTo and context relationships of the item,
+// replacing the ones from a previous version of it.
+func (t *threads) Add(it vocab.Item) {
+	if vocab.IsNil(it) || vocab.IsIRI(it) {
+		return
+	}
+	iri := it.GetLink()
+
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	t.remove(iri)
+	_ = vocab.OnObject(it, func(ob *vocab.Object) error {
+		for _, parent := range linksOf(ob.InReplyTo) {
+			if parent.Equals(iri, true) {
+				continue
+			}
+			appendIRI(t.Parents, iri, parent)
+			appendIRI(t.Replies, parent, iri)
+		}
+		if !vocab.IsNil(ob.Context) {
+			ctx := ob.Context.GetLink()
+			t.Contexts[iri] = ctx
+			appendIRI(t.Members, ctx, iri)
+		}
+		return nil
+	})
+}
+
+// Remove drops the relationships of the item from the thread index.
+// The replies to it are kept, so they can be re-attached if the item gets saved again.
+func (t *threads) Remove(iri vocab.IRI) {
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	t.remove(iri)
+}
+
+// ancestors returns the chain of objects the iri replies to, starting with the top of the thread.
+func (t *threads) ancestors(iri vocab.IRI) vocab.IRIs {
+	result := make(vocab.IRIs, 0)
+	seen := map[vocab.IRI]struct{}{iri: {}}
+	for {
+		parents := t.Parents[iri]
+		if len(parents) == 0 {
+			break
+		}
+		iri = parents[0]
+		if _, ok := seen[iri]; ok {
+			break
+		}
+		seen[iri] = struct{}{}
+		result = append(result, iri)
+	}
+	slices.Reverse(result)
+	return result
+}
+
+// descendants returns all the replies to iri, breadth first.
+func (t *threads) descendants(iri vocab.IRI) vocab.IRIs {
+	result := make(vocab.IRIs, 0)
+	seen := map[vocab.IRI]struct{}{iri: {}}
+	queue := vocab.IRIs{iri}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, reply := range t.Replies[cur] {
+			if _, ok := seen[reply]; ok {
+				continue
+			}
+			seen[reply] = struct{}{}
+			result = append(result, reply)
+			queue = append(queue, reply)
+		}
+	}
+	return result
+}
+
+// thread returns the ancestors, the object itself and its descendants.
+func (t *threads) thread(iri vocab.IRI) vocab.IRIs {
+	t.w.RLock()
+	defer t.w.RUnlock()
+
+	result := t.ancestors(iri)
+	result = append(result, iri)
+	return append(result, t.descendants(iri)...)
+}
+
+func (t *threads) members(ctx vocab.IRI) vocab.IRIs {
+	t.w.RLock()
+	defer t.w.RUnlock()
+
+	return slices.Clone(t.Members[ctx])
+}
+
+func (r *repo) loadThreadItems(iris vocab.IRIs, ff ...filters.Check) vocab.ItemCollection {
+	result := make(vocab.ItemCollection, 0, len(iris))
+	for _, iri := range iris {
+		it, err := r.loadItemFromPath(getObjectKey(r.pathOf(iri)))
+		if err != nil || vocab.IsNil(it) {
+			continue
+		}
+		if len(ff) > 0 && !applyAllFiltersOnItem(it, ff...) {
+			continue
+		}
+		result = append(result, it)
+	}
+	return result
+}
+
+// LoadThread returns the reply tree the iri object is part of: the objects it replies to, starting
+// from the top of the thread, the object itself and all the replies to it, breadth first.
+// The objects that are not stored locally are skipped.
+func (r *repo) LoadThread(iri vocab.IRI, ff ...filters.Check) (vocab.ItemCollection, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if r.index == nil || r.index.threads == nil {
+		return nil, indexDisabled
+	}
+	if len(iri) == 0 {
+		return nil, errors.NotFoundf("empty IRI")
+	}
+	_ = r.loadIndex()
+
+	return r.loadThreadItems(r.index.threads.thread(iri), ff...), nil
+}
+
+// LoadConversation returns the objects that share the ctx context.
+func (r *repo) LoadConversation(ctx vocab.IRI, ff ...filters.Check) (vocab.ItemCollection, error) {
+	if r == nil || r.root == nil {
+		return nil, errNotOpen
+	}
+	if r.index == nil || r.index.threads == nil {
+		return nil, indexDisabled
+	}
+	if len(ctx) == 0 {
+		return nil, errors.NotFoundf("empty context")
+	}
+	_ = r.loadIndex()
+
+	return r.loadThreadItems(r.index.threads.members(ctx), ff...), nil
+}
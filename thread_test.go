@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"reflect"
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+var (
+	threadRoot    = &vocab.Object{ID: "https://example.com/objects/root", Type: vocab.NoteType, Context: vocab.IRI("https://example.com/contexts/1")}
+	threadReply   = &vocab.Object{ID: "https://example.com/objects/reply", Type: vocab.NoteType, InReplyTo: threadRoot.ID, Context: vocab.IRI("https://example.com/contexts/1")}
+	threadReply2  = &vocab.Object{ID: "https://example.com/objects/reply2", Type: vocab.NoteType, InReplyTo: threadRoot.ID}
+	threadNested  = &vocab.Object{ID: "https://example.com/objects/nested", Type: vocab.NoteType, InReplyTo: threadReply.ID}
+	threadUnknown = &vocab.Object{ID: "https://example.com/objects/lonely", Type: vocab.NoteType}
+
+	mockThreadItems = vocab.ItemCollection{threadRoot, threadReply, threadReply2, threadNested, threadUnknown}
+)
+
+func Test_threads_thread(t *testing.T) {
+	th := newThreads()
+	for _, it := range mockThreadItems {
+		th.Add(it)
+	}
+
+	tests := []struct {
+		name string
+		iri  vocab.IRI
+		want vocab.IRIs
+	}{
+		{
+			name: "empty",
+			want: vocab.IRIs{""},
+		},
+		{
+			name: "root",
+			iri:  threadRoot.ID,
+			want: vocab.IRIs{threadRoot.ID, threadReply.ID, threadReply2.ID, threadNested.ID},
+		},
+		{
+			name: "reply",
+			iri:  threadReply.ID,
+			want: vocab.IRIs{threadRoot.ID, threadReply.ID, threadNested.ID},
+		},
+		{
+			name: "nested",
+			iri:  threadNested.ID,
+			want: vocab.IRIs{threadRoot.ID, threadReply.ID, threadNested.ID},
+		},
+		{
+			name: "no replies",
+			iri:  threadUnknown.ID,
+			want: vocab.IRIs{threadUnknown.ID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := th.thread(tt.iri); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("thread() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_threads_Remove(t *testing.T) {
+	th := newThreads()
+	for _, it := range mockThreadItems {
+		th.Add(it)
+	}
+	th.Remove(threadReply.ID)
+
+	want := vocab.IRIs{threadRoot.ID, threadReply2.ID}
+	if got := th.thread(threadRoot.ID); !reflect.DeepEqual(got, want) {
+		t.Errorf("thread() after Remove() = %v, want %v", got, want)
+	}
+	wantMembers := vocab.IRIs{threadRoot.ID}
+	if got := th.members("https://example.com/contexts/1"); !reflect.DeepEqual(got, wantMembers) {
+		t.Errorf("members() after Remove() = %v, want %v", got, wantMembers)
+	}
+}
+
+func Test_repo_LoadThread(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  fields
+		iri     vocab.IRI
+		want    int
+		wantErr error
+	}{
+		{
+			name:    "empty",
+			wantErr: errNotOpen,
+		},
+		{
+			name: "index disabled",
+			fields: fields{
+				path: t.TempDir(),
+				root: openRoot(t, t.TempDir()),
+			},
+			iri:     threadRoot.ID,
+			wantErr: indexDisabled,
+		},
+		{
+			name: "thread of reply",
+			fields: fields{
+				path:  t.TempDir(),
+				root:  openRoot(t, t.TempDir()),
+				index: newBitmap(),
+			},
+			iri:  threadReply.ID,
+			want: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := mockRepo(t, tt.fields)
+			if r.root != nil {
+				r = withItems(mockThreadItems...)(t, r)
+			}
+			got, err := r.LoadThread(tt.iri)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("LoadThread() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("LoadThread() returned %d items, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
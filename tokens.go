@@ -0,0 +1,214 @@
+package fs
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+// tokenIndex maps the string tokens extracted from an item to the bitmap of the items containing them.
+// It is used for the index types this package adds on top of the ones from the filters/index package.
+type tokenIndex struct {
+	w sync.RWMutex
+	// Tokens holds the bitmap of item references for every token.
+	Tokens map[string]*roaring64.Bitmap
+	// Refs holds the tokens extracted for every item reference, so the item can be removed.
+	Refs map[uint64][]string
+
+	extractFn func(vocab.LinkOrIRI) []string
+
+	// dw guards decoded, which holds the items decoded from the tokens, for the indexes where the tokens
+	// are encoded items, like ByTag. As the tokens are the encoding of the items, the entries never get stale.
+	dw      sync.Mutex
+	decoded map[string]vocab.Item
+}
+
+func newTokenIndex(extractFn func(vocab.LinkOrIRI) []string) *tokenIndex {
+	return &tokenIndex{
+		Tokens:    make(map[string]*roaring64.Bitmap),
+		Refs:      make(map[uint64][]string),
+		extractFn: extractFn,
+	}
+}
+
+func (t *tokenIndex) remove(ref uint64) {
+	for _, tok := range t.Refs[ref] {
+		if bmp, ok := t.Tokens[tok]; ok {
+			bmp.Remove(ref)
+			if bmp.IsEmpty() {
+				delete(t.Tokens, tok)
+				t.forget(tok)
+			}
+		}
+	}
+	delete(t.Refs, ref)
+}
+
+// forget drops the decoded item of the token.
+func (t *tokenIndex) forget(tok string) {
+	t.dw.Lock()
+	defer t.dw.Unlock()
+
+	delete(t.decoded, tok)
+}
+
+// decode returns the item encoded in the token, decoding it only the first time it's needed.
+// It must be called with t.w held.
+func (t *tokenIndex) decode(tok string, decodeFn func(string) (vocab.Item, error)) vocab.Item {
+	t.dw.Lock()
+	defer t.dw.Unlock()
+
+	if it, ok := t.decoded[tok]; ok {
+		return it
+	}
+	if t.decoded == nil {
+		t.decoded = make(map[string]vocab.Item)
+	}
+	if len(t.decoded) > len(t.Tokens) {
+		// NOTE(marius): the index was loaded again since the items were decoded, and some tokens are gone.
+		for k := range t.decoded {
+			if _, ok := t.Tokens[k]; !ok {
+				delete(t.decoded, k)
+			}
+		}
+	}
+	it, err := decodeFn(tok)
+	if err != nil {
+		it = nil
+	}
+	t.decoded[tok] = it
+	return it
+}
+
+// Add indexes the tokens extracted from li, replacing the ones from a previous version of it.
+func (t *tokenIndex) Add(li vocab.LinkOrIRI) uint64 {
+	if li == nil || index.HashFn == nil || t.extractFn == nil {
+		return 0
+	}
+	ref := index.HashFn(li.GetLink())
+	tokens := t.extractFn(li)
+
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	t.remove(ref)
+	if len(tokens) == 0 {
+		return ref
+	}
+	slices.Sort(tokens)
+	tokens = slices.Compact(tokens)
+	for _, tok := range tokens {
+		bmp, ok := t.Tokens[tok]
+		if !ok {
+			bmp = roaring64.New()
+			t.Tokens[tok] = bmp
+		}
+		bmp.Add(ref)
+	}
+	t.Refs[ref] = tokens
+	return ref
+}
+
+// Remove drops li from the index.
+func (t *tokenIndex) Remove(li vocab.LinkOrIRI) error {
+	if li == nil || index.HashFn == nil {
+		return nil
+	}
+
+	t.w.Lock()
+	defer t.w.Unlock()
+
+	t.remove(index.HashFn(li.GetLink()))
+	return nil
+}
+
+// Search returns the references of the items containing any of the tokens.
+func (t *tokenIndex) Search(tokens ...string) *roaring64.Bitmap {
+	t.w.RLock()
+	defer t.w.RUnlock()
+
+	result := roaring64.New()
+	for _, tok := range tokens {
+		if bmp, ok := t.Tokens[tok]; ok {
+			result.Or(bmp)
+		}
+	}
+	return result
+}
+
+// tokenCheck is a filters.Check that can be answered by one of the token indexes.
+type tokenCheck struct {
+	typ       index.Type
+	tokens    []string
+	extractFn func(vocab.LinkOrIRI) []string
+}
+
+// Match checks if any of the tokens extracted from the item are part of the check's tokens.
+func (c tokenCheck) Match(it vocab.Item) bool {
+	if vocab.IsNil(it) || c.extractFn == nil {
+		return false
+	}
+	for _, tok := range c.extractFn(it) {
+		if slices.Contains(c.tokens, tok) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c tokenCheck) indexMatch(b *bitmaps) *roaring64.Bitmap {
+	idx, ok := b.tokens[c.typ]
+	if !ok {
+		return nil
+	}
+	return idx.Search(c.tokens...)
+}
+
+type indexMatcher interface {
+	indexMatch(*bitmaps) *roaring64.Bitmap
+}
+
+// match returns the bitmap of the items matching all the filters that can be answered from the indexes.
+// The checks that are specific to this package get resolved against the token indexes, the rest are
+// passed on to the filters package.
+func (b *bitmaps) match(ff ...filters.Check) *roaring64.Bitmap {
+	rest := make(filters.Checks, 0, len(ff))
+	local := make([]indexMatcher, 0)
+	for _, f := range ff {
+		if m, ok := f.(indexMatcher); ok {
+			local = append(local, m)
+			continue
+		}
+		if tc := filters.TagChecks(f); len(tc) > 0 {
+			local = append(local, tagCheck(tc))
+			continue
+		}
+		rest = append(rest, f)
+	}
+
+	var bmp *roaring64.Bitmap
+	if len(rest) > 0 || len(local) == 0 {
+		bmp = rest.IndexMatch(b.all)
+	}
+	for _, m := range local {
+		lbmp := m.indexMatch(b)
+		if lbmp == nil {
+			// NOTE(marius): the check can't be answered from the indexes, so nothing is returned,
+			// and the search falls back to loading the items from disk.
+			return roaring64.New()
+		}
+		if bmp == nil {
+			bmp = lbmp
+			continue
+		}
+		bmp.And(lbmp)
+	}
+	if bmp == nil {
+		bmp = roaring64.New()
+	}
+	return bmp
+}
@@ -0,0 +1,104 @@
+package fs
+
+import (
+	"testing"
+
+	vocab "github.com/go-ap/activitypub"
+	"github.com/go-ap/filters"
+	"github.com/go-ap/filters/index"
+)
+
+func extractIDHost(li vocab.LinkOrIRI) []string {
+	u, err := li.GetLink().URL()
+	if err != nil {
+		return nil
+	}
+	return []string{u.Host}
+}
+
+func Test_tokenIndex(t *testing.T) {
+	idx := newTokenIndex(extractIDHost)
+	items := vocab.ItemCollection{
+		vocab.IRI("https://example.com/1"),
+		vocab.IRI("https://example.com/2"),
+		vocab.IRI("https://example.org/1"),
+	}
+	for _, it := range items {
+		if ref := idx.Add(it); ref != index.HashFn(it.GetLink()) {
+			t.Errorf("Add() = %d, want %d", ref, index.HashFn(it.GetLink()))
+		}
+	}
+	_ = idx.Remove(items[1])
+
+	tests := []struct {
+		name   string
+		tokens []string
+		want   vocab.IRIs
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:   "example.com",
+			tokens: []string{"example.com"},
+			want:   vocab.IRIs{"https://example.com/1"},
+		},
+		{
+			name:   "any host",
+			tokens: []string{"example.com", "example.org"},
+			want:   vocab.IRIs{"https://example.com/1", "https://example.org/1"},
+		},
+		{
+			name:   "unknown",
+			tokens: []string{"example.net"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := idx.Search(tt.tokens...)
+			if got.GetCardinality() != uint64(len(tt.want)) {
+				t.Errorf("Search() returned %d results, want %d", got.GetCardinality(), len(tt.want))
+			}
+			for _, iri := range tt.want {
+				if !got.Contains(index.HashFn(iri)) {
+					t.Errorf("Search() didn't return %s", iri)
+				}
+			}
+		})
+	}
+}
+
+func Test_bitmaps_match(t *testing.T) {
+	b := newBitmap(index.ByID, ByHashtag)
+	for _, it := range mockTaggedItems {
+		_ = b.tokens[ByHashtag].Add(it)
+	}
+
+	tests := []struct {
+		name string
+		ff   filters.Checks
+		want uint64
+	}{
+		{
+			name: "hashtag",
+			ff:   filters.Checks{HashtagIs("golang")},
+			want: 2,
+		},
+		{
+			name: "two hashtags",
+			ff:   filters.Checks{HashtagIs("golang"), HashtagIs("#fediverse")},
+			want: 1,
+		},
+		{
+			name: "disabled index",
+			ff:   filters.Checks{MentionOf("@alice@example.com")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := b.match(tt.ff...); got.GetCardinality() != tt.want {
+				t.Errorf("match() returned %d results, want %d", got.GetCardinality(), tt.want)
+			}
+		})
+	}
+}